@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ResourceType int8
+
+const (
+	RESOURCE_UNKNOWN          ResourceType = 0
+	RESOURCE_ANY              ResourceType = 1
+	RESOURCE_TOPIC            ResourceType = 2
+	RESOURCE_GROUP            ResourceType = 3
+	RESOURCE_CLUSTER          ResourceType = 4
+	RESOURCE_TRANSACTIONAL_ID ResourceType = 5
+	RESOURCE_DELEGATION_TOKEN ResourceType = 6
+	RESOURCE_USER             ResourceType = 7
+)
+
+type PatternType int8
+
+const (
+	PATTERN_UNKNOWN PatternType = 0
+	PATTERN_ANY     PatternType = 1
+	// Filters only: every pattern that applies to the resource name
+	PATTERN_MATCH    PatternType = 2
+	PATTERN_LITERAL  PatternType = 3
+	PATTERN_PREFIXED PatternType = 4
+)
+
+type AclOperation int8
+
+const (
+	OPERATION_UNKNOWN          AclOperation = 0
+	OPERATION_ANY              AclOperation = 1
+	OPERATION_ALL              AclOperation = 2
+	OPERATION_READ             AclOperation = 3
+	OPERATION_WRITE            AclOperation = 4
+	OPERATION_CREATE           AclOperation = 5
+	OPERATION_DELETE           AclOperation = 6
+	OPERATION_ALTER            AclOperation = 7
+	OPERATION_DESCRIBE         AclOperation = 8
+	OPERATION_CLUSTER_ACTION   AclOperation = 9
+	OPERATION_DESCRIBE_CONFIGS AclOperation = 10
+	OPERATION_ALTER_CONFIGS    AclOperation = 11
+	OPERATION_IDEMPOTENT_WRITE AclOperation = 12
+	OPERATION_CREATE_TOKENS    AclOperation = 13
+	OPERATION_DESCRIBE_TOKENS  AclOperation = 14
+)
+
+type AclPermissionType int8
+
+const (
+	PERMISSION_UNKNOWN AclPermissionType = 0
+	PERMISSION_ANY     AclPermissionType = 1
+	PERMISSION_DENY    AclPermissionType = 2
+	PERMISSION_ALLOW   AclPermissionType = 3
+)
+
+const (
+	// The only name a CLUSTER resource can have
+	CLUSTER_RESOURCE_NAME = "kafka-cluster"
+	WILDCARD_RESOURCE     = "*"
+	WILDCARD_PRINCIPAL    = "User:*"
+	WILDCARD_HOST         = "*"
+)
+
+// Operations that apply to each resource type, i.e. the bits of its
+// authorized operations
+var ResourceOperations = map[ResourceType][]AclOperation{
+	RESOURCE_TOPIC: {
+		OPERATION_READ, OPERATION_WRITE, OPERATION_CREATE, OPERATION_DELETE, OPERATION_ALTER,
+		OPERATION_DESCRIBE, OPERATION_DESCRIBE_CONFIGS, OPERATION_ALTER_CONFIGS,
+	},
+	RESOURCE_CLUSTER: {
+		OPERATION_CREATE, OPERATION_ALTER, OPERATION_DESCRIBE, OPERATION_CLUSTER_ACTION,
+		OPERATION_DESCRIBE_CONFIGS, OPERATION_ALTER_CONFIGS, OPERATION_IDEMPOTENT_WRITE,
+	},
+}
+
+// Operations that imply another one when allowed, like in Kafka: whoever
+// may read a topic may also describe it
+var ImpliedOperations = map[AclOperation][]AclOperation{
+	OPERATION_DESCRIBE:         {OPERATION_READ, OPERATION_WRITE, OPERATION_DELETE, OPERATION_ALTER},
+	OPERATION_DESCRIBE_CONFIGS: {OPERATION_ALTER_CONFIGS},
+}
+
+// Resources an ACL applies to: a name, every name starting with a prefix,
+// or every name at all with the literal "*"
+type ResourcePattern struct {
+	resourceType ResourceType
+	name         string
+	patternType  PatternType
+}
+
+// Who may or may not do what, from where
+type AccessControlEntry struct {
+	principal      string
+	host           string
+	operation      AclOperation
+	permissionType AclPermissionType
+}
+
+type AclBinding struct {
+	pattern ResourcePattern
+	entry   AccessControlEntry
+}
+
+// Selects ACLs for DescribeAcls and DeleteAcls. ANY and empty strings
+// (null on the wire) match everything.
+type AclBindingFilter struct {
+	pattern ResourcePattern
+	entry   AccessControlEntry
+}
+
+// Check that a binding can be stored, CreateAcls reports the error to the
+// client
+func (b AclBinding) validate() error {
+	switch b.pattern.resourceType {
+	case RESOURCE_TOPIC, RESOURCE_GROUP, RESOURCE_CLUSTER, RESOURCE_TRANSACTIONAL_ID, RESOURCE_DELEGATION_TOKEN, RESOURCE_USER:
+	default:
+		return newKafkaError(ERR_INVALID_REQUEST, "Invalid resource type %d", b.pattern.resourceType)
+	}
+	if b.pattern.patternType != PATTERN_LITERAL && b.pattern.patternType != PATTERN_PREFIXED {
+		return newKafkaError(ERR_INVALID_REQUEST, "Invalid pattern type %d, ACLs must be LITERAL or PREFIXED", b.pattern.patternType)
+	}
+	if b.pattern.name == "" {
+		return newKafkaError(ERR_INVALID_REQUEST, "Resource name must not be empty")
+	}
+	if b.pattern.resourceType == RESOURCE_CLUSTER && (b.pattern.name != CLUSTER_RESOURCE_NAME || b.pattern.patternType != PATTERN_LITERAL) {
+		return newKafkaError(ERR_INVALID_REQUEST, "The only valid name for the CLUSTER resource is %s", CLUSTER_RESOURCE_NAME)
+	}
+
+	if _, err := parseKafkaPrincipal(b.entry.principal); err != nil {
+		return newKafkaError(ERR_INVALID_REQUEST, "%s", err.Error())
+	}
+	if b.entry.host == "" {
+		return newKafkaError(ERR_INVALID_REQUEST, "Host must not be empty")
+	}
+	if b.entry.operation < OPERATION_ALL || b.entry.operation > OPERATION_DESCRIBE_TOKENS {
+		return newKafkaError(ERR_INVALID_REQUEST, "Invalid operation %d", b.entry.operation)
+	}
+	if b.entry.permissionType != PERMISSION_ALLOW && b.entry.permissionType != PERMISSION_DENY {
+		return newKafkaError(ERR_INVALID_REQUEST, "Invalid permission type %d", b.entry.permissionType)
+	}
+	return nil
+}
+
+// Whether the pattern covers the named resource
+func (p ResourcePattern) matchesResource(resourceType ResourceType, name string) bool {
+	if p.resourceType != resourceType {
+		return false
+	}
+	switch p.patternType {
+	case PATTERN_LITERAL:
+		return p.name == name || p.name == WILDCARD_RESOURCE
+	case PATTERN_PREFIXED:
+		return strings.HasPrefix(name, p.name)
+	}
+	return false
+}
+
+// Whether the entry applies to the principal connecting from host
+func (e AccessControlEntry) matchesPrincipal(principal string, host string) bool {
+	return (e.principal == principal || e.principal == WILDCARD_PRINCIPAL) &&
+		(e.host == host || e.host == WILDCARD_HOST)
+}
+
+func (f AclBindingFilter) matches(b AclBinding) bool {
+	if f.pattern.resourceType != RESOURCE_ANY && f.pattern.resourceType != b.pattern.resourceType {
+		return false
+	}
+	switch f.pattern.patternType {
+	case PATTERN_ANY:
+		if f.pattern.name != "" && f.pattern.name != b.pattern.name {
+			return false
+		}
+	case PATTERN_MATCH:
+		if f.pattern.name != "" && !b.pattern.matchesResource(b.pattern.resourceType, f.pattern.name) {
+			return false
+		}
+	default:
+		if f.pattern.patternType != b.pattern.patternType || (f.pattern.name != "" && f.pattern.name != b.pattern.name) {
+			return false
+		}
+	}
+
+	return (f.entry.principal == "" || f.entry.principal == b.entry.principal) &&
+		(f.entry.host == "" || f.entry.host == b.entry.host) &&
+		(f.entry.operation == OPERATION_ANY || f.entry.operation == b.entry.operation) &&
+		(f.entry.permissionType == PERMISSION_ANY || f.entry.permissionType == b.entry.permissionType)
+}
+
+// Check that a filter can't match more than the client meant to, e.g.
+// because of an unknown enum value
+func (f AclBindingFilter) validate() error {
+	if f.pattern.resourceType == RESOURCE_UNKNOWN || f.pattern.patternType == PATTERN_UNKNOWN ||
+		f.entry.operation == OPERATION_UNKNOWN || f.entry.permissionType == PERMISSION_UNKNOWN {
+		return newKafkaError(ERR_INVALID_REQUEST, "Filters must not contain UNKNOWN elements")
+	}
+	return nil
+}
+
+// Parse a principal in its Type:name string form
+func parseKafkaPrincipal(s string) (KafkaPrincipal, error) {
+	principalType, name, ok := strings.Cut(s, ":")
+	if !ok || principalType == "" || name == "" {
+		return KafkaPrincipal{}, fmt.Errorf("Invalid principal %q, expected Type:name", s)
+	}
+	return KafkaPrincipal{principalType: principalType, name: name}, nil
+}
+
+func (r AccessControlEntryRecord) binding() AclBinding {
+	return AclBinding{
+		pattern: ResourcePattern{resourceType: r.resourceType, name: r.resourceName, patternType: r.patternType},
+		entry:   AccessControlEntry{principal: r.principal, host: r.host, operation: r.operation, permissionType: r.permissionType},
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Response
+type AlterClientQuotasResponse struct {
+	version      int16
+	throttleTime int32
+	entries      []AlterClientQuotasResult
+	tagBuffer    byte
+}
+
+// Outcome of one entry, with its entity as sent
+type AlterClientQuotasResult struct {
+	version      int16
+	errorCode    ErrorCode
+	errorMessage string
+	entity       []QuotaEntityData
+	tagBuffer    byte
+}
+
+func (r AlterClientQuotasResponse) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(ALTER_CLIENT_QUOTAS, r.version)
+
+	res = binary.BigEndian.AppendUint32(res, uint32(r.throttleTime))
+
+	entries := make([]SerializableElement, len(r.entries))
+	for i, v := range r.entries {
+		entries[i] = v
+	}
+	res = append(res, encodeCustomArray(entries, flexible)...)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (r AlterClientQuotasResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
+
+func (r AlterClientQuotasResponse) errorCounts() map[ErrorCode]int {
+	counts := map[ErrorCode]int{}
+	for _, entry := range r.entries {
+		counts[entry.errorCode]++
+	}
+	return counts
+}
+
+func (r AlterClientQuotasResult) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(ALTER_CLIENT_QUOTAS, r.version)
+
+	res = binary.BigEndian.AppendUint16(res, uint16(r.errorCode))
+	res = appendNullableString(res, r.errorMessage, flexible)
+	res = appendQuotaEntityData(res, r.entity, flexible)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (b *Broker) buildAlterClientQuotasResponse(req RequestMessage) AlterClientQuotasResponse {
+	reqBody := req.body.(*AlterClientQuotasRequest)
+	response := AlterClientQuotasResponse{version: reqBody.version, entries: []AlterClientQuotasResult{}}
+
+	results := make([]AlterClientQuotasResult, len(reqBody.entries))
+	for i, entry := range reqBody.entries {
+		results[i] = AlterClientQuotasResult{version: reqBody.version, entity: entry.entity}
+	}
+	if !b.authorize(req.context, OPERATION_ALTER_CONFIGS, RESOURCE_CLUSTER, CLUSTER_RESOURCE_NAME) {
+		for i := range results {
+			results[i].errorCode = ERR_CLUSTER_AUTHORIZATION_FAILED
+		}
+		response.entries = results
+		return response
+	}
+
+	// Entries with invalid entities fail on their own, the others are
+	// validated and stored together
+	alterations := []QuotaAlteration{}
+	alterationIndexes := []int{}
+	for i, entry := range reqBody.entries {
+		entity, err := newQuotaEntity(entry.entity)
+		if err != nil {
+			results[i].errorCode = errorCodeOf(err)
+			results[i].errorMessage = err.Error()
+			continue
+		}
+		alterations = append(alterations, QuotaAlteration{entity: entity, ops: entry.ops})
+		alterationIndexes = append(alterationIndexes, i)
+	}
+
+	errs := b.quotas.alterQuotas(alterations, reqBody.validateOnly)
+	for j, i := range alterationIndexes {
+		if errs[j] != nil {
+			results[i].errorCode = errorCodeOf(errs[j])
+			results[i].errorMessage = errs[j].Error()
+		}
+	}
+
+	response.entries = results
+	return response
+}
+
+// Every entry fails with the error. The request is decoded with the newest
+// layout we know, on a best-effort basis.
+func buildAlterClientQuotasErrorResponse(req RequestMessage, errorCode ErrorCode) AlterClientQuotasResponse {
+	supported, _ := getSupportedApiVersion(ALTER_CLIENT_QUOTAS)
+	version := min(req.header.requestApiVersion, supported.MaxVersion)
+	response := AlterClientQuotasResponse{version: version, entries: []AlterClientQuotasResult{}}
+
+	reqBody := &AlterClientQuotasRequest{version: version}
+	if !tryDeserialize(reqBody, req.rawBody) {
+		return response
+	}
+
+	for _, entry := range reqBody.entries {
+		response.entries = append(response.entries, AlterClientQuotasResult{
+			version:   version,
+			errorCode: errorCode,
+			entity:    entry.entity,
+		})
+	}
+	return response
+}
+
+// Request
+type AlterClientQuotasRequest struct {
+	version      int16
+	entries      []AlterClientQuotasEntry
+	validateOnly bool
+}
+
+type AlterClientQuotasEntry struct {
+	version int16
+	entity  []QuotaEntityData
+	ops     []QuotaOp
+}
+
+func (r *AlterClientQuotasRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+	flexible := isFlexibleVersion(ALTER_CLIENT_QUOTAS, r.version)
+
+	r.entries = []AlterClientQuotasEntry{}
+	entries := readCustomArray(buf, flexible, func() CompactArrayElement {
+		return &AlterClientQuotasEntry{version: r.version}
+	})
+	for _, elem := range entries {
+		if entry, ok := elem.(*AlterClientQuotasEntry); ok {
+			r.entries = append(r.entries, *entry)
+		}
+	}
+
+	err := binary.Read(buf, binary.BigEndian, &r.validateOnly)
+	checkError(err)
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
+
+func (e *AlterClientQuotasEntry) deserialize(buf *bytes.Buffer) {
+	flexible := isFlexibleVersion(ALTER_CLIENT_QUOTAS, e.version)
+
+	e.entity = readQuotaEntityData(buf, flexible)
+
+	e.ops = []QuotaOp{}
+	for range max(0, readArrayLength(buf, flexible)) {
+		op := QuotaOp{}
+		op.key = readString(buf, flexible)
+
+		err := binary.Read(buf, binary.BigEndian, &op.value)
+		checkError(err)
+
+		err = binary.Read(buf, binary.BigEndian, &op.remove)
+		checkError(err)
+
+		if flexible {
+			skipTaggedFields(buf)
+		}
+		e.ops = append(e.ops, op)
+	}
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
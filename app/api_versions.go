@@ -1,15 +1,54 @@
 package main
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"strconv"
+)
 
 type ApiKey int16
 
 const (
 	FETCH                     ApiKey = 1
+	LIST_OFFSETS              ApiKey = 2
+	METADATA                  ApiKey = 3
+	SASL_HANDSHAKE            ApiKey = 17
 	API_VERSIONS              ApiKey = 18
+	DELETE_RECORDS            ApiKey = 21
+	DESCRIBE_ACLS             ApiKey = 29
+	CREATE_ACLS               ApiKey = 30
+	DELETE_ACLS               ApiKey = 31
+	SASL_AUTHENTICATE         ApiKey = 36
+	DESCRIBE_CLIENT_QUOTAS    ApiKey = 48
+	ALTER_CLIENT_QUOTAS       ApiKey = 49
+	DESCRIBE_CLUSTER          ApiKey = 60
 	DESCRIBE_TOPIC_PARTITIONS ApiKey = 75
 )
 
+// Kafka's names for the APIs, as used in logs and metrics
+var apiNames = map[ApiKey]string{
+	FETCH:                     "Fetch",
+	LIST_OFFSETS:              "ListOffsets",
+	METADATA:                  "Metadata",
+	SASL_HANDSHAKE:            "SaslHandshake",
+	API_VERSIONS:              "ApiVersions",
+	DELETE_RECORDS:            "DeleteRecords",
+	DESCRIBE_ACLS:             "DescribeAcls",
+	CREATE_ACLS:               "CreateAcls",
+	DELETE_ACLS:               "DeleteAcls",
+	SASL_AUTHENTICATE:         "SaslAuthenticate",
+	DESCRIBE_CLIENT_QUOTAS:    "DescribeClientQuotas",
+	ALTER_CLIENT_QUOTAS:       "AlterClientQuotas",
+	DESCRIBE_CLUSTER:          "DescribeCluster",
+	DESCRIBE_TOPIC_PARTITIONS: "DescribeTopicPartitions",
+}
+
+func (k ApiKey) String() string {
+	if name, ok := apiNames[k]; ok {
+		return name
+	}
+	return strconv.Itoa(int(k))
+}
+
 type ApiVersion struct {
 	ApiKey     ApiKey
 	MinVersion int16
@@ -17,8 +56,10 @@ type ApiVersion struct {
 }
 
 type ApiVersionsResponse struct {
-	apiVersions []ApiVersion
-	errorCode   ErrorCode
+	version      int16
+	apiVersions  []ApiVersion
+	errorCode    ErrorCode
+	throttleTime int32
 }
 
 var SupportedApiVersions = []ApiVersion{
@@ -37,50 +78,156 @@ var SupportedApiVersions = []ApiVersion{
 		MinVersion: 0,
 		MaxVersion: 16,
 	},
+	{
+		// v0 returns offsets the old way, Kafka 4.0 dropped it (KIP-896)
+		ApiKey:     LIST_OFFSETS,
+		MinVersion: 1,
+		MaxVersion: 9,
+	},
+	{
+		ApiKey:     METADATA,
+		MinVersion: 0,
+		MaxVersion: 12,
+	},
+	{
+		ApiKey:     DELETE_RECORDS,
+		MinVersion: 0,
+		MaxVersion: 2,
+	},
+	{
+		ApiKey:     DESCRIBE_CLUSTER,
+		MinVersion: 0,
+		MaxVersion: 1,
+	},
+	{
+		// v0 exchanges the SASL tokens outside of Kafka requests, Kafka 4.0
+		// dropped it (KIP-896)
+		ApiKey:     SASL_HANDSHAKE,
+		MinVersion: 1,
+		MaxVersion: 1,
+	},
+	{
+		ApiKey:     SASL_AUTHENTICATE,
+		MinVersion: 0,
+		MaxVersion: 2,
+	},
+	{
+		// v0 has no pattern types, Kafka 4.0 dropped it (KIP-896)
+		ApiKey:     DESCRIBE_ACLS,
+		MinVersion: 1,
+		MaxVersion: 3,
+	},
+	{
+		ApiKey:     CREATE_ACLS,
+		MinVersion: 1,
+		MaxVersion: 3,
+	},
+	{
+		ApiKey:     DELETE_ACLS,
+		MinVersion: 1,
+		MaxVersion: 3,
+	},
+	{
+		ApiKey:     DESCRIBE_CLIENT_QUOTAS,
+		MinVersion: 0,
+		MaxVersion: 1,
+	},
+	{
+		ApiKey:     ALTER_CLIENT_QUOTAS,
+		MinVersion: 0,
+		MaxVersion: 1,
+	},
+}
+
+// First version of each API that uses flexible (KIP-482) encoding
+var FlexibleVersions = map[ApiKey]int16{
+	API_VERSIONS:              3,
+	DESCRIBE_TOPIC_PARTITIONS: 0,
+	FETCH:                     12,
+	LIST_OFFSETS:              6,
+	METADATA:                  9,
+	DELETE_RECORDS:            2,
+	DESCRIBE_CLUSTER:          0,
+	SASL_AUTHENTICATE:         2,
+	DESCRIBE_ACLS:             2,
+	CREATE_ACLS:               2,
+	DELETE_ACLS:               2,
+	DESCRIBE_CLIENT_QUOTAS:    1,
+	ALTER_CLIENT_QUOTAS:       1,
+}
+
+func getSupportedApiVersion(apiKey ApiKey) (ApiVersion, bool) {
+	for _, version := range SupportedApiVersions {
+		if version.ApiKey == apiKey {
+			return version, true
+		}
+	}
+	return ApiVersion{}, false
+}
+
+func (v ApiVersion) isSupported(version int16) bool {
+	return version >= v.MinVersion && version <= v.MaxVersion
+}
+
+func isFlexibleVersion(apiKey ApiKey, version int16) bool {
+	flexibleVersion, ok := FlexibleVersions[apiKey]
+	return ok && version >= flexibleVersion
 }
 
 func (r ApiVersionsResponse) serialize() []byte {
 	var body []byte
+	flexible := isFlexibleVersion(API_VERSIONS, r.version)
 
 	// Set error code
 	body = binary.BigEndian.AppendUint16(body, uint16(r.errorCode))
 
-	numApiVersions := len(r.apiVersions) + 1
-	body = append(body, byte(numApiVersions))
+	body = appendArrayLength(body, len(r.apiVersions), flexible)
 
 	for _, version := range r.apiVersions {
 		body = binary.BigEndian.AppendUint16(body, uint16(version.ApiKey))
 		body = binary.BigEndian.AppendUint16(body, uint16(version.MinVersion))
 		body = binary.BigEndian.AppendUint16(body, uint16(version.MaxVersion))
 
-		// Compact array tag buffer
-		body = append(body, 0)
+		if flexible {
+			// Compact array tag buffer
+			body = append(body, 0)
+		}
 	}
 
-	// Throttle time
-	body = append(body, []byte{0, 0, 0, 0}...)
+	if r.version >= 1 {
+		body = binary.BigEndian.AppendUint32(body, uint32(r.throttleTime))
+	}
 
-	// Tag buffer
-	body = append(body, 0)
+	if flexible {
+		// Tag buffer
+		body = append(body, 0)
+	}
 	return body
 }
 
-func buildApiVersionsResponse(req RequestMessage) ApiVersionsResponse {
-	var err ErrorCode = ERR_NONE
-	v := req.header.requestApiVersion
-	apiKey := req.header.requestApiKey
+func (r ApiVersionsResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
 
-	for _, version := range SupportedApiVersions {
-		if version.ApiKey != apiKey {
-			continue
-		}
-		if !(v >= version.MinVersion && v <= version.MaxVersion) {
-			err = ERR_UNSUPPORTED_VERSION
-			break
-		}
+func (r ApiVersionsResponse) errorCounts() map[ErrorCode]int {
+	return map[ErrorCode]int{r.errorCode: 1}
+}
+
+func buildApiVersionsResponse(req RequestMessage) ApiVersionsResponse {
+	return ApiVersionsResponse{
+		version:     req.header.requestApiVersion,
+		apiVersions: SupportedApiVersions,
+		errorCode:   ERR_NONE,
 	}
+}
+
+// The client can't know which layout we understand, so ApiVersions errors
+// are always encoded as v0 (KIP-511)
+func buildApiVersionsErrorResponse(req RequestMessage, errorCode ErrorCode) ApiVersionsResponse {
 	return ApiVersionsResponse{
+		version:     0,
 		apiVersions: SupportedApiVersions,
-		errorCode:   err,
+		errorCode:   errorCode,
 	}
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"slices"
+	"sync"
+)
+
+// Kafka's KRaft authorizer, the only authorizer.class.name we accept
+const STANDARD_AUTHORIZER = "org.apache.kafka.metadata.authorizer.StandardAuthorizer"
+
+// Decides what principals may do, modelled after
+// org.apache.kafka.server.authorizer.Authorizer
+type Authorizer interface {
+	authorize(ctx RequestContext, operation AclOperation, resourceType ResourceType, resourceName string) bool
+	// Store the bindings, returning an error (or nil) for each of them
+	createAcls(bindings []AclBinding) []error
+	// Remove the ACLs matching the filters and return, for each filter,
+	// the ones it matched
+	deleteAcls(filters []AclBindingFilter) ([][]AclBinding, error)
+	acls(filter AclBindingFilter) []AclBinding
+}
+
+// Returns nil if authorizer.class.name isn't set, in which case every
+// request is allowed
+func newAuthorizer(config *Config, metadata *MetadataLog) Authorizer {
+	if config.authorizerClassName == "" {
+		return nil
+	}
+	return &StandardAuthorizer{
+		metadata:                  metadata,
+		superUsers:                config.superUsers,
+		allowEveryoneIfNoAclFound: config.allowEveryoneIfNoAclFound,
+	}
+}
+
+// ACLs stored in the metadata log as AccessControlEntryRecords. DENY wins
+// over ALLOW, and resources without any ACL are only open to super users
+// unless allow.everyone.if.no.acl.found is set.
+type StandardAuthorizer struct {
+	metadata                  *MetadataLog
+	superUsers                []string
+	allowEveryoneIfNoAclFound bool
+	// Serializes changes, so deletes don't race with each other
+	mu sync.Mutex
+}
+
+// The ACLs in effect, from the cached image of the metadata log like
+// Kafka's in-memory ACL cache. Shared, so callers mustn't modify them.
+func (a *StandardAuthorizer) records() []AccessControlEntryRecord {
+	return a.metadata.image().records.AccessControlEntryRecords
+}
+
+func (a *StandardAuthorizer) authorize(ctx RequestContext, operation AclOperation, resourceType ResourceType, resourceName string) bool {
+	return a.authorizeWith(a.records(), ctx, operation, resourceType, resourceName)
+}
+
+func (a *StandardAuthorizer) authorizeWith(records []AccessControlEntryRecord, ctx RequestContext, operation AclOperation, resourceType ResourceType, resourceName string) bool {
+	principal := ctx.principal.String()
+	if slices.Contains(a.superUsers, principal) {
+		return true
+	}
+	host := ctx.clientHost()
+
+	found := false
+	allowed := false
+	for _, record := range records {
+		acl := record.binding()
+		if !acl.pattern.matchesResource(resourceType, resourceName) {
+			continue
+		}
+		found = true
+		if !acl.entry.matchesPrincipal(principal, host) {
+			continue
+		}
+
+		switch acl.entry.permissionType {
+		case PERMISSION_DENY:
+			if acl.entry.operation == OPERATION_ALL || acl.entry.operation == operation {
+				return false
+			}
+		case PERMISSION_ALLOW:
+			if acl.entry.operation == OPERATION_ALL || acl.entry.operation == operation ||
+				slices.Contains(ImpliedOperations[operation], acl.entry.operation) {
+				allowed = true
+			}
+		}
+	}
+	return allowed || (!found && a.allowEveryoneIfNoAclFound)
+}
+
+func (a *StandardAuthorizer) createAcls(bindings []AclBinding) []error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Creating an ACL that already exists succeeds without a new record
+	existing := map[AclBinding]bool{}
+	for _, record := range a.records() {
+		existing[record.binding()] = true
+	}
+
+	errs := make([]error, len(bindings))
+	values := [][]byte{}
+	for i, binding := range bindings {
+		if errs[i] = binding.validate(); errs[i] != nil || existing[binding] {
+			continue
+		}
+		existing[binding] = true
+		record := AccessControlEntryRecord{
+			resourceType:   binding.pattern.resourceType,
+			resourceName:   binding.pattern.name,
+			patternType:    binding.pattern.patternType,
+			principal:      binding.entry.principal,
+			host:           binding.entry.host,
+			operation:      binding.entry.operation,
+			permissionType: binding.entry.permissionType,
+		}
+		_, err := rand.Read(record.id[:])
+		checkError(err)
+		values = append(values, record.serialize())
+	}
+	if len(values) == 0 {
+		return errs
+	}
+
+	if err := a.metadata.appendRecords(values); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+func (a *StandardAuthorizer) deleteAcls(filters []AclBindingFilter) ([][]AclBinding, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	records := a.records()
+	matched := make([][]AclBinding, len(filters))
+	removed := map[UUID]bool{}
+	values := [][]byte{}
+	for i, filter := range filters {
+		for _, record := range records {
+			if !filter.matches(record.binding()) {
+				continue
+			}
+			matched[i] = append(matched[i], record.binding())
+			// An ACL matched by several filters is only removed once
+			if !removed[record.id] {
+				removed[record.id] = true
+				values = append(values, RemoveAccessControlEntryRecord{id: record.id}.serialize())
+			}
+		}
+	}
+	if len(values) == 0 {
+		return matched, nil
+	}
+	return matched, a.metadata.appendRecords(values)
+}
+
+func (a *StandardAuthorizer) acls(filter AclBindingFilter) []AclBinding {
+	out := []AclBinding{}
+	for _, record := range a.records() {
+		if filter.matches(record.binding()) {
+			out = append(out, record.binding())
+		}
+	}
+	return out
+}
+
+// The address the client connected from, as ACL hosts are written
+func (c RequestContext) clientHost() string {
+	if c.clientAddress == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(c.clientAddress.String())
+	if err != nil {
+		return c.clientAddress.String()
+	}
+	return host
+}
+
+// Whether the request may perform operation on the resource. Without an
+// authorizer everything is allowed.
+func (b *Broker) authorize(ctx RequestContext, operation AclOperation, resourceType ResourceType, resourceName string) bool {
+	if b.authorizer == nil {
+		return true
+	}
+	return b.authorizer.authorize(ctx, operation, resourceType, resourceName)
+}
+
+// Only clients that may describe the cluster get to know what else they
+// may do with it
+func (b *Broker) clusterAuthorizedOperations(ctx RequestContext) int32 {
+	if !b.authorize(ctx, OPERATION_DESCRIBE, RESOURCE_CLUSTER, CLUSTER_RESOURCE_NAME) {
+		return AUTHORIZED_OPERATIONS_OMITTED
+	}
+	return b.authorizedOperations(ctx, RESOURCE_CLUSTER, CLUSTER_RESOURCE_NAME)
+}
+
+// Bitfield of the operations the request may perform on the resource, as
+// sent in the authorized operations fields of Metadata and friends
+func (b *Broker) authorizedOperations(ctx RequestContext, resourceType ResourceType, resourceName string) int32 {
+	var operations int32
+	standard, isStandard := b.authorizer.(*StandardAuthorizer)
+	records := []AccessControlEntryRecord{}
+	if isStandard {
+		// Read the ACLs once rather than for every operation
+		records = standard.records()
+	}
+
+	for _, operation := range ResourceOperations[resourceType] {
+		var allowed bool
+		if isStandard {
+			allowed = standard.authorizeWith(records, ctx, operation, resourceType, resourceName)
+		} else {
+			allowed = b.authorize(ctx, operation, resourceType, resourceName)
+		}
+		if allowed {
+			operations |= 1 << operation
+		}
+	}
+	return operations
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func topicRecord(name string, id UUID) []byte {
+	value := []byte{1, byte(TOPIC_RECORD), 0}
+	value = append(value, encodeCompactString(name)...)
+	value = append(value, id[:]...)
+	return append(value, 0)
+}
+
+func Test_StandardAuthorizer_authorize(t *testing.T) {
+	props := map[string]string{"authorizer.class.name": STANDARD_AUTHORIZER, "super.users": "User:admin"}
+	broker := newTestBroker(t, props)
+
+	acl := func(resourceType ResourceType, name string, patternType PatternType, principal string, host string, operation AclOperation, permission AclPermissionType) AclBinding {
+		return AclBinding{
+			pattern: ResourcePattern{resourceType: resourceType, name: name, patternType: patternType},
+			entry:   AccessControlEntry{principal: principal, host: host, operation: operation, permissionType: permission},
+		}
+	}
+	errs := broker.authorizer.createAcls([]AclBinding{
+		acl(RESOURCE_TOPIC, "orders-", PATTERN_PREFIXED, "User:alice", "*", OPERATION_READ, PERMISSION_ALLOW),
+		acl(RESOURCE_TOPIC, "orders-secret", PATTERN_LITERAL, "User:alice", "*", OPERATION_READ, PERMISSION_DENY),
+		acl(RESOURCE_TOPIC, "public", PATTERN_LITERAL, "User:*", "*", OPERATION_DESCRIBE, PERMISSION_ALLOW),
+		acl(RESOURCE_TOPIC, "*", PATTERN_LITERAL, "User:bob", "10.0.0.1", OPERATION_ALL, PERMISSION_ALLOW),
+		// Rejected, only LITERAL and PREFIXED ACLs can be stored
+		acl(RESOURCE_TOPIC, "payments", PATTERN_MATCH, "User:alice", "*", OPERATION_READ, PERMISSION_ALLOW),
+	})
+	for i, err := range errs[:4] {
+		if err != nil {
+			t.Fatalf("createAcls() error for ACL %d = %v", i, err)
+		}
+	}
+	if errorCodeOf(errs[4]) != ERR_INVALID_REQUEST {
+		t.Errorf("createAcls() error for MATCH pattern = %v, want INVALID_REQUEST", errs[4])
+	}
+
+	allowEveryone := &StandardAuthorizer{metadata: broker.metadata, allowEveryoneIfNoAclFound: true}
+
+	tests := []struct {
+		name         string
+		authorizer   Authorizer
+		principal    string
+		host         string
+		operation    AclOperation
+		resourceType ResourceType
+		resource     string
+		want         bool
+	}{
+		{"prefixed ACL", broker.authorizer, "alice", "10.0.0.2", OPERATION_READ, RESOURCE_TOPIC, "orders-eu", true},
+		{"READ implies DESCRIBE", broker.authorizer, "alice", "10.0.0.2", OPERATION_DESCRIBE, RESOURCE_TOPIC, "orders-eu", true},
+		{"other operation", broker.authorizer, "alice", "10.0.0.2", OPERATION_WRITE, RESOURCE_TOPIC, "orders-eu", false},
+		{"DENY wins over ALLOW", broker.authorizer, "alice", "10.0.0.2", OPERATION_READ, RESOURCE_TOPIC, "orders-secret", false},
+		{"wildcard principal", broker.authorizer, "carol", "10.0.0.2", OPERATION_DESCRIBE, RESOURCE_TOPIC, "public", true},
+		{"DESCRIBE doesn't imply READ", broker.authorizer, "carol", "10.0.0.2", OPERATION_READ, RESOURCE_TOPIC, "public", false},
+		{"wildcard resource from the ACL host", broker.authorizer, "bob", "10.0.0.1", OPERATION_WRITE, RESOURCE_TOPIC, "payments", true},
+		{"wildcard resource from another host", broker.authorizer, "bob", "10.0.0.2", OPERATION_WRITE, RESOURCE_TOPIC, "payments", false},
+		{"super user", broker.authorizer, "admin", "10.0.0.2", OPERATION_ALTER, RESOURCE_CLUSTER, CLUSTER_RESOURCE_NAME, true},
+		{"no ACL found", broker.authorizer, "alice", "10.0.0.2", OPERATION_READ, RESOURCE_GROUP, "orders-app", false},
+		{"no ACL found, allow everyone", allowEveryone, "alice", "10.0.0.2", OPERATION_READ, RESOURCE_GROUP, "orders-app", true},
+		{"ACL found, allow everyone", allowEveryone, "carol", "10.0.0.2", OPERATION_WRITE, RESOURCE_TOPIC, "public", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := RequestContext{
+				principal:     KafkaPrincipal{principalType: "User", name: tt.principal},
+				clientAddress: &net.TCPAddr{IP: net.ParseIP(tt.host), Port: 50000},
+			}
+			if got := tt.authorizer.authorize(ctx, tt.operation, tt.resourceType, tt.resource); got != tt.want {
+				t.Errorf("authorize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Error code and authorized operations of each topic DescribeTopicPartitions
+// returns. Only works for topics without partitions.
+func describeTopics(t *testing.T, conn io.ReadWriter, names ...string) map[string][2]int32 {
+	t.Helper()
+
+	body := appendArrayLength(nil, len(names), true)
+	for _, name := range names {
+		body = append(appendString(body, name, true), 0)
+	}
+	body = binary.BigEndian.AppendUint32(body, 100)
+	body = append(body, 0xff, 0)
+	response, err := sendTestRequest(conn, DESCRIBE_TOPIC_PARTITIONS, 0, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(response[4:])
+	topics := map[string][2]int32{}
+	for range readArrayLength(buf, true) {
+		errorCode := int16(binary.BigEndian.Uint16(buf.Next(2)))
+		name := readComapctString(buf)
+		buf.Next(16 + 1) // topic ID, is internal
+		if partitions := readArrayLength(buf, true); partitions != 0 {
+			t.Fatalf("topic %s has %d partitions", name, partitions)
+		}
+		operations := int32(binary.BigEndian.Uint32(buf.Next(4)))
+		buf.Next(1)
+		topics[name] = [2]int32{int32(errorCode), operations}
+	}
+	return topics
+}
+
+func Test_AclApis(t *testing.T) {
+	props := map[string]string{"authorizer.class.name": STANDARD_AUTHORIZER, "super.users": "User:admin"}
+	for k, v := range testSaslProps {
+		props[k] = v
+	}
+	broker := newTestBroker(t, props)
+	writeMetadataRecords(t, broker, topicRecord("orders-eu", UUID{1}), topicRecord("payments", UUID{2}))
+
+	connect := func(username string, password string) net.Conn {
+		client, server := net.Pipe()
+		go newConnection(broker, "SASL_PLAINTEXT", server).serve()
+		t.Cleanup(func() { client.Close() })
+		if err := plainLogin(client, username, password); err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	admin := connect("admin", "admin-secret")
+	alice := connect("alice", "alice-secret")
+
+	// Only super users may manage ACLs until someone else is allowed to
+	create := appendArrayLength(nil, 1, true)
+	create = append(create, byte(RESOURCE_TOPIC))
+	create = appendString(create, "orders-", true)
+	create = append(create, byte(PATTERN_PREFIXED))
+	create = appendString(create, "User:alice", true)
+	create = appendString(create, "*", true)
+	create = append(create, byte(OPERATION_READ), byte(PERMISSION_ALLOW), 0, 0)
+	// Creating it again is a no-op
+	for _, tt := range []struct {
+		conn    net.Conn
+		wantErr ErrorCode
+	}{{alice, ERR_CLUSTER_AUTHORIZATION_FAILED}, {admin, ERR_NONE}, {admin, ERR_NONE}} {
+		response, err := sendTestRequest(tt.conn, CREATE_ACLS, 3, create)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ErrorCode(binary.BigEndian.Uint16(response[5:])); got != tt.wantErr {
+			t.Errorf("CreateAcls error = %v, want %v", got, tt.wantErr)
+		}
+	}
+
+	anyAcl := []byte{byte(RESOURCE_ANY), 0, byte(PATTERN_ANY), 0, 0, byte(OPERATION_ANY), byte(PERMISSION_ANY)}
+	response, err := sendTestRequest(admin, DESCRIBE_ACLS, 3, append(anyAcl, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(response[4:])
+	if errorCode := ErrorCode(binary.BigEndian.Uint16(buf.Next(2))); errorCode != ERR_NONE {
+		t.Fatalf("DescribeAcls error = %v", errorCode)
+	}
+	readComapctString(buf) // error message
+	if resources := readArrayLength(buf, true); resources != 1 {
+		t.Fatalf("DescribeAcls returned %d resources, want 1", resources)
+	}
+	if resourceType, name := ResourceType(buf.Next(1)[0]), readComapctString(buf); resourceType != RESOURCE_TOPIC || name != "orders-" {
+		t.Errorf("DescribeAcls resource = %v %v, want TOPIC orders-", resourceType, name)
+	}
+
+	// READ implies DESCRIBE, so alice gets both bits
+	readAndDescribe := int32(1<<OPERATION_READ | 1<<OPERATION_DESCRIBE)
+	want := map[string][2]int32{
+		"orders-eu": {int32(ERR_NONE), readAndDescribe},
+		"payments":  {int32(ERR_TOPIC_AUTHORIZATION_FAILED), AUTHORIZED_OPERATIONS_OMITTED},
+		"orders-us": {int32(ERR_UNKNOWN_TOPIC_OR_PARTITION), readAndDescribe},
+	}
+	if got := describeTopics(t, alice, "orders-eu", "payments", "orders-us"); got["orders-eu"] != want["orders-eu"] ||
+		got["payments"] != want["payments"] || got["orders-us"] != want["orders-us"] {
+		t.Errorf("DescribeTopicPartitions = %v, want %v", got, want)
+	}
+	if got := describeTopics(t, admin, "payments")["payments"]; got != [2]int32{int32(ERR_NONE), 0x0df8} {
+		t.Errorf("DescribeTopicPartitions for a super user = %v, want every topic operation", got)
+	}
+
+	response, err = sendTestRequest(admin, DELETE_ACLS, 3, append(append(appendArrayLength(nil, 1, true), anyAcl...), 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = bytes.NewBuffer(response[4:])
+	readArrayLength(buf, true)
+	if errorCode := ErrorCode(binary.BigEndian.Uint16(buf.Next(2))); errorCode != ERR_NONE {
+		t.Fatalf("DeleteAcls error = %v", errorCode)
+	}
+	readComapctString(buf)
+	if matching := readArrayLength(buf, true); matching != 1 {
+		t.Errorf("DeleteAcls removed %d ACLs, want 1", matching)
+	}
+
+	if got := describeTopics(t, alice, "orders-eu")["orders-eu"][0]; got != int32(ERR_TOPIC_AUTHORIZATION_FAILED) {
+		t.Errorf("DescribeTopicPartitions error after the ACL was deleted = %v, want TOPIC_AUTHORIZATION_FAILED", got)
+	}
+}
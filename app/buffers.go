@@ -0,0 +1,33 @@
+package main
+
+import "sync"
+
+// Larger buffers go back to the garbage collector, so that a single large
+// request or response doesn't keep its memory pinned in the pool
+const MAX_POOLED_BUFFER_SIZE = 1 << 20
+
+// Buffers requests are read into and responses are encoded into
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// A buffer with room for at least size bytes, to be handed back with
+// putBuffer once nothing refers to its contents
+func getBuffer(size int) *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, 0, size)
+	}
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > MAX_POOLED_BUFFER_SIZE {
+		return
+	}
+	*buf = (*buf)[:0]
+	bufferPool.Put(buf)
+}
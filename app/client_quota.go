@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+// Quota config keys, as set with kafka-configs.sh --add-config. Produce
+// isn't served yet, so producer_byte_rate is stored but never enforced.
+const (
+	PRODUCER_BYTE_RATE = "producer_byte_rate"
+	CONSUMER_BYTE_RATE = "consumer_byte_rate"
+	REQUEST_PERCENTAGE = "request_percentage"
+)
+
+// Entity types quotas can be set for. Kafka's ip quotas only limit the
+// connection rate, which we don't track.
+const (
+	QUOTA_ENTITY_USER      = "user"
+	QUOTA_ENTITY_CLIENT_ID = "client-id"
+)
+
+// Match types of DescribeClientQuotas filter components
+const (
+	QUOTA_MATCH_EXACT   int8 = 0
+	QUOTA_MATCH_DEFAULT int8 = 1
+	QUOTA_MATCH_ANY     int8 = 2
+)
+
+// One part of a quota entity: missing, the default entity, or a specific
+// user or client ID. The default applies to every user (or client ID)
+// without a quota of its own.
+type QuotaEntityName struct {
+	set       bool
+	isDefault bool
+	name      string
+}
+
+// What a quota applies to: a user, a client ID, or a client ID of a user
+type QuotaEntity struct {
+	user     QuotaEntityName
+	clientID QuotaEntityName
+}
+
+// An entity part as sent on the wire, where a null name is the default
+// entity
+type QuotaEntityData struct {
+	entityType string
+	entityName string
+	isDefault  bool
+}
+
+func namedQuotaEntity(name string) QuotaEntityName {
+	return QuotaEntityName{set: true, name: name}
+}
+
+func defaultQuotaEntity() QuotaEntityName {
+	return QuotaEntityName{set: true, isDefault: true}
+}
+
+func (n QuotaEntityName) String() string {
+	if n.isDefault {
+		return "<default>"
+	}
+	return n.name
+}
+
+func (e QuotaEntity) String() string {
+	parts := []string{}
+	for _, part := range e.data() {
+		name := part.entityName
+		if part.isDefault {
+			name = "<default>"
+		}
+		parts = append(parts, part.entityType+"="+name)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Build an entity from its parts, which must have distinct, known types
+func newQuotaEntity(parts []QuotaEntityData) (QuotaEntity, error) {
+	entity := QuotaEntity{}
+	if len(parts) == 0 {
+		return entity, newKafkaError(ERR_INVALID_REQUEST, "Invalid empty client quota entity")
+	}
+
+	for _, part := range parts {
+		name := namedQuotaEntity(part.entityName)
+		if part.isDefault {
+			name = defaultQuotaEntity()
+		}
+
+		var field *QuotaEntityName
+		switch part.entityType {
+		case QUOTA_ENTITY_USER:
+			field = &entity.user
+		case QUOTA_ENTITY_CLIENT_ID:
+			field = &entity.clientID
+		default:
+			return entity, newKafkaError(ERR_INVALID_REQUEST, "Unsupported client quota entity type: %s", part.entityType)
+		}
+		if field.set {
+			return entity, newKafkaError(ERR_INVALID_REQUEST, "Duplicate %s in client quota entity", part.entityType)
+		}
+		*field = name
+	}
+	return entity, nil
+}
+
+// The entity's parts, user first
+func (e QuotaEntity) data() []QuotaEntityData {
+	parts := []QuotaEntityData{}
+	if e.user.set {
+		parts = append(parts, QuotaEntityData{entityType: QUOTA_ENTITY_USER, entityName: e.user.name, isDefault: e.user.isDefault})
+	}
+	if e.clientID.set {
+		parts = append(parts, QuotaEntityData{entityType: QUOTA_ENTITY_CLIENT_ID, entityName: e.clientID.name, isDefault: e.clientID.isDefault})
+	}
+	return parts
+}
+
+// Check a quota value before it is stored. Byte rates are whole numbers of
+// bytes per second.
+func validateQuota(key string, value float64) error {
+	switch key {
+	case PRODUCER_BYTE_RATE, CONSUMER_BYTE_RATE:
+		if value != math.Trunc(value) {
+			return newKafkaError(ERR_INVALID_REQUEST, "Quota %s must be a whole number, got %v", key, value)
+		}
+	case REQUEST_PERCENTAGE:
+	default:
+		return newKafkaError(ERR_INVALID_REQUEST, "Unknown client quota key: %s", key)
+	}
+	if value <= 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return newKafkaError(ERR_INVALID_REQUEST, "Quota %s must be positive, got %v", key, value)
+	}
+	return nil
+}
+
+// A DescribeClientQuotas filter component, matching one part of entities
+type QuotaFilterComponent struct {
+	entityType string
+	matchType  int8
+	match      string
+}
+
+func (c QuotaFilterComponent) matches(entity QuotaEntity) bool {
+	name := entity.user
+	if c.entityType == QUOTA_ENTITY_CLIENT_ID {
+		name = entity.clientID
+	}
+
+	switch c.matchType {
+	case QUOTA_MATCH_EXACT:
+		return name.set && !name.isDefault && name.name == c.match
+	case QUOTA_MATCH_DEFAULT:
+		return name.isDefault
+	default:
+		return name.set
+	}
+}
+
+// Reject components with unknown types or match types, or several
+// components for the same entity type
+func validateQuotaFilter(components []QuotaFilterComponent) error {
+	seen := map[string]bool{}
+	for _, c := range components {
+		if c.entityType != QUOTA_ENTITY_USER && c.entityType != QUOTA_ENTITY_CLIENT_ID {
+			return newKafkaError(ERR_INVALID_REQUEST, "Unsupported client quota entity type: %s", c.entityType)
+		}
+		if seen[c.entityType] {
+			return newKafkaError(ERR_INVALID_REQUEST, "Duplicate %s filter component", c.entityType)
+		}
+		seen[c.entityType] = true
+		if c.matchType < QUOTA_MATCH_EXACT || c.matchType > QUOTA_MATCH_ANY {
+			return newKafkaError(ERR_INVALID_REQUEST, "Unknown match type %d", c.matchType)
+		}
+	}
+	return nil
+}
+
+// Whether the entity matches every component. Strict filters also reject
+// entities with parts no component mentions.
+func matchesQuotaFilter(entity QuotaEntity, components []QuotaFilterComponent, strict bool) bool {
+	mentioned := map[string]bool{}
+	for _, c := range components {
+		if !c.matches(entity) {
+			return false
+		}
+		mentioned[c.entityType] = true
+	}
+	if !strict {
+		return true
+	}
+	for _, part := range entity.data() {
+		if !mentioned[part.entityType] {
+			return false
+		}
+	}
+	return true
+}
+
+// The entity layout shared by DescribeClientQuotas and AlterClientQuotas
+func readQuotaEntityData(buf *bytes.Buffer, flexible bool) []QuotaEntityData {
+	parts := []QuotaEntityData{}
+	for range max(0, readArrayLength(buf, flexible)) {
+		part := QuotaEntityData{}
+		part.entityType = readString(buf, flexible)
+		part.entityName, part.isDefault = readNullableString(buf, flexible)
+		if flexible {
+			skipTaggedFields(buf)
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+func appendQuotaEntityData(b []byte, parts []QuotaEntityData, flexible bool) []byte {
+	b = appendArrayLength(b, len(parts), flexible)
+	for _, part := range parts {
+		b = appendString(b, part.entityType, flexible)
+		if part.isDefault {
+			b = appendNullableString(b, "", flexible)
+		} else {
+			b = appendString(b, part.entityName, flexible)
+		}
+		if flexible {
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+func appendFloat64(b []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+}
@@ -0,0 +1,875 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
+)
+
+// Broker configuration, read from a server.properties file and overridden
+// from the command line
+type Config struct {
+	nodeID                      int32
+	listeners                   []Endpoint
+	advertisedListeners         []Endpoint
+	securityProtocolMap         map[string]SecurityProtocol
+	controllerListenerNames     []string
+	rack                        string
+	logDirs                     []string
+	metadataLogDir              string
+	numPartitions               int32
+	defaultReplicationFactor    int16
+	logRetentionMs              int64
+	logRetentionBytes           int64
+	logSegmentBytes             int64
+	logRollMs                   int64
+	logRetentionCheckIntervalMs int64
+	maxInFlightRequests         int
+	gracefulShutdownTimeout     time.Duration
+	authorizerClassName         string
+	superUsers                  []string
+	allowEveryoneIfNoAclFound   bool
+	quotaWindowNum              int
+	quotaWindowSize             time.Duration
+	// Most partitions a DescribeTopicPartitions response holds
+	maxResponsePartitions int
+	logIndexIntervalBytes int
+	logIndexSizeMaxBytes  int
+	// Compaction of topics whose cleanup policy is compact
+	logCleanupPolicy             []string
+	logCleanerEnable             bool
+	logCleanerBackoffMs          int64
+	logCleanerDeleteRetentionMs  int64
+	logCleanerMinCompactionLagMs int64
+	// Limits on what a client may take up
+	socketRequestMaxBytes int
+	connectionsMaxIdle    time.Duration
+	maxConnectionsPerIp   int
+	// Per-IP overrides of maxConnectionsPerIp
+	maxConnectionsPerIpOverrides map[string]int
+	// The broker log, and the request log which is off below DEBUG
+	loggerLevel        slog.Level
+	loggerFormat       string
+	requestLoggerLevel slog.Level
+	// Client whose request and response frames the request log dumps
+	requestLoggerDumpClientID string
+	// Where /metrics is served, "" to not serve it
+	metricsHTTPAddress string
+	// Where request spans are exported, see startTracing
+	tracingExporter     string
+	tracingOtlpEndpoint string
+	tracingFilePath     string
+	// Every property as read, including the ones not listed above
+	props map[string]string
+}
+
+type SecurityProtocol string
+
+const (
+	PLAINTEXT      SecurityProtocol = "PLAINTEXT"
+	SSL            SecurityProtocol = "SSL"
+	SASL_PLAINTEXT SecurityProtocol = "SASL_PLAINTEXT"
+	SASL_SSL       SecurityProtocol = "SASL_SSL"
+)
+
+// A listener as written in listeners/advertised.listeners: NAME://host:port
+type Endpoint struct {
+	listenerName string
+	host         string
+	port         int32
+}
+
+var DefaultProperties = map[string]string{
+	"node.id":                               "1",
+	"listeners":                             "PLAINTEXT://:9092",
+	"listener.security.protocol.map":        "PLAINTEXT:PLAINTEXT,SSL:SSL,SASL_PLAINTEXT:SASL_PLAINTEXT,SASL_SSL:SASL_SSL",
+	"log.dirs":                              "/tmp/kraft-combined-logs",
+	"num.partitions":                        "1",
+	"default.replication.factor":            "1",
+	"log.retention.hours":                   "168",
+	"log.retention.bytes":                   "-1",
+	"log.segment.bytes":                     "1073741824",
+	"log.roll.hours":                        "168",
+	"log.retention.check.interval.ms":       "300000",
+	"max.in.flight.requests.per.connection": "5",
+	"graceful.shutdown.timeout.ms":          "30000",
+	"ssl.keystore.type":                     "PEM",
+	"ssl.truststore.type":                   "PEM",
+	"ssl.client.auth":                       "none",
+	"ssl.principal.mapping.rules":           "DEFAULT",
+	"sasl.enabled.mechanisms":               "GSSAPI",
+	"connections.max.reauth.ms":             "0",
+	"sasl.oauthbearer.sub.claim.name":       "sub",
+	"sasl.oauthbearer.scope.claim.name":     "scope",
+	"sasl.oauthbearer.clock.skew.seconds":   "30",
+	"allow.everyone.if.no.acl.found":        "false",
+	"quota.window.num":                      "11",
+	"quota.window.size.seconds":             "1",
+	"max.request.partition.size.limit":      "2000",
+	"log.index.interval.bytes":              "4096",
+	"log.index.size.max.bytes":              "10485760",
+	"log.cleanup.policy":                    "delete",
+	"log.cleaner.enable":                    "true",
+	"log.cleaner.backoff.ms":                "15000",
+	"log.cleaner.delete.retention.ms":       "86400000",
+	"log.cleaner.min.compaction.lag.ms":     "0",
+	"socket.request.max.bytes":              "104857600",
+	"connections.max.idle.ms":               "600000",
+	"max.connections.per.ip":                "2147483647",
+	"max.connections.per.ip.overrides":      "",
+	"logger.level":                          "INFO",
+	"logger.format":                         LOGGER_FORMAT_TEXT,
+	"request.logger.level":                  "WARN",
+	"request.logger.dump.client.id":         "",
+	"metrics.http.address":                  "",
+	"tracing.exporter":                      TRACING_EXPORTER_NONE,
+	"tracing.otlp.endpoint":                 "http://localhost:4318/v1/traces",
+	"tracing.file.path":                     "",
+}
+
+// Properties we understand. Anything else is kept but reported at startup.
+var KnownProperties = []string{
+	"node.id", "broker.id", "broker.rack", "process.roles", "controller.quorum.voters",
+	"controller.quorum.bootstrap.servers", "controller.listener.names",
+	"inter.broker.listener.name", "listeners", "advertised.listeners",
+	"listener.security.protocol.map", "log.dir", "log.dirs", "metadata.log.dir",
+	"num.partitions", "default.replication.factor", "log.retention.ms",
+	"log.retention.minutes", "log.retention.hours", "log.retention.bytes",
+	"log.segment.bytes", "log.roll.ms", "log.roll.hours",
+	"log.retention.check.interval.ms", "max.in.flight.requests.per.connection",
+	"graceful.shutdown.timeout.ms", "ssl.keystore.type", "ssl.keystore.location",
+	"ssl.keystore.key", "ssl.keystore.certificate.chain", "ssl.key.password",
+	"ssl.truststore.type", "ssl.truststore.location", "ssl.truststore.certificates",
+	"ssl.client.auth", "ssl.principal.mapping.rules", "sasl.enabled.mechanisms",
+	"sasl.jaas.config", "connections.max.reauth.ms", "sasl.server.callback.handler.class",
+	"sasl.oauthbearer.jwks.endpoint.url", "sasl.oauthbearer.sub.claim.name",
+	"sasl.oauthbearer.scope.claim.name", "sasl.oauthbearer.expected.audience",
+	"sasl.oauthbearer.expected.issuer", "sasl.oauthbearer.clock.skew.seconds",
+	"authorizer.class.name", "super.users", "allow.everyone.if.no.acl.found",
+	"quota.window.num", "quota.window.size.seconds", "max.request.partition.size.limit",
+	"log.index.interval.bytes", "log.index.size.max.bytes", "log.cleanup.policy",
+	"log.cleaner.enable", "log.cleaner.backoff.ms", "log.cleaner.delete.retention.ms",
+	"log.cleaner.min.compaction.lag.ms", "socket.request.max.bytes", "connections.max.idle.ms",
+	"max.connections.per.ip", "max.connections.per.ip.overrides", "logger.level", "logger.format",
+	"request.logger.level", "request.logger.dump.client.id", "metrics.http.address",
+	"tracing.exporter", "tracing.otlp.endpoint", "tracing.file.path",
+}
+
+// Parse kafka-server-start.sh style arguments:
+//
+//	server.properties [--override key=value]...
+func parseCommandLine(args []string) (configPath string, overrides map[string]string, err error) {
+	overrides = map[string]string{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--override" || arg == "-override":
+			if i+1 == len(args) {
+				return "", nil, fmt.Errorf("%s requires a key=value argument", arg)
+			}
+			i++
+			arg = args[i]
+		case strings.HasPrefix(arg, "--override=") || strings.HasPrefix(arg, "-override="):
+			arg = arg[strings.Index(arg, "=")+1:]
+		case strings.HasPrefix(arg, "-"):
+			return "", nil, fmt.Errorf("unknown flag %s", arg)
+		default:
+			if configPath != "" {
+				return "", nil, fmt.Errorf("unexpected argument %s", arg)
+			}
+			configPath = arg
+			continue
+		}
+
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok || key == "" {
+			return "", nil, fmt.Errorf("invalid override %q, expected key=value", arg)
+		}
+		overrides[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return configPath, overrides, nil
+}
+
+// Load the properties file at path (if any), apply overrides on top and
+// validate the result
+func loadConfig(path string, overrides map[string]string) (*Config, error) {
+	props := map[string]string{}
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if props, err = readProperties(f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	for k, v := range overrides {
+		props[k] = v
+	}
+
+	return newConfig(props)
+}
+
+// Read a Java .properties file. Supports '=', ':' and whitespace separators,
+// '#'/'!' comments, line continuations and the usual backslash escapes.
+func readProperties(r io.Reader) (map[string]string, error) {
+	props := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		// An odd number of trailing backslashes continues the line
+		for strings.HasSuffix(line, "\\") && (len(line)-len(strings.TrimRight(line, "\\")))%2 == 1 {
+			line = line[:len(line)-1]
+			if !scanner.Scan() {
+				break
+			}
+			lineNumber++
+			line += strings.TrimLeft(scanner.Text(), " \t\f")
+		}
+
+		key, value, err := splitProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		props[key] = value
+	}
+
+	return props, scanner.Err()
+}
+
+func splitProperty(line string) (key string, value string, err error) {
+	sepIdx := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.IndexByte("=: \t\f", line[i]) >= 0 {
+			sepIdx = i
+			break
+		}
+	}
+
+	rest := strings.TrimLeft(line[min(sepIdx, len(line)):], " \t\f")
+	if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+
+	if key, err = unescapeProperty(line[:sepIdx]); err != nil {
+		return "", "", err
+	}
+	if value, err = unescapeProperty(rest); err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+func unescapeProperty(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			out.WriteByte('\t')
+		case 'n':
+			out.WriteByte('\n')
+		case 'r':
+			out.WriteByte('\r')
+		case 'f':
+			out.WriteByte('\f')
+		case 'u':
+			if i+5 > len(s) {
+				return "", fmt.Errorf("malformed \\u escape in %q", s)
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("malformed \\u escape in %q", s)
+			}
+			out.WriteRune(rune(r))
+			i += 4
+		default:
+			out.WriteByte(s[i])
+		}
+	}
+	return out.String(), nil
+}
+
+// Build a config from explicitly set properties, falling back to
+// DefaultProperties for the rest
+func newConfig(props map[string]string) (*Config, error) {
+	c := &Config{props: props}
+	p := propertyParser{props: props}
+
+	// broker.id is the pre-KRaft name of node.id
+	if p.isSet("broker.id") && !p.isSet("node.id") {
+		c.nodeID = int32(p.int("broker.id", 0, 1<<31-1))
+	} else {
+		c.nodeID = int32(p.int("node.id", 0, 1<<31-1))
+	}
+
+	c.securityProtocolMap = p.securityProtocolMap("listener.security.protocol.map")
+	c.controllerListenerNames = p.list("controller.listener.names")
+	c.rack = p.value("broker.rack")
+	c.listeners = p.endpoints("listeners")
+	// A copy, since validate fills in the hosts of wildcard listeners
+	c.advertisedListeners = slices.Clone(c.listeners)
+	if p.isSet("advertised.listeners") {
+		c.advertisedListeners = p.endpoints("advertised.listeners")
+	}
+
+	// log.dirs takes precedence over log.dir
+	if p.isSet("log.dir") && !p.isSet("log.dirs") {
+		c.logDirs = p.list("log.dir")
+	} else {
+		c.logDirs = p.list("log.dirs")
+	}
+	c.metadataLogDir = p.value("metadata.log.dir")
+	if c.metadataLogDir == "" && len(c.logDirs) > 0 {
+		c.metadataLogDir = c.logDirs[0]
+	}
+
+	c.numPartitions = int32(p.int("num.partitions", 1, 1<<31-1))
+	c.defaultReplicationFactor = int16(p.int("default.replication.factor", 1, 1<<15-1))
+
+	// The most precise retention/roll setting wins, like in Kafka
+	switch {
+	case p.isSet("log.retention.ms"):
+		c.logRetentionMs = p.int("log.retention.ms", -1, 1<<63-1)
+	case p.isSet("log.retention.minutes"):
+		c.logRetentionMs = p.int("log.retention.minutes", -1, 1<<31-1) * int64(time.Minute/time.Millisecond)
+	default:
+		c.logRetentionMs = p.int("log.retention.hours", -1, 1<<31-1) * int64(time.Hour/time.Millisecond)
+	}
+	if c.logRetentionMs < 0 {
+		c.logRetentionMs = -1
+	}
+	c.logRetentionBytes = p.int("log.retention.bytes", -1, 1<<63-1)
+	c.logSegmentBytes = p.int("log.segment.bytes", 14, 1<<31-1)
+	if p.isSet("log.roll.ms") {
+		c.logRollMs = p.int("log.roll.ms", 1, 1<<63-1)
+	} else {
+		c.logRollMs = p.int("log.roll.hours", 1, 1<<31-1) * int64(time.Hour/time.Millisecond)
+	}
+	c.logRetentionCheckIntervalMs = p.int("log.retention.check.interval.ms", 1, 1<<63-1)
+
+	c.maxInFlightRequests = int(p.int("max.in.flight.requests.per.connection", 1, 1<<31-1))
+	c.gracefulShutdownTimeout = time.Duration(p.int("graceful.shutdown.timeout.ms", 0, 1<<31-1)) * time.Millisecond
+
+	c.authorizerClassName = p.value("authorizer.class.name")
+	// Unlike other lists, super.users is separated by semicolons since
+	// principal names may contain commas
+	c.superUsers = []string{}
+	for _, user := range strings.Split(p.value("super.users"), ";") {
+		if user = strings.TrimSpace(user); user != "" {
+			c.superUsers = append(c.superUsers, user)
+		}
+	}
+	c.allowEveryoneIfNoAclFound = p.bool("allow.everyone.if.no.acl.found")
+
+	c.quotaWindowNum = int(p.int("quota.window.num", 1, 1<<31-1))
+	c.quotaWindowSize = time.Duration(p.int("quota.window.size.seconds", 1, 1<<31-1)) * time.Second
+
+	c.maxResponsePartitions = int(p.int("max.request.partition.size.limit", 1, 1<<31-1))
+
+	c.logIndexIntervalBytes = int(p.int("log.index.interval.bytes", 0, 1<<31-1))
+	// Room for at least one entry of either index
+	c.logIndexSizeMaxBytes = int(p.int("log.index.size.max.bytes", 12, 1<<31-1))
+
+	c.logCleanupPolicy = p.cleanupPolicy("log.cleanup.policy")
+	c.logCleanerEnable = p.bool("log.cleaner.enable")
+	c.logCleanerBackoffMs = p.int("log.cleaner.backoff.ms", 1, 1<<63-1)
+	c.logCleanerDeleteRetentionMs = p.int("log.cleaner.delete.retention.ms", 0, 1<<63-1)
+	c.logCleanerMinCompactionLagMs = p.int("log.cleaner.min.compaction.lag.ms", 0, 1<<63-1)
+
+	c.socketRequestMaxBytes = int(p.int("socket.request.max.bytes", 1, 1<<31-1))
+	c.connectionsMaxIdle = time.Duration(p.int("connections.max.idle.ms", 1, 1<<31-1)) * time.Millisecond
+	c.maxConnectionsPerIp = int(p.int("max.connections.per.ip", 0, 1<<31-1))
+	c.maxConnectionsPerIpOverrides = p.connectionLimits("max.connections.per.ip.overrides")
+
+	c.loggerLevel = p.logLevel("logger.level")
+	c.loggerFormat = p.value("logger.format")
+	if c.loggerFormat != LOGGER_FORMAT_TEXT && c.loggerFormat != LOGGER_FORMAT_JSON {
+		p.fail("logger.format", "unknown format %s", c.loggerFormat)
+	}
+	c.requestLoggerLevel = p.logLevel("request.logger.level")
+	c.requestLoggerDumpClientID = p.value("request.logger.dump.client.id")
+	c.metricsHTTPAddress = p.value("metrics.http.address")
+
+	c.tracingExporter = p.value("tracing.exporter")
+	switch c.tracingExporter {
+	case TRACING_EXPORTER_NONE, TRACING_EXPORTER_OTLP:
+	case TRACING_EXPORTER_FILE:
+		if p.value("tracing.file.path") == "" {
+			p.fail("tracing.file.path", "must be set to export spans to a file")
+		}
+	default:
+		p.fail("tracing.exporter", "unknown exporter %s", c.tracingExporter)
+	}
+	c.tracingOtlpEndpoint = p.value("tracing.otlp.endpoint")
+	c.tracingFilePath = p.value("tracing.file.path")
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	return c, c.validate()
+}
+
+func (c *Config) validate() error {
+	if len(c.logDirs) == 0 {
+		return fmt.Errorf("log.dirs must contain at least one directory")
+	}
+
+	names := map[string]bool{}
+	for _, listener := range c.listeners {
+		if names[listener.listenerName] {
+			return fmt.Errorf("listeners: listener name %s is used more than once", listener.listenerName)
+		}
+		names[listener.listenerName] = true
+
+		protocol, ok := c.securityProtocolMap[listener.listenerName]
+		if !ok {
+			return fmt.Errorf("listeners: no security protocol defined for listener %s in listener.security.protocol.map", listener.listenerName)
+		}
+		switch protocol {
+		case PLAINTEXT:
+		case SSL:
+			if err := c.validateSSL(listener.listenerName); err != nil {
+				return err
+			}
+		case SASL_PLAINTEXT:
+			if err := c.validateSASL(listener.listenerName); err != nil {
+				return err
+			}
+		case SASL_SSL:
+			if err := c.validateSSL(listener.listenerName); err != nil {
+				return err
+			}
+			if err := c.validateSASL(listener.listenerName); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("listeners: security protocol %s of listener %s is not supported", protocol, listener.listenerName)
+		}
+	}
+	if len(c.brokerListeners()) == 0 {
+		return fmt.Errorf("listeners must contain at least one listener that isn't a controller listener")
+	}
+
+	if c.authorizerClassName != "" && c.authorizerClassName != STANDARD_AUTHORIZER {
+		return fmt.Errorf("authorizer.class.name: %s is not supported, only %s is", c.authorizerClassName, STANDARD_AUTHORIZER)
+	}
+	for _, user := range c.superUsers {
+		if _, err := parseKafkaPrincipal(user); err != nil {
+			return fmt.Errorf("super.users: %w", err)
+		}
+	}
+
+	for i, advertised := range c.advertisedListeners {
+		if !names[advertised.listenerName] {
+			return fmt.Errorf("advertised.listeners: listener %s is not in listeners", advertised.listenerName)
+		}
+		if slices.Contains(c.controllerListenerNames, advertised.listenerName) {
+			continue
+		}
+		if advertised.host == "" || advertised.host == "0.0.0.0" || advertised.host == "::" {
+			// Clients can't connect to a wildcard address, advertise our
+			// hostname instead like Kafka does
+			hostname, err := os.Hostname()
+			if err != nil {
+				return fmt.Errorf("advertised.listeners: %s has no host and the hostname is unknown", advertised.listenerName)
+			}
+			c.advertisedListeners[i].host = hostname
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateSSL(listenerName string) error {
+	if keystoreType := c.listenerProperty(listenerName, "ssl.keystore.type"); keystoreType != "PEM" {
+		return fmt.Errorf("listener %s: ssl.keystore.type %s is not supported, only PEM is", listenerName, keystoreType)
+	}
+	if c.listenerProperty(listenerName, "ssl.keystore.location") == "" && c.listenerProperty(listenerName, "ssl.keystore.key") == "" {
+		return fmt.Errorf("listener %s: SSL requires ssl.keystore.location or ssl.keystore.key", listenerName)
+	}
+	if c.listenerProperty(listenerName, "ssl.key.password") != "" {
+		return fmt.Errorf("listener %s: encrypted private keys (ssl.key.password) are not supported", listenerName)
+	}
+	if truststoreType := c.listenerProperty(listenerName, "ssl.truststore.type"); truststoreType != "PEM" {
+		return fmt.Errorf("listener %s: ssl.truststore.type %s is not supported, only PEM is", listenerName, truststoreType)
+	}
+
+	clientAuth := c.listenerProperty(listenerName, "ssl.client.auth")
+	if !slices.Contains([]string{"required", "requested", "none"}, clientAuth) {
+		return fmt.Errorf("listener %s: ssl.client.auth must be one of required, requested or none", listenerName)
+	}
+	hasTruststore := c.listenerProperty(listenerName, "ssl.truststore.location") != "" || c.listenerProperty(listenerName, "ssl.truststore.certificates") != ""
+	if clientAuth != "none" && !hasTruststore {
+		return fmt.Errorf("listener %s: ssl.client.auth=%s requires a truststore to verify client certificates", listenerName, clientAuth)
+	}
+
+	if _, err := parsePrincipalMappingRules(c.listenerProperty(listenerName, "ssl.principal.mapping.rules")); err != nil {
+		return fmt.Errorf("listener %s: ssl.principal.mapping.rules: %w", listenerName, err)
+	}
+	return nil
+}
+
+func (c *Config) validateSASL(listenerName string) error {
+	mechanisms := c.saslMechanisms(listenerName)
+	if len(mechanisms) == 0 {
+		return fmt.Errorf("listener %s: sasl.enabled.mechanisms is empty", listenerName)
+	}
+
+	for _, mechanism := range mechanisms {
+		if !slices.Contains(SupportedSaslMechanisms, mechanism) {
+			return fmt.Errorf("listener %s: SASL mechanism %s is not supported, supported mechanisms are %s", listenerName, mechanism, strings.Join(SupportedSaslMechanisms, ", "))
+		}
+
+		key := "listener.name." + strings.ToLower(listenerName) + "." + strings.ToLower(mechanism) + ".sasl.jaas.config"
+		jaas := JaasConfig{}
+		if value := c.saslProperty(listenerName, mechanism, "sasl.jaas.config"); value != "" {
+			var err error
+			if jaas, err = parseJaasConfig(value); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		// SCRAM users can also be created through the metadata log, PLAIN
+		// ones only exist in the JAAS config
+		if mechanism == SASL_PLAIN && len(jaas.users()) == 0 {
+			return fmt.Errorf("listener %s: PLAIN requires user_<name> entries in %s", listenerName, key)
+		}
+
+		if mechanism == SASL_OAUTHBEARER {
+			if _, err := jwksFilePath(c.saslProperty(listenerName, mechanism, "sasl.oauthbearer.jwks.endpoint.url")); err != nil {
+				return fmt.Errorf("listener %s: %w", listenerName, err)
+			}
+			if skew, err := strconv.Atoi(c.saslProperty(listenerName, mechanism, "sasl.oauthbearer.clock.skew.seconds")); err != nil || skew < 0 {
+				return fmt.Errorf("listener %s: sasl.oauthbearer.clock.skew.seconds must be a non-negative number", listenerName)
+			}
+		}
+
+		reauth, err := strconv.ParseInt(c.saslProperty(listenerName, mechanism, "connections.max.reauth.ms"), 10, 64)
+		if err != nil || reauth < 0 {
+			return fmt.Errorf("listener %s: connections.max.reauth.ms must be a non-negative number", listenerName)
+		}
+	}
+	return nil
+}
+
+func (c *Config) saslMechanisms(listenerName string) []string {
+	out := []string{}
+	for _, mechanism := range strings.Split(c.listenerProperty(listenerName, "sasl.enabled.mechanisms"), ",") {
+		if mechanism = strings.TrimSpace(mechanism); mechanism != "" {
+			out = append(out, strings.ToUpper(mechanism))
+		}
+	}
+	return out
+}
+
+// The JAAS config of a SASL mechanism of a listener, which validate made
+// sure is well formed
+func (c *Config) jaasConfig(listenerName string, mechanism string) JaasConfig {
+	jaas, _ := parseJaasConfig(c.saslProperty(listenerName, mechanism, "sasl.jaas.config"))
+	return jaas
+}
+
+// How long a SASL session lasts before the client has to re-authenticate
+// (KIP-368), zero if it doesn't have to
+func (c *Config) sessionLifetime(listenerName string, mechanism string) time.Duration {
+	ms, _ := strconv.ParseInt(c.saslProperty(listenerName, mechanism, "connections.max.reauth.ms"), 10, 64)
+	return time.Duration(ms) * time.Millisecond
+}
+
+// Look up a property that can be set per SASL mechanism of a listener, as
+// in listener.name.sasl_ssl.scram-sha-256.sasl.jaas.config
+func (c *Config) saslProperty(listenerName string, mechanism string, key string) string {
+	if value, ok := c.props["listener.name."+strings.ToLower(listenerName)+"."+strings.ToLower(mechanism)+"."+key]; ok {
+		return strings.TrimSpace(value)
+	}
+	return c.listenerProperty(listenerName, key)
+}
+
+// Look up a property that can be set per listener, as in
+// listener.name.external.ssl.keystore.location
+func (c *Config) listenerProperty(listenerName string, key string) string {
+	if value, ok := c.props["listener.name."+strings.ToLower(listenerName)+"."+key]; ok {
+		return strings.TrimSpace(value)
+	}
+	p := propertyParser{props: c.props}
+	return p.value(key)
+}
+
+// Listeners serving clients; controller listeners are for the KRaft quorum
+// which this broker doesn't take part in
+func (c *Config) brokerListeners() []Endpoint {
+	out := []Endpoint{}
+	for _, listener := range c.listeners {
+		if !slices.Contains(c.controllerListenerNames, listener.listenerName) {
+			out = append(out, listener)
+		}
+	}
+	return out
+}
+
+// Where clients of the given listener should connect to
+func (c *Config) advertisedListener(listenerName string) (Endpoint, bool) {
+	for _, endpoint := range c.advertisedListeners {
+		if endpoint.listenerName == listenerName {
+			return endpoint, true
+		}
+	}
+	return Endpoint{}, false
+}
+
+// How many connections clients at ip may have open at once
+func (c *Config) maxConnections(ip string) int {
+	if limit, ok := c.maxConnectionsPerIpOverrides[ip]; ok {
+		return limit
+	}
+	return c.maxConnectionsPerIp
+}
+
+// Settings of the partition logs
+func (c *Config) logConfig() log.Config {
+	return log.Config{
+		SegmentBytes:       c.logSegmentBytes,
+		SegmentMs:          c.logRollMs,
+		IndexIntervalBytes: c.logIndexIntervalBytes,
+		MaxIndexSize:       c.logIndexSizeMaxBytes,
+		RetentionMs:        c.logRetentionMs,
+		RetentionBytes:     c.logRetentionBytes,
+		CleanupPolicy:      strings.Join(c.logCleanupPolicy, ","),
+		DeleteRetentionMs:  c.logCleanerDeleteRetentionMs,
+		MinCompactionLagMs: c.logCleanerMinCompactionLagMs,
+	}
+}
+
+// Log settings of a topic: the broker's, overridden by the configs set on
+// the topic. The controller validated those, anything unparsable is
+// ignored.
+func (c *Config) topicLogConfig(topicConfigs map[string]string) log.Config {
+	config := c.logConfig()
+	for name, setting := range map[string]*int64{
+		"retention.ms":          &config.RetentionMs,
+		"retention.bytes":       &config.RetentionBytes,
+		"segment.ms":            &config.SegmentMs,
+		"delete.retention.ms":   &config.DeleteRetentionMs,
+		"min.compaction.lag.ms": &config.MinCompactionLagMs,
+	} {
+		if value, err := strconv.ParseInt(topicConfigs[name], 10, 64); err == nil {
+			*setting = value
+		}
+	}
+	if policy, ok := topicConfigs["cleanup.policy"]; ok {
+		config.CleanupPolicy = policy
+	}
+	if config.RetentionMs < 0 {
+		config.RetentionMs = -1
+	}
+	return config
+}
+
+func (c *Config) metadataLogPath() string {
+	return filepath.Join(c.metadataLogDir, "__cluster_metadata-0")
+}
+
+// Properties we were given but don't know about
+func (c *Config) unknownProperties() []string {
+	out := []string{}
+	for k := range c.props {
+		// Per listener overrides: listener.name.<listener>.<property>, and
+		// for SASL listener.name.<listener>.<mechanism>.<property>
+		key := k
+		if rest, ok := strings.CutPrefix(k, "listener.name."); ok {
+			if _, property, ok := strings.Cut(rest, "."); ok {
+				key = property
+			}
+			if _, property, ok := strings.Cut(key, "."); ok && !slices.Contains(KnownProperties, key) {
+				key = property
+			}
+		}
+		if !slices.Contains(KnownProperties, key) {
+			out = append(out, k)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func (e Endpoint) address() string {
+	return net.JoinHostPort(e.host, strconv.Itoa(int(e.port)))
+}
+
+func (e Endpoint) String() string {
+	return e.listenerName + "://" + e.address()
+}
+
+// Parses typed properties, remembering the first error
+type propertyParser struct {
+	props map[string]string
+	err   error
+}
+
+func (p *propertyParser) fail(key string, format string, args ...any) {
+	if p.err == nil {
+		p.err = fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...))
+	}
+}
+
+func (p *propertyParser) isSet(key string) bool {
+	_, ok := p.props[key]
+	return ok
+}
+
+func (p *propertyParser) value(key string) string {
+	if value, ok := p.props[key]; ok {
+		return strings.TrimSpace(value)
+	}
+	return DefaultProperties[key]
+}
+
+func (p *propertyParser) int(key string, minValue int64, maxValue int64) int64 {
+	value := p.value(key)
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		p.fail(key, "invalid integer %q", value)
+		return 0
+	}
+	if n < minValue || n > maxValue {
+		p.fail(key, "%d is out of range [%d, %d]", n, minValue, maxValue)
+	}
+	return n
+}
+
+func (p *propertyParser) bool(key string) bool {
+	value := p.value(key)
+	switch strings.ToLower(value) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	p.fail(key, "invalid boolean %q", value)
+	return false
+}
+
+func (p *propertyParser) list(key string) []string {
+	out := []string{}
+	for _, item := range strings.Split(p.value(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// A cleanup policy: delete, compact or both
+func (p *propertyParser) cleanupPolicy(key string) []string {
+	policies := p.list(key)
+	for _, policy := range policies {
+		if policy != log.CLEANUP_POLICY_DELETE && policy != log.CLEANUP_POLICY_COMPACT {
+			p.fail(key, "unknown cleanup policy %s", policy)
+		}
+	}
+	return policies
+}
+
+// Connection limits by IP address, written IP:COUNT
+func (p *propertyParser) connectionLimits(key string) map[string]int {
+	out := map[string]int{}
+	for _, item := range p.list(key) {
+		i := strings.LastIndex(item, ":")
+		count, err := strconv.Atoi(item[i+1:])
+		if i < 0 || err != nil || count < 0 {
+			p.fail(key, "invalid entry %q, expected IP:COUNT", item)
+			continue
+		}
+		out[item[:i]] = count
+	}
+	return out
+}
+
+// A slog level: DEBUG, INFO, WARN or ERROR
+func (p *propertyParser) logLevel(key string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(p.value(key))); err != nil {
+		p.fail(key, "unknown level %s", p.value(key))
+	}
+	return level
+}
+
+func (p *propertyParser) securityProtocolMap(key string) map[string]SecurityProtocol {
+	out := map[string]SecurityProtocol{}
+	for _, item := range p.list(key) {
+		name, protocol, ok := strings.Cut(item, ":")
+		if !ok {
+			p.fail(key, "invalid entry %q, expected NAME:PROTOCOL", item)
+			continue
+		}
+		switch SecurityProtocol(strings.ToUpper(protocol)) {
+		case PLAINTEXT, SSL, SASL_PLAINTEXT, SASL_SSL:
+			out[strings.ToUpper(name)] = SecurityProtocol(strings.ToUpper(protocol))
+		default:
+			p.fail(key, "unknown security protocol %s", protocol)
+		}
+	}
+	return out
+}
+
+func (p *propertyParser) endpoints(key string) []Endpoint {
+	out := []Endpoint{}
+	for _, item := range p.list(key) {
+		name, address, ok := strings.Cut(item, "://")
+		if !ok {
+			p.fail(key, "invalid listener %q, expected NAME://host:port", item)
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			p.fail(key, "invalid listener %q: %s", item, err.Error())
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			p.fail(key, "invalid port in listener %q", item)
+			continue
+		}
+		out = append(out, Endpoint{
+			listenerName: strings.ToUpper(name),
+			host:         host,
+			port:         int32(port),
+		})
+	}
+	return out
+}
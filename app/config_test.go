@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_readProperties(t *testing.T) {
+	input := `# The id of the broker
+node.id=3
+! legacy comment
+listeners = PLAINTEXT://:9092,\
+    CONTROLLER://:9093
+log.dirs:/var/lib/kafka
+empty.value=
+spaced.key value with spaces
+escaped\=key=tab\there
+unicode=café
+`
+	want := map[string]string{
+		"node.id":     "3",
+		"listeners":   "PLAINTEXT://:9092,CONTROLLER://:9093",
+		"log.dirs":    "/var/lib/kafka",
+		"empty.value": "",
+		"spaced.key":  "value with spaces",
+		"escaped=key": "tab\there",
+		"unicode":     "café",
+	}
+
+	got, err := readProperties(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("readProperties() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readProperties() = %v, want %v", got, want)
+	}
+}
+
+func Test_parseCommandLine(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		wantPath      string
+		wantOverrides map[string]string
+		wantErr       bool
+	}{
+		{
+			name:          "no arguments",
+			args:          []string{},
+			wantOverrides: map[string]string{},
+		},
+		{
+			name:          "path and overrides",
+			args:          []string{"/tmp/server.properties", "--override", "node.id=2", "-override=log.dirs=/data"},
+			wantPath:      "/tmp/server.properties",
+			wantOverrides: map[string]string{"node.id": "2", "log.dirs": "/data"},
+		},
+		{
+			name:          "overrides before path",
+			args:          []string{"--override", "num.partitions=3", "server.properties"},
+			wantPath:      "server.properties",
+			wantOverrides: map[string]string{"num.partitions": "3"},
+		},
+		{name: "override without value", args: []string{"--override"}, wantErr: true},
+		{name: "override without '='", args: []string{"--override", "node.id"}, wantErr: true},
+		{name: "unknown flag", args: []string{"--verbose"}, wantErr: true},
+		{name: "two paths", args: []string{"a.properties", "b.properties"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPath, gotOverrides, err := parseCommandLine(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCommandLine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if gotPath != tt.wantPath {
+				t.Errorf("parseCommandLine() path = %v, want %v", gotPath, tt.wantPath)
+			}
+			if !reflect.DeepEqual(gotOverrides, tt.wantOverrides) {
+				t.Errorf("parseCommandLine() overrides = %v, want %v", gotOverrides, tt.wantOverrides)
+			}
+		})
+	}
+}
+
+func Test_newConfig(t *testing.T) {
+	config, err := newConfig(map[string]string{
+		"process.roles":                  "broker,controller",
+		"node.id":                        "1",
+		"controller.listener.names":      "CONTROLLER",
+		"listeners":                      "PLAINTEXT://:9092,CONTROLLER://:9093",
+		"advertised.listeners":           "PLAINTEXT://localhost:9092",
+		"listener.security.protocol.map": "CONTROLLER:PLAINTEXT,PLAINTEXT:PLAINTEXT",
+		"log.dirs":                       "/tmp/a,/tmp/b",
+		"log.retention.minutes":          "10",
+		"log.roll.ms":                    "1000",
+	})
+	if err != nil {
+		t.Fatalf("newConfig() error = %v", err)
+	}
+
+	if config.nodeID != 1 {
+		t.Errorf("nodeID = %v, want 1", config.nodeID)
+	}
+	if want := []Endpoint{{"PLAINTEXT", "", 9092}}; !reflect.DeepEqual(config.brokerListeners(), want) {
+		t.Errorf("brokerListeners() = %v, want %v", config.brokerListeners(), want)
+	}
+	if want := []Endpoint{{"PLAINTEXT", "localhost", 9092}}; !reflect.DeepEqual(config.advertisedListeners, want) {
+		t.Errorf("advertisedListeners = %v, want %v", config.advertisedListeners, want)
+	}
+	if config.metadataLogPath() != "/tmp/a/__cluster_metadata-0" {
+		t.Errorf("metadataLogPath() = %v", config.metadataLogPath())
+	}
+	if config.logRetentionMs != (10 * time.Minute).Milliseconds() {
+		t.Errorf("logRetentionMs = %v", config.logRetentionMs)
+	}
+	if config.logRollMs != 1000 {
+		t.Errorf("logRollMs = %v, want 1000", config.logRollMs)
+	}
+	if config.numPartitions != 1 || config.logSegmentBytes != 1073741824 {
+		t.Errorf("defaults not applied: numPartitions = %v, logSegmentBytes = %v", config.numPartitions, config.logSegmentBytes)
+	}
+	if unknown := config.unknownProperties(); len(unknown) != 0 {
+		t.Errorf("unknownProperties() = %v, want none", unknown)
+	}
+
+	// Without advertised.listeners the hostname is advertised, but the
+	// broker still binds to every interface
+	config, err = newConfig(map[string]string{"listeners": "PLAINTEXT://:9092"})
+	if err != nil {
+		t.Fatalf("newConfig() error = %v", err)
+	}
+	if want := []Endpoint{{"PLAINTEXT", "", 9092}}; !reflect.DeepEqual(config.brokerListeners(), want) {
+		t.Errorf("brokerListeners() without advertised.listeners = %v, want %v", config.brokerListeners(), want)
+	}
+	hostname, _ := os.Hostname()
+	if advertised, _ := config.advertisedListener("PLAINTEXT"); advertised.host != hostname {
+		t.Errorf("advertised host = %q, want %q", advertised.host, hostname)
+	}
+}
+
+func Test_newConfig_validation(t *testing.T) {
+	tests := []struct {
+		name  string
+		props map[string]string
+	}{
+		{"negative node id", map[string]string{"node.id": "-1"}},
+		{"non-numeric partitions", map[string]string{"num.partitions": "many"}},
+		{"zero partitions", map[string]string{"num.partitions": "0"}},
+		{"tiny segments", map[string]string{"log.segment.bytes": "1"}},
+		{"no log dirs", map[string]string{"log.dirs": " , "}},
+		{"malformed listener", map[string]string{"listeners": "localhost:9092"}},
+		{"unmapped listener", map[string]string{"listeners": "INTERNAL://:9092"}},
+		{"duplicate listener", map[string]string{"listeners": "PLAINTEXT://:9092,PLAINTEXT://:9093"}},
+		{"unknown protocol", map[string]string{"listener.security.protocol.map": "PLAINTEXT:CARRIER_PIGEON"}},
+		{"advertised listener not bound", map[string]string{"advertised.listeners": "EXTERNAL://example.com:9092"}},
+		{"only controller listeners", map[string]string{"controller.listener.names": "PLAINTEXT"}},
+		{"SSL without keystore", map[string]string{"listeners": "SSL://:9093", "listener.security.protocol.map": "SSL:SSL"}},
+		{"SSL client auth without truststore", map[string]string{
+			"listeners": "SSL://:9093", "listener.security.protocol.map": "SSL:SSL",
+			"ssl.keystore.location": "/tmp/server.pem", "ssl.client.auth": "required",
+		}},
+		{"JKS keystore", map[string]string{
+			"listeners": "SSL://:9093", "listener.security.protocol.map": "SSL:SSL",
+			"ssl.keystore.location": "/tmp/server.jks", "ssl.keystore.type": "JKS",
+		}},
+		{"SASL with GSSAPI", map[string]string{"listeners": "SASL_PLAINTEXT://:9092", "listener.security.protocol.map": "SASL_PLAINTEXT:SASL_PLAINTEXT"}},
+		{"SASL PLAIN without users", map[string]string{
+			"listeners": "SASL_PLAINTEXT://:9092", "listener.security.protocol.map": "SASL_PLAINTEXT:SASL_PLAINTEXT",
+			"sasl.enabled.mechanisms": "PLAIN",
+		}},
+		{"malformed JAAS config", map[string]string{
+			"listeners": "SASL_PLAINTEXT://:9092", "listener.security.protocol.map": "SASL_PLAINTEXT:SASL_PLAINTEXT",
+			"sasl.enabled.mechanisms":                                     "SCRAM-SHA-256",
+			"listener.name.sasl_plaintext.scram-sha-256.sasl.jaas.config": "ScramLoginModule required",
+		}},
+		{"remote JWKS", map[string]string{
+			"listeners": "SASL_PLAINTEXT://:9092", "listener.security.protocol.map": "SASL_PLAINTEXT:SASL_PLAINTEXT",
+			"sasl.enabled.mechanisms":            "OAUTHBEARER",
+			"sasl.oauthbearer.jwks.endpoint.url": "https://idp.example.com/jwks",
+		}},
+		{"invalid mapping rule", map[string]string{
+			"listeners": "SSL://:9093", "listener.security.protocol.map": "SSL:SSL",
+			"ssl.keystore.location": "/tmp/server.pem", "ssl.principal.mapping.rules": "RULE:^CN=(.*)$",
+		}},
+		{"ZooKeeper authorizer", map[string]string{"authorizer.class.name": "kafka.security.authorizer.AclAuthorizer"}},
+		{"super user without type", map[string]string{"authorizer.class.name": STANDARD_AUTHORIZER, "super.users": "User:admin;alice"}},
+		{"non-boolean allow everyone", map[string]string{"allow.everyone.if.no.acl.found": "yes"}},
+		{"unknown cleanup policy", map[string]string{"log.cleanup.policy": "compact,archive"}},
+		{"connection limit without count", map[string]string{"max.connections.per.ip.overrides": "127.0.0.1"}},
+		{"unknown log level", map[string]string{"logger.level": "CHATTY"}},
+		{"unknown log format", map[string]string{"logger.format": "xml"}},
+		{"unknown tracing exporter", map[string]string{"tracing.exporter": "zipkin"}},
+		{"file exporter without path", map[string]string{"tracing.exporter": "file"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newConfig(tt.props); err == nil {
+				t.Errorf("newConfig() accepted %v", tt.props)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// APIs whose handlers only read broker state and can run concurrently with
+// other requests on the same connection. Anything else acts as a barrier:
+// it waits for earlier requests to finish and runs on its own.
+var ConcurrentApis = map[ApiKey]bool{
+	API_VERSIONS:              true,
+	DESCRIBE_TOPIC_PARTITIONS: true,
+	FETCH:                     true,
+	LIST_OFFSETS:              true,
+	METADATA:                  true,
+	DESCRIBE_CLUSTER:          true,
+	DESCRIBE_ACLS:             true,
+	DESCRIBE_CLIENT_QUOTAS:    true,
+}
+
+type Connection struct {
+	broker  *Broker
+	conn    net.Conn
+	context RequestContext
+	// Responses in the order their requests were read, which is the order
+	// Kafka clients expect them back in
+	responses chan *PendingResponse
+	// Holds one token per in-flight request. Once max.in.flight.requests.per.connection
+	// are in flight we stop reading from the socket until the oldest
+	// response goes out.
+	slots     chan struct{}
+	inFlight  sync.WaitGroup
+	closed    chan struct{}
+	closeOnce sync.Once
+	// Set once the broker shuts down; no more requests are read but the
+	// ones already read still get their responses
+	draining atomic.Bool
+	// When a throttled client may send requests again, in Unix nanoseconds
+	mutedUntil atomic.Int64
+}
+
+// How long a client gets to complete the TLS handshake
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+type PendingResponse struct {
+	// What the response answers, for the request log
+	header    RequestHeader
+	principal KafkaPrincipal
+	received  time.Time
+	response  *ResponseMessage
+	// Ended once the response is sent, nil unless tracing is on
+	span *Span
+	// How long the connection is muted for once the response is sent
+	throttle time.Duration
+	done     chan struct{}
+}
+
+func newConnection(broker *Broker, listenerName string, conn net.Conn) *Connection {
+	maxInFlightRequests := broker.config.maxInFlightRequests
+	c := &Connection{
+		broker: broker,
+		conn:   conn,
+		context: RequestContext{
+			listenerName:     listenerName,
+			securityProtocol: broker.config.securityProtocolMap[listenerName],
+			clientAddress:    conn.RemoteAddr(),
+			principal:        ANONYMOUS_PRINCIPAL,
+		},
+		responses: make(chan *PendingResponse, maxInFlightRequests),
+		slots:     make(chan struct{}, maxInFlightRequests),
+		closed:    make(chan struct{}),
+	}
+	if c.context.securityProtocol == SASL_PLAINTEXT || c.context.securityProtocol == SASL_SSL {
+		c.context.sasl = newSaslSession(broker, listenerName)
+	}
+	return c
+}
+
+func (c *Connection) serve() {
+	if err := c.handshake(); err != nil {
+		slog.Info("Failed authentication, SSL handshake failed", "clientAddress", c.context.clientAddress.String(), "error", err)
+		c.close()
+		return
+	}
+
+	go c.readRequests()
+	c.writeResponses()
+}
+
+// Complete the TLS handshake of SSL connections and authenticate the client
+// by its certificate
+func (c *Connection) handshake() error {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), TLS_HANDSHAKE_TIMEOUT)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+
+	// On SASL_SSL listeners the principal comes from SASL instead
+	if c.context.securityProtocol != SSL {
+		return nil
+	}
+	principal, err := c.broker.tlsLoaders[c.context.listenerName].principal(tlsConn.ConnectionState())
+	if err != nil {
+		return err
+	}
+	c.context.principal = principal
+	return nil
+}
+
+// Stop reading requests. The connection closes once the responses to the
+// requests already read have been written.
+func (c *Connection) drain() {
+	c.draining.Store(true)
+	c.conn.SetReadDeadline(time.Now())
+}
+
+func (c *Connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+func (c *Connection) readRequests() {
+	defer close(c.responses)
+
+	for {
+		// Backpressure: wait for a free slot before reading the next request
+		select {
+		case c.slots <- struct{}{}:
+		case <-c.closed:
+			return
+		}
+
+		// Clients that go quiet for connections.max.idle.ms are dropped.
+		// Set before checking draining, so drain() can't be undone.
+		c.conn.SetReadDeadline(time.Now().Add(c.broker.config.connectionsMaxIdle))
+		if c.draining.Load() {
+			return
+		}
+
+		requestMessage, err := c.readRequest()
+		if err != nil {
+			switch {
+			case errors.Is(err, io.EOF) || c.draining.Load():
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				slog.Debug("Closing idle connection", "clientAddress", c.context.clientAddress.String(), "maxIdle", c.broker.config.connectionsMaxIdle)
+			default:
+				slog.Warn("Closing connection", "clientAddress", c.context.clientAddress.String(), "error", err)
+			}
+			// Requests already read still get answered, the writer closes
+			// the connection once it runs out of responses
+			return
+		}
+		decoded := time.Now()
+		requestMessage.context = c.context
+		if session := c.context.sasl; session != nil {
+			// SASL requests are barriers, so the session is up to date
+			// with every request read before this one
+			if err := session.checkRequest(requestMessage.header.requestApiKey, time.Now()); err != nil {
+				slog.Info("Closing connection", "clientAddress", c.context.clientAddress.String(), "error", err)
+				requestMessage.release()
+				return
+			}
+			requestMessage.context.principal = session.principal
+		}
+		if c.dumpsFrames(requestMessage.header) {
+			c.dumpFrame("Request frame", requestMessage.header, requestFrame(requestMessage))
+		}
+
+		// Like Kafka, throttled clients aren't served until their throttle
+		// time is up, whatever they send in the meantime
+		if !c.waitUnmuted() {
+			requestMessage.release()
+			return
+		}
+
+		pending := &PendingResponse{
+			header:    requestMessage.header,
+			principal: requestMessage.context.principal,
+			received:  requestMessage.received,
+			span:      c.startRequestSpan(requestMessage),
+			done:      make(chan struct{}),
+		}
+		pending.span.startChild("decode", requestMessage.received).finishAt(decoded)
+		c.responses <- pending
+
+		process := func() {
+			defer close(pending.done)
+			defer requestMessage.release()
+			start := time.Now()
+			handler := pending.span.startChild("handle", start)
+			defer handler.finish()
+			defer func() {
+				// A failed handler leaves the response nil, which closes the
+				// connection instead of taking the whole broker down
+				if r := recover(); r != nil {
+					slog.Error("Error handling request", "api", requestMessage.header.requestApiKey.String(), "clientAddress", c.context.clientAddress.String(), "error", r)
+					handler.fail(fmt.Sprint(r))
+				}
+			}()
+			requestMessage.span = handler
+			pending.response = c.broker.NewResponse(requestMessage)
+			pending.throttle = c.broker.throttle(requestMessage, pending.response, time.Since(start))
+		}
+
+		if ConcurrentApis[requestMessage.header.requestApiKey] {
+			c.inFlight.Add(1)
+			go func() {
+				defer c.inFlight.Done()
+				process()
+			}()
+		} else {
+			c.inFlight.Wait()
+			process()
+		}
+
+		// Failed authentications get their error response, then the
+		// connection is closed
+		if session := c.context.sasl; session != nil && session.state == SASL_FAILED {
+			return
+		}
+	}
+}
+
+// Read the next request, turning decoding panics into errors
+func (c *Connection) readRequest() (requestMessage RequestMessage, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed request: %v", r)
+		}
+	}()
+	return getRequestMessage(c.conn, c.broker.config.socketRequestMaxBytes)
+}
+
+func (c *Connection) writeResponses() {
+	defer func() {
+		c.close()
+		// Responses that won't be sent still hold segment files open
+		for pending := range c.responses {
+			<-pending.done
+			releaseResponse(pending.response)
+			pending.span.fail("connection closed")
+			pending.span.finish()
+		}
+	}()
+
+	for pending := range c.responses {
+		<-pending.done
+		<-c.slots
+
+		if pending.response == nil {
+			// Unknown API or failed handler, same as Kafka we just drop
+			// the connection
+			pending.span.fail("no response")
+			pending.span.finish()
+			return
+		}
+		if c.dumpsFrames(pending.header) {
+			c.dumpFrame("Response frame", pending.header, pending.response.serialize())
+		}
+		n, err := sendResponse(c.conn, *pending.response, pending.span)
+		if err == nil {
+			c.logRequest(pending, n)
+			c.broker.metrics.recordRequest(pending.header, time.Since(pending.received), pending.response.body.errorCounts())
+		}
+		releaseResponse(pending.response)
+		if err != nil {
+			slog.Debug("Error sending response", "clientAddress", c.context.clientAddress.String(), "error", err)
+			pending.span.fail(err.Error())
+			pending.span.finish()
+			return
+		}
+		pending.span.finish()
+		if pending.throttle > 0 {
+			c.mute(pending.throttle)
+		}
+	}
+}
+
+// Stop serving requests for d, counting from now
+func (c *Connection) mute(d time.Duration) {
+	until := time.Now().Add(d).UnixNano()
+	for {
+		current := c.mutedUntil.Load()
+		if current >= until || c.mutedUntil.CompareAndSwap(current, until) {
+			return
+		}
+	}
+}
+
+// Wait until the connection is no longer muted. Returns false if it was
+// closed in the meantime.
+func (c *Connection) waitUnmuted() bool {
+	d := time.Until(time.Unix(0, c.mutedUntil.Load()))
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Connection_pipelinedResponsesInOrder(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConnection(newTestBroker(t, nil), "PLAINTEXT", server).serve()
+
+	const numRequests = 20
+	go func() {
+		for i := range numRequests {
+			frame := encodeRequest(API_VERSIONS, 4, int32(i), []byte{2, 't', 2, '1', 0})
+			if _, err := client.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := range numRequests {
+		sizeBytes := make([]byte, 4)
+		if _, err := io.ReadFull(client, sizeBytes); err != nil {
+			t.Fatalf("reading response %v: %v", i, err)
+		}
+		message := make([]byte, binary.BigEndian.Uint32(sizeBytes))
+		if _, err := io.ReadFull(client, message); err != nil {
+			t.Fatalf("reading response %v: %v", i, err)
+		}
+
+		if correlationID := int32(binary.BigEndian.Uint32(message)); correlationID != int32(i) {
+			t.Fatalf("response %v has correlationID %v", i, correlationID)
+		}
+	}
+}
+
+func Test_Connection_mutedWhileThrottled(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConnection(newTestBroker(t, nil), "PLAINTEXT", server)
+	c.mute(200 * time.Millisecond)
+	go c.serve()
+
+	start := time.Now()
+	if _, err := sendTestRequest(client, API_VERSIONS, 4, []byte{2, 't', 2, '1', 0}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("muted connection answered after %v, want at least 200ms", elapsed)
+	}
+}
+
+func Test_Connection_closed(t *testing.T) {
+	tests := []struct {
+		name  string
+		props map[string]string
+		frame []byte
+	}{
+		{"request over socket.request.max.bytes", map[string]string{"socket.request.max.bytes": "100"}, binary.BigEndian.AppendUint32(nil, 101)},
+		{"2 GB request", nil, binary.BigEndian.AppendUint32(nil, 1<<31-1)},
+		{"negative request size", nil, binary.BigEndian.AppendUint32(nil, 0xffffffff)},
+		{"idle connection", map[string]string{"connections.max.idle.ms": "100"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go newConnection(newTestBroker(t, tt.props), "PLAINTEXT", server).serve()
+
+			if tt.frame != nil {
+				if _, err := client.Write(tt.frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("client read error = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+// Hands each log record to the test as it is written
+type recordWriter chan map[string]any
+
+func (w recordWriter) Write(b []byte) (int, error) {
+	record := map[string]any{}
+	if err := json.Unmarshal(b, &record); err != nil {
+		return 0, err
+	}
+	w <- record
+	return len(b), nil
+}
+
+func Test_Connection_requestLog(t *testing.T) {
+	broker := newTestBroker(t, map[string]string{"request.logger.dump.client.id": "test-client"})
+	records := make(recordWriter, 10)
+	broker.requestLog = newLogger(records, LOGGER_FORMAT_JSON, slog.LevelDebug)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConnection(broker, "PLAINTEXT", server).serve()
+
+	body := []byte{2, 't', 2, '1', 0}
+	response, err := sendTestRequest(client, API_VERSIONS, 4, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseFrame := binary.BigEndian.AppendUint32(nil, uint32(len(response)+4))
+	responseFrame = binary.BigEndian.AppendUint32(responseFrame, 1)
+	responseFrame = append(responseFrame, response...)
+
+	want := []map[string]any{
+		{"msg": "Request frame", "frame": hex.EncodeToString(encodeRequest(API_VERSIONS, 4, 1, body))},
+		{"msg": "Response frame", "frame": hex.EncodeToString(responseFrame)},
+		{
+			"msg": "Completed request", "api": "ApiVersions", "version": 4.0, "clientId": "test-client",
+			"correlationId": 1.0, "principal": "User:ANONYMOUS", "listener": "PLAINTEXT",
+			"responseBytes": float64(len(responseFrame)), "errors": map[string]any{"NONE": 1.0},
+		},
+	}
+	for _, fields := range want {
+		select {
+		case record := <-records:
+			for key, value := range fields {
+				if !reflect.DeepEqual(record[key], value) {
+					t.Errorf("%s %s = %v, want %v", fields["msg"], key, record[key], value)
+				}
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s record", fields["msg"])
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Response
+type CreateAclsResponse struct {
+	version      int16
+	throttleTime int32
+	results      []CreateAclsResult
+	tagBuffer    byte
+}
+
+// Outcome of one creation, in request order
+type CreateAclsResult struct {
+	version      int16
+	errorCode    ErrorCode
+	errorMessage string
+	tagBuffer    byte
+}
+
+func (r CreateAclsResponse) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(CREATE_ACLS, r.version)
+
+	res = binary.BigEndian.AppendUint32(res, uint32(r.throttleTime))
+
+	results := make([]SerializableElement, len(r.results))
+	for i, v := range r.results {
+		results[i] = v
+	}
+	res = append(res, encodeCustomArray(results, flexible)...)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (r CreateAclsResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
+
+func (r CreateAclsResponse) errorCounts() map[ErrorCode]int {
+	counts := map[ErrorCode]int{}
+	for _, result := range r.results {
+		counts[result.errorCode]++
+	}
+	return counts
+}
+
+func (r CreateAclsResult) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(CREATE_ACLS, r.version)
+
+	res = binary.BigEndian.AppendUint16(res, uint16(r.errorCode))
+	res = appendNullableString(res, r.errorMessage, flexible)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (b *Broker) buildCreateAclsResponse(req RequestMessage) CreateAclsResponse {
+	reqBody := req.body.(*CreateAclsRequest)
+	response := CreateAclsResponse{version: reqBody.version, results: []CreateAclsResult{}}
+
+	failAll := func(errorCode ErrorCode, message string) CreateAclsResponse {
+		for range reqBody.creations {
+			response.results = append(response.results, CreateAclsResult{version: reqBody.version, errorCode: errorCode, errorMessage: message})
+		}
+		return response
+	}
+	if b.authorizer == nil {
+		return failAll(ERR_SECURITY_DISABLED, NO_AUTHORIZER_MESSAGE)
+	}
+	if !b.authorize(req.context, OPERATION_ALTER, RESOURCE_CLUSTER, CLUSTER_RESOURCE_NAME) {
+		return failAll(ERR_CLUSTER_AUTHORIZATION_FAILED, "")
+	}
+
+	for _, err := range b.authorizer.createAcls(reqBody.creations) {
+		result := CreateAclsResult{version: reqBody.version}
+		if err != nil {
+			result.errorCode = errorCodeOf(err)
+			result.errorMessage = err.Error()
+		}
+		response.results = append(response.results, result)
+	}
+	return response
+}
+
+// Every creation fails with the error. The request is decoded with the
+// newest layout we know, on a best-effort basis.
+func buildCreateAclsErrorResponse(req RequestMessage, errorCode ErrorCode) CreateAclsResponse {
+	supported, _ := getSupportedApiVersion(CREATE_ACLS)
+	version := min(req.header.requestApiVersion, supported.MaxVersion)
+	response := CreateAclsResponse{version: version, results: []CreateAclsResult{}}
+
+	reqBody := &CreateAclsRequest{version: version}
+	if !tryDeserialize(reqBody, req.rawBody) {
+		return response
+	}
+
+	for range reqBody.creations {
+		response.results = append(response.results, CreateAclsResult{version: version, errorCode: errorCode})
+	}
+	return response
+}
+
+// Request
+type CreateAclsRequest struct {
+	version   int16
+	creations []AclBinding
+}
+
+type CreateAclsCreation struct {
+	version int16
+	AclBinding
+}
+
+func (r *CreateAclsRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+	flexible := isFlexibleVersion(CREATE_ACLS, r.version)
+
+	r.creations = []AclBinding{}
+	creations := readCustomArray(buf, flexible, func() CompactArrayElement {
+		return &CreateAclsCreation{version: r.version}
+	})
+	for _, elem := range creations {
+		if creation, ok := elem.(*CreateAclsCreation); ok {
+			r.creations = append(r.creations, creation.AclBinding)
+		}
+	}
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
+
+func (c *CreateAclsCreation) deserialize(buf *bytes.Buffer) {
+	flexible := isFlexibleVersion(CREATE_ACLS, c.version)
+
+	err := binary.Read(buf, binary.BigEndian, &c.pattern.resourceType)
+	checkError(err)
+
+	c.pattern.name = readString(buf, flexible)
+
+	c.pattern.patternType = PATTERN_LITERAL
+	if c.version >= 1 {
+		err = binary.Read(buf, binary.BigEndian, &c.pattern.patternType)
+		checkError(err)
+	}
+
+	c.entry.principal = readString(buf, flexible)
+	c.entry.host = readString(buf, flexible)
+
+	err = binary.Read(buf, binary.BigEndian, &c.entry.operation)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &c.entry.permissionType)
+	checkError(err)
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
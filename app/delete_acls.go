@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Response
+type DeleteAclsResponse struct {
+	version       int16
+	throttleTime  int32
+	filterResults []DeleteAclsFilterResult
+	tagBuffer     byte
+}
+
+// The ACLs one filter removed, in request order
+type DeleteAclsFilterResult struct {
+	version      int16
+	errorCode    ErrorCode
+	errorMessage string
+	matchingAcls []DeleteAclsMatchingAcl
+	tagBuffer    byte
+}
+
+type DeleteAclsMatchingAcl struct {
+	version      int16
+	errorCode    ErrorCode
+	errorMessage string
+	AclBinding
+	tagBuffer byte
+}
+
+func (r DeleteAclsResponse) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DELETE_ACLS, r.version)
+
+	res = binary.BigEndian.AppendUint32(res, uint32(r.throttleTime))
+
+	results := make([]SerializableElement, len(r.filterResults))
+	for i, v := range r.filterResults {
+		results[i] = v
+	}
+	res = append(res, encodeCustomArray(results, flexible)...)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (r DeleteAclsResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
+
+func (r DeleteAclsResponse) errorCounts() map[ErrorCode]int {
+	counts := map[ErrorCode]int{}
+	for _, result := range r.filterResults {
+		counts[result.errorCode]++
+	}
+	return counts
+}
+
+func (r DeleteAclsFilterResult) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DELETE_ACLS, r.version)
+
+	res = binary.BigEndian.AppendUint16(res, uint16(r.errorCode))
+	res = appendNullableString(res, r.errorMessage, flexible)
+
+	acls := make([]SerializableElement, len(r.matchingAcls))
+	for i, v := range r.matchingAcls {
+		acls[i] = v
+	}
+	res = append(res, encodeCustomArray(acls, flexible)...)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (a DeleteAclsMatchingAcl) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DELETE_ACLS, a.version)
+
+	res = binary.BigEndian.AppendUint16(res, uint16(a.errorCode))
+	res = appendNullableString(res, a.errorMessage, flexible)
+	res = append(res, byte(a.pattern.resourceType))
+	res = appendString(res, a.pattern.name, flexible)
+	if a.version >= 1 {
+		res = append(res, byte(a.pattern.patternType))
+	}
+	res = appendString(res, a.entry.principal, flexible)
+	res = appendString(res, a.entry.host, flexible)
+	res = append(res, byte(a.entry.operation), byte(a.entry.permissionType))
+
+	if flexible {
+		res = append(res, a.tagBuffer)
+	}
+	return res
+}
+
+func (b *Broker) buildDeleteAclsResponse(req RequestMessage) DeleteAclsResponse {
+	reqBody := req.body.(*DeleteAclsRequest)
+	response := DeleteAclsResponse{version: reqBody.version, filterResults: []DeleteAclsFilterResult{}}
+
+	results := make([]DeleteAclsFilterResult, len(reqBody.filters))
+	for i := range results {
+		results[i] = DeleteAclsFilterResult{version: reqBody.version, matchingAcls: []DeleteAclsMatchingAcl{}}
+	}
+	failAll := func(errorCode ErrorCode, message string) DeleteAclsResponse {
+		for _, result := range results {
+			result.errorCode = errorCode
+			result.errorMessage = message
+			response.filterResults = append(response.filterResults, result)
+		}
+		return response
+	}
+	if b.authorizer == nil {
+		return failAll(ERR_SECURITY_DISABLED, NO_AUTHORIZER_MESSAGE)
+	}
+	if !b.authorize(req.context, OPERATION_ALTER, RESOURCE_CLUSTER, CLUSTER_RESOURCE_NAME) {
+		return failAll(ERR_CLUSTER_AUTHORIZATION_FAILED, "")
+	}
+
+	// Invalid filters fail on their own, the others are applied together
+	validFilters := []AclBindingFilter{}
+	validIndexes := []int{}
+	for i, filter := range reqBody.filters {
+		if err := filter.validate(); err != nil {
+			results[i].errorCode = errorCodeOf(err)
+			results[i].errorMessage = err.Error()
+			continue
+		}
+		validFilters = append(validFilters, filter)
+		validIndexes = append(validIndexes, i)
+	}
+
+	matched, err := b.authorizer.deleteAcls(validFilters)
+	for j, i := range validIndexes {
+		if err != nil {
+			results[i].errorCode = errorCodeOf(err)
+			results[i].errorMessage = err.Error()
+			continue
+		}
+		for _, acl := range matched[j] {
+			results[i].matchingAcls = append(results[i].matchingAcls, DeleteAclsMatchingAcl{version: reqBody.version, AclBinding: acl})
+		}
+	}
+
+	response.filterResults = results
+	return response
+}
+
+// Every filter fails with the error. The request is decoded with the newest
+// layout we know, on a best-effort basis.
+func buildDeleteAclsErrorResponse(req RequestMessage, errorCode ErrorCode) DeleteAclsResponse {
+	supported, _ := getSupportedApiVersion(DELETE_ACLS)
+	version := min(req.header.requestApiVersion, supported.MaxVersion)
+	response := DeleteAclsResponse{version: version, filterResults: []DeleteAclsFilterResult{}}
+
+	reqBody := &DeleteAclsRequest{version: version}
+	if !tryDeserialize(reqBody, req.rawBody) {
+		return response
+	}
+
+	for range reqBody.filters {
+		response.filterResults = append(response.filterResults, DeleteAclsFilterResult{
+			version:      version,
+			errorCode:    errorCode,
+			matchingAcls: []DeleteAclsMatchingAcl{},
+		})
+	}
+	return response
+}
+
+// Request
+type DeleteAclsRequest struct {
+	version int16
+	filters []AclBindingFilter
+}
+
+type DeleteAclsRequestFilter struct {
+	version int16
+	AclBindingFilter
+}
+
+func (r *DeleteAclsRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+	flexible := isFlexibleVersion(DELETE_ACLS, r.version)
+
+	r.filters = []AclBindingFilter{}
+	filters := readCustomArray(buf, flexible, func() CompactArrayElement {
+		return &DeleteAclsRequestFilter{version: r.version}
+	})
+	for _, elem := range filters {
+		if filter, ok := elem.(*DeleteAclsRequestFilter); ok {
+			r.filters = append(r.filters, filter.AclBindingFilter)
+		}
+	}
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
+
+func (f *DeleteAclsRequestFilter) deserialize(buf *bytes.Buffer) {
+	flexible := isFlexibleVersion(DELETE_ACLS, f.version)
+
+	f.AclBindingFilter = readAclBindingFilter(buf, f.version, flexible)
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
+)
+
+// The offset DeleteRecords asks for to delete everything up to the high
+// watermark
+const DELETE_UP_TO_HIGH_WATERMARK int64 = -1
+
+// Response
+type DeleteRecordsResponse struct {
+	version      int16
+	throttleTime int32
+	topics       []DeleteRecordsResponseTopic
+	tagBuffer    byte
+}
+
+type DeleteRecordsResponseTopic struct {
+	version    int16
+	name       string
+	partitions []DeleteRecordsResponsePartition
+	tagBuffer  byte
+}
+
+type DeleteRecordsResponsePartition struct {
+	version        int16
+	partitionIndex int32
+	lowWatermark   int64
+	errorCode      ErrorCode
+	tagBuffer      byte
+}
+
+func (r DeleteRecordsResponse) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DELETE_RECORDS, r.version)
+
+	res = binary.BigEndian.AppendUint32(res, uint32(r.throttleTime))
+
+	topics := make([]SerializableElement, len(r.topics))
+	for i, v := range r.topics {
+		topics[i] = v
+	}
+	res = append(res, encodeCustomArray(topics, flexible)...)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (r DeleteRecordsResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
+
+func (r DeleteRecordsResponse) errorCounts() map[ErrorCode]int {
+	counts := map[ErrorCode]int{}
+	for _, topic := range r.topics {
+		for _, partition := range topic.partitions {
+			counts[partition.errorCode]++
+		}
+	}
+	return counts
+}
+
+func (t DeleteRecordsResponseTopic) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DELETE_RECORDS, t.version)
+
+	res = appendString(res, t.name, flexible)
+
+	partitions := make([]SerializableElement, len(t.partitions))
+	for i, v := range t.partitions {
+		partitions[i] = v
+	}
+	res = append(res, encodeCustomArray(partitions, flexible)...)
+
+	if flexible {
+		res = append(res, t.tagBuffer)
+	}
+	return res
+}
+
+func (p DeleteRecordsResponsePartition) serialize() []byte {
+	res := []byte{}
+
+	res = binary.BigEndian.AppendUint32(res, uint32(p.partitionIndex))
+	res = binary.BigEndian.AppendUint64(res, uint64(p.lowWatermark))
+	res = binary.BigEndian.AppendUint16(res, uint16(p.errorCode))
+
+	if isFlexibleVersion(DELETE_RECORDS, p.version) {
+		res = append(res, p.tagBuffer)
+	}
+	return res
+}
+
+func (b *Broker) buildDeleteRecordsResponse(req RequestMessage) DeleteRecordsResponse {
+	reqBody := req.body.(*DeleteRecordsRequest)
+	res := DeleteRecordsResponse{
+		version: reqBody.version,
+		topics:  []DeleteRecordsResponseTopic{},
+	}
+
+	deleted := false
+	for _, topic := range reqBody.topics {
+		foundTopic := b.metadata.getTopicByName(topic.name)
+		err := foundTopic.errorCode
+		if !b.authorize(req.context, OPERATION_DELETE, RESOURCE_TOPIC, topic.name) {
+			err = ERR_TOPIC_AUTHORIZATION_FAILED
+		}
+
+		responseTopic := DeleteRecordsResponseTopic{
+			version:    reqBody.version,
+			name:       topic.name,
+			partitions: []DeleteRecordsResponsePartition{},
+		}
+		for _, partition := range topic.partitions {
+			responsePartition := DeleteRecordsResponsePartition{
+				version:        reqBody.version,
+				partitionIndex: partition.partitionIndex,
+				lowWatermark:   -1,
+				errorCode:      err,
+			}
+			if err == ERR_NONE {
+				if _, ok := b.metadata.getPartition(foundTopic.topicID, partition.partitionIndex); ok {
+					span := req.span.startChild("log.delete_records", time.Now(), partitionAttributes(topic.name, partition.partitionIndex)...)
+					responsePartition.errorCode = b.deleteRecords(&responsePartition, topic.name, partition.offset)
+					span.setErrorCode(responsePartition.errorCode)
+					span.finish()
+					deleted = deleted || responsePartition.errorCode == ERR_NONE
+				} else {
+					responsePartition.errorCode = ERR_UNKNOWN_TOPIC_OR_PARTITION
+				}
+			}
+			responseTopic.partitions = append(responseTopic.partitions, responsePartition)
+		}
+		res.topics = append(res.topics, responseTopic)
+	}
+
+	// Deleted records must stay deleted if the broker dies before the next
+	// periodic checkpoint
+	if deleted {
+		span := req.span.startChild("log.checkpoint", time.Now())
+		b.checkpointLogs()
+		span.finish()
+	}
+	return res
+}
+
+// Move the log start offset of a partition forward to offset. A partition
+// without a log on this broker is empty, so there is nothing to delete.
+func (b *Broker) deleteRecords(res *DeleteRecordsResponsePartition, topicName string, offset int64) ErrorCode {
+	l := b.partitionLog(topicName, res.partitionIndex)
+	if l == nil {
+		if offset != DELETE_UP_TO_HIGH_WATERMARK && offset != 0 {
+			return ERR_OFFSET_OUT_OF_RANGE
+		}
+		res.lowWatermark = 0
+		return ERR_NONE
+	}
+
+	if offset == DELETE_UP_TO_HIGH_WATERMARK {
+		offset = l.HighWatermark()
+	}
+	if offset < 0 {
+		return ERR_OFFSET_OUT_OF_RANGE
+	}
+	lowWatermark, err := l.DeleteRecordsBefore(offset)
+	if errors.Is(err, log.ErrOffsetOutOfRange) {
+		return ERR_OFFSET_OUT_OF_RANGE
+	}
+	if err != nil {
+		slog.Error("Failed to delete records", "topic", topicName, "partition", res.partitionIndex, "offset", offset, "error", err)
+		return ERR_KAFKA_STORAGE_ERROR
+	}
+	res.lowWatermark = lowWatermark
+	return ERR_NONE
+}
+
+// DeleteRecords has no top-level error code, so every requested partition
+// gets the error
+func buildDeleteRecordsErrorResponse(req RequestMessage, errorCode ErrorCode) DeleteRecordsResponse {
+	supported, _ := getSupportedApiVersion(DELETE_RECORDS)
+	version := min(req.header.requestApiVersion, supported.MaxVersion)
+	res := DeleteRecordsResponse{version: version, topics: []DeleteRecordsResponseTopic{}}
+
+	reqBody := &DeleteRecordsRequest{version: version}
+	if !tryDeserialize(reqBody, req.rawBody) {
+		reqBody.topics = nil
+	}
+
+	for _, topic := range reqBody.topics {
+		responseTopic := DeleteRecordsResponseTopic{version: version, name: topic.name}
+		for _, partition := range topic.partitions {
+			responseTopic.partitions = append(responseTopic.partitions, DeleteRecordsResponsePartition{
+				version:        version,
+				partitionIndex: partition.partitionIndex,
+				lowWatermark:   -1,
+				errorCode:      errorCode,
+			})
+		}
+		res.topics = append(res.topics, responseTopic)
+	}
+	return res
+}
+
+// Request
+type DeleteRecordsRequest struct {
+	version   int16
+	topics    []DeleteRecordsRequestTopic
+	timeoutMs int32
+}
+
+type DeleteRecordsRequestTopic struct {
+	version    int16
+	name       string
+	partitions []DeleteRecordsRequestPartition
+}
+
+type DeleteRecordsRequestPartition struct {
+	version        int16
+	partitionIndex int32
+	offset         int64
+}
+
+func (r *DeleteRecordsRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+	flexible := isFlexibleVersion(DELETE_RECORDS, r.version)
+
+	topics := readCustomArray(buf, flexible, func() CompactArrayElement {
+		return &DeleteRecordsRequestTopic{version: r.version}
+	})
+	for _, elem := range topics {
+		if topic, ok := elem.(*DeleteRecordsRequestTopic); ok {
+			r.topics = append(r.topics, *topic)
+		}
+	}
+
+	err := binary.Read(buf, binary.BigEndian, &r.timeoutMs)
+	checkError(err)
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
+
+func (t *DeleteRecordsRequestTopic) deserialize(buf *bytes.Buffer) {
+	flexible := isFlexibleVersion(DELETE_RECORDS, t.version)
+
+	t.name = readString(buf, flexible)
+
+	partitions := readCustomArray(buf, flexible, func() CompactArrayElement {
+		return &DeleteRecordsRequestPartition{version: t.version}
+	})
+	for _, elem := range partitions {
+		if partition, ok := elem.(*DeleteRecordsRequestPartition); ok {
+			t.partitions = append(t.partitions, *partition)
+		}
+	}
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
+
+func (p *DeleteRecordsRequestPartition) deserialize(buf *bytes.Buffer) {
+	err := binary.Read(buf, binary.BigEndian, &p.partitionIndex)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &p.offset)
+	checkError(err)
+
+	if isFlexibleVersion(DELETE_RECORDS, p.version) {
+		skipTaggedFields(buf)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
+)
+
+// Send a v2 DeleteRecords request for partition 0 of topic
+func deleteRecords(t *testing.T, client io.ReadWriter, topic string, offset int64) (errorCode ErrorCode, lowWatermark int64) {
+	t.Helper()
+
+	body := appendArrayLength(nil, 1, true)
+	body = appendString(body, topic, true)
+	body = appendArrayLength(body, 1, true)
+	body = binary.BigEndian.AppendUint32(body, 0)
+	body = binary.BigEndian.AppendUint64(body, uint64(offset))
+	body = append(body, 0, 0)
+	body = binary.BigEndian.AppendUint32(body, 1000) // timeout
+	body = append(body, 0)
+
+	response, err := sendTestRequest(client, DELETE_RECORDS, 2, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(response[4:])
+	readArrayLength(buf, true)
+	readString(buf, true)
+	readArrayLength(buf, true)
+	buf.Next(4)
+	lowWatermark = int64(binary.BigEndian.Uint64(buf.Next(8)))
+	errorCode = ErrorCode(binary.BigEndian.Uint16(buf.Next(2)))
+	return errorCode, lowWatermark
+}
+
+func Test_DeleteRecords(t *testing.T) {
+	// Two batches per segment
+	broker := newTestBroker(t, map[string]string{"log.segment.bytes": "200"})
+	alpha := UUID{1}
+	writeMetadataRecords(t, broker, topicRecord("alpha", alpha), partitionRecord(alpha, 0))
+	if err := broker.loadLogs(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.shutdown(time.Second) })
+
+	// Offsets 0 to 4
+	l, err := broker.logs[0].GetOrCreateLog(log.TopicPartition{Topic: "alpha", Partition: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 5 {
+		if _, err := l.Append(encodeRecordBatch(0, time.Now().UnixMilli(), [][]byte{[]byte("hello")}), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConnection(broker, "PLAINTEXT", server).serve()
+
+	// Each step starts where the previous one left the log
+	tests := []struct {
+		name             string
+		topic            string
+		offset           int64
+		wantErrorCode    ErrorCode
+		wantLowWatermark int64
+	}{
+		{"within a segment", "alpha", 3, ERR_NONE, 3},
+		{"before the log start offset", "alpha", 1, ERR_NONE, 3},
+		{"past the high watermark", "alpha", 6, ERR_OFFSET_OUT_OF_RANGE, -1},
+		{"unknown topic", "beta", 0, ERR_UNKNOWN_TOPIC_OR_PARTITION, -1},
+		{"up to the high watermark", "alpha", DELETE_UP_TO_HIGH_WATERMARK, ERR_NONE, 5},
+	}
+	for _, tt := range tests {
+		errorCode, lowWatermark := deleteRecords(t, client, tt.topic, tt.offset)
+		if errorCode != tt.wantErrorCode || lowWatermark != tt.wantLowWatermark {
+			t.Errorf("DeleteRecords() %s = %v, %d, want %v, %d", tt.name, errorCode, lowWatermark, tt.wantErrorCode, tt.wantLowWatermark)
+		}
+	}
+
+	if errorCode, _, offset := listOffsets(t, client, EARLIEST_TIMESTAMP); errorCode != ERR_NONE || offset != 5 {
+		t.Errorf("ListOffsets() earliest = %v, %d, want %v, 5", errorCode, offset, ERR_NONE)
+	}
+	if errorCode, logStartOffset, _ := fetchPartition(t, client, alpha, 4); errorCode != ERR_OFFSET_OUT_OF_RANGE || logStartOffset != 5 {
+		t.Errorf("Fetch() of a deleted offset = %v, log start offset %d, want %v, 5", errorCode, logStartOffset, ERR_OFFSET_OUT_OF_RANGE)
+	}
+	dir := log.PartitionDir(broker.config.logDirs[0], "alpha", 0)
+	for _, name := range []string{"00000000000000000000.log", "00000000000000000002.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("segment %s still exists", name)
+		}
+	}
+
+	// The new log start offset was checkpointed right away, so it survives
+	// an unclean shutdown
+	manager, err := log.OpenManager(broker.config.logDirs[0], broker.config.logConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	if start := manager.Log(log.TopicPartition{Topic: "alpha", Partition: 0}).StartOffset(); start != 5 {
+		t.Errorf("StartOffset() after reopening = %d, want 5", start)
+	}
+}
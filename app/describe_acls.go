@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const NO_AUTHORIZER_MESSAGE = "No Authorizer is configured."
+
+// Response
+type DescribeAclsResponse struct {
+	version      int16
+	throttleTime int32
+	errorCode    ErrorCode
+	errorMessage string
+	resources    []DescribeAclsResource
+	tagBuffer    byte
+}
+
+// The ACLs of one resource pattern
+type DescribeAclsResource struct {
+	version   int16
+	pattern   ResourcePattern
+	acls      []DescribeAclsEntry
+	tagBuffer byte
+}
+
+type DescribeAclsEntry struct {
+	version int16
+	AccessControlEntry
+	tagBuffer byte
+}
+
+func (r DescribeAclsResponse) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DESCRIBE_ACLS, r.version)
+
+	res = binary.BigEndian.AppendUint32(res, uint32(r.throttleTime))
+	res = binary.BigEndian.AppendUint16(res, uint16(r.errorCode))
+	res = appendNullableString(res, r.errorMessage, flexible)
+
+	resources := make([]SerializableElement, len(r.resources))
+	for i, v := range r.resources {
+		resources[i] = v
+	}
+	res = append(res, encodeCustomArray(resources, flexible)...)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (r DescribeAclsResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
+
+func (r DescribeAclsResponse) errorCounts() map[ErrorCode]int {
+	return map[ErrorCode]int{r.errorCode: 1}
+}
+
+func (r DescribeAclsResource) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DESCRIBE_ACLS, r.version)
+
+	res = append(res, byte(r.pattern.resourceType))
+	res = appendString(res, r.pattern.name, flexible)
+	if r.version >= 1 {
+		res = append(res, byte(r.pattern.patternType))
+	}
+
+	acls := make([]SerializableElement, len(r.acls))
+	for i, v := range r.acls {
+		acls[i] = v
+	}
+	res = append(res, encodeCustomArray(acls, flexible)...)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (e DescribeAclsEntry) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DESCRIBE_ACLS, e.version)
+
+	res = appendString(res, e.principal, flexible)
+	res = appendString(res, e.host, flexible)
+	res = append(res, byte(e.operation), byte(e.permissionType))
+
+	if flexible {
+		res = append(res, e.tagBuffer)
+	}
+	return res
+}
+
+func (b *Broker) buildDescribeAclsResponse(req RequestMessage) DescribeAclsResponse {
+	reqBody := req.body.(*DescribeAclsRequest)
+	response := DescribeAclsResponse{version: reqBody.version, resources: []DescribeAclsResource{}}
+
+	if b.authorizer == nil {
+		response.errorCode = ERR_SECURITY_DISABLED
+		response.errorMessage = NO_AUTHORIZER_MESSAGE
+		return response
+	}
+	if !b.authorize(req.context, OPERATION_DESCRIBE, RESOURCE_CLUSTER, CLUSTER_RESOURCE_NAME) {
+		response.errorCode = ERR_CLUSTER_AUTHORIZATION_FAILED
+		return response
+	}
+	if err := reqBody.filter.validate(); err != nil {
+		response.errorCode = errorCodeOf(err)
+		response.errorMessage = err.Error()
+		return response
+	}
+
+	// Group the entries by resource pattern, in the order they were found
+	for _, acl := range b.authorizer.acls(reqBody.filter) {
+		i := 0
+		for i < len(response.resources) && response.resources[i].pattern != acl.pattern {
+			i++
+		}
+		if i == len(response.resources) {
+			response.resources = append(response.resources, DescribeAclsResource{version: reqBody.version, pattern: acl.pattern})
+		}
+		response.resources[i].acls = append(response.resources[i].acls, DescribeAclsEntry{version: reqBody.version, AccessControlEntry: acl.entry})
+	}
+	return response
+}
+
+func buildDescribeAclsErrorResponse(req RequestMessage, errorCode ErrorCode) DescribeAclsResponse {
+	supported, _ := getSupportedApiVersion(DESCRIBE_ACLS)
+	return DescribeAclsResponse{
+		version:   min(req.header.requestApiVersion, supported.MaxVersion),
+		errorCode: errorCode,
+		resources: []DescribeAclsResource{},
+	}
+}
+
+// Request
+type DescribeAclsRequest struct {
+	version int16
+	filter  AclBindingFilter
+}
+
+func (r *DescribeAclsRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+	flexible := isFlexibleVersion(DESCRIBE_ACLS, r.version)
+
+	r.filter = readAclBindingFilter(buf, r.version, flexible)
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
+
+// The filter layout shared by DescribeAcls and DeleteAcls. Null names,
+// principals and hosts match anything.
+func readAclBindingFilter(buf *bytes.Buffer, version int16, flexible bool) AclBindingFilter {
+	filter := AclBindingFilter{}
+
+	err := binary.Read(buf, binary.BigEndian, &filter.pattern.resourceType)
+	checkError(err)
+
+	filter.pattern.name = readString(buf, flexible)
+
+	// v0 predates prefixed ACLs
+	filter.pattern.patternType = PATTERN_LITERAL
+	if version >= 1 {
+		err = binary.Read(buf, binary.BigEndian, &filter.pattern.patternType)
+		checkError(err)
+	}
+
+	filter.entry.principal = readString(buf, flexible)
+	filter.entry.host = readString(buf, flexible)
+
+	err = binary.Read(buf, binary.BigEndian, &filter.entry.operation)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &filter.entry.permissionType)
+	checkError(err)
+
+	return filter
+}
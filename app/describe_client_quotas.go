@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// Response
+type DescribeClientQuotasResponse struct {
+	version      int16
+	throttleTime int32
+	errorCode    ErrorCode
+	errorMessage string
+	// nil when the request failed
+	entries   []DescribeClientQuotasEntry
+	tagBuffer byte
+}
+
+// The quotas of one entity
+type DescribeClientQuotasEntry struct {
+	version   int16
+	entity    QuotaEntity
+	values    []DescribeClientQuotasValue
+	tagBuffer byte
+}
+
+type DescribeClientQuotasValue struct {
+	version   int16
+	key       string
+	value     float64
+	tagBuffer byte
+}
+
+func (r DescribeClientQuotasResponse) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DESCRIBE_CLIENT_QUOTAS, r.version)
+
+	res = binary.BigEndian.AppendUint32(res, uint32(r.throttleTime))
+	res = binary.BigEndian.AppendUint16(res, uint16(r.errorCode))
+	res = appendNullableString(res, r.errorMessage, flexible)
+
+	var entries []SerializableElement
+	if r.entries != nil {
+		entries = make([]SerializableElement, len(r.entries))
+		for i, v := range r.entries {
+			entries[i] = v
+		}
+	}
+	res = append(res, encodeCustomArray(entries, flexible)...)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (r DescribeClientQuotasResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
+
+func (r DescribeClientQuotasResponse) errorCounts() map[ErrorCode]int {
+	return map[ErrorCode]int{r.errorCode: 1}
+}
+
+func (e DescribeClientQuotasEntry) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DESCRIBE_CLIENT_QUOTAS, e.version)
+
+	res = appendQuotaEntityData(res, e.entity.data(), flexible)
+
+	values := make([]SerializableElement, len(e.values))
+	for i, v := range e.values {
+		values[i] = v
+	}
+	res = append(res, encodeCustomArray(values, flexible)...)
+
+	if flexible {
+		res = append(res, e.tagBuffer)
+	}
+	return res
+}
+
+func (v DescribeClientQuotasValue) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(DESCRIBE_CLIENT_QUOTAS, v.version)
+
+	res = appendString(res, v.key, flexible)
+	res = appendFloat64(res, v.value)
+
+	if flexible {
+		res = append(res, v.tagBuffer)
+	}
+	return res
+}
+
+func (b *Broker) buildDescribeClientQuotasResponse(req RequestMessage) DescribeClientQuotasResponse {
+	reqBody := req.body.(*DescribeClientQuotasRequest)
+	response := DescribeClientQuotasResponse{version: reqBody.version}
+
+	if !b.authorize(req.context, OPERATION_DESCRIBE_CONFIGS, RESOURCE_CLUSTER, CLUSTER_RESOURCE_NAME) {
+		response.errorCode = ERR_CLUSTER_AUTHORIZATION_FAILED
+		return response
+	}
+	if err := validateQuotaFilter(reqBody.components); err != nil {
+		response.errorCode = errorCodeOf(err)
+		response.errorMessage = err.Error()
+		return response
+	}
+
+	response.entries = []DescribeClientQuotasEntry{}
+	for entity, values := range b.quotas.quotas() {
+		if !matchesQuotaFilter(entity, reqBody.components, reqBody.strict) {
+			continue
+		}
+		entry := DescribeClientQuotasEntry{version: reqBody.version, entity: entity}
+		for key, value := range values {
+			entry.values = append(entry.values, DescribeClientQuotasValue{version: reqBody.version, key: key, value: value})
+		}
+		sort.Slice(entry.values, func(i, j int) bool { return entry.values[i].key < entry.values[j].key })
+		response.entries = append(response.entries, entry)
+	}
+	sort.Slice(response.entries, func(i, j int) bool {
+		return response.entries[i].entity.String() < response.entries[j].entity.String()
+	})
+	return response
+}
+
+func buildDescribeClientQuotasErrorResponse(req RequestMessage, errorCode ErrorCode) DescribeClientQuotasResponse {
+	supported, _ := getSupportedApiVersion(DESCRIBE_CLIENT_QUOTAS)
+	return DescribeClientQuotasResponse{
+		version:   min(req.header.requestApiVersion, supported.MaxVersion),
+		errorCode: errorCode,
+	}
+}
+
+// Request
+type DescribeClientQuotasRequest struct {
+	version    int16
+	components []QuotaFilterComponent
+	// Only match entities without parts beyond the components
+	strict bool
+}
+
+func (r *DescribeClientQuotasRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+	flexible := isFlexibleVersion(DESCRIBE_CLIENT_QUOTAS, r.version)
+
+	r.components = []QuotaFilterComponent{}
+	for range max(0, readArrayLength(buf, flexible)) {
+		component := QuotaFilterComponent{}
+		component.entityType = readString(buf, flexible)
+
+		err := binary.Read(buf, binary.BigEndian, &component.matchType)
+		checkError(err)
+
+		component.match = readString(buf, flexible)
+
+		if flexible {
+			skipTaggedFields(buf)
+		}
+		r.components = append(r.components, component)
+	}
+
+	err := binary.Read(buf, binary.BigEndian, &r.strict)
+	checkError(err)
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	ENDPOINT_TYPE_BROKERS     int8 = 1
+	ENDPOINT_TYPE_CONTROLLERS int8 = 2
+)
+
+// Response
+type DescribeClusterResponse struct {
+	version                     int16
+	throttleTime                int32
+	errorCode                   ErrorCode
+	errorMessage                string
+	endpointType                int8
+	clusterID                   string
+	controllerID                int32
+	brokers                     []DescribeClusterBroker
+	clusterAuthorizedOperations int32
+	tagBuffer                   byte
+}
+
+type DescribeClusterBroker struct {
+	brokerID  int32
+	host      string
+	port      int32
+	rack      string
+	tagBuffer byte
+}
+
+func (r DescribeClusterResponse) serialize() []byte {
+	res := []byte{}
+
+	res = binary.BigEndian.AppendUint32(res, uint32(r.throttleTime))
+	res = binary.BigEndian.AppendUint16(res, uint16(r.errorCode))
+	res = appendNullableString(res, r.errorMessage, true)
+	if r.version >= 1 {
+		res = append(res, byte(r.endpointType))
+	}
+	res = appendString(res, r.clusterID, true)
+	res = binary.BigEndian.AppendUint32(res, uint32(r.controllerID))
+
+	brokers := make([]SerializableElement, len(r.brokers))
+	for i, v := range r.brokers {
+		brokers[i] = v
+	}
+	res = append(res, encodeCustomCompactArray(brokers)...)
+
+	res = binary.BigEndian.AppendUint32(res, uint32(r.clusterAuthorizedOperations))
+	res = append(res, r.tagBuffer)
+	return res
+}
+
+func (r DescribeClusterResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
+
+func (r DescribeClusterResponse) errorCounts() map[ErrorCode]int {
+	return map[ErrorCode]int{r.errorCode: 1}
+}
+
+func (b DescribeClusterBroker) serialize() []byte {
+	res := []byte{}
+	res = binary.BigEndian.AppendUint32(res, uint32(b.brokerID))
+	res = appendString(res, b.host, true)
+	res = binary.BigEndian.AppendUint32(res, uint32(b.port))
+	res = appendNullableString(res, b.rack, true)
+	res = append(res, b.tagBuffer)
+	return res
+}
+
+func (b *Broker) buildDescribeClusterResponse(req RequestMessage) DescribeClusterResponse {
+	reqBody := req.body.(*DescribeClusterRequest)
+	response := DescribeClusterResponse{
+		version:                     reqBody.version,
+		endpointType:                reqBody.endpointType,
+		clusterID:                   b.clusterID,
+		controllerID:                b.config.nodeID,
+		brokers:                     []DescribeClusterBroker{},
+		clusterAuthorizedOperations: AUTHORIZED_OPERATIONS_OMITTED,
+	}
+
+	// Controllers can only be described by asking a controller
+	if reqBody.endpointType != ENDPOINT_TYPE_BROKERS {
+		response.errorCode = ERR_UNSUPPORTED_ENDPOINT_TYPE
+		response.errorMessage = "The target broker only supports broker endpoints"
+		response.controllerID = -1
+		return response
+	}
+
+	for _, broker := range b.getAdvertisedBrokers(req.context.listenerName) {
+		response.brokers = append(response.brokers, DescribeClusterBroker{
+			brokerID: broker.nodeID,
+			host:     broker.host,
+			port:     broker.port,
+			rack:     broker.rack,
+		})
+	}
+
+	if reqBody.includeClusterAuthorizedOperations {
+		response.clusterAuthorizedOperations = b.clusterAuthorizedOperations(req.context)
+	}
+
+	return response
+}
+
+func buildDescribeClusterErrorResponse(req RequestMessage, errorCode ErrorCode) DescribeClusterResponse {
+	supported, _ := getSupportedApiVersion(DESCRIBE_CLUSTER)
+	return DescribeClusterResponse{
+		version:                     min(req.header.requestApiVersion, supported.MaxVersion),
+		errorCode:                   errorCode,
+		endpointType:                ENDPOINT_TYPE_BROKERS,
+		controllerID:                -1,
+		brokers:                     []DescribeClusterBroker{},
+		clusterAuthorizedOperations: AUTHORIZED_OPERATIONS_OMITTED,
+	}
+}
+
+// Request
+type DescribeClusterRequest struct {
+	version                            int16
+	includeClusterAuthorizedOperations bool
+	endpointType                       int8
+}
+
+func (r *DescribeClusterRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+
+	err := binary.Read(buf, binary.BigEndian, &r.includeClusterAuthorizedOperations)
+	checkError(err)
+
+	r.endpointType = ENDPOINT_TYPE_BROKERS
+	if r.version >= 1 {
+		err = binary.Read(buf, binary.BigEndian, &r.endpointType)
+		checkError(err)
+	}
+
+	skipTaggedFields(buf)
+}
@@ -3,111 +3,229 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"slices"
 )
 
 // Response
 type DescribeTopicPartitionsResponse struct {
 	throttleTime int32
 	Topics       []Topic
-	nextCursor   byte
-	tagBuffer    byte
+	// Where the next page starts, nil on the last page
+	nextCursor *DescribeTopicPartitionsCursor
+	tagBuffer  byte
+}
+
+// A topic and the partition within it to continue from
+type DescribeTopicPartitionsCursor struct {
+	topicName      string
+	partitionIndex int32
+	tagBuffer      byte
 }
 
 func (r DescribeTopicPartitionsResponse) serialize() []byte {
-	res := []byte{}
+	e := newEncoder(0)
+	defer e.release()
+	r.encode(e)
+	return e.Bytes()
+}
 
+func (r DescribeTopicPartitionsResponse) encode(e *Encoder) {
 	// Throttle Time
-	res = binary.BigEndian.AppendUint32(res, uint32(r.throttleTime))
+	e.putInt32(r.throttleTime)
 
 	// Topics Array
-	arrayLength := len(r.Topics) + 1
-	res = append(res, byte(arrayLength))
+	e.putArrayLength(len(r.Topics), true)
 
 	for _, details := range r.Topics {
 		// Error code
-		res = binary.BigEndian.AppendUint16(res, uint16(details.errorCode))
+		e.putInt16(int16(details.errorCode))
 		// Topic Name
-		topicName := encodeCompactString(details.topicName)
-		res = append(res, topicName...)
+		e.putString(details.topicName, true)
 		// Topic ID
-		res = append(res, details.topicID[:]...)
+		e.putBytes(details.topicID[:])
 		// Is Internal
-		var internal byte = 0x00
-		if details.isInternal {
-			internal = 0x11
-		}
-		res = append(res, internal)
+		e.putBool(details.isInternal)
 
 		// Partitions Array
-		arrayLength := len(details.partitions) + 1
-		res = append(res, byte(arrayLength))
+		e.putArrayLength(len(details.partitions), true)
 
 		for _, partition := range details.partitions {
-			res = append(res, partition.serialize()...)
+			partition.encode(e)
 		}
 
 		// Topic Authorized Operations
-		res = append(res, details.authorizedOperations[:]...)
+		e.putInt32(details.authorizedOperations)
 		// Tag Buffer
-		res = append(res, details.tagBuffer)
+		e.putInt8(int8(details.tagBuffer))
 	}
 	// Next Cursor
-	res = append(res, r.nextCursor)
+	r.nextCursor.encode(e)
 	// Tag Buffer
-	res = append(res, r.tagBuffer)
+	e.putInt8(int8(r.tagBuffer))
+}
+
+// Cursors are nullable structs: -1 for null, 1 followed by the fields
+// otherwise
+func (c *DescribeTopicPartitionsCursor) encode(e *Encoder) {
+	if c == nil {
+		e.putInt8(-1)
+		return
+	}
+	e.putInt8(1)
+	e.putString(c.topicName, true)
+	e.putInt32(c.partitionIndex)
+	e.putInt8(int8(c.tagBuffer))
+}
+
+func (r DescribeTopicPartitionsResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
 
-	return res
+func (r DescribeTopicPartitionsResponse) errorCounts() map[ErrorCode]int {
+	counts := map[ErrorCode]int{}
+	for _, topic := range r.Topics {
+		counts[topic.errorCode]++
+		for _, partition := range topic.partitions {
+			counts[partition.errorCode]++
+		}
+	}
+	return counts
 }
 
-func buildDescribeTopicPartitionsResponse(req RequestMessage) DescribeTopicPartitionsResponse {
+func (b *Broker) buildDescribeTopicPartitionsResponse(req RequestMessage) DescribeTopicPartitionsResponse {
 	reqBody := req.body.(*DescribeTopicPartitionsRequest)
 	response := DescribeTopicPartitionsResponse{
 		throttleTime: 0,
-		nextCursor:   0xff,
+		Topics:       []Topic{},
 		tagBuffer:    0,
 	}
 
-	for _, topicName := range reqBody.TopicNames {
-		topic := getTopicByName(topicName)
+	// An empty request describes every topic the client may describe.
+	// Topics are described in name order, starting from the cursor.
+	fetchAllTopics := len(reqBody.TopicNames) == 0
+	topicNames := slices.Clone(reqBody.TopicNames)
+	if fetchAllTopics {
+		for _, name := range b.metadata.getTopicNames() {
+			if b.authorize(req.context, OPERATION_DESCRIBE, RESOURCE_TOPIC, name) {
+				topicNames = append(topicNames, name)
+			}
+		}
+	}
+	slices.Sort(topicNames)
+	topicNames = slices.Compact(topicNames)
+	cursor := reqBody.cursor
+	if cursor != nil {
+		// The cursor topic doesn't have to exist when listing everything,
+		// it may have been deleted since the previous page
+		if !fetchAllTopics && !slices.Contains(topicNames, cursor.topicName) {
+			return buildDescribeTopicPartitionsErrorResponse(req, ERR_INVALID_REQUEST)
+		}
+		topicNames = slices.DeleteFunc(topicNames, func(name string) bool { return name < cursor.topicName })
+	}
+
+	// Pages end once they hold the partition limit, which the broker caps
+	remaining := min(int(reqBody.responsePartitionLimit), b.config.maxResponsePartitions)
+	for _, topicName := range topicNames {
+		if remaining <= 0 {
+			// The previous topic filled the page exactly
+			response.nextCursor = &DescribeTopicPartitionsCursor{topicName: topicName}
+			break
+		}
+
+		// Checked before the lookup, so unauthorized clients can't tell
+		// which topics exist
+		if !b.authorize(req.context, OPERATION_DESCRIBE, RESOURCE_TOPIC, topicName) {
+			response.Topics = append(response.Topics, Topic{
+				errorCode:            ERR_TOPIC_AUTHORIZATION_FAILED,
+				topicName:            topicName,
+				partitions:           []Partition{},
+				authorizedOperations: AUTHORIZED_OPERATIONS_OMITTED,
+			})
+			continue
+		}
+
+		topic := b.metadata.getTopicByName(topicName)
+		topic.authorizedOperations = b.authorizedOperations(req.context, RESOURCE_TOPIC, topicName)
+
+		if cursor != nil && topicName == cursor.topicName {
+			topic.partitions = slices.DeleteFunc(topic.partitions, func(p Partition) bool {
+				return p.partitionIndex < cursor.partitionIndex
+			})
+		}
+		if len(topic.partitions) > remaining {
+			response.nextCursor = &DescribeTopicPartitionsCursor{
+				topicName:      topicName,
+				partitionIndex: topic.partitions[remaining].partitionIndex,
+			}
+			topic.partitions = topic.partitions[:remaining]
+		}
 		response.Topics = append(response.Topics, topic)
+		if response.nextCursor != nil {
+			break
+		}
+		remaining -= len(topic.partitions)
 	}
 
 	return response
 }
 
+// Every requested topic is echoed back with the error. The request is
+// decoded with the newest layout we know, on a best-effort basis.
+func buildDescribeTopicPartitionsErrorResponse(req RequestMessage, errorCode ErrorCode) DescribeTopicPartitionsResponse {
+	response := DescribeTopicPartitionsResponse{
+		throttleTime: 0,
+		Topics:       []Topic{},
+		tagBuffer:    0,
+	}
+
+	reqBody := &DescribeTopicPartitionsRequest{}
+	if !tryDeserialize(reqBody, req.rawBody) {
+		return response
+	}
+
+	for _, topicName := range reqBody.TopicNames {
+		response.Topics = append(response.Topics, Topic{
+			errorCode:            errorCode,
+			topicName:            topicName,
+			partitions:           []Partition{},
+			authorizedOperations: AUTHORIZED_OPERATIONS_OMITTED,
+		})
+	}
+	return response
+}
+
 // Request
 type DescribeTopicPartitionsRequest struct {
-	TopicNames []string
+	version                int16
+	TopicNames             []string
+	responsePartitionLimit int32
+	// Where to continue from, nil for the first page
+	cursor *DescribeTopicPartitionsCursor
 }
 
 func (r *DescribeTopicPartitionsRequest) deserialize(data []byte) {
 	buf := bytes.NewBuffer(data)
 	r.TopicNames = []string{}
 
-	var lengthByte byte
-	binary.Read(buf, binary.BigEndian, &lengthByte)
-	length := max(int(lengthByte)-1, 0)
-	if length == 0 {
-		return
+	for range max(0, readArrayLength(buf, true)) {
+		r.TopicNames = append(r.TopicNames, readComapctString(buf))
+		skipTaggedFields(buf)
 	}
 
-	for range length {
-		var topicNameLengthByte byte
-		binary.Read(buf, binary.BigEndian, &topicNameLengthByte)
-		topicNameLength := max(int(topicNameLengthByte)-1, 0)
-
-		topicName := make([]byte, topicNameLength)
-		buf.Read(topicName)
-
-		r.TopicNames = append(r.TopicNames, string(topicName))
-		var topicTagBuffer byte
-		binary.Read(buf, binary.BigEndian, &topicTagBuffer)
+	err := binary.Read(buf, binary.BigEndian, &r.responsePartitionLimit)
+	checkError(err)
+
+	var present int8
+	err = binary.Read(buf, binary.BigEndian, &present)
+	checkError(err)
+	if present >= 0 {
+		r.cursor = &DescribeTopicPartitionsCursor{}
+		r.cursor.topicName = readComapctString(buf)
+		err = binary.Read(buf, binary.BigEndian, &r.cursor.partitionIndex)
+		checkError(err)
+		skipTaggedFields(buf)
 	}
 
-	var responsePartitionLimit int32
-	binary.Read(buf, binary.BigEndian, &responsePartitionLimit)
-
-	var cursor, tagBuffer byte
-	binary.Read(buf, binary.BigEndian, &cursor)
-	binary.Read(buf, binary.BigEndian, &tagBuffer)
+	skipTaggedFields(buf)
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func partitionRecord(topicID UUID, partitionID int32) []byte {
+	value := []byte{1, byte(PARTITION_RECORD), 1}
+	value = binary.BigEndian.AppendUint32(value, uint32(partitionID))
+	value = append(value, topicID[:]...)
+	value = append(value, 2, 0, 0, 0, 1) // replicas
+	value = append(value, 2, 0, 0, 0, 1) // ISR
+	value = append(value, 1, 1)          // removing and adding replicas
+	value = binary.BigEndian.AppendUint32(value, 1)
+	value = binary.BigEndian.AppendUint32(value, 0) // leader epoch
+	value = binary.BigEndian.AppendUint32(value, 0) // partition epoch
+	value = append(value, 1)                        // directories
+	return append(value, 0)
+}
+
+func registerBrokerRecord(brokerID int32) []byte {
+	value := []byte{1, byte(REGISTER_BROKER_RECORD), 0}
+	value = binary.BigEndian.AppendUint32(value, uint32(brokerID))
+	value = append(value, make([]byte, 16)...)      // incarnation ID
+	value = binary.BigEndian.AppendUint64(value, 1) // broker epoch
+	value = append(value, 1, 1, 0)                  // endpoints, features, rack
+	return append(value, 0, 0)                      // fenced, tag buffer
+}
+
+// A tagged field holding replica IDs
+func replicasTag(tag int, replicas ...ReplicaID) []byte {
+	field := encodeInt32Array(replicas, true)
+	value := appendUnsignedVarint(nil, tag)
+	value = appendUnsignedVarint(value, len(field))
+	return append(value, field...)
+}
+
+func Test_DescribeTopicPartitions_replicaState(t *testing.T) {
+	broker := newTestBroker(t, nil)
+	alpha, beta := UUID{1}, UUID{2}
+
+	// Replicas 1-4 with ELR [2] and last known ELR [3]
+	partition := []byte{1, byte(PARTITION_RECORD), 1}
+	partition = binary.BigEndian.AppendUint32(partition, 0)
+	partition = append(partition, beta[:]...)
+	partition = append(partition, encodeInt32Array([]ReplicaID{1, 2, 3, 4}, true)...)
+	partition = append(partition, encodeInt32Array([]ReplicaID{1}, true)...)
+	partition = append(partition, 1, 1) // removing and adding replicas
+	partition = binary.BigEndian.AppendUint32(partition, 1)
+	partition = binary.BigEndian.AppendUint32(partition, 0) // leader epoch
+	partition = binary.BigEndian.AppendUint32(partition, 0) // partition epoch
+	partition = append(partition, 1)                        // directories
+	partition = append(partition, 2)
+	partition = append(partition, replicasTag(1, 2)...)
+	partition = append(partition, replicasTag(2, 3)...)
+
+	// Leader 2 and ELR [2 3]
+	change := []byte{1, byte(PARTITION_CHANGE_RECORD), 0}
+	change = binary.BigEndian.AppendUint32(change, 0)
+	change = append(change, beta[:]...)
+	change = append(change, 2, 1, 4, 0, 0, 0, 2)
+	change = append(change, replicasTag(6, 2, 3)...)
+
+	// Broker 3 is fenced and broker 4 never registered
+	fence := []byte{1, byte(FENCE_BROKER_RECORD), 0}
+	fence = binary.BigEndian.AppendUint32(fence, 3)
+	fence = binary.BigEndian.AppendUint64(fence, 1)
+	fence = append(fence, 0)
+
+	writeMetadataRecords(t, broker,
+		registerBrokerRecord(2), registerBrokerRecord(3), fence,
+		topicRecord("beta", beta), topicRecord("alpha", alpha),
+		partition, change, partitionRecord(alpha, 0),
+	)
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConnection(broker, "PLAINTEXT", server).serve()
+
+	// No topics asks for all of them
+	body := appendArrayLength(nil, 0, true)
+	body = binary.BigEndian.AppendUint32(body, 100)
+	body = append(body, 0xff, 0)
+	response, err := sendTestRequest(client, DESCRIBE_TOPIC_PARTITIONS, 0, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(response[4:])
+	got := []string{}
+	for range readArrayLength(buf, true) {
+		buf.Next(2)
+		name := readComapctString(buf)
+		buf.Next(16 + 1) // topic ID, is internal
+		for range readArrayLength(buf, true) {
+			buf.Next(2 + 4) // error code, partition index
+			leader, leaderEpoch := int32(binary.BigEndian.Uint32(buf.Next(4))), int32(binary.BigEndian.Uint32(buf.Next(4)))
+			replicas := [5][]ReplicaID{}
+			for i := range replicas {
+				replicas[i] = readCompactArray[ReplicaID](buf)
+			}
+			buf.Next(1)
+			got = append(got, fmt.Sprintf("%s leader=%d/%d replicas=%v isr=%v elr=%v lastKnownElr=%v offline=%v",
+				name, leader, leaderEpoch, replicas[0], replicas[1], replicas[2], replicas[3], replicas[4]))
+		}
+		buf.Next(4 + 1) // authorized operations, tag buffer
+	}
+
+	want := []string{
+		"alpha leader=1/0 replicas=[1] isr=[1] elr=[] lastKnownElr=[] offline=[]",
+		"beta leader=2/1 replicas=[1 2 3 4] isr=[1] elr=[2 3] lastKnownElr=[3] offline=[3 4]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("partitions = %v, want %v", got, want)
+	}
+}
+
+func Test_DescribeTopicPartitions_pagination(t *testing.T) {
+	broker := newTestBroker(t, map[string]string{"max.request.partition.size.limit": "4"})
+	alpha, beta, gamma := UUID{1}, UUID{2}, UUID{3}
+	writeMetadataRecords(t, broker,
+		topicRecord("alpha", alpha), topicRecord("beta", beta), topicRecord("gamma", gamma),
+		partitionRecord(alpha, 0), partitionRecord(alpha, 1), partitionRecord(alpha, 2),
+		partitionRecord(beta, 0), partitionRecord(beta, 1),
+		partitionRecord(gamma, 0),
+	)
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConnection(broker, "PLAINTEXT", server).serve()
+
+	type cursor struct {
+		topicName      string
+		partitionIndex int32
+	}
+	tests := []struct {
+		name   string
+		limit  int32
+		cursor *cursor
+		// Partition indexes, or the error code, by topic in response order
+		want       []string
+		wantCursor *cursor
+	}{
+		{"capped by the broker", 10, nil, []string{"alpha [0 1 2]", "beta [0]"}, &cursor{"beta", 1}},
+		{"topic cut short", 2, nil, []string{"alpha [0 1]"}, &cursor{"alpha", 2}},
+		{"page filled exactly", 3, nil, []string{"alpha [0 1 2]"}, &cursor{"beta", 0}},
+		{"from the cursor", 2, &cursor{"alpha", 2}, []string{"alpha [2]", "beta [0]"}, &cursor{"beta", 1}},
+		{"last page", 10, &cursor{"beta", 1}, []string{"beta [1]", "gamma [0]"}, nil},
+		// Errors for the whole request echo the topics as requested
+		{"cursor outside the request", 10, &cursor{"delta", 0}, []string{"gamma 42", "alpha 42", "beta 42"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := appendArrayLength(nil, 3, true)
+			for _, name := range []string{"gamma", "alpha", "beta"} {
+				body = append(appendString(body, name, true), 0)
+			}
+			body = binary.BigEndian.AppendUint32(body, uint32(tt.limit))
+			if tt.cursor == nil {
+				body = append(body, 0xff)
+			} else {
+				body = append(body, 1)
+				body = appendString(body, tt.cursor.topicName, true)
+				body = binary.BigEndian.AppendUint32(body, uint32(tt.cursor.partitionIndex))
+				body = append(body, 0)
+			}
+			body = append(body, 0)
+			response, err := sendTestRequest(client, DESCRIBE_TOPIC_PARTITIONS, 0, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := bytes.NewBuffer(response[4:])
+			got := []string{}
+			for range readArrayLength(buf, true) {
+				errorCode := ErrorCode(binary.BigEndian.Uint16(buf.Next(2)))
+				name := readComapctString(buf)
+				buf.Next(16 + 1) // topic ID, is internal
+				partitions := []int32{}
+				for range readArrayLength(buf, true) {
+					buf.Next(2)
+					partitions = append(partitions, int32(binary.BigEndian.Uint32(buf.Next(4))))
+					buf.Next(8) // leader ID and epoch
+					for range 5 {
+						buf.Next(4 * readArrayLength(buf, true))
+					}
+					buf.Next(1)
+				}
+				buf.Next(4 + 1) // authorized operations, tag buffer
+				if errorCode != ERR_NONE {
+					got = append(got, fmt.Sprintf("%s %d", name, errorCode))
+				} else {
+					got = append(got, fmt.Sprintf("%s %v", name, partitions))
+				}
+			}
+			var gotCursor *cursor
+			if present := int8(buf.Next(1)[0]); present >= 0 {
+				gotCursor = &cursor{readComapctString(buf), int32(binary.BigEndian.Uint32(buf.Next(4)))}
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topics = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(gotCursor, tt.wantCursor) {
+				t.Errorf("next cursor = %+v, want %+v", gotCursor, tt.wantCursor)
+			}
+		})
+	}
+}
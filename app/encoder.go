@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Writes a response field by field into one buffer. Responses are encoded
+// twice: first by an encoder that only counts, so that the message size is
+// known up front and a pooled buffer of the right size can be taken, then
+// for real. File regions aren't copied into the buffer, they are sent from
+// their files between the buffered bytes.
+type Encoder struct {
+	counting bool
+	data     []byte
+	// The pooled buffer data was taken from
+	buf *[]byte
+	// File regions, each sent before data[position:]
+	files     []EncodedFile
+	fileBytes int
+	size      int
+}
+
+type EncodedFile struct {
+	position int
+	file     FileRegion
+}
+
+func newCountingEncoder() *Encoder {
+	return &Encoder{counting: true}
+}
+
+// An encoder writing into a pooled buffer that holds at least size bytes.
+// It must be released once its contents have been written out.
+func newEncoder(size int) *Encoder {
+	buf := getBuffer(size)
+	return &Encoder{data: *buf, buf: buf}
+}
+
+// Hand the buffer back to the pool. The encoder can't be used afterwards.
+func (e *Encoder) release() {
+	if e.counting {
+		return
+	}
+	// data may have outgrown the buffer
+	*e.buf = e.data
+	putBuffer(e.buf)
+	e.data, e.buf, e.files = nil, nil, nil
+}
+
+// Bytes encoded so far, file regions included
+func (e *Encoder) Len() int {
+	return e.size
+}
+
+// Bytes encoded so far that go in the buffer
+func (e *Encoder) bufferedLen() int {
+	return e.size - e.fileBytes
+}
+
+func (e *Encoder) putInt8(v int8) {
+	e.size++
+	if !e.counting {
+		e.data = append(e.data, byte(v))
+	}
+}
+
+func (e *Encoder) putBool(v bool) {
+	e.size++
+	if !e.counting {
+		e.data = appendBool(e.data, v)
+	}
+}
+
+func (e *Encoder) putInt16(v int16) {
+	e.size += 2
+	if !e.counting {
+		e.data = binary.BigEndian.AppendUint16(e.data, uint16(v))
+	}
+}
+
+func (e *Encoder) putInt32(v int32) {
+	e.size += 4
+	if !e.counting {
+		e.data = binary.BigEndian.AppendUint32(e.data, uint32(v))
+	}
+}
+
+func (e *Encoder) putInt64(v int64) {
+	e.size += 8
+	if !e.counting {
+		e.data = binary.BigEndian.AppendUint64(e.data, uint64(v))
+	}
+}
+
+func (e *Encoder) putUnsignedVarint(v int) {
+	e.size += uvarintSize(uint64(v))
+	if !e.counting {
+		e.data = appendUnsignedVarint(e.data, v)
+	}
+}
+
+func uvarintSize(v uint64) int {
+	size := 1
+	for ; v >= 0x80; v >>= 7 {
+		size++
+	}
+	return size
+}
+
+// The length of an ARRAY or, for flexible versions, a COMPACT_ARRAY. -1
+// makes a null array.
+func (e *Encoder) putArrayLength(arrLen int, flexible bool) {
+	if flexible {
+		e.putUnsignedVarint(arrLen + 1)
+	} else {
+		e.putInt32(int32(arrLen))
+	}
+}
+
+// A STRING or, for flexible versions, a COMPACT_STRING
+func (e *Encoder) putString(s string, flexible bool) {
+	if flexible {
+		e.putUnsignedVarint(len(s) + 1)
+	} else {
+		e.putInt16(int16(len(s)))
+	}
+	e.size += len(s)
+	if !e.counting {
+		e.data = append(e.data, s...)
+	}
+}
+
+// Raw bytes, without a length prefix
+func (e *Encoder) putBytes(b []byte) {
+	e.size += len(b)
+	if !e.counting {
+		e.data = append(e.data, b...)
+	}
+}
+
+// An ARRAY or COMPACT_ARRAY of int32s, nil making a null array
+func (e *Encoder) putInt32Array(arr []ReplicaID, flexible bool) {
+	if arr == nil {
+		e.putArrayLength(-1, flexible)
+		return
+	}
+	e.putArrayLength(len(arr), flexible)
+	for _, v := range arr {
+		e.putInt32(int32(v))
+	}
+}
+
+// A file region, sent straight from its file
+func (e *Encoder) putFile(file FileRegion) {
+	e.size += file.Len()
+	e.fileBytes += file.Len()
+	if !e.counting {
+		e.files = append(e.files, EncodedFile{position: len(e.data), file: file})
+	}
+}
+
+// Write everything in order: the buffered bytes up to each file region,
+// then the region through its own WriteTo so that sockets get it with
+// sendfile.
+func (e *Encoder) WriteTo(w io.Writer) (int64, error) {
+	written, position := int64(0), 0
+	for _, f := range e.files {
+		n, err := w.Write(e.data[position:f.position])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		m, err := f.file.WriteTo(w)
+		written += m
+		if err != nil {
+			return written, err
+		}
+		position = f.position
+	}
+	n, err := w.Write(e.data[position:])
+	return written + int64(n), err
+}
+
+// A copy of everything encoded, with the file regions read in
+func (e *Encoder) Bytes() []byte {
+	out := make([]byte, 0, e.size)
+	position := 0
+	for _, f := range e.files {
+		out = append(out, e.data[position:f.position]...)
+		data, err := f.file.Bytes()
+		checkError(err)
+		out = append(out, data...)
+		position = f.position
+	}
+	return append(out, e.data[position:]...)
+}
@@ -1,10 +1,76 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
 type ErrorCode int16
 
 const (
-	ERR_NONE                       ErrorCode = 0
-	ERR_UNKNOWN_TOPIC_OR_PARTITION ErrorCode = 3
-	ERR_UNSUPPORTED_VERSION        ErrorCode = 35
-	ERR_UNKNOWN_TOPIC   		ErrorCode = 100
+	ERR_UNKNOWN_SERVER_ERROR         ErrorCode = -1
+	ERR_NONE                         ErrorCode = 0
+	ERR_OFFSET_OUT_OF_RANGE          ErrorCode = 1
+	ERR_UNKNOWN_TOPIC_OR_PARTITION   ErrorCode = 3
+	ERR_TOPIC_AUTHORIZATION_FAILED   ErrorCode = 29
+	ERR_CLUSTER_AUTHORIZATION_FAILED ErrorCode = 31
+	ERR_UNSUPPORTED_SASL_MECHANISM   ErrorCode = 33
+	ERR_ILLEGAL_SASL_STATE           ErrorCode = 34
+	ERR_UNSUPPORTED_VERSION          ErrorCode = 35
+	ERR_INVALID_REQUEST              ErrorCode = 42
+	ERR_SECURITY_DISABLED            ErrorCode = 54
+	ERR_KAFKA_STORAGE_ERROR          ErrorCode = 56
+	ERR_SASL_AUTHENTICATION_FAILED   ErrorCode = 58
+	ERR_UNKNOWN_TOPIC                ErrorCode = 100
+	ERR_UNSUPPORTED_ENDPOINT_TYPE    ErrorCode = 119
 )
+
+// Kafka's names for the error codes, as used in logs and metrics
+var errorNames = map[ErrorCode]string{
+	ERR_UNKNOWN_SERVER_ERROR:         "UNKNOWN_SERVER_ERROR",
+	ERR_NONE:                         "NONE",
+	ERR_OFFSET_OUT_OF_RANGE:          "OFFSET_OUT_OF_RANGE",
+	ERR_UNKNOWN_TOPIC_OR_PARTITION:   "UNKNOWN_TOPIC_OR_PARTITION",
+	ERR_TOPIC_AUTHORIZATION_FAILED:   "TOPIC_AUTHORIZATION_FAILED",
+	ERR_CLUSTER_AUTHORIZATION_FAILED: "CLUSTER_AUTHORIZATION_FAILED",
+	ERR_UNSUPPORTED_SASL_MECHANISM:   "UNSUPPORTED_SASL_MECHANISM",
+	ERR_ILLEGAL_SASL_STATE:           "ILLEGAL_SASL_STATE",
+	ERR_UNSUPPORTED_VERSION:          "UNSUPPORTED_VERSION",
+	ERR_INVALID_REQUEST:              "INVALID_REQUEST",
+	ERR_SECURITY_DISABLED:            "SECURITY_DISABLED",
+	ERR_KAFKA_STORAGE_ERROR:          "KAFKA_STORAGE_ERROR",
+	ERR_SASL_AUTHENTICATION_FAILED:   "SASL_AUTHENTICATION_FAILED",
+	ERR_UNKNOWN_TOPIC:                "UNKNOWN_TOPIC_ID",
+	ERR_UNSUPPORTED_ENDPOINT_TYPE:    "UNSUPPORTED_ENDPOINT_TYPE",
+}
+
+func (e ErrorCode) String() string {
+	if name, ok := errorNames[e]; ok {
+		return name
+	}
+	return strconv.Itoa(int(e))
+}
+
+// An error that is reported to the client with its own code
+type KafkaError struct {
+	code    ErrorCode
+	message string
+}
+
+func (e KafkaError) Error() string {
+	return e.message
+}
+
+func newKafkaError(code ErrorCode, format string, args ...any) KafkaError {
+	return KafkaError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// The code to report err with, UNKNOWN_SERVER_ERROR unless it's a KafkaError
+func errorCodeOf(err error) ErrorCode {
+	var kafkaErr KafkaError
+	if errors.As(err, &kafkaErr) {
+		return kafkaErr.code
+	}
+	return ERR_UNKNOWN_SERVER_ERROR
+}
@@ -3,128 +3,238 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-)
+	"errors"
+	"log/slog"
+	"time"
 
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
+)
 
 type FetchResponse struct {
+	version      int16
 	throttleTime int32
-	errorCode ErrorCode
-	sessionID int32
-	responses []FetchResponseTopic
-	tagBuffer byte
+	errorCode    ErrorCode
+	sessionID    int32
+	responses    []FetchResponseTopic
+	tagBuffer    byte
 }
 
 type FetchResponseTopic struct {
-	topicID UUID
+	version    int16
+	topicName  string
+	topicID    UUID
 	partitions []FetchResponsePartition
-	tagBuffer byte
+	tagBuffer  byte
 }
 
 type FetchResponsePartition struct {
-	partitionIndex int32
-	errorCode ErrorCode
-	highWatermark int64
-	lastStableOffset int64
-	logStartOffset int64
-	abortedTransactions []FetchResponseAbortedTransaction
+	version              int16
+	partitionIndex       int32
+	errorCode            ErrorCode
+	highWatermark        int64
+	lastStableOffset     int64
+	logStartOffset       int64
+	abortedTransactions  []FetchResponseAbortedTransaction
 	preferredReadReplica ReplicaID
-	records byte
-	tagBuffer byte
+	records              []byte
+	// Records left in a segment file, sent instead of records
+	fileRecords FileRegion
+	tagBuffer   byte
 }
 
 type FetchResponseAbortedTransaction struct {
-	producerID int64
+	version     int16
+	producerID  int64
 	firstOffset int64
-	tagBuffer byte
+	tagBuffer   byte
 }
 
 func (f FetchResponse) serialize() []byte {
-	out := []byte{}
+	e := newEncoder(0)
+	defer e.release()
+	f.encode(e)
+	return e.Bytes()
+}
 
-	out = binary.BigEndian.AppendUint32(out, uint32(f.throttleTime))
-	out = binary.BigEndian.AppendUint16(out, uint16(f.errorCode))
-	out = binary.BigEndian.AppendUint32(out, uint32(f.sessionID))
+// Records read from the partition logs are left in their segment files
+func (f FetchResponse) encode(e *Encoder) {
+	flexible := isFlexibleVersion(FETCH, f.version)
 
-	serializableElements := make([]SerializableElement, len(f.responses))
-	for i, v := range f.responses {
-		serializableElements[i] = v
+	if f.version >= 1 {
+		e.putInt32(f.throttleTime)
+	}
+	if f.version >= 7 {
+		e.putInt16(int16(f.errorCode))
+		e.putInt32(f.sessionID)
 	}
-	out = append(out, encodeCustomCompactArray(serializableElements)...)
 
-	out = append(out, f.tagBuffer)
-	return out
+	e.putArrayLength(len(f.responses), flexible)
+	for _, topic := range f.responses {
+		topic.encode(e)
+	}
+
+	if flexible {
+		e.putInt8(int8(f.tagBuffer))
+	}
 }
 
-func (f FetchResponseTopic) serialize() []byte {
-	out := []byte{}
-	out = append(out, f.topicID[:]...)
+func (f FetchResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	f.throttleTime = throttleTime
+	return f
+}
+
+func (f FetchResponse) errorCounts() map[ErrorCode]int {
+	counts := map[ErrorCode]int{f.errorCode: 1}
+	for _, topic := range f.responses {
+		for _, partition := range topic.partitions {
+			counts[partition.errorCode]++
+		}
+	}
+	return counts
+}
 
-	serializableElements := make([]SerializableElement, len(f.partitions))
-	for i, v := range f.partitions {
-		serializableElements[i] = v
+// Close the segment files the records are read from
+func (f FetchResponse) Close() error {
+	errs := []error{}
+	for _, topic := range f.responses {
+		for _, partition := range topic.partitions {
+			if partition.fileRecords != nil {
+				errs = append(errs, partition.fileRecords.Close())
+			}
+		}
 	}
-	out = append(out, encodeCustomCompactArray(serializableElements)...)
-	
-	out = append(out, f.tagBuffer)
-	return out
+	return errors.Join(errs...)
 }
 
-func (f FetchResponsePartition) serialize() []byte {
-	out := []byte{}
-	out = binary.BigEndian.AppendUint32(out, uint32(f.partitionIndex))
-	out = binary.BigEndian.AppendUint16(out, uint16(f.errorCode))
+func (f FetchResponseTopic) encode(e *Encoder) {
+	flexible := isFlexibleVersion(FETCH, f.version)
 
-	out = binary.BigEndian.AppendUint64(out, uint64(f.highWatermark))
-	out = binary.BigEndian.AppendUint64(out, uint64(f.lastStableOffset))
-	out = binary.BigEndian.AppendUint64(out, uint64(f.logStartOffset))
+	if f.version >= 13 {
+		e.putBytes(f.topicID[:])
+	} else {
+		e.putString(f.topicName, flexible)
+	}
 
-	serializableElements := make([]SerializableElement, len(f.abortedTransactions))
-	for i, v := range f.abortedTransactions {
-		serializableElements[i] = v
+	e.putArrayLength(len(f.partitions), flexible)
+	for _, partition := range f.partitions {
+		partition.encode(e)
 	}
-	out = append(out, encodeCustomCompactArray(serializableElements)...)
 
-	out = binary.BigEndian.AppendUint32(out, uint32(f.preferredReadReplica))
+	if flexible {
+		e.putInt8(int8(f.tagBuffer))
+	}
+}
 
-	// Compact records
-	out = append(out, f.records)
+func (f FetchResponsePartition) encode(e *Encoder) {
+	flexible := isFlexibleVersion(FETCH, f.version)
 
-	out = append(out, f.tagBuffer)
-	return out
-}
+	e.putInt32(f.partitionIndex)
+	e.putInt16(int16(f.errorCode))
+
+	e.putInt64(f.highWatermark)
+	if f.version >= 4 {
+		e.putInt64(f.lastStableOffset)
+	}
+	if f.version >= 5 {
+		e.putInt64(f.logStartOffset)
+	}
+
+	if f.version >= 4 {
+		e.putArrayLength(len(f.abortedTransactions), flexible)
+		for _, transaction := range f.abortedTransactions {
+			transaction.encode(e)
+		}
+	}
+
+	if f.version >= 11 {
+		e.putInt32(int32(f.preferredReadReplica))
+	}
 
-func (f FetchResponseAbortedTransaction) serialize() []byte {
-	out := []byte{}
-	out = binary.BigEndian.AppendUint64(out, uint64(f.producerID))
-	out = binary.BigEndian.AppendUint64(out, uint64(f.firstOffset))
+	// Records are nullable bytes
+	switch {
+	case f.fileRecords != nil:
+		e.putArrayLength(f.fileRecords.Len(), flexible)
+		e.putFile(f.fileRecords)
+	case f.records == nil:
+		e.putArrayLength(-1, flexible)
+	default:
+		e.putArrayLength(len(f.records), flexible)
+		e.putBytes(f.records)
+	}
 
-	out = append(out, f.tagBuffer)
-	return out
+	if flexible {
+		e.putInt8(int8(f.tagBuffer))
+	}
 }
 
+func (f FetchResponseAbortedTransaction) encode(e *Encoder) {
+	e.putInt64(f.producerID)
+	e.putInt64(f.firstOffset)
 
-func buildFetchResposne(req RequestMessage) FetchResponse {
+	if isFlexibleVersion(FETCH, f.version) {
+		e.putInt8(int8(f.tagBuffer))
+	}
+}
+
+func (b *Broker) buildFetchResposne(req RequestMessage) FetchResponse {
 	reqBody := req.body.(*FetchRequest)
-	res :=  FetchResponse{
+	res := FetchResponse{
+		version:      reqBody.version,
 		throttleTime: 0,
-		sessionID: reqBody.sessionID,
+		sessionID:    reqBody.sessionID,
 	}
-
-	for _, topic := range(reqBody.topics) {
-		foundTopic := getTopicByID(topic.topicID)
+	// What is left of the response's max bytes
+	remainingBytes := int(reqBody.maxBytes)
+
+	for _, topic := range reqBody.topics {
+		// Topics are identified by ID from v13 onwards
+		var foundTopic Topic
+		if reqBody.version >= 13 {
+			foundTopic = b.metadata.getTopicByID(topic.topicID)
+		} else {
+			foundTopic = b.metadata.getTopicByName(topic.topicName)
+		}
 
 		err := ERR_NONE
 		if foundTopic.errorCode != ERR_NONE {
 			err = foundTopic.errorCode
 		}
+		// Names are checked whether the topic exists or not, so that
+		// unauthorized clients can't probe for topics. Unknown IDs have no
+		// name to check.
+		if (reqBody.version < 13 || err == ERR_NONE) && !b.authorize(req.context, OPERATION_READ, RESOURCE_TOPIC, foundTopic.topicName) {
+			err = ERR_TOPIC_AUTHORIZATION_FAILED
+		}
 
 		responseTopic := FetchResponseTopic{
-			topicID: topic.topicID,
+			version:   reqBody.version,
+			topicName: topic.topicName,
+			topicID:   topic.topicID,
 		}
-		for _, partition := range(topic.partitions) {
+		for _, partition := range topic.partitions {
+			partitionErr := err
+			if err == ERR_NONE {
+				if _, ok := b.metadata.getPartition(foundTopic.topicID, partition.partition); !ok {
+					partitionErr = ERR_UNKNOWN_TOPIC_OR_PARTITION
+				}
+			}
 			responsePartition := FetchResponsePartition{
-				partitionIndex: partition.partition,
-				errorCode: err,
+				version:              reqBody.version,
+				partitionIndex:       partition.partition,
+				errorCode:            partitionErr,
+				preferredReadReplica: -1,
+			}
+			if partitionErr == ERR_NONE {
+				span := req.span.startChild("log.read", time.Now(), partitionAttributes(foundTopic.topicName, partition.partition)...)
+				responsePartition.errorCode = b.readPartition(&responsePartition, foundTopic.topicName, partition, remainingBytes)
+				if responsePartition.fileRecords != nil {
+					span.setAttributes(slog.Int("kafka.records.bytes", responsePartition.fileRecords.Len()))
+				}
+				span.setErrorCode(responsePartition.errorCode)
+				span.finish()
+				if responsePartition.fileRecords != nil {
+					remainingBytes -= responsePartition.fileRecords.Len()
+				}
 			}
 			responseTopic.partitions = append(responseTopic.partitions, responsePartition)
 		}
@@ -134,44 +244,133 @@ func buildFetchResposne(req RequestMessage) FetchResponse {
 	return res
 }
 
+// Fill in the offsets of a partition and its records from the fetch
+// offset on, as many as fit in the partition's max bytes and maxBytes. A
+// partition without a log on this broker reads as empty.
+func (b *Broker) readPartition(res *FetchResponsePartition, topicName string, partition FetchRequestPartition, maxBytes int) ErrorCode {
+	res.records = []byte{}
+	l := b.partitionLog(topicName, partition.partition)
+	if l != nil {
+		res.logStartOffset = l.StartOffset()
+		res.highWatermark = l.HighWatermark()
+	}
+	res.lastStableOffset = res.highWatermark
+
+	if partition.fetchOffset < res.logStartOffset || partition.fetchOffset > res.highWatermark {
+		return ERR_OFFSET_OUT_OF_RANGE
+	}
+	if l == nil || maxBytes <= 0 || partition.partitionMaxBytes <= 0 {
+		return ERR_NONE
+	}
+
+	records, err := l.ReadFile(partition.fetchOffset, min(int(partition.partitionMaxBytes), maxBytes))
+	if errors.Is(err, log.ErrOffsetOutOfRange) {
+		// Retention deleted the segment since the offsets were read
+		return ERR_OFFSET_OUT_OF_RANGE
+	}
+	if err != nil {
+		slog.Error("Failed to read records", "topic", topicName, "partition", partition.partition, "error", err)
+		return ERR_KAFKA_STORAGE_ERROR
+	}
+	// An interface holding a nil pointer isn't nil
+	if records != nil {
+		res.fileRecords = records
+		b.metrics.bytesOut.add(float64(records.Len()), topicName)
+	}
+	return ERR_NONE
+}
+
+// Versions 7+ carry a top-level error code. Older versions can only report
+// errors per partition, so every requested partition gets the error.
+func buildFetchErrorResponse(req RequestMessage, errorCode ErrorCode) FetchResponse {
+	supported, _ := getSupportedApiVersion(FETCH)
+	version := min(req.header.requestApiVersion, supported.MaxVersion)
+	res := FetchResponse{version: version}
+
+	if version >= 7 {
+		res.errorCode = errorCode
+		res.responses = []FetchResponseTopic{}
+		return res
+	}
+
+	reqBody := &FetchRequest{version: version}
+	if !tryDeserialize(reqBody, req.rawBody) {
+		reqBody.topics = nil
+	}
+
+	res.responses = []FetchResponseTopic{}
+	for _, topic := range reqBody.topics {
+		responseTopic := FetchResponseTopic{
+			version:   version,
+			topicName: topic.topicName,
+			topicID:   topic.topicID,
+		}
+		for _, partition := range topic.partitions {
+			responseTopic.partitions = append(responseTopic.partitions, FetchResponsePartition{
+				version:              version,
+				partitionIndex:       partition.partition,
+				errorCode:            errorCode,
+				preferredReadReplica: -1,
+			})
+		}
+		res.responses = append(res.responses, responseTopic)
+	}
+	return res
+}
+
 // Request
 type FetchRequest struct {
-	maxWait int32
-	minBytes int32
-	maxBytes int32
-	isolationLevel int8
-	sessionID int32
-	sessionEpoch int32
-	topics []FetchRequestTopic
+	version             int16
+	replicaID           int32
+	maxWait             int32
+	minBytes            int32
+	maxBytes            int32
+	isolationLevel      int8
+	sessionID           int32
+	sessionEpoch        int32
+	topics              []FetchRequestTopic
 	forgottenTopicsData []ForgottenTopic
-	rackID string
-	tagBuffer byte
+	rackID              string
+	tagBuffer           byte
 }
 
 type FetchRequestTopic struct {
-	topicID UUID
+	version    int16
+	topicName  string
+	topicID    UUID
 	partitions []FetchRequestPartition
-	tagBuffer byte
+	tagBuffer  byte
 }
 
 type FetchRequestPartition struct {
-	partition int32
+	version            int16
+	partition          int32
 	currentLeaderEpoch int32
-	fetchOffset int64
-	lastFetchedEpoch int32
-	logStartOffset int64
-	partitionMaxBytes int32
-	tagBuffer byte
+	fetchOffset        int64
+	lastFetchedEpoch   int32
+	logStartOffset     int64
+	partitionMaxBytes  int32
+	tagBuffer          byte
 }
 
 type ForgottenTopic struct {
-	topicID UUID
-	partitions int32
-	tagBuffer byte
+	version    int16
+	topicName  string
+	topicID    UUID
+	partitions []int32
+	tagBuffer  byte
 }
 
 func (r *FetchRequest) deserialize(data []byte) {
 	buf := bytes.NewBuffer(data)
+	flexible := isFlexibleVersion(FETCH, r.version)
+
+	// Replica ID moved to a tagged field in v15
+	r.replicaID = -1
+	if r.version <= 14 {
+		err := binary.Read(buf, binary.BigEndian, &r.replicaID)
+		checkError(err)
+	}
 
 	err := binary.Read(buf, binary.BigEndian, &r.maxWait)
 	checkError(err)
@@ -179,95 +378,129 @@ func (r *FetchRequest) deserialize(data []byte) {
 	err = binary.Read(buf, binary.BigEndian, &r.minBytes)
 	checkError(err)
 
-	err = binary.Read(buf, binary.BigEndian, &r.maxBytes)
-	checkError(err)
+	if r.version >= 3 {
+		err = binary.Read(buf, binary.BigEndian, &r.maxBytes)
+		checkError(err)
+	}
 
-	err = binary.Read(buf, binary.BigEndian, &r.isolationLevel)
-	checkError(err)
+	if r.version >= 4 {
+		err = binary.Read(buf, binary.BigEndian, &r.isolationLevel)
+		checkError(err)
+	}
 
-	err = binary.Read(buf, binary.BigEndian, &r.sessionID)
-	checkError(err)
+	if r.version >= 7 {
+		err = binary.Read(buf, binary.BigEndian, &r.sessionID)
+		checkError(err)
 
-	err = binary.Read(buf, binary.BigEndian, &r.sessionEpoch)
-	checkError(err)
+		err = binary.Read(buf, binary.BigEndian, &r.sessionEpoch)
+		checkError(err)
+	}
 
-	topics := readCustomComapctArray(buf, newFetchRequestTopic)
+	topics := readCustomArray(buf, flexible, func() CompactArrayElement {
+		return &FetchRequestTopic{version: r.version}
+	})
 	for _, elem := range topics {
 		if topic, ok := elem.(*FetchRequestTopic); ok {
 			r.topics = append(r.topics, *topic)
-		} 
-	}
-	
-	forgottenTopics := readCustomComapctArray(buf, newForgottenTopic)
-	for _, elem := range forgottenTopics {
-		if topic, ok := elem.(*ForgottenTopic); ok {
-			r.forgottenTopicsData = append(r.forgottenTopicsData, *topic)
-		} 
+		}
 	}
 
-	r.rackID = readComapctString(buf)
+	if r.version >= 7 {
+		forgottenTopics := readCustomArray(buf, flexible, func() CompactArrayElement {
+			return &ForgottenTopic{version: r.version}
+		})
+		for _, elem := range forgottenTopics {
+			if topic, ok := elem.(*ForgottenTopic); ok {
+				r.forgottenTopicsData = append(r.forgottenTopicsData, *topic)
+			}
+		}
+	}
 
-	err = binary.Read(buf, binary.BigEndian, &r.tagBuffer)
-	checkError(err)
-}
+	if r.version >= 11 {
+		r.rackID = readString(buf, flexible)
+	}
 
-func newFetchRequestTopic() CompactArrayElement {
-	return &FetchRequestTopic{}
+	if flexible {
+		skipTaggedFields(buf)
+	}
 }
 
 func (t *FetchRequestTopic) deserialize(buf *bytes.Buffer) {
-	err := binary.Read(buf, binary.BigEndian, &t.topicID)
-	checkError(err)
-	
-	topicPartitions := readCustomComapctArray(buf, newFetchRequestPartition)
+	flexible := isFlexibleVersion(FETCH, t.version)
+
+	if t.version >= 13 {
+		err := binary.Read(buf, binary.BigEndian, &t.topicID)
+		checkError(err)
+	} else {
+		t.topicName = readString(buf, flexible)
+	}
+
+	topicPartitions := readCustomArray(buf, flexible, func() CompactArrayElement {
+		return &FetchRequestPartition{version: t.version}
+	})
 	for _, elem := range topicPartitions {
 		if partition, ok := elem.(*FetchRequestPartition); ok {
 			t.partitions = append(t.partitions, *partition)
-		} 
+		}
 	}
 
-	err = binary.Read(buf, binary.BigEndian, &t.tagBuffer)
-	checkError(err)
-}
-
-func newFetchRequestPartition() CompactArrayElement {
-	return &FetchRequestPartition{}
+	if flexible {
+		skipTaggedFields(buf)
+	}
 }
 
 func (p *FetchRequestPartition) deserialize(buf *bytes.Buffer) {
 	err := binary.Read(buf, binary.BigEndian, &p.partition)
 	checkError(err)
 
-	err = binary.Read(buf, binary.BigEndian, &p.currentLeaderEpoch)
-	checkError(err)
+	p.currentLeaderEpoch = -1
+	if p.version >= 9 {
+		err = binary.Read(buf, binary.BigEndian, &p.currentLeaderEpoch)
+		checkError(err)
+	}
 
 	err = binary.Read(buf, binary.BigEndian, &p.fetchOffset)
 	checkError(err)
 
-	err = binary.Read(buf, binary.BigEndian, &p.lastFetchedEpoch)
-	checkError(err)
+	p.lastFetchedEpoch = -1
+	if p.version >= 12 {
+		err = binary.Read(buf, binary.BigEndian, &p.lastFetchedEpoch)
+		checkError(err)
+	}
 
-	err = binary.Read(buf, binary.BigEndian, &p.logStartOffset)
-	checkError(err)
+	p.logStartOffset = -1
+	if p.version >= 5 {
+		err = binary.Read(buf, binary.BigEndian, &p.logStartOffset)
+		checkError(err)
+	}
 
 	err = binary.Read(buf, binary.BigEndian, &p.partitionMaxBytes)
 	checkError(err)
 
-	err = binary.Read(buf, binary.BigEndian, &p.tagBuffer)
-	checkError(err)
-}
-
-func newForgottenTopic() CompactArrayElement {
-	return &ForgottenTopic{}
+	if isFlexibleVersion(FETCH, p.version) {
+		skipTaggedFields(buf)
+	}
 }
 
 func (f *ForgottenTopic) deserialize(buf *bytes.Buffer) {
-	err := binary.Read(buf, binary.BigEndian, &f.topicID)
-	checkError(err)
+	flexible := isFlexibleVersion(FETCH, f.version)
 
-	err = binary.Read(buf, binary.BigEndian, &f.partitions)
-	checkError(err)
+	if f.version >= 13 {
+		err := binary.Read(buf, binary.BigEndian, &f.topicID)
+		checkError(err)
+	} else {
+		f.topicName = readString(buf, flexible)
+	}
 
-	err = binary.Read(buf, binary.BigEndian, &f.tagBuffer)
-	checkError(err)
-}
\ No newline at end of file
+	arrLen := readArrayLength(buf, flexible)
+	for range max(0, arrLen) {
+		var partition int32
+		err := binary.Read(buf, binary.BigEndian, &partition)
+		checkError(err)
+		f.partitions = append(f.partitions, partition)
+	}
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
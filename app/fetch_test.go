@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
+)
+
+func Test_Fetch_sendfile(t *testing.T) {
+	broker := newTestBroker(t, nil)
+	alpha := UUID{1}
+	writeMetadataRecords(t, broker, topicRecord("alpha", alpha), partitionRecord(alpha, 0))
+	if err := broker.loadLogs(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.shutdown(time.Second) })
+
+	l, err := broker.logs[0].GetOrCreateLog(log.TopicPartition{Topic: "alpha", Partition: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		if _, err := l.Append(encodeRecordBatch(0, time.Now().UnixMilli(), [][]byte{bytes.Repeat([]byte{byte(i)}, 1000)}), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Records go through sendfile on TCP connections, and are copied on
+	// anything else
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go newConnection(broker, "PLAINTEXT", conn).serve()
+		}
+	}()
+	tcpClient, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpClient.Close()
+
+	pipeClient, server := net.Pipe()
+	defer pipeClient.Close()
+	go newConnection(broker, "PLAINTEXT", server).serve()
+
+	want, err := l.Read(1, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, client := range map[string]net.Conn{"TCP": tcpClient, "pipe": pipeClient} {
+		response, err := sendTestRequest(client, FETCH, 16, fetchRequestBody(alpha, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasSuffix(response, append(append(appendArrayLength(nil, len(want), true), want...), 0, 0, 0)) {
+			t.Errorf("Fetch() over %s doesn't end with the records from offset 1", name)
+		}
+	}
+}
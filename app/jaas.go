@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// A sasl.jaas.config value: a single login module with its options, e.g.
+//
+//	org.apache.kafka.common.security.plain.PlainLoginModule required
+//	    user_alice="alice-secret";
+type JaasConfig struct {
+	loginModule string
+	flag        string
+	options     map[string]string
+}
+
+var JaasControlFlags = []string{"required", "requisite", "sufficient", "optional"}
+
+func parseJaasConfig(value string) (JaasConfig, error) {
+	config := JaasConfig{options: map[string]string{}}
+	s := jaasScanner{input: strings.TrimSpace(value)}
+
+	config.loginModule = s.word()
+	config.flag = s.word()
+	if config.loginModule == "" || config.flag == "" {
+		return JaasConfig{}, fmt.Errorf("expected a login module and a control flag")
+	}
+	if !slices.Contains(JaasControlFlags, strings.ToLower(config.flag)) {
+		return JaasConfig{}, fmt.Errorf("invalid control flag %s", config.flag)
+	}
+
+	for {
+		s.skipSpaces()
+		if s.consume(';') {
+			break
+		}
+		if s.done() {
+			return JaasConfig{}, fmt.Errorf("missing ';' after the options of %s", config.loginModule)
+		}
+
+		key := s.word()
+		if key == "" || !s.consume('=') {
+			return JaasConfig{}, fmt.Errorf("invalid option of %s, expected key=value", config.loginModule)
+		}
+		value, err := s.value()
+		if err != nil {
+			return JaasConfig{}, err
+		}
+		config.options[key] = value
+	}
+
+	if s.skipSpaces(); !s.done() {
+		return JaasConfig{}, fmt.Errorf("only one login module is allowed")
+	}
+	return config, nil
+}
+
+// Passwords of the users the login module knows, from user_<name> options
+func (c JaasConfig) users() map[string]string {
+	users := map[string]string{}
+	for key, value := range c.options {
+		if name, ok := strings.CutPrefix(key, "user_"); ok {
+			users[name] = value
+		}
+	}
+	return users
+}
+
+type jaasScanner struct {
+	input string
+	pos   int
+}
+
+func (s *jaasScanner) done() bool {
+	return s.pos >= len(s.input)
+}
+
+func (s *jaasScanner) skipSpaces() {
+	for !s.done() && unicode.IsSpace(rune(s.input[s.pos])) {
+		s.pos++
+	}
+}
+
+func (s *jaasScanner) consume(c byte) bool {
+	if !s.done() && s.input[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+// A class name, flag or option key
+func (s *jaasScanner) word() string {
+	s.skipSpaces()
+	start := s.pos
+	for !s.done() && !unicode.IsSpace(rune(s.input[s.pos])) && !strings.ContainsRune("=;\"", rune(s.input[s.pos])) {
+		s.pos++
+	}
+	return s.input[start:s.pos]
+}
+
+// An option value, either a bare word or a double quoted string with
+// backslash escapes
+func (s *jaasScanner) value() (string, error) {
+	if !s.consume('"') {
+		return s.word(), nil
+	}
+
+	var value strings.Builder
+	for !s.done() {
+		c := s.input[s.pos]
+		s.pos++
+		switch {
+		case c == '"':
+			return value.String(), nil
+		case c == '\\' && !s.done():
+			value.WriteByte(s.input[s.pos])
+			s.pos++
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted value")
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"time"
+)
+
+// Timestamps ListOffsets asks for that stand for a position in the log
+// rather than a time
+const (
+	LATEST_TIMESTAMP         int64 = -1
+	EARLIEST_TIMESTAMP       int64 = -2
+	MAX_TIMESTAMP            int64 = -3
+	EARLIEST_LOCAL_TIMESTAMP int64 = -4
+	LATEST_TIERED_TIMESTAMP  int64 = -5
+)
+
+// Response
+type ListOffsetsResponse struct {
+	version      int16
+	throttleTime int32
+	topics       []ListOffsetsResponseTopic
+	tagBuffer    byte
+}
+
+type ListOffsetsResponseTopic struct {
+	version    int16
+	name       string
+	partitions []ListOffsetsResponsePartition
+	tagBuffer  byte
+}
+
+type ListOffsetsResponsePartition struct {
+	version        int16
+	partitionIndex int32
+	errorCode      ErrorCode
+	timestamp      int64
+	offset         int64
+	leaderEpoch    int32
+	tagBuffer      byte
+}
+
+func (r ListOffsetsResponse) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(LIST_OFFSETS, r.version)
+
+	if r.version >= 2 {
+		res = binary.BigEndian.AppendUint32(res, uint32(r.throttleTime))
+	}
+
+	topics := make([]SerializableElement, len(r.topics))
+	for i, v := range r.topics {
+		topics[i] = v
+	}
+	res = append(res, encodeCustomArray(topics, flexible)...)
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (r ListOffsetsResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
+
+func (r ListOffsetsResponse) errorCounts() map[ErrorCode]int {
+	counts := map[ErrorCode]int{}
+	for _, topic := range r.topics {
+		for _, partition := range topic.partitions {
+			counts[partition.errorCode]++
+		}
+	}
+	return counts
+}
+
+func (t ListOffsetsResponseTopic) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(LIST_OFFSETS, t.version)
+
+	res = appendString(res, t.name, flexible)
+
+	partitions := make([]SerializableElement, len(t.partitions))
+	for i, v := range t.partitions {
+		partitions[i] = v
+	}
+	res = append(res, encodeCustomArray(partitions, flexible)...)
+
+	if flexible {
+		res = append(res, t.tagBuffer)
+	}
+	return res
+}
+
+func (p ListOffsetsResponsePartition) serialize() []byte {
+	res := []byte{}
+
+	res = binary.BigEndian.AppendUint32(res, uint32(p.partitionIndex))
+	res = binary.BigEndian.AppendUint16(res, uint16(p.errorCode))
+	res = binary.BigEndian.AppendUint64(res, uint64(p.timestamp))
+	res = binary.BigEndian.AppendUint64(res, uint64(p.offset))
+	if p.version >= 4 {
+		res = binary.BigEndian.AppendUint32(res, uint32(p.leaderEpoch))
+	}
+
+	if isFlexibleVersion(LIST_OFFSETS, p.version) {
+		res = append(res, p.tagBuffer)
+	}
+	return res
+}
+
+func (b *Broker) buildListOffsetsResponse(req RequestMessage) ListOffsetsResponse {
+	reqBody := req.body.(*ListOffsetsRequest)
+	res := ListOffsetsResponse{
+		version: reqBody.version,
+		topics:  []ListOffsetsResponseTopic{},
+	}
+
+	for _, topic := range reqBody.topics {
+		foundTopic := b.metadata.getTopicByName(topic.name)
+		err := foundTopic.errorCode
+		if !b.authorize(req.context, OPERATION_DESCRIBE, RESOURCE_TOPIC, topic.name) {
+			err = ERR_TOPIC_AUTHORIZATION_FAILED
+		}
+
+		responseTopic := ListOffsetsResponseTopic{
+			version:    reqBody.version,
+			name:       topic.name,
+			partitions: []ListOffsetsResponsePartition{},
+		}
+		for _, partition := range topic.partitions {
+			responsePartition := ListOffsetsResponsePartition{
+				version:        reqBody.version,
+				partitionIndex: partition.partitionIndex,
+				errorCode:      err,
+				timestamp:      -1,
+				offset:         -1,
+				leaderEpoch:    -1,
+			}
+			if err == ERR_NONE {
+				record, ok := b.metadata.getPartition(foundTopic.topicID, partition.partitionIndex)
+				if ok {
+					span := req.span.startChild("log.list_offset", time.Now(), partitionAttributes(topic.name, partition.partitionIndex)...)
+					responsePartition.errorCode = b.listOffset(&responsePartition, topic.name, partition.timestamp, record.leaderEpoch)
+					span.setErrorCode(responsePartition.errorCode)
+					span.finish()
+				} else {
+					responsePartition.errorCode = ERR_UNKNOWN_TOPIC_OR_PARTITION
+				}
+			}
+			responseTopic.partitions = append(responseTopic.partitions, responsePartition)
+		}
+		res.topics = append(res.topics, responseTopic)
+	}
+
+	return res
+}
+
+// Find the offset for a timestamp, or for one of the special timestamps. A
+// partition without a log on this broker is empty. Timestamps no record
+// reaches get -1 for both the timestamp and the offset.
+func (b *Broker) listOffset(res *ListOffsetsResponsePartition, topicName string, timestamp int64, leaderEpoch int32) ErrorCode {
+	l := b.partitionLog(topicName, res.partitionIndex)
+	startOffset, highWatermark := int64(0), int64(0)
+	if l != nil {
+		startOffset, highWatermark = l.StartOffset(), l.HighWatermark()
+	}
+
+	switch timestamp {
+	case EARLIEST_TIMESTAMP, EARLIEST_LOCAL_TIMESTAMP:
+		res.offset, res.leaderEpoch = startOffset, leaderEpoch
+	case LATEST_TIMESTAMP:
+		// Without transactions, the last stable offset is the high
+		// watermark whatever the isolation level
+		res.offset, res.leaderEpoch = highWatermark, leaderEpoch
+	case LATEST_TIERED_TIMESTAMP:
+		// Nothing is moved to remote storage
+	case MAX_TIMESTAMP:
+		if l == nil {
+			break
+		}
+		if found, ok := l.MaxTimestamp(); ok {
+			res.timestamp, res.offset, res.leaderEpoch = found.Timestamp, found.Offset, leaderEpoch
+		}
+	default:
+		if l == nil {
+			break
+		}
+		found, ok, err := l.OffsetForTimestamp(timestamp)
+		if err != nil {
+			slog.Error("Failed to look up timestamp", "topic", topicName, "partition", res.partitionIndex, "timestamp", timestamp, "error", err)
+			return ERR_KAFKA_STORAGE_ERROR
+		}
+		if ok {
+			res.timestamp, res.offset, res.leaderEpoch = found.Timestamp, found.Offset, leaderEpoch
+		}
+	}
+	return ERR_NONE
+}
+
+// ListOffsets has no top-level error code, so every requested partition
+// gets the error
+func buildListOffsetsErrorResponse(req RequestMessage, errorCode ErrorCode) ListOffsetsResponse {
+	supported, _ := getSupportedApiVersion(LIST_OFFSETS)
+	version := min(req.header.requestApiVersion, supported.MaxVersion)
+	res := ListOffsetsResponse{version: version, topics: []ListOffsetsResponseTopic{}}
+
+	reqBody := &ListOffsetsRequest{version: version}
+	if !tryDeserialize(reqBody, req.rawBody) {
+		reqBody.topics = nil
+	}
+
+	for _, topic := range reqBody.topics {
+		responseTopic := ListOffsetsResponseTopic{version: version, name: topic.name}
+		for _, partition := range topic.partitions {
+			responseTopic.partitions = append(responseTopic.partitions, ListOffsetsResponsePartition{
+				version:        version,
+				partitionIndex: partition.partitionIndex,
+				errorCode:      errorCode,
+				timestamp:      -1,
+				offset:         -1,
+				leaderEpoch:    -1,
+			})
+		}
+		res.topics = append(res.topics, responseTopic)
+	}
+	return res
+}
+
+// Request
+type ListOffsetsRequest struct {
+	version        int16
+	replicaID      int32
+	isolationLevel int8
+	topics         []ListOffsetsRequestTopic
+}
+
+type ListOffsetsRequestTopic struct {
+	version    int16
+	name       string
+	partitions []ListOffsetsRequestPartition
+}
+
+type ListOffsetsRequestPartition struct {
+	version            int16
+	partitionIndex     int32
+	currentLeaderEpoch int32
+	timestamp          int64
+}
+
+func (r *ListOffsetsRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+	flexible := isFlexibleVersion(LIST_OFFSETS, r.version)
+
+	err := binary.Read(buf, binary.BigEndian, &r.replicaID)
+	checkError(err)
+
+	if r.version >= 2 {
+		err = binary.Read(buf, binary.BigEndian, &r.isolationLevel)
+		checkError(err)
+	}
+
+	topics := readCustomArray(buf, flexible, func() CompactArrayElement {
+		return &ListOffsetsRequestTopic{version: r.version}
+	})
+	for _, elem := range topics {
+		if topic, ok := elem.(*ListOffsetsRequestTopic); ok {
+			r.topics = append(r.topics, *topic)
+		}
+	}
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
+
+func (t *ListOffsetsRequestTopic) deserialize(buf *bytes.Buffer) {
+	flexible := isFlexibleVersion(LIST_OFFSETS, t.version)
+
+	t.name = readString(buf, flexible)
+
+	partitions := readCustomArray(buf, flexible, func() CompactArrayElement {
+		return &ListOffsetsRequestPartition{version: t.version}
+	})
+	for _, elem := range partitions {
+		if partition, ok := elem.(*ListOffsetsRequestPartition); ok {
+			t.partitions = append(t.partitions, *partition)
+		}
+	}
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
+
+func (p *ListOffsetsRequestPartition) deserialize(buf *bytes.Buffer) {
+	err := binary.Read(buf, binary.BigEndian, &p.partitionIndex)
+	checkError(err)
+
+	p.currentLeaderEpoch = -1
+	if p.version >= 4 {
+		err = binary.Read(buf, binary.BigEndian, &p.currentLeaderEpoch)
+		checkError(err)
+	}
+
+	err = binary.Read(buf, binary.BigEndian, &p.timestamp)
+	checkError(err)
+
+	if isFlexibleVersion(LIST_OFFSETS, p.version) {
+		skipTaggedFields(buf)
+	}
+}
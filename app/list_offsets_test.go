@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
+)
+
+func topicConfigRecord(topic string, name string, value string) []byte {
+	record := []byte{1, byte(CONFIG_RECORD), 0, byte(CONFIG_RESOURCE_TOPIC)}
+	record = append(record, encodeCompactString(topic)...)
+	record = append(record, encodeCompactString(name)...)
+	record = append(record, encodeCompactString(value)...)
+	return append(record, 0)
+}
+
+// Send a v7 ListOffsets request for partition 0 of alpha
+func listOffsets(t *testing.T, client io.ReadWriter, timestamp int64) (errorCode ErrorCode, foundTimestamp int64, offset int64) {
+	t.Helper()
+
+	body := binary.BigEndian.AppendUint32(nil, 0xffffffff) // replica ID
+	body = append(body, 0)                                 // isolation level
+	body = appendArrayLength(body, 1, true)
+	body = appendString(body, "alpha", true)
+	body = appendArrayLength(body, 1, true)
+	body = binary.BigEndian.AppendUint32(body, 0)
+	body = binary.BigEndian.AppendUint32(body, 0xffffffff) // current leader epoch
+	body = binary.BigEndian.AppendUint64(body, uint64(timestamp))
+	body = append(body, 0, 0, 0)
+
+	response, err := sendTestRequest(client, LIST_OFFSETS, 7, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(response[4:])
+	readArrayLength(buf, true)
+	readString(buf, true)
+	readArrayLength(buf, true)
+	buf.Next(4)
+	errorCode = ErrorCode(binary.BigEndian.Uint16(buf.Next(2)))
+	foundTimestamp = int64(binary.BigEndian.Uint64(buf.Next(8)))
+	offset = int64(binary.BigEndian.Uint64(buf.Next(8)))
+	return errorCode, foundTimestamp, offset
+}
+
+// A v16 Fetch request for partition 0 of topicID
+func fetchRequestBody(topicID UUID, fetchOffset int64) []byte {
+	body := binary.BigEndian.AppendUint32(nil, 0) // max wait
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, 1<<20)
+	body = append(body, 0)
+	body = binary.BigEndian.AppendUint32(body, 0) // session ID
+	body = binary.BigEndian.AppendUint32(body, 0) // session epoch
+	body = appendArrayLength(body, 1, true)
+	body = append(body, topicID[:]...)
+	body = appendArrayLength(body, 1, true)
+	body = binary.BigEndian.AppendUint32(body, 0)
+	body = binary.BigEndian.AppendUint32(body, 0) // current leader epoch
+	body = binary.BigEndian.AppendUint64(body, uint64(fetchOffset))
+	body = binary.BigEndian.AppendUint32(body, 0)     // last fetched epoch
+	body = binary.BigEndian.AppendUint64(body, 0)     // log start offset
+	body = binary.BigEndian.AppendUint32(body, 1<<20) // partition max bytes
+	return append(body, 0, 0, 1, 1, 0)                // tag buffers, forgotten topics, rack ID
+}
+
+// Send a v16 Fetch request for partition 0 of topicID. Returns the base
+// offset of the first batch, or -1 if there is none.
+func fetchPartition(t *testing.T, client io.ReadWriter, topicID UUID, fetchOffset int64) (errorCode ErrorCode, logStartOffset int64, firstOffset int64) {
+	t.Helper()
+
+	response, err := sendTestRequest(client, FETCH, 16, fetchRequestBody(topicID, fetchOffset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(response[4+2+4:])
+	readArrayLength(buf, true)
+	buf.Next(16)
+	readArrayLength(buf, true)
+	buf.Next(4)
+	errorCode = ErrorCode(binary.BigEndian.Uint16(buf.Next(2)))
+	buf.Next(8 + 8) // high watermark, last stable offset
+	logStartOffset = int64(binary.BigEndian.Uint64(buf.Next(8)))
+	readArrayLength(buf, true)
+	buf.Next(4) // preferred read replica
+	records := readBytes(buf, true)
+	if len(records) < 8 {
+		return errorCode, logStartOffset, -1
+	}
+	return errorCode, logStartOffset, int64(binary.BigEndian.Uint64(records))
+}
+
+func Test_ListOffsets_retention(t *testing.T) {
+	// Two batches per segment
+	broker := newTestBroker(t, map[string]string{"log.segment.bytes": "200"})
+	alpha := UUID{1}
+	writeMetadataRecords(t, broker, topicRecord("alpha", alpha), partitionRecord(alpha, 0))
+	if err := broker.loadLogs(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.shutdown(time.Second) })
+
+	// Offsets 0 to 4, a second apart
+	l, err := broker.logs[0].GetOrCreateLog(log.TopicPartition{Topic: "alpha", Partition: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour).UnixMilli()
+	for i := range 5 {
+		if _, err := l.Append(encodeRecordBatch(0, start+int64(i)*1000, [][]byte{[]byte("hello")}), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConnection(broker, "PLAINTEXT", server).serve()
+
+	tests := []struct {
+		name          string
+		timestamp     int64
+		wantTimestamp int64
+		wantOffset    int64
+	}{
+		{"earliest", EARLIEST_TIMESTAMP, -1, 0},
+		{"latest", LATEST_TIMESTAMP, -1, 5},
+		{"max timestamp", MAX_TIMESTAMP, start + 4000, 4},
+		{"by timestamp", start + 1500, start + 2000, 2},
+		{"after every record", start + 5000, -1, -1},
+	}
+	for _, tt := range tests {
+		errorCode, timestamp, offset := listOffsets(t, client, tt.timestamp)
+		if errorCode != ERR_NONE || timestamp != tt.wantTimestamp || offset != tt.wantOffset {
+			t.Errorf("ListOffsets() %s = %v, %d, %d, want %v, %d, %d", tt.name, errorCode, timestamp, offset, ERR_NONE, tt.wantTimestamp, tt.wantOffset)
+		}
+	}
+
+	// The first segment has to go for the log to fit in 200 bytes
+	writeMetadataRecords(t, broker, topicConfigRecord("alpha", "retention.bytes", "200"))
+	broker.deleteOldSegments()
+	if l.StartOffset() != 2 {
+		t.Fatalf("StartOffset() after retention = %d, want 2", l.StartOffset())
+	}
+
+	if errorCode, _, offset := listOffsets(t, client, EARLIEST_TIMESTAMP); errorCode != ERR_NONE || offset != 2 {
+		t.Errorf("ListOffsets() earliest after retention = %v, %d, want %v, 2", errorCode, offset, ERR_NONE)
+	}
+	if errorCode, _, offset := listOffsets(t, client, start); errorCode != ERR_NONE || offset != 2 {
+		t.Errorf("ListOffsets() of a deleted timestamp = %v, %d, want %v, 2", errorCode, offset, ERR_NONE)
+	}
+	if errorCode, logStartOffset, _ := fetchPartition(t, client, alpha, 0); errorCode != ERR_OFFSET_OUT_OF_RANGE || logStartOffset != 2 {
+		t.Errorf("Fetch() of a deleted offset = %v, log start offset %d, want %v, 2", errorCode, logStartOffset, ERR_OFFSET_OUT_OF_RANGE)
+	}
+	if errorCode, logStartOffset, firstOffset := fetchPartition(t, client, alpha, 2); errorCode != ERR_NONE || logStartOffset != 2 || firstOffset != 2 {
+		t.Errorf("Fetch() from the log start offset = %v, %d, first batch %d, want %v, 2, 2", errorCode, logStartOffset, firstOffset, ERR_NONE)
+	}
+}
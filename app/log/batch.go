@@ -0,0 +1,391 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+// Where the fields of a v2 record batch start
+const (
+	BASE_OFFSET_OFFSET            = 0
+	LENGTH_OFFSET                 = 8
+	PARTITION_LEADER_EPOCH_OFFSET = 12
+	MAGIC_OFFSET                  = 16
+	CRC_OFFSET                    = 17
+	ATTRIBUTES_OFFSET             = 21
+	LAST_OFFSET_DELTA_OFFSET      = 23
+	BASE_TIMESTAMP_OFFSET         = 27
+	MAX_TIMESTAMP_OFFSET          = 35
+	PRODUCER_ID_OFFSET            = 43
+	PRODUCER_EPOCH_OFFSET         = 51
+	BASE_SEQUENCE_OFFSET          = 53
+	RECORDS_COUNT_OFFSET          = 57
+	// Size of the header, records follow it
+	RECORD_BATCH_OVERHEAD = 61
+	// Base offset and length, which every message format starts with
+	LOG_OVERHEAD = 12
+)
+
+// The only message format we write
+const CURRENT_MAGIC = 2
+
+const (
+	// Bits of the attributes
+	COMPRESSION_CODEC_MASK = 0x07
+	TIMESTAMP_TYPE_MASK    = 0x08
+	TRANSACTIONAL_FLAG     = 0x10
+	CONTROL_FLAG           = 0x20
+	// Timestamp of a record without one
+	NO_TIMESTAMP = -1
+)
+
+// Compression codecs. Snappy, LZ4 and ZSTD batches are stored and served
+// as they are, but their records can't be read.
+const (
+	COMPRESSION_NONE = 0
+	COMPRESSION_GZIP = 1
+)
+
+var (
+	ErrCorruptRecord      = errors.New("record batch is corrupt")
+	ErrUnsupportedVersion = errors.New("record batch uses an unsupported message format")
+)
+
+var ErrUnsupportedCompression = errors.New("record batch uses an unsupported compression codec")
+
+// A record of a batch, as much of it as the log looks at
+type Record struct {
+	Offset    int64
+	Timestamp int64
+	// nil for records without a key
+	Key []byte
+	// nil for tombstones
+	Value []byte
+	// The record as encoded in its batch, length included
+	raw []byte
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// One whole record batch, header included, as found in a segment
+type RecordBatch []byte
+
+func (b RecordBatch) BaseOffset() int64 {
+	return int64(binary.BigEndian.Uint64(b[BASE_OFFSET_OFFSET:]))
+}
+
+func (b RecordBatch) LastOffset() int64 {
+	return b.BaseOffset() + int64(b.LastOffsetDelta())
+}
+
+func (b RecordBatch) LastOffsetDelta() int32 {
+	return int32(binary.BigEndian.Uint32(b[LAST_OFFSET_DELTA_OFFSET:]))
+}
+
+func (b RecordBatch) PartitionLeaderEpoch() int32 {
+	return int32(binary.BigEndian.Uint32(b[PARTITION_LEADER_EPOCH_OFFSET:]))
+}
+
+func (b RecordBatch) Magic() int8 {
+	return int8(b[MAGIC_OFFSET])
+}
+
+func (b RecordBatch) BaseTimestamp() int64 {
+	return int64(binary.BigEndian.Uint64(b[BASE_TIMESTAMP_OFFSET:]))
+}
+
+func (b RecordBatch) MaxTimestamp() int64 {
+	return int64(binary.BigEndian.Uint64(b[MAX_TIMESTAMP_OFFSET:]))
+}
+
+func (b RecordBatch) RecordsCount() int32 {
+	return int32(binary.BigEndian.Uint32(b[RECORDS_COUNT_OFFSET:]))
+}
+
+func (b RecordBatch) Attributes() int16 {
+	return int16(binary.BigEndian.Uint16(b[ATTRIBUTES_OFFSET:]))
+}
+
+func (b RecordBatch) ProducerID() int64 {
+	return int64(binary.BigEndian.Uint64(b[PRODUCER_ID_OFFSET:]))
+}
+
+func (b RecordBatch) compression() int {
+	return int(b.Attributes() & COMPRESSION_CODEC_MASK)
+}
+
+// Control batches hold transaction markers rather than records
+func (b RecordBatch) isControl() bool {
+	return b.Attributes()&CONTROL_FLAG != 0
+}
+
+func (b RecordBatch) isTransactional() bool {
+	return b.Attributes()&TRANSACTIONAL_FLAG != 0
+}
+
+// Whether the records' own timestamps can be read. Those of batches
+// stamped with the log append time don't matter.
+func (b RecordBatch) hasRecordTimestamps() bool {
+	compression := b.compression()
+	return b.Attributes()&TIMESTAMP_TYPE_MASK == 0 && (compression == COMPRESSION_NONE || compression == COMPRESSION_GZIP)
+}
+
+// Timestamp and offset of each record. Batches without record timestamps
+// have a single entry: their max timestamp and base offset.
+func (b RecordBatch) recordTimestamps() ([]TimestampAndOffset, error) {
+	if !b.hasRecordTimestamps() {
+		return []TimestampAndOffset{{Timestamp: b.MaxTimestamp(), Offset: b.BaseOffset()}}, nil
+	}
+	records, err := b.Records()
+	if err != nil {
+		return nil, err
+	}
+	timestamps := make([]TimestampAndOffset, len(records))
+	for i, record := range records {
+		timestamps[i] = TimestampAndOffset{Timestamp: record.Timestamp, Offset: record.Offset}
+	}
+	return timestamps, nil
+}
+
+// The records of the batch, decompressed
+func (b RecordBatch) Records() ([]Record, error) {
+	data, err := b.recordsData()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]Record, 0, max(0, b.RecordsCount()))
+	for range b.RecordsCount() {
+		record, err := b.readRecord(data)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		data = data[len(record.raw):]
+	}
+	return records, nil
+}
+
+func (b RecordBatch) recordsData() ([]byte, error) {
+	switch b.compression() {
+	case COMPRESSION_NONE:
+		return b[RECORD_BATCH_OVERHEAD:], nil
+	case COMPRESSION_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(b[RECORD_BATCH_OVERHEAD:]))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptRecord, err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptRecord, err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("%w: codec %d", ErrUnsupportedCompression, b.compression())
+	}
+}
+
+// Read the record data starts with:
+//
+//	length, attributes, timestamp delta, offset delta, key, value, headers
+//
+// with every length and delta a varint
+func (b RecordBatch) readRecord(data []byte) (Record, error) {
+	length, n := binary.Varint(data)
+	if n <= 0 || length < 1 || int64(len(data)-n) < length {
+		return Record{}, fmt.Errorf("%w: record cut short", ErrCorruptRecord)
+	}
+	record := Record{raw: data[:n+int(length)]}
+	fields := data[n+1 : n+int(length)]
+
+	timestampDelta, fields, ok := readVarint(fields)
+	offsetDelta, fields, ok2 := readVarint(fields)
+	key, fields, ok3 := readVarBytes(fields)
+	value, _, ok4 := readVarBytes(fields)
+	if !ok || !ok2 || !ok3 || !ok4 {
+		return Record{}, fmt.Errorf("%w: malformed record", ErrCorruptRecord)
+	}
+	record.Timestamp = b.BaseTimestamp() + timestampDelta
+	record.Offset = b.BaseOffset() + offsetDelta
+	record.Key, record.Value = key, value
+	return record, nil
+}
+
+func readVarint(data []byte) (int64, []byte, bool) {
+	v, n := binary.Varint(data)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return v, data[n:], true
+}
+
+// Bytes prefixed with their varint length, -1 for null
+func readVarBytes(data []byte) ([]byte, []byte, bool) {
+	length, data, ok := readVarint(data)
+	if !ok || length < -1 || length > int64(len(data)) {
+		return nil, nil, false
+	}
+	if length < 0 {
+		return nil, data, true
+	}
+	return data[:length], data[length:], true
+}
+
+// A copy of the batch holding only records, which must be some of its own.
+// Offsets, the base timestamp and the producer fields stay as they were,
+// so the records are copied as they are. The max timestamp becomes that of
+// the records kept.
+func (b RecordBatch) withRecords(records []Record) (RecordBatch, error) {
+	data := []byte{}
+	maxTimestamp := int64(NO_TIMESTAMP)
+	for _, record := range records {
+		data = append(data, record.raw...)
+		maxTimestamp = max(maxTimestamp, record.Timestamp)
+	}
+	if b.Attributes()&TIMESTAMP_TYPE_MASK != 0 {
+		maxTimestamp = b.MaxTimestamp()
+	}
+
+	if b.compression() == COMPRESSION_GZIP {
+		var compressed bytes.Buffer
+		w := gzip.NewWriter(&compressed)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		data = compressed.Bytes()
+	}
+
+	batch := append(slices.Clone(b[:RECORD_BATCH_OVERHEAD]), data...)
+	binary.BigEndian.PutUint32(batch[RECORDS_COUNT_OFFSET:], uint32(len(records)))
+	binary.BigEndian.PutUint64(batch[MAX_TIMESTAMP_OFFSET:], uint64(maxTimestamp))
+	batch.seal()
+	return batch, nil
+}
+
+// Set the length and CRC once everything else is written
+func (b RecordBatch) seal() {
+	binary.BigEndian.PutUint32(b[LENGTH_OFFSET:], uint32(len(b)-LOG_OVERHEAD))
+	binary.BigEndian.PutUint32(b[CRC_OFFSET:], crc32.Checksum(b[ATTRIBUTES_OFFSET:], crc32c))
+}
+
+// Encode an uncompressed v2 batch of records, without a producer and
+// stamped with their create time. Offsets and timestamps are taken from
+// the records, the first one's being the batch's base.
+func EncodeRecordBatch(records []Record) RecordBatch {
+	baseOffset, baseTimestamp := records[0].Offset, records[0].Timestamp
+	maxTimestamp := baseTimestamp
+
+	batch := make(RecordBatch, RECORD_BATCH_OVERHEAD)
+	for _, record := range records {
+		encoded := []byte{0} // attributes
+		encoded = binary.AppendVarint(encoded, record.Timestamp-baseTimestamp)
+		encoded = binary.AppendVarint(encoded, record.Offset-baseOffset)
+		encoded = appendVarBytes(encoded, record.Key)
+		encoded = appendVarBytes(encoded, record.Value)
+		encoded = binary.AppendUvarint(encoded, 0) // headers
+		batch = binary.AppendVarint(batch, int64(len(encoded)))
+		batch = append(batch, encoded...)
+		maxTimestamp = max(maxTimestamp, record.Timestamp)
+	}
+
+	batch.setBaseOffset(baseOffset)
+	batch[MAGIC_OFFSET] = CURRENT_MAGIC
+	binary.BigEndian.PutUint32(batch[LAST_OFFSET_DELTA_OFFSET:], uint32(records[len(records)-1].Offset-baseOffset))
+	binary.BigEndian.PutUint64(batch[BASE_TIMESTAMP_OFFSET:], uint64(baseTimestamp))
+	binary.BigEndian.PutUint64(batch[MAX_TIMESTAMP_OFFSET:], uint64(maxTimestamp))
+	binary.BigEndian.PutUint64(batch[PRODUCER_ID_OFFSET:], 0xffffffffffffffff)
+	binary.BigEndian.PutUint16(batch[PRODUCER_EPOCH_OFFSET:], 0xffff)
+	binary.BigEndian.PutUint32(batch[BASE_SEQUENCE_OFFSET:], 0xffffffff)
+	binary.BigEndian.PutUint32(batch[RECORDS_COUNT_OFFSET:], uint32(len(records)))
+	batch.seal()
+	return batch
+}
+
+func appendVarBytes(b []byte, data []byte) []byte {
+	if data == nil {
+		return binary.AppendVarint(b, -1)
+	}
+	b = binary.AppendVarint(b, int64(len(data)))
+	return append(b, data...)
+}
+
+// The offset fields aren't covered by the CRC, so they can be set without
+// recomputing it
+func (b RecordBatch) setBaseOffset(offset int64) {
+	binary.BigEndian.PutUint64(b[BASE_OFFSET_OFFSET:], uint64(offset))
+}
+
+func (b RecordBatch) setPartitionLeaderEpoch(epoch int32) {
+	binary.BigEndian.PutUint32(b[PARTITION_LEADER_EPOCH_OFFSET:], uint32(epoch))
+}
+
+// Check the header and the CRC, which covers everything from the
+// attributes onwards
+func (b RecordBatch) validate() error {
+	if len(b) < RECORD_BATCH_OVERHEAD {
+		return fmt.Errorf("%w: batch of %d bytes is smaller than its header", ErrCorruptRecord, len(b))
+	}
+	if b.Magic() != CURRENT_MAGIC {
+		return fmt.Errorf("%w: magic %d", ErrUnsupportedVersion, b.Magic())
+	}
+	if crc := binary.BigEndian.Uint32(b[CRC_OFFSET:]); crc != crc32.Checksum(b[ATTRIBUTES_OFFSET:], crc32c) {
+		return fmt.Errorf("%w: CRC mismatch", ErrCorruptRecord)
+	}
+	if b.LastOffsetDelta() < 0 || b.RecordsCount() < 0 {
+		return fmt.Errorf("%w: negative record count", ErrCorruptRecord)
+	}
+	return nil
+}
+
+// Size of the batch that starts the header, or an error if the header is
+// cut short or makes no sense
+func batchSize(header []byte) (int, error) {
+	if len(header) < LOG_OVERHEAD {
+		return 0, fmt.Errorf("%w: batch header cut short", ErrCorruptRecord)
+	}
+	length := int32(binary.BigEndian.Uint32(header[LENGTH_OFFSET:]))
+	if length < RECORD_BATCH_OVERHEAD-LOG_OVERHEAD {
+		return 0, fmt.Errorf("%w: batch length %d", ErrCorruptRecord, length)
+	}
+	return LOG_OVERHEAD + int(length), nil
+}
+
+// Split records into batches. Every byte must belong to a whole batch.
+func splitBatches(records []byte) ([]RecordBatch, error) {
+	batches := []RecordBatch{}
+	for pos := 0; pos < len(records); {
+		size, err := batchSize(records[pos:])
+		if err != nil {
+			return nil, err
+		}
+		if pos+size > len(records) {
+			return nil, fmt.Errorf("%w: batch of %d bytes cut short at %d", ErrCorruptRecord, size, len(records)-pos)
+		}
+		batches = append(batches, RecordBatch(records[pos:pos+size]))
+		pos += size
+	}
+	return batches, nil
+}
+
+// Length of the whole, valid batches records starts with. Whatever follows
+// was torn by a crash or is corrupt.
+func ValidBytes(records []byte) int {
+	pos := 0
+	for pos < len(records) {
+		size, err := batchSize(records[pos:])
+		if err != nil || pos+size > len(records) || RecordBatch(records[pos:pos+size]).validate() != nil {
+			break
+		}
+		pos += size
+	}
+	return pos
+}
@@ -0,0 +1,343 @@
+package log
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// A cleaned segment while it's being written, and once it is complete
+	// but hasn't replaced the segments it was cleaned from yet
+	CLEANED_FILE_SUFFIX = ".cleaned"
+	SWAP_FILE_SUFFIX    = ".swap"
+)
+
+const (
+	CLEANUP_POLICY_DELETE  = "delete"
+	CLEANUP_POLICY_COMPACT = "compact"
+)
+
+// What a compaction did
+type CleanerStats struct {
+	SegmentsCleaned int
+	BytesRead       int64
+	BytesWritten    int64
+	RecordsRemoved  int
+}
+
+func (c Config) hasCleanupPolicy(policy string) bool {
+	if c.CleanupPolicy == "" {
+		return policy == CLEANUP_POLICY_DELETE
+	}
+	for _, p := range strings.Split(c.CleanupPolicy, ",") {
+		if strings.TrimSpace(p) == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Compact the log if its cleanup policy says so. Of the records before the
+// first uncleanable offset, only the latest one of each key is kept, and
+// tombstones only until delete.retention.ms has passed since they were
+// written. Records without a key are dropped. Appends and reads wait for
+// the compaction to finish.
+func (l *Log) Compact() (CleanerStats, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := CleanerStats{}
+	if !l.config.hasCleanupPolicy(CLEANUP_POLICY_COMPACT) {
+		return stats, nil
+	}
+	now := l.now().UnixMilli()
+
+	// The active segment is never cleaned, nor are segments holding
+	// records younger than min.compaction.lag.ms
+	uncleanable := len(l.segments) - 1
+	for i, segment := range l.segments[:uncleanable] {
+		largestTimestamp, err := segment.largestTimestamp()
+		if err != nil {
+			return stats, err
+		}
+		if now-largestTimestamp < l.config.MinCompactionLagMs {
+			uncleanable = i
+			break
+		}
+	}
+	firstUncleanableOffset := l.segments[uncleanable].baseOffset
+	firstDirtyOffset := max(l.firstDirtyOffset, l.startOffset)
+	if firstDirtyOffset >= firstUncleanableOffset {
+		return stats, nil
+	}
+
+	offsets, err := buildOffsetMap(l.segments[:uncleanable+1], firstDirtyOffset, firstUncleanableOffset)
+	if err != nil {
+		return stats, err
+	}
+
+	cleaned := []*Segment{}
+	for _, group := range l.groupSegments(uncleanable) {
+		segment, err := l.cleanSegments(group, offsets, now, &stats)
+		if err != nil {
+			// The groups cleaned so far are already in place, the one that
+			// failed and the ones after it are still open
+			l.segments = append(cleaned, l.segments[stats.SegmentsCleaned:]...)
+			return stats, err
+		}
+		cleaned = append(cleaned, segment)
+		stats.SegmentsCleaned += len(group)
+	}
+	l.segments = append(cleaned, l.segments[uncleanable:]...)
+	l.firstDirtyOffset = firstUncleanableOffset
+	return stats, nil
+}
+
+// Where the cleaner will start next time: records before it have been
+// compacted
+func (l *Log) FirstDirtyOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.firstDirtyOffset
+}
+
+// The offset of the latest record of each key between from and to
+func buildOffsetMap(segments []*Segment, from int64, to int64) (map[string]int64, error) {
+	offsets := map[string]int64{}
+	for _, segment := range segments {
+		err := segment.forEachBatch(func(batch RecordBatch) error {
+			if batch.isControl() || batch.LastOffset() < from || batch.BaseOffset() >= to {
+				return nil
+			}
+			records, err := batch.Records()
+			if errors.Is(err, ErrUnsupportedCompression) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				if record.Key != nil && record.Offset >= from && record.Offset < to {
+					offsets[string(record.Key)] = record.Offset
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return offsets, nil
+}
+
+// Split the segments before the uncleanable one into runs that fit in a
+// single segment once cleaned, so that cleaning doesn't leave ever smaller
+// segments behind. Runs are sized by what the segments hold before
+// cleaning, so they always fit.
+func (l *Log) groupSegments(uncleanable int) [][]*Segment {
+	groups := [][]*Segment{}
+	for i := 0; i < uncleanable; {
+		group := []*Segment{l.segments[i]}
+		size := l.segments[i].size
+		for i++; i < uncleanable; i++ {
+			next := l.segments[i]
+			// The group would hold offsets up to the segment after next
+			lastOffset := l.segments[i+1].baseOffset - 1
+			if size+next.size > l.config.SegmentBytes || lastOffset-group[0].baseOffset > math.MaxInt32 {
+				break
+			}
+			group = append(group, next)
+			size += next.size
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// Write the records of group worth keeping to a new segment, then replace
+// the group with it. The new segment goes through a .swap file that Open
+// finishes swapping in if the broker dies halfway. The group is only
+// closed once the new segment is open, so on failure it stays readable
+// through its open files and the log can keep it.
+func (l *Log) cleanSegments(group []*Segment, offsets map[string]int64, now int64, stats *CleanerStats) (*Segment, error) {
+	baseOffset := group[0].baseOffset
+	cleanedPath := segmentPath(l.dir, baseOffset, LOG_FILE_SUFFIX+CLEANED_FILE_SUFFIX)
+	f, err := os.Create(cleanedPath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(cleanedPath)
+
+	for _, segment := range group {
+		stats.BytesRead += segment.size
+		err := segment.forEachBatch(func(batch RecordBatch) error {
+			kept, removed, err := l.cleanBatch(batch, offsets, now)
+			if err != nil {
+				return err
+			}
+			stats.RecordsRemoved += removed
+			stats.BytesWritten += int64(len(kept))
+			_, err = f.Write(kept)
+			return err
+		})
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := errors.Join(f.Sync(), f.Close()); err != nil {
+		return nil, err
+	}
+
+	swapPath := segmentPath(l.dir, baseOffset, LOG_FILE_SUFFIX+SWAP_FILE_SUFFIX)
+	if err := os.Rename(cleanedPath, swapPath); err != nil {
+		return nil, err
+	}
+	for _, segment := range group {
+		if err := segment.delete(l.dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Rename(swapPath, segmentPath(l.dir, baseOffset, LOG_FILE_SUFFIX)); err != nil {
+		return nil, err
+	}
+	replacement, err := openCleanedSegment(l.dir, baseOffset, l.config, l.now())
+	if err != nil {
+		// Indexes written halfway would be trusted after a clean shutdown,
+		// without them Open builds them again
+		for _, suffix := range []string{INDEX_FILE_SUFFIX, TIME_INDEX_FILE_SUFFIX} {
+			os.Remove(segmentPath(l.dir, baseOffset, suffix))
+		}
+		return nil, err
+	}
+	for _, segment := range group {
+		if err := segment.close(); err != nil {
+			slog.Warn("Failed to close cleaned segment", "segment", segment.baseOffset, "dir", l.dir, "error", err)
+		}
+	}
+	return replacement, nil
+}
+
+// The batch with only the records worth keeping, if any, and how many
+// records were removed. Control and transactional batches, and batches
+// whose records can't be read, are kept whole.
+func (l *Log) cleanBatch(batch RecordBatch, offsets map[string]int64, now int64) (RecordBatch, int, error) {
+	if batch.isControl() || batch.isTransactional() {
+		return batch, 0, nil
+	}
+	records, err := batch.Records()
+	if errors.Is(err, ErrUnsupportedCompression) {
+		return batch, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kept := []Record{}
+	for _, record := range records {
+		if record.Key == nil {
+			continue
+		}
+		if latest, ok := offsets[string(record.Key)]; ok && latest > record.Offset {
+			continue
+		}
+		// Tombstones stay long enough for consumers to see them
+		if record.Value == nil && now-batch.MaxTimestamp() > l.config.DeleteRetentionMs {
+			continue
+		}
+		kept = append(kept, record)
+	}
+
+	removed := len(records) - len(kept)
+	switch {
+	case removed == 0:
+		return batch, 0, nil
+	case len(kept) == 0:
+		return nil, removed, nil
+	}
+	cleaned, err := batch.withRecords(kept)
+	return cleaned, removed, err
+}
+
+// Open a segment the cleaner wrote, building its indexes
+func openCleanedSegment(dir string, baseOffset int64, config Config, now time.Time) (*Segment, error) {
+	segment, err := openSegment(dir, baseOffset, config, now)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := segment.recover(); err != nil {
+		segment.close()
+		return nil, err
+	}
+	if err := segment.onBecomeInactive(); err != nil {
+		segment.close()
+		return nil, err
+	}
+	return segment, nil
+}
+
+// Finish what a compaction interrupted by a crash left behind. Cleaned
+// files that weren't complete are dropped. Swap files were complete, so
+// the segments they replace are deleted and they take their place.
+func completeSwaps(dir string) error {
+	cleaned, err := filepath.Glob(filepath.Join(dir, "*"+CLEANED_FILE_SUFFIX))
+	if err != nil {
+		return err
+	}
+	for _, path := range cleaned {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	swaps, err := filepath.Glob(filepath.Join(dir, "*"+LOG_FILE_SUFFIX+SWAP_FILE_SUFFIX))
+	if err != nil {
+		return err
+	}
+	sort.Strings(swaps)
+	for _, swapPath := range swaps {
+		baseOffset, ok := parseSegmentPath(strings.TrimSuffix(swapPath, SWAP_FILE_SUFFIX), LOG_FILE_SUFFIX)
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(swapPath)
+		if err != nil {
+			return err
+		}
+		batches, err := splitBatches(data[:ValidBytes(data)])
+		if err != nil {
+			return err
+		}
+		lastOffset := baseOffset
+		if len(batches) > 0 {
+			lastOffset = batches[len(batches)-1].LastOffset()
+		}
+
+		paths, err := filepath.Glob(filepath.Join(dir, "*"+LOG_FILE_SUFFIX))
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			offset, ok := parseSegmentPath(path, LOG_FILE_SUFFIX)
+			if !ok || offset < baseOffset || offset > lastOffset {
+				continue
+			}
+			segment := &Segment{baseOffset: offset}
+			if err := segment.delete(dir); err != nil {
+				return err
+			}
+		}
+		// The indexes are rebuilt when the segment is opened
+		if err := os.Rename(swapPath, segmentPath(dir, baseOffset, LOG_FILE_SUFFIX)); err != nil {
+			return err
+		}
+		slog.Info("Swapped in cleaned segment", "segment", baseOffset, "dir", dir)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A batch of one record. An empty value makes a tombstone, an empty key a
+// record without one.
+func keyedBatch(key string, value string, timestamp int64) []byte {
+	record := Record{Timestamp: timestamp}
+	if key != "" {
+		record.Key = []byte(key)
+	}
+	if value != "" {
+		record.Value = []byte(value)
+	}
+	return EncodeRecordBatch([]Record{record})
+}
+
+// Every record of the log as offset:key=value
+func logRecords(t *testing.T, l *Log) []string {
+	t.Helper()
+	out := []string{}
+	for _, segment := range l.segments {
+		err := segment.forEachBatch(func(batch RecordBatch) error {
+			records, err := batch.Records()
+			for _, record := range records {
+				out = append(out, fmt.Sprintf("%d:%s=%s", record.Offset, record.Key, record.Value))
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out
+}
+
+func Test_Log_Compact(t *testing.T) {
+	batchSize := int64(len(keyedBatch("k1", "v1", 0)))
+	now := time.UnixMilli(1700000000000)
+
+	type record struct {
+		key, value string
+		age        time.Duration
+	}
+	tests := []struct {
+		name               string
+		policy             string
+		deleteRetentionMs  int64
+		minCompactionLagMs int64
+		// Two records per segment, the last segment is active
+		records []record
+		want    []string
+	}{
+		{
+			"delete policy", "delete", 0, 0,
+			[]record{{"k1", "v1", 0}, {"k1", "v2", 0}, {"k1", "v3", 0}},
+			[]string{"0:k1=v1", "1:k1=v2", "2:k1=v3"},
+		},
+		{
+			// Records in the active segment don't supersede anything yet
+			"latest per key", "compact", 0, 0,
+			[]record{{"k1", "v1", 0}, {"k2", "v1", 0}, {"k1", "v2", 0}, {"k3", "v1", 0}, {"k2", "v2", 0}, {"k1", "v3", 0}},
+			[]string{"1:k2=v1", "2:k1=v2", "3:k3=v1", "4:k2=v2", "5:k1=v3"},
+		},
+		{
+			"records without a key", "compact", 0, 0,
+			[]record{{"", "v1", 0}, {"k1", "v1", 0}, {"k1", "v2", 0}},
+			[]string{"1:k1=v1", "2:k1=v2"},
+		},
+		{
+			"tombstones within delete.retention.ms", "compact", 60 * 60 * 1000, 0,
+			[]record{{"k1", "v1", time.Minute}, {"k1", "", time.Minute}, {"k2", "v1", 0}},
+			[]string{"1:k1=", "2:k2=v1"},
+		},
+		{
+			"tombstones past delete.retention.ms", "compact", 60 * 60 * 1000, 0,
+			[]record{{"k1", "v1", 2 * time.Hour}, {"k1", "", 2 * time.Hour}, {"k2", "v1", 0}},
+			[]string{"2:k2=v1"},
+		},
+		{
+			// The second segment is too young, so is the active one after
+			"min.compaction.lag.ms", "compact", 0, 60 * 60 * 1000,
+			[]record{{"k1", "v1", 2 * time.Hour}, {"k1", "v2", 2 * time.Hour}, {"k1", "v3", time.Minute}, {"k1", "v4", 0}, {"k1", "v5", 0}},
+			[]string{"1:k1=v2", "2:k1=v3", "3:k1=v4", "4:k1=v5"},
+		},
+		{
+			"compact and delete", "compact,delete", 0, 0,
+			[]record{{"k1", "v1", 0}, {"k1", "v2", 0}, {"k1", "v3", 0}},
+			[]string{"1:k1=v2", "2:k1=v3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				SegmentBytes:       2 * batchSize,
+				SegmentMs:          DefaultConfig.SegmentMs,
+				IndexIntervalBytes: 4096,
+				MaxIndexSize:       1024,
+				RetentionMs:        -1,
+				RetentionBytes:     -1,
+				CleanupPolicy:      tt.policy,
+				DeleteRetentionMs:  tt.deleteRetentionMs,
+				MinCompactionLagMs: tt.minCompactionLagMs,
+			}
+			l := openTestLog(t, t.TempDir(), config)
+			l.now = func() time.Time { return now }
+			for _, record := range tt.records {
+				if _, err := l.Append(keyedBatch(record.key, record.value, now.Add(-record.age).UnixMilli()), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := l.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			if got := logRecords(t, l); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("records after Compact() = %v, want %v", got, tt.want)
+			}
+			if l.EndOffset() != int64(len(tt.records)) {
+				t.Errorf("EndOffset() = %d, want %d", l.EndOffset(), len(tt.records))
+			}
+
+			// A second run has nothing left to do
+			stats, err := l.Compact()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.RecordsRemoved != 0 {
+				t.Errorf("second Compact() removed %d records, want 0", stats.RecordsRemoved)
+			}
+		})
+	}
+}
+
+func Test_Log_completeSwaps(t *testing.T) {
+	dir := t.TempDir()
+	batchSize := int64(len(keyedBatch("k1", "v1", 0)))
+	config := DefaultConfig
+	config.SegmentBytes = 2 * batchSize
+	l := openTestLog(t, dir, config)
+	for i := range 6 {
+		if _, err := l.Append(keyedBatch("k1", fmt.Sprintf("v%d", i), 0), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash after the cleaned segment replacing the first two was
+	// complete, and while the next one was being written
+	swap := EncodeRecordBatch([]Record{{Offset: 3, Key: []byte("k1"), Value: []byte("v3")}})
+	if err := os.WriteFile(segmentPath(dir, 0, LOG_FILE_SUFFIX+SWAP_FILE_SUFFIX), swap, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(segmentPath(dir, 4, LOG_FILE_SUFFIX+CLEANED_FILE_SUFFIX), []byte("torn"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openTestLog(t, dir, config)
+	want := []string{"3:k1=v3", "4:k1=v4", "5:k1=v5"}
+	if got := logRecords(t, l); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after reopening = %v, want %v", got, want)
+	}
+	for _, path := range []string{
+		segmentPath(dir, 0, LOG_FILE_SUFFIX+SWAP_FILE_SUFFIX),
+		segmentPath(dir, 2, LOG_FILE_SUFFIX),
+		segmentPath(dir, 4, LOG_FILE_SUFFIX+CLEANED_FILE_SUFFIX),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists", path)
+		}
+	}
+}
+
+func Test_Log_Compact_failedSwap(t *testing.T) {
+	dir := t.TempDir()
+	batchSize := int64(len(keyedBatch("k1", "v1", 0)))
+	config := DefaultConfig
+	config.SegmentBytes = 2 * batchSize
+	config.CleanupPolicy = CLEANUP_POLICY_COMPACT
+	l := openTestLog(t, dir, config)
+	for i := range 3 {
+		if _, err := l.Append(keyedBatch("k1", fmt.Sprintf("v%d", i), time.Now().UnixMilli()), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first segment's files can't all be deleted
+	timeIndexPath := segmentPath(dir, 0, TIME_INDEX_FILE_SUFFIX)
+	if err := os.Remove(timeIndexPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(timeIndexPath, "blocker"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Compact(); err == nil {
+		t.Fatal("Compact() succeeded")
+	}
+
+	// The segment that failed to be replaced is still read and appended to
+	want := []string{"0:k1=v0", "1:k1=v1", "2:k1=v2"}
+	if got := logRecords(t, l); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after failed Compact() = %v, want %v", got, want)
+	}
+	read, err := l.Read(0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := l.ReadFile(0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer records.Close()
+	if got, err := records.Bytes(); err != nil || !bytes.Equal(got, read) {
+		t.Errorf("ReadFile() after failed Compact() = %d bytes, %v, want the %d bytes Read() returned", len(got), err, len(read))
+	}
+	if _, err := l.Append(keyedBatch("k1", "v3", time.Now().UnixMilli()), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next start finishes the swap
+	if err := os.RemoveAll(timeIndexPath); err != nil {
+		t.Fatal(err)
+	}
+	l = openTestLog(t, dir, config)
+	want = []string{"1:k1=v1", "2:k1=v2", "3:k1=v3"}
+	if got := logRecords(t, l); !reflect.DeepEqual(got, want) {
+		t.Errorf("records after reopening = %v, want %v", got, want)
+	}
+}
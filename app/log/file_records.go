@@ -0,0 +1,103 @@
+package log
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Whole record batches of a segment file, left on disk until they are
+// written out so that they can go to a socket with sendfile. The segment's
+// file descriptor is duplicated when the records are read, so they stay
+// readable if the segment is deleted or compacted in the meantime. They
+// must be closed once written.
+type FileRecords struct {
+	file     *os.File
+	position int64
+	size     int64
+}
+
+func newFileRecords(file *os.File, position int64, size int64) (*FileRecords, error) {
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		return nil, &os.PathError{Op: "dup", Path: file.Name(), Err: err}
+	}
+	return &FileRecords{file: os.NewFile(uintptr(fd), file.Name()), position: position, size: size}, nil
+}
+
+func (r *FileRecords) Len() int {
+	return int(r.size)
+}
+
+// Write the records to w. Sockets, like *net.TCPConn, get them with
+// sendfile.
+func (r *FileRecords) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	var err error
+	if conn, ok := w.(syscall.Conn); ok {
+		n, err = r.sendfile(conn)
+	} else {
+		n, err = io.Copy(w, io.NewSectionReader(r.file, r.position, r.size))
+	}
+	if err == nil && n < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// The file offset is shared with the segment and every other read of it,
+// so sendfile is given our own
+func (r *FileRecords) sendfile(conn syscall.Conn) (int64, error) {
+	dst, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	src, err := r.file.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	offset, end := r.position, r.position+r.size
+	var writeErr, sendErr error
+	err = src.Control(func(in uintptr) {
+		writeErr = dst.Write(func(out uintptr) bool {
+			for offset < end {
+				n, err := syscall.Sendfile(int(out), int(in), &offset, int(min(end-offset, 1<<30)))
+				switch {
+				case err == syscall.EINTR:
+					continue
+				case err == syscall.EAGAIN:
+					// Wait for the socket to drain
+					return false
+				case err != nil:
+					sendErr = os.NewSyscallError("sendfile", err)
+					return true
+				case n == 0:
+					// The file is shorter than the records
+					return true
+				}
+			}
+			return true
+		})
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = sendErr
+	}
+	return offset - r.position, err
+}
+
+// The records read into memory
+func (r *FileRecords) Bytes() ([]byte, error) {
+	data := make([]byte, r.size)
+	if _, err := r.file.ReadAt(data, r.position); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (r *FileRecords) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,177 @@
+package log
+
+import (
+	"encoding/binary"
+	"os"
+	"sort"
+)
+
+const (
+	// Relative offset and position
+	OFFSET_INDEX_ENTRY_SIZE = 8
+	// Timestamp and relative offset
+	TIME_INDEX_ENTRY_SIZE = 12
+)
+
+// Maps offsets to positions in the segment's .log file. Entries are
+// sparse: one every index.interval.bytes, for the last offset of the batch
+// starting at the position.
+type OffsetIndex struct {
+	file       *os.File
+	baseOffset int64
+	entries    []OffsetIndexEntry
+	maxEntries int
+}
+
+type OffsetIndexEntry struct {
+	offset   int64
+	position int64
+}
+
+// Maps timestamps to offsets. An entry is only added when the timestamp is
+// larger than any before it.
+type TimeIndex struct {
+	file       *os.File
+	baseOffset int64
+	entries    []TimeIndexEntry
+	maxEntries int
+}
+
+type TimeIndexEntry struct {
+	timestamp int64
+	offset    int64
+}
+
+// Open an index file, creating it if needed. Kafka preallocates index
+// files and fills the rest with zeros, which the first zero entry after
+// the start tells apart from real entries.
+func openIndexFile(path string, entrySize int, decode func(entry []byte)) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	n := 0
+	for ; (n+1)*entrySize <= len(data); n++ {
+		entry := data[n*entrySize : (n+1)*entrySize]
+		if n > 0 && isZero(entry) {
+			break
+		}
+		decode(entry)
+	}
+	// Appends go after the last real entry
+	if err := file.Truncate(int64(n * entrySize)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func openOffsetIndex(path string, baseOffset int64, maxIndexSize int) (*OffsetIndex, error) {
+	index := &OffsetIndex{baseOffset: baseOffset, maxEntries: maxIndexSize / OFFSET_INDEX_ENTRY_SIZE}
+	file, err := openIndexFile(path, OFFSET_INDEX_ENTRY_SIZE, func(entry []byte) {
+		index.entries = append(index.entries, OffsetIndexEntry{
+			offset:   baseOffset + int64(binary.BigEndian.Uint32(entry)),
+			position: int64(binary.BigEndian.Uint32(entry[4:])),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	index.file = file
+	return index, nil
+}
+
+func (i *OffsetIndex) append(offset int64, position int64) error {
+	if n := len(i.entries); n > 0 && offset <= i.entries[n-1].offset {
+		return nil
+	}
+	entry := binary.BigEndian.AppendUint32(nil, uint32(offset-i.baseOffset))
+	entry = binary.BigEndian.AppendUint32(entry, uint32(position))
+	if _, err := i.file.WriteAt(entry, int64(len(i.entries)*OFFSET_INDEX_ENTRY_SIZE)); err != nil {
+		return err
+	}
+	i.entries = append(i.entries, OffsetIndexEntry{offset: offset, position: position})
+	return nil
+}
+
+// The last entry for an offset at or before offset, or the start of the
+// segment if there is none
+func (i *OffsetIndex) lookup(offset int64) OffsetIndexEntry {
+	n := sort.Search(len(i.entries), func(j int) bool { return i.entries[j].offset > offset })
+	if n == 0 {
+		return OffsetIndexEntry{offset: i.baseOffset, position: 0}
+	}
+	return i.entries[n-1]
+}
+
+func (i *OffsetIndex) truncate() error {
+	i.entries = nil
+	return i.file.Truncate(0)
+}
+
+func (i *OffsetIndex) isFull() bool {
+	return len(i.entries) >= i.maxEntries
+}
+
+func openTimeIndex(path string, baseOffset int64, maxIndexSize int) (*TimeIndex, error) {
+	index := &TimeIndex{baseOffset: baseOffset, maxEntries: maxIndexSize / TIME_INDEX_ENTRY_SIZE}
+	file, err := openIndexFile(path, TIME_INDEX_ENTRY_SIZE, func(entry []byte) {
+		index.entries = append(index.entries, TimeIndexEntry{
+			timestamp: int64(binary.BigEndian.Uint64(entry)),
+			offset:    baseOffset + int64(binary.BigEndian.Uint32(entry[8:])),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	index.file = file
+	return index, nil
+}
+
+// Add an entry if timestamp is newer than the last one
+func (i *TimeIndex) maybeAppend(timestamp int64, offset int64) error {
+	if n := len(i.entries); n > 0 && timestamp <= i.entries[n-1].timestamp {
+		return nil
+	}
+	entry := binary.BigEndian.AppendUint64(nil, uint64(timestamp))
+	entry = binary.BigEndian.AppendUint32(entry, uint32(offset-i.baseOffset))
+	if _, err := i.file.WriteAt(entry, int64(len(i.entries)*TIME_INDEX_ENTRY_SIZE)); err != nil {
+		return err
+	}
+	i.entries = append(i.entries, TimeIndexEntry{timestamp: timestamp, offset: offset})
+	return nil
+}
+
+// The last entry for a timestamp at or before timestamp, or the start of
+// the segment if there is none
+func (i *TimeIndex) lookup(timestamp int64) TimeIndexEntry {
+	n := sort.Search(len(i.entries), func(j int) bool { return i.entries[j].timestamp > timestamp })
+	if n == 0 {
+		return TimeIndexEntry{timestamp: -1, offset: i.baseOffset}
+	}
+	return i.entries[n-1]
+}
+
+func (i *TimeIndex) truncate() error {
+	i.entries = nil
+	return i.file.Truncate(0)
+}
+
+func (i *TimeIndex) isFull() bool {
+	return len(i.entries) >= i.maxEntries
+}
@@ -0,0 +1,546 @@
+// Package log stores partitions the way Apache Kafka does: a directory per
+// partition holding segments of record batches, each with a sparse offset
+// index and time index, so that Kafka's tools can read our files and ours
+// can read theirs.
+package log
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrOffsetOutOfRange    = errors.New("offset is out of range")
+	ErrRecordBatchTooLarge = errors.New("records are larger than a segment")
+)
+
+// Settings of a log, named after the broker properties they come from.
+// Topics can override some of them.
+type Config struct {
+	// log.segment.bytes
+	SegmentBytes int64
+	// log.roll.ms, or the topic's segment.ms
+	SegmentMs int64
+	// log.index.interval.bytes
+	IndexIntervalBytes int
+	// log.index.size.max.bytes
+	MaxIndexSize int
+	// log.retention.ms, or the topic's retention.ms. -1 keeps segments
+	// however old they are.
+	RetentionMs int64
+	// log.retention.bytes, or the topic's retention.bytes. -1 keeps
+	// segments however large the log is.
+	RetentionBytes int64
+	// log.cleanup.policy, or the topic's cleanup.policy: delete, compact
+	// or both, comma separated. Empty means delete.
+	CleanupPolicy string
+	// log.cleaner.delete.retention.ms, or the topic's delete.retention.ms:
+	// how long compaction keeps tombstones
+	DeleteRetentionMs int64
+	// log.cleaner.min.compaction.lag.ms, or the topic's
+	// min.compaction.lag.ms: how old records must be to be compacted
+	MinCompactionLagMs int64
+}
+
+var DefaultConfig = Config{
+	SegmentBytes:       1073741824,
+	SegmentMs:          7 * 24 * 60 * 60 * 1000,
+	IndexIntervalBytes: 4096,
+	MaxIndexSize:       10485760,
+	RetentionMs:        7 * 24 * 60 * 60 * 1000,
+	RetentionBytes:     -1,
+	CleanupPolicy:      CLEANUP_POLICY_DELETE,
+	DeleteRetentionMs:  24 * 60 * 60 * 1000,
+	MinCompactionLagMs: 0,
+}
+
+// What the checkpoint files of a log dir say about one of its logs. The
+// zero value has the whole log recovered.
+type Checkpoint struct {
+	// Whether the broker wrote the clean shutdown marker when it last
+	// stopped
+	CleanShutdown bool
+	// Everything before this offset was flushed to disk
+	RecoveryPoint int64
+	// Where the cleaner stopped compacting
+	FirstDirtyOffset int64
+	// Where DeleteRecords moved the log start offset, if past the first
+	// segment
+	LogStartOffset int64
+}
+
+// A record found by its timestamp
+type TimestampAndOffset struct {
+	Timestamp int64
+	Offset    int64
+}
+
+// Where a batch append went
+type AppendInfo struct {
+	FirstOffset int64
+	LastOffset  int64
+}
+
+// The log of one partition
+type Log struct {
+	dir    string
+	config Config
+	// Guards the segments and offsets. Reads share it.
+	mu sync.RWMutex
+	// Oldest first, the last one is active
+	segments    []*Segment
+	startOffset int64
+	nextOffset  int64
+	// Everything before this offset has been flushed to disk
+	recoveryPoint int64
+	// Everything before this offset is committed. With no followers to
+	// wait for, that is everything appended.
+	highWatermark int64
+	// Records before this offset have been compacted
+	firstDirtyOffset int64
+	now              func() time.Time
+}
+
+// The directory of a partition's log in one of the log.dirs
+func PartitionDir(logDir string, topic string, partition int32) string {
+	return filepath.Join(logDir, fmt.Sprintf("%s-%d", topic, partition))
+}
+
+// Open the log in dir, creating it if it doesn't exist. Unless the broker
+// shut down cleanly, the segments holding anything past the recovery point
+// are recovered: batches are checked, whatever follows a torn or corrupt
+// one is truncated, and the indexes are rebuilt.
+func Open(dir string, config Config, checkpoint Checkpoint) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, config: config, now: time.Now}
+	if err := completeSwaps(dir); err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+LOG_FILE_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		baseOffset, ok := parseSegmentPath(path, LOG_FILE_SUFFIX)
+		if !ok {
+			continue
+		}
+		segment, err := openSegment(dir, baseOffset, config, l.now())
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to open segment %s: %w", path, err)
+		}
+		l.segments = append(l.segments, segment)
+	}
+
+	if len(l.segments) == 0 {
+		segment, err := openSegment(dir, 0, config, l.now())
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, segment)
+	}
+	if err := l.recover(checkpoint); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	if l.nextOffset, err = l.activeSegment().nextOffset(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	l.startOffset = min(max(checkpoint.LogStartOffset, l.segments[0].baseOffset), l.nextOffset)
+	// Recovered segments were flushed, so everything is on disk now
+	l.recoveryPoint = l.nextOffset
+	// There are no other replicas to wait for, everything is committed
+	l.highWatermark = l.nextOffset
+	l.firstDirtyOffset = min(max(checkpoint.FirstDirtyOffset, l.startOffset), l.nextOffset)
+	return l, nil
+}
+
+// Recover the segments that may have been torn by an unclean shutdown, and
+// any segment whose indexes are missing
+func (l *Log) recover(checkpoint Checkpoint) error {
+	for i, segment := range l.segments {
+		// Segments that end before the recovery point were flushed whole
+		flushed := i+1 < len(l.segments) && l.segments[i+1].baseOffset <= checkpoint.RecoveryPoint
+		if (checkpoint.CleanShutdown || flushed) && !segment.indexesMissing {
+			continue
+		}
+
+		truncated, err := segment.recover()
+		if err != nil {
+			return fmt.Errorf("failed to recover segment %d: %w", segment.baseOffset, err)
+		}
+		if err := segment.flush(); err != nil {
+			return err
+		}
+		if truncated == 0 {
+			continue
+		}
+
+		// Offsets must be contiguous, so nothing after a torn batch is kept
+		slog.Warn("Truncated invalid batches", "bytes", truncated, "segment", segment.baseOffset, "dir", l.dir)
+		for _, later := range l.segments[i+1:] {
+			if err := errors.Join(later.close(), later.delete(l.dir)); err != nil {
+				return err
+			}
+		}
+		l.segments = l.segments[:i+1]
+		return nil
+	}
+	return nil
+}
+
+// Everything before this offset has been flushed to disk
+func (l *Log) RecoveryPoint() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.recoveryPoint
+}
+
+func (l *Log) HighWatermark() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.highWatermark
+}
+
+// Replace the log's settings, e.g. when its topic's configs change. They
+// apply from the next append or retention check.
+func (l *Log) SetConfig(config Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+}
+
+func (l *Log) activeSegment() *Segment {
+	return l.segments[len(l.segments)-1]
+}
+
+// The first offset that can be read
+func (l *Log) StartOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.startOffset
+}
+
+// The offset the next record gets
+func (l *Log) EndOffset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.nextOffset
+}
+
+// Bytes taken up by the segments
+func (l *Log) Size() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.size()
+}
+
+// Like Size, with l.mu already held
+func (l *Log) size() int64 {
+	size := int64(0)
+	for _, segment := range l.segments {
+		size += segment.size
+	}
+	return size
+}
+
+func (l *Log) NumSegments() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.segments)
+}
+
+// Append record batches, as a producer sends them. Offsets are assigned
+// from the end of the log and the leader epoch is stamped on each batch.
+func (l *Log) Append(records []byte, leaderEpoch int32) (AppendInfo, error) {
+	// Offsets are written into our own copy, not the caller's
+	records = slices.Clone(records)
+	batches, err := splitBatches(records)
+	if err != nil {
+		return AppendInfo{}, err
+	}
+	if len(batches) == 0 {
+		return AppendInfo{}, fmt.Errorf("%w: no record batches", ErrCorruptRecord)
+	}
+	for _, batch := range batches {
+		if err := batch.validate(); err != nil {
+			return AppendInfo{}, err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if int64(len(records)) > l.config.SegmentBytes {
+		return AppendInfo{}, fmt.Errorf("%w: %d bytes, segments hold %d", ErrRecordBatchTooLarge, len(records), l.config.SegmentBytes)
+	}
+
+	info := AppendInfo{FirstOffset: l.nextOffset}
+	offset := l.nextOffset
+	for _, batch := range batches {
+		batch.setBaseOffset(offset)
+		batch.setPartitionLeaderEpoch(leaderEpoch)
+		offset = batch.LastOffset() + 1
+	}
+	info.LastOffset = offset - 1
+
+	segment, err := l.maybeRoll(len(records), info.LastOffset)
+	if err != nil {
+		return AppendInfo{}, err
+	}
+	if err := segment.append(records, batches); err != nil {
+		return AppendInfo{}, err
+	}
+	l.nextOffset = offset
+	l.highWatermark = offset
+	return info, nil
+}
+
+// The segment to append size bytes ending at lastOffset to. A new one is
+// rolled when the active segment is full, older than log.roll.ms, or
+// can't hold lastOffset relative to its base offset.
+func (l *Log) maybeRoll(size int, lastOffset int64) (*Segment, error) {
+	active := l.activeSegment()
+	if active.size == 0 {
+		return active, nil
+	}
+	full := active.size+int64(size) > l.config.SegmentBytes
+	expired := active.age(l.now()) >= time.Duration(l.config.SegmentMs)*time.Millisecond
+	indexFull := active.offsetIndex.isFull() || active.timeIndex.isFull()
+	overflow := lastOffset-active.baseOffset > math.MaxInt32
+	if !full && !expired && !indexFull && !overflow {
+		return active, nil
+	}
+
+	return l.roll()
+}
+
+// Start a new active segment at the end of the log
+func (l *Log) roll() (*Segment, error) {
+	if err := l.activeSegment().onBecomeInactive(); err != nil {
+		return nil, err
+	}
+	l.recoveryPoint = l.nextOffset
+	segment, err := openSegment(l.dir, l.nextOffset, l.config, l.now())
+	if err != nil {
+		return nil, err
+	}
+	l.segments = append(l.segments, segment)
+	return segment, nil
+}
+
+// Delete the oldest segments whose records are all older than
+// retention.ms, or that the log can do without and still hold
+// retention.bytes, moving the log start offset past them. Returns how many
+// segments were deleted. Logs whose cleanup policy doesn't include delete
+// keep every segment.
+func (l *Log) DeleteOldSegments() (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.config.hasCleanupPolicy(CLEANUP_POLICY_DELETE) {
+		return 0, nil
+	}
+
+	size := l.size()
+	now := l.now().UnixMilli()
+	deletable := 0
+	for i, segment := range l.segments {
+		// Only committed records are deleted, and an empty active segment
+		// has none
+		end := l.nextOffset
+		if i+1 < len(l.segments) {
+			end = l.segments[i+1].baseOffset
+		}
+		if segment.size == 0 || end > l.highWatermark {
+			break
+		}
+		largestTimestamp, err := segment.largestTimestamp()
+		if err != nil {
+			return 0, err
+		}
+		expired := l.config.RetentionMs >= 0 && now-largestTimestamp > l.config.RetentionMs
+		oversized := l.config.RetentionBytes >= 0 && size-segment.size >= l.config.RetentionBytes
+		if !expired && !oversized {
+			break
+		}
+		size -= segment.size
+		deletable++
+	}
+	if deletable == 0 {
+		return 0, nil
+	}
+
+	// The log always keeps an active segment, so a deleted one is replaced
+	if deletable == len(l.segments) {
+		if _, err := l.roll(); err != nil {
+			return 0, err
+		}
+	}
+	return deletable, l.deleteSegments(deletable)
+}
+
+// Move the log start offset forward to offset, which may not be past the
+// high watermark, and delete the segments that end before it. Records of
+// the first remaining segment before offset stay on disk but can't be read
+// anymore. Returns the log start offset.
+func (l *Log) DeleteRecordsBefore(offset int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if offset > l.highWatermark {
+		return l.startOffset, fmt.Errorf("%w: %d is past the high watermark %d", ErrOffsetOutOfRange, offset, l.highWatermark)
+	}
+	if offset <= l.startOffset {
+		return l.startOffset, nil
+	}
+	l.startOffset = offset
+
+	deletable := 0
+	for deletable+1 < len(l.segments) && l.segments[deletable+1].baseOffset <= offset {
+		deletable++
+	}
+	return l.startOffset, l.deleteSegments(deletable)
+}
+
+// Delete the oldest count segments, moving the log start offset past them.
+// The active segment must not be one of them.
+func (l *Log) deleteSegments(count int) error {
+	deleted := l.segments[:count]
+	l.segments = l.segments[count:]
+	l.startOffset = max(l.startOffset, l.segments[0].baseOffset)
+	l.recoveryPoint = max(l.recoveryPoint, l.startOffset)
+	l.firstDirtyOffset = max(l.firstDirtyOffset, l.startOffset)
+
+	var errs []error
+	for _, segment := range deleted {
+		errs = append(errs, segment.close(), segment.delete(l.dir))
+	}
+	return errors.Join(errs...)
+}
+
+// The first record at or after the log start offset with a timestamp at
+// or after timestamp. Returns false if every record is older.
+func (l *Log) OffsetForTimestamp(timestamp int64) (TimestampAndOffset, bool, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for _, segment := range l.segments {
+		largestTimestamp, err := segment.largestTimestamp()
+		if err != nil {
+			return TimestampAndOffset{}, false, err
+		}
+		if largestTimestamp < timestamp {
+			continue
+		}
+		found, ok, err := segment.findOffsetByTimestamp(timestamp, l.startOffset)
+		if err != nil || ok {
+			return found, ok, err
+		}
+	}
+	return TimestampAndOffset{}, false, nil
+}
+
+// The record with the largest timestamp, the first one if several share
+// it. Returns false if the log has no timestamps.
+func (l *Log) MaxTimestamp() (TimestampAndOffset, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	found := TimestampAndOffset{Timestamp: NO_TIMESTAMP, Offset: -1}
+	for _, segment := range l.segments {
+		if segment.maxTimestamp > found.Timestamp {
+			found = TimestampAndOffset{Timestamp: segment.maxTimestamp, Offset: segment.offsetOfMaxTimestamp}
+		}
+	}
+	return found, found.Timestamp != NO_TIMESTAMP
+}
+
+// Whole record batches from the one holding offset onwards, as many as fit
+// in maxBytes but at least one so that large batches can still be read.
+// Reading at the end of the log returns nothing.
+func (l *Log) Read(offset int64, maxBytes int) ([]byte, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if offset < l.startOffset || offset > l.nextOffset {
+		return nil, fmt.Errorf("%w: %d is outside [%d, %d]", ErrOffsetOutOfRange, offset, l.startOffset, l.nextOffset)
+	}
+
+	// The last segment starting at or before offset holds it, unless
+	// offset falls in a gap at its end
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].baseOffset > offset }) - 1
+	for ; i < len(l.segments); i++ {
+		data, err := l.segments[i].read(offset, maxBytes)
+		if err != nil || data != nil {
+			return data, err
+		}
+	}
+	return nil, nil
+}
+
+// Like Read, but the batches are left in the segment file to be written
+// straight from there. Returns nil if there is nothing to read.
+func (l *Log) ReadFile(offset int64, maxBytes int) (*FileRecords, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if offset < l.startOffset || offset > l.nextOffset {
+		return nil, fmt.Errorf("%w: %d is outside [%d, %d]", ErrOffsetOutOfRange, offset, l.startOffset, l.nextOffset)
+	}
+
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].baseOffset > offset }) - 1
+	for ; i < len(l.segments); i++ {
+		records, err := l.segments[i].readFile(offset, maxBytes)
+		if err != nil || records != nil {
+			return records, err
+		}
+	}
+	return nil, nil
+}
+
+// Write everything appended so far to disk
+func (l *Log) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.activeSegment().flush(); err != nil {
+		return err
+	}
+	l.recoveryPoint = l.nextOffset
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var errs []error
+	if len(l.segments) > 0 {
+		// Like when it's rolled, the active segment's max timestamp goes in
+		// its time index so that it is known when it's opened again
+		if err := l.activeSegment().onBecomeInactive(); err != nil {
+			errs = append(errs, err)
+		} else {
+			l.recoveryPoint = l.nextOffset
+		}
+	}
+	for _, segment := range l.segments {
+		errs = append(errs, segment.close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,502 @@
+package log
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A batch of count records with 100 byte values, as a producer sends it
+func newBatch(count int, timestamp int64) []byte {
+	records := []byte{}
+	for i := range count {
+		record := []byte{0}                     // attributes
+		record = binary.AppendVarint(record, 0) // timestamp delta
+		record = binary.AppendVarint(record, int64(i))
+		record = binary.AppendVarint(record, -1) // key
+		record = binary.AppendVarint(record, 100)
+		record = append(record, make([]byte, 100)...)
+		record = binary.AppendUvarint(record, 0) // headers
+		records = binary.AppendVarint(records, int64(len(record)))
+		records = append(records, record...)
+	}
+
+	afterCRC := binary.BigEndian.AppendUint16(nil, 0)
+	afterCRC = binary.BigEndian.AppendUint32(afterCRC, uint32(count-1))
+	afterCRC = binary.BigEndian.AppendUint64(afterCRC, uint64(timestamp))
+	afterCRC = binary.BigEndian.AppendUint64(afterCRC, uint64(timestamp))
+	afterCRC = binary.BigEndian.AppendUint64(afterCRC, 0xffffffffffffffff) // producer ID
+	afterCRC = binary.BigEndian.AppendUint16(afterCRC, 0xffff)             // producer epoch
+	afterCRC = binary.BigEndian.AppendUint32(afterCRC, 0xffffffff)         // base sequence
+	afterCRC = binary.BigEndian.AppendUint32(afterCRC, uint32(count))
+	afterCRC = append(afterCRC, records...)
+
+	batch := binary.BigEndian.AppendUint64(nil, 0)
+	batch = binary.BigEndian.AppendUint32(batch, uint32(RECORD_BATCH_OVERHEAD-LOG_OVERHEAD+len(records)))
+	batch = binary.BigEndian.AppendUint32(batch, 0) // partition leader epoch
+	batch = append(batch, CURRENT_MAGIC)
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(afterCRC, crc32c))
+	return append(batch, afterCRC...)
+}
+
+// Base offsets of the batches in records
+func baseOffsets(t *testing.T, records []byte) []int64 {
+	t.Helper()
+	batches, err := splitBatches(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := []int64{}
+	for _, batch := range batches {
+		offsets = append(offsets, batch.BaseOffset())
+	}
+	return offsets
+}
+
+func openTestLog(t *testing.T, dir string, config Config) *Log {
+	t.Helper()
+	l, err := Open(dir, config, Checkpoint{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func Test_Log_Read(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), DefaultConfig)
+	batchSize := len(newBatch(1, 0))
+	for _, count := range []int{1, 3, 2} {
+		if _, err := l.Append(newBatch(count, 0), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		offset   int64
+		maxBytes int
+		want     []int64
+		wantErr  error
+	}{
+		{"everything", 0, 1 << 20, []int64{0, 1, 4}, nil},
+		{"inside a batch", 2, 1 << 20, []int64{1, 4}, nil},
+		{"last batch", 5, 1 << 20, []int64{4}, nil},
+		{"up to max bytes", 0, 2 * batchSize, []int64{0}, nil},
+		{"at least one batch", 1, 1, []int64{1}, nil},
+		{"end of the log", 6, 1 << 20, []int64{}, nil},
+		{"past the end", 7, 1 << 20, nil, ErrOffsetOutOfRange},
+		{"before the start", -1, 1 << 20, nil, ErrOffsetOutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := l.Read(tt.offset, tt.maxBytes)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Read() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := baseOffsets(t, records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Read() batches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Log_ReadFile(t *testing.T) {
+	batchSize := int64(len(newBatch(1, 0)))
+	config := DefaultConfig
+	config.SegmentBytes = 2 * batchSize
+	l := openTestLog(t, t.TempDir(), config)
+	for range 5 {
+		if _, err := l.Append(newBatch(1, 0), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := l.Read(0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := l.ReadFile(0, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer records.Close()
+	if records.Len() != len(want) {
+		t.Errorf("Len() = %d, want %d", records.Len(), len(want))
+	}
+
+	// Records read stay readable once their segment is deleted
+	if _, err := l.DeleteRecordsBefore(4); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		var got bytes.Buffer
+		if _, err := records.WriteTo(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("WriteTo() = %d bytes, want the %d bytes Read() returned", got.Len(), len(want))
+		}
+	}
+
+	if records, err := l.ReadFile(5, 1<<20); records != nil || err != nil {
+		t.Errorf("ReadFile() at the end of the log = %v, %v, want nil, nil", records, err)
+	}
+}
+
+func Test_Log_Append(t *testing.T) {
+	corrupt := newBatch(1, 0)
+	corrupt[len(corrupt)-1] ^= 1
+	oldMagic := newBatch(1, 0)
+	oldMagic[MAGIC_OFFSET] = 1
+
+	tests := []struct {
+		name    string
+		records []byte
+		want    AppendInfo
+		wantErr error
+	}{
+		{"one batch", newBatch(3, 0), AppendInfo{FirstOffset: 1, LastOffset: 3}, nil},
+		{"several batches", append(newBatch(2, 0), newBatch(2, 0)...), AppendInfo{FirstOffset: 1, LastOffset: 4}, nil},
+		{"CRC mismatch", corrupt, AppendInfo{}, ErrCorruptRecord},
+		{"cut short", newBatch(1, 0)[:100], AppendInfo{}, ErrCorruptRecord},
+		{"old message format", oldMagic, AppendInfo{}, ErrUnsupportedVersion},
+		{"nothing", []byte{}, AppendInfo{}, ErrCorruptRecord},
+		{"larger than a segment", newBatch(20, 0), AppendInfo{}, ErrRecordBatchTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := openTestLog(t, t.TempDir(), Config{SegmentBytes: 1024, SegmentMs: DefaultConfig.SegmentMs, IndexIntervalBytes: 4096, MaxIndexSize: 1024})
+			if _, err := l.Append(newBatch(1, 0), 0); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := l.Append(tt.records, 5)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Append() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Append() = %+v, want %+v", got, tt.want)
+			}
+			if err == nil && l.EndOffset() != tt.want.LastOffset+1 {
+				t.Errorf("EndOffset() = %d, want %d", l.EndOffset(), tt.want.LastOffset+1)
+			}
+			if err != nil && l.EndOffset() != 1 {
+				t.Errorf("EndOffset() after a failed append = %d, want 1", l.EndOffset())
+			}
+		})
+	}
+}
+
+func Test_Log_roll(t *testing.T) {
+	batchSize := int64(len(newBatch(1, 0)))
+	start := time.UnixMilli(1700000000000)
+
+	tests := []struct {
+		name   string
+		config Config
+		// Time of each one record batch since start
+		appends []time.Duration
+		want    []string
+	}{
+		{"by size", Config{SegmentBytes: 2*batchSize + batchSize/2, SegmentMs: DefaultConfig.SegmentMs, IndexIntervalBytes: 4096, MaxIndexSize: 1024},
+			[]time.Duration{0, 0, 0, 0, 0}, []string{"00000000000000000000", "00000000000000000002", "00000000000000000004"}},
+		{"by time", Config{SegmentBytes: 1 << 20, SegmentMs: 1000, IndexIntervalBytes: 4096, MaxIndexSize: 1024},
+			[]time.Duration{0, 500 * time.Millisecond, time.Second, 1200 * time.Millisecond}, []string{"00000000000000000000", "00000000000000000002"}},
+		// Every batch after the first is indexed, the time index holds three
+		{"index full", Config{SegmentBytes: 1 << 20, SegmentMs: DefaultConfig.SegmentMs, IndexIntervalBytes: 1, MaxIndexSize: 3 * TIME_INDEX_ENTRY_SIZE},
+			[]time.Duration{0, time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 4 * time.Millisecond}, []string{"00000000000000000000", "00000000000000000004"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l := openTestLog(t, dir, tt.config)
+			for i, after := range tt.appends {
+				now := start.Add(after)
+				l.now = func() time.Time { return now }
+				if _, err := l.Append(newBatch(1, now.UnixMilli()), 0); err != nil {
+					t.Fatalf("Append() of batch %d: %v", i, err)
+				}
+			}
+
+			got := []string{}
+			for _, segment := range l.segments {
+				got = append(got, filepath.Base(segmentPath(dir, segment.baseOffset, "")))
+				for _, suffix := range []string{LOG_FILE_SUFFIX, INDEX_FILE_SUFFIX, TIME_INDEX_FILE_SUFFIX} {
+					if _, err := os.Stat(segmentPath(dir, segment.baseOffset, suffix)); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("segments = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The index files must be laid out the way Kafka's tools expect them
+func Test_Log_indexes(t *testing.T) {
+	dir := t.TempDir()
+	l := openTestLog(t, dir, Config{SegmentBytes: 1 << 20, SegmentMs: DefaultConfig.SegmentMs, IndexIntervalBytes: 1, MaxIndexSize: 1024})
+	l.now = func() time.Time { return time.UnixMilli(2000) }
+	batchSize := len(newBatch(2, 0))
+	for i := range 3 {
+		if _, err := l.Append(newBatch(2, 1000+int64(i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// No entry for the first batch, then one for the last offset of every
+	// batch after it
+	index, err := os.ReadFile(segmentPath(dir, 0, INDEX_FILE_SUFFIX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{}
+	for _, entry := range [][2]int{{3, batchSize}, {5, 2 * batchSize}} {
+		want = binary.BigEndian.AppendUint32(want, uint32(entry[0]))
+		want = binary.BigEndian.AppendUint32(want, uint32(entry[1]))
+	}
+	if !reflect.DeepEqual(index, want) {
+		t.Errorf(".index = %v, want %v", index, want)
+	}
+
+	timeIndex, err := os.ReadFile(segmentPath(dir, 0, TIME_INDEX_FILE_SUFFIX))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []byte{}
+	for _, entry := range [][2]int{{1001, 3}, {1002, 5}} {
+		want = binary.BigEndian.AppendUint64(want, uint64(entry[0]))
+		want = binary.BigEndian.AppendUint32(want, uint32(entry[1]))
+	}
+	if !reflect.DeepEqual(timeIndex, want) {
+		t.Errorf(".timeindex = %v, want %v", timeIndex, want)
+	}
+
+	// The indexes and offsets survive reopening the log
+	l.Close()
+	l = openTestLog(t, dir, l.config)
+	if l.EndOffset() != 6 {
+		t.Errorf("EndOffset() after reopening = %d, want 6", l.EndOffset())
+	}
+	records, err := l.Read(4, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := baseOffsets(t, records); !reflect.DeepEqual(got, []int64{4}) {
+		t.Errorf("Read() after reopening = %v, want [4]", got)
+	}
+	if info, err := l.Append(newBatch(1, 0), 0); err != nil || info.FirstOffset != 6 {
+		t.Errorf("Append() after reopening = %+v, %v, want offset 6", info, err)
+	}
+}
+
+func Test_Log_recover(t *testing.T) {
+	batchSize := int64(len(newBatch(1, 0)))
+	// Three batches per segment, the first two segments full
+	config := Config{SegmentBytes: 3 * batchSize, SegmentMs: DefaultConfig.SegmentMs, IndexIntervalBytes: 1, MaxIndexSize: 1024}
+
+	tests := []struct {
+		name       string
+		checkpoint Checkpoint
+		// Damage done to the log dir while the broker was down
+		damage       func(dir string) error
+		wantEnd      int64
+		wantSegments []int64
+	}{
+		{"torn tail", Checkpoint{RecoveryPoint: 6}, func(dir string) error {
+			return os.Truncate(segmentPath(dir, 6, LOG_FILE_SUFFIX), batchSize+batchSize/2)
+		}, 7, []int64{0, 3, 6}},
+		{"corrupt batch before the recovery point", Checkpoint{}, func(dir string) error {
+			return flipByte(segmentPath(dir, 3, LOG_FILE_SUFFIX), batchSize+RECORD_BATCH_OVERHEAD)
+		}, 4, []int64{0, 3}},
+		{"flushed segments aren't checked", Checkpoint{RecoveryPoint: 6}, func(dir string) error {
+			return flipByte(segmentPath(dir, 3, LOG_FILE_SUFFIX), batchSize+RECORD_BATCH_OVERHEAD)
+		}, 8, []int64{0, 3, 6}},
+		{"missing index", Checkpoint{CleanShutdown: true, RecoveryPoint: 8}, func(dir string) error {
+			return os.Remove(segmentPath(dir, 3, INDEX_FILE_SUFFIX))
+		}, 8, []int64{0, 3, 6}},
+		{"clean shutdown", Checkpoint{CleanShutdown: true, RecoveryPoint: 8}, func(dir string) error {
+			return nil
+		}, 8, []int64{0, 3, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l, err := Open(dir, config, Checkpoint{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 8 {
+				if _, err := l.Append(newBatch(1, 0), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			l.Close()
+			if err := tt.damage(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err = Open(dir, config, tt.checkpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			if l.EndOffset() != tt.wantEnd {
+				t.Errorf("EndOffset() = %d, want %d", l.EndOffset(), tt.wantEnd)
+			}
+			if l.RecoveryPoint() != tt.wantEnd {
+				t.Errorf("RecoveryPoint() = %d, want %d", l.RecoveryPoint(), tt.wantEnd)
+			}
+			if l.HighWatermark() != tt.wantEnd {
+				t.Errorf("HighWatermark() = %d, want %d", l.HighWatermark(), tt.wantEnd)
+			}
+			got := []int64{}
+			for _, segment := range l.segments {
+				got = append(got, segment.baseOffset)
+			}
+			if !reflect.DeepEqual(got, tt.wantSegments) {
+				t.Errorf("segments = %v, want %v", got, tt.wantSegments)
+			}
+			for _, suffix := range []string{LOG_FILE_SUFFIX, INDEX_FILE_SUFFIX, TIME_INDEX_FILE_SUFFIX} {
+				paths, _ := filepath.Glob(filepath.Join(dir, "*"+suffix))
+				if len(paths) != len(tt.wantSegments) {
+					t.Errorf("%d %s files, want %d", len(paths), suffix, len(tt.wantSegments))
+				}
+			}
+
+			// Every offset that is left can be read, and appends carry on
+			// from the end
+			for offset := int64(0); offset < l.EndOffset(); offset++ {
+				records, err := l.Read(offset, 1)
+				if err != nil {
+					t.Fatalf("Read(%d) error = %v", offset, err)
+				}
+				if got := baseOffsets(t, records); !reflect.DeepEqual(got, []int64{offset}) {
+					t.Errorf("Read(%d) = %v", offset, got)
+				}
+			}
+			if info, err := l.Append(newBatch(1, 0), 0); err != nil || info.FirstOffset != tt.wantEnd {
+				t.Errorf("Append() = %+v, %v, want offset %d", info, err, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func flipByte(path string, position int64) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data[position] ^= 1
+	return os.WriteFile(path, data, 0o644)
+}
+
+func Test_Log_DeleteOldSegments(t *testing.T) {
+	batchSize := int64(len(newBatch(1, 0)))
+	now := time.UnixMilli(1700000000000)
+
+	tests := []struct {
+		name           string
+		retentionMs    int64
+		retentionBytes int64
+		// Batch timestamps before now, two batches per segment
+		ages      []time.Duration
+		want      int
+		wantStart int64
+	}{
+		{"nothing to delete", -1, -1, []time.Duration{time.Hour, time.Hour, time.Hour}, 0, 0},
+		{"by time", 90 * 60 * 1000, -1, []time.Duration{3 * time.Hour, 2 * time.Hour, time.Hour, time.Hour, 0}, 1, 2},
+		// The newest record of a segment decides
+		{"by time, partly expired", 90 * 60 * 1000, -1, []time.Duration{3 * time.Hour, time.Hour, 0}, 0, 0},
+		{"by size", -1, 3 * batchSize, []time.Duration{0, 0, 0, 0, 0}, 1, 2},
+		{"by size, keeping at least the limit", -1, 3*batchSize - 1, []time.Duration{0, 0, 0, 0, 0}, 1, 2},
+		// The active segment is rolled so that it can go too
+		{"everything", 1000, -1, []time.Duration{time.Hour, time.Hour, time.Hour}, 2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := Config{SegmentBytes: 2 * batchSize, SegmentMs: DefaultConfig.SegmentMs, IndexIntervalBytes: 4096, MaxIndexSize: 1024, RetentionMs: -1, RetentionBytes: -1}
+			l := openTestLog(t, dir, config)
+			l.now = func() time.Time { return now }
+			for _, age := range tt.ages {
+				if _, err := l.Append(newBatch(1, now.Add(-age).UnixMilli()), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			config.RetentionMs, config.RetentionBytes = tt.retentionMs, tt.retentionBytes
+			l.SetConfig(config)
+			deleted, err := l.DeleteOldSegments()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != tt.want {
+				t.Errorf("DeleteOldSegments() = %d, want %d", deleted, tt.want)
+			}
+			if l.StartOffset() != tt.wantStart {
+				t.Errorf("StartOffset() = %d, want %d", l.StartOffset(), tt.wantStart)
+			}
+			if _, err := os.Stat(segmentPath(dir, 0, LOG_FILE_SUFFIX)); os.IsNotExist(err) != (tt.want > 0) {
+				t.Errorf("first segment exists = %v, want %v", err == nil, tt.want == 0)
+			}
+			if _, err := l.Read(tt.wantStart-1, 1<<20); tt.wantStart > 0 && !errors.Is(err, ErrOffsetOutOfRange) {
+				t.Errorf("Read() before the start offset error = %v, want %v", err, ErrOffsetOutOfRange)
+			}
+			if l.EndOffset() != int64(len(tt.ages)) {
+				t.Errorf("EndOffset() = %d, want %d", l.EndOffset(), len(tt.ages))
+			}
+		})
+	}
+}
+
+func Test_Log_OffsetForTimestamp(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), Config{SegmentBytes: 1 << 20, SegmentMs: DefaultConfig.SegmentMs, IndexIntervalBytes: 1, MaxIndexSize: 1024})
+	l.now = func() time.Time { return time.UnixMilli(2000) }
+	// Offsets 0-1 at 1000, 2 at 1010, 3 at 1005, 4-6 at 1020
+	for _, batch := range []struct {
+		count     int
+		timestamp int64
+	}{{2, 1000}, {1, 1010}, {1, 1005}, {3, 1020}} {
+		if _, err := l.Append(newBatch(batch.count, batch.timestamp), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		timestamp int64
+		want      TimestampAndOffset
+		wantOk    bool
+	}{
+		{0, TimestampAndOffset{1000, 0}, true},
+		{1000, TimestampAndOffset{1000, 0}, true},
+		{1001, TimestampAndOffset{1010, 2}, true},
+		{1011, TimestampAndOffset{1020, 4}, true},
+		{1021, TimestampAndOffset{}, false},
+	}
+	for _, tt := range tests {
+		got, ok, err := l.OffsetForTimestamp(tt.timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("OffsetForTimestamp(%d) = %+v, %v, want %+v, %v", tt.timestamp, got, ok, tt.want, tt.wantOk)
+		}
+	}
+
+	if got, ok := l.MaxTimestamp(); !ok || got != (TimestampAndOffset{1020, 6}) {
+		t.Errorf("MaxTimestamp() = %+v, %v, want {1020 6}", got, ok)
+	}
+}
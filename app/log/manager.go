@@ -0,0 +1,278 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Written once every log of the dir is closed, and removed again when
+	// they have been loaded
+	CLEAN_SHUTDOWN_FILE            = ".kafka_cleanshutdown"
+	RECOVERY_POINT_CHECKPOINT_FILE = "recovery-point-offset-checkpoint"
+	HIGH_WATERMARK_CHECKPOINT_FILE = "replication-offset-checkpoint"
+	CLEANER_CHECKPOINT_FILE        = "cleaner-offset-checkpoint"
+	LOG_START_CHECKPOINT_FILE      = "log-start-offset-checkpoint"
+	// The metadata log has its own recovery
+	METADATA_LOG_DIR = "__cluster_metadata-0"
+)
+
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+func (tp TopicPartition) String() string {
+	return fmt.Sprintf("%s-%d", tp.Topic, tp.Partition)
+}
+
+// The partition logs of one log dir, along with the checkpoint files
+// Kafka keeps next to them
+type Manager struct {
+	dir    string
+	config Config
+	mu     sync.Mutex
+	logs   map[TopicPartition]*Log
+}
+
+// Open every partition log in dir, recovering them if the broker didn't
+// shut down cleanly
+func OpenManager(dir string, config Config) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	m := &Manager{dir: dir, config: config, logs: map[TopicPartition]*Log{}}
+
+	_, err := os.Stat(filepath.Join(dir, CLEAN_SHUTDOWN_FILE))
+	cleanShutdown := err == nil
+	recoveryPoints := m.readCheckpoint(RECOVERY_POINT_CHECKPOINT_FILE)
+	firstDirtyOffsets := m.readCheckpoint(CLEANER_CHECKPOINT_FILE)
+	logStartOffsets := m.readCheckpoint(LOG_START_CHECKPOINT_FILE)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		tp, ok := parsePartitionDir(entry.Name())
+		if !entry.IsDir() || !ok || entry.Name() == METADATA_LOG_DIR {
+			continue
+		}
+		checkpoint := Checkpoint{
+			CleanShutdown:    cleanShutdown,
+			RecoveryPoint:    recoveryPoints[tp],
+			FirstDirtyOffset: firstDirtyOffsets[tp],
+			LogStartOffset:   logStartOffsets[tp],
+		}
+		l, err := Open(filepath.Join(dir, entry.Name()), config, checkpoint)
+		if err != nil {
+			m.closeLogs()
+			return nil, fmt.Errorf("failed to load log %s: %w", tp, err)
+		}
+		m.logs[tp] = l
+	}
+
+	// From here on, stopping without Close is an unclean shutdown
+	if err := m.Checkpoint(); err != nil {
+		m.closeLogs()
+		return nil, err
+	}
+	if err := os.Remove(filepath.Join(dir, CLEAN_SHUTDOWN_FILE)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		m.closeLogs()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Partition directories are named <topic>-<partition>. Topic names may
+// contain dashes themselves.
+func parsePartitionDir(name string) (TopicPartition, bool) {
+	i := strings.LastIndexByte(name, '-')
+	if i <= 0 {
+		return TopicPartition{}, false
+	}
+	partition, err := strconv.ParseInt(name[i+1:], 10, 32)
+	if err != nil || partition < 0 {
+		return TopicPartition{}, false
+	}
+	return TopicPartition{Topic: name[:i], Partition: int32(partition)}, true
+}
+
+// The log of a partition, or nil if this dir doesn't have it
+func (m *Manager) Log(tp TopicPartition) *Log {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.logs[tp]
+}
+
+// Every log of the dir
+func (m *Manager) Logs() map[TopicPartition]*Log {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.logs)
+}
+
+// The log of a partition, created if this dir doesn't have it yet
+func (m *Manager) GetOrCreateLog(tp TopicPartition) (*Log, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if l, ok := m.logs[tp]; ok {
+		return l, nil
+	}
+	l, err := Open(PartitionDir(m.dir, tp.Topic, tp.Partition), m.config, Checkpoint{})
+	if err != nil {
+		return nil, err
+	}
+	m.logs[tp] = l
+	return l, nil
+}
+
+// Write the recovery point, high watermark, first dirty offset and log
+// start offset of every log, so that a restart only recovers what was
+// appended since, the cleaner carries on where it stopped and deleted
+// records stay deleted
+func (m *Manager) Checkpoint() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	recoveryPoints := map[TopicPartition]int64{}
+	highWatermarks := map[TopicPartition]int64{}
+	firstDirtyOffsets := map[TopicPartition]int64{}
+	logStartOffsets := map[TopicPartition]int64{}
+	for tp, l := range m.logs {
+		recoveryPoints[tp] = l.RecoveryPoint()
+		highWatermarks[tp] = l.HighWatermark()
+		firstDirtyOffsets[tp] = l.FirstDirtyOffset()
+		logStartOffsets[tp] = l.StartOffset()
+	}
+	return errors.Join(
+		m.writeCheckpoint(RECOVERY_POINT_CHECKPOINT_FILE, recoveryPoints),
+		m.writeCheckpoint(HIGH_WATERMARK_CHECKPOINT_FILE, highWatermarks),
+		m.writeCheckpoint(CLEANER_CHECKPOINT_FILE, firstDirtyOffsets),
+		m.writeCheckpoint(LOG_START_CHECKPOINT_FILE, logStartOffsets),
+	)
+}
+
+// Flush and close every log, then mark the shutdown as clean
+func (m *Manager) Close() error {
+	if err := m.closeLogs(); err != nil {
+		return err
+	}
+	if err := m.Checkpoint(); err != nil {
+		return err
+	}
+	return writeFileSync(filepath.Join(m.dir, CLEAN_SHUTDOWN_FILE), nil)
+}
+
+func (m *Manager) closeLogs() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	for _, l := range m.logs {
+		errs = append(errs, l.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Read a checkpoint file:
+//
+//	0
+//	<number of entries>
+//	<topic> <partition> <offset>
+//	...
+//
+// A missing or unreadable file has logs recovered from the start.
+func (m *Manager) readCheckpoint(name string) map[TopicPartition]int64 {
+	offsets := map[TopicPartition]int64{}
+	f, err := os.Open(filepath.Join(m.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return offsets
+	}
+	if err == nil {
+		defer f.Close()
+		err = parseCheckpoint(bufio.NewScanner(f), offsets)
+	}
+	if err != nil {
+		slog.Warn("Error reading checkpoint, resetting it", "checkpoint", name, "dir", m.dir, "error", err)
+		return map[TopicPartition]int64{}
+	}
+	return offsets
+}
+
+func parseCheckpoint(scanner *bufio.Scanner, offsets map[TopicPartition]int64) error {
+	lines := []string{}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(lines) < 2 || lines[0] != "0" {
+		return fmt.Errorf("unsupported checkpoint version")
+	}
+	count, err := strconv.Atoi(lines[1])
+	if err != nil || count != len(lines)-2 {
+		return fmt.Errorf("expected %s entries, found %d", lines[1], len(lines)-2)
+	}
+	for _, line := range lines[2:] {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("malformed entry %q", line)
+		}
+		partition, err := strconv.ParseInt(fields[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("malformed entry %q", line)
+		}
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed entry %q", line)
+		}
+		offsets[TopicPartition{Topic: fields[0], Partition: int32(partition)}] = offset
+	}
+	return nil
+}
+
+func (m *Manager) writeCheckpoint(name string, offsets map[TopicPartition]int64) error {
+	tps := make([]TopicPartition, 0, len(offsets))
+	for tp := range offsets {
+		tps = append(tps, tp)
+	}
+	sort.Slice(tps, func(i, j int) bool { return tps[i].String() < tps[j].String() })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "0\n%d\n", len(tps))
+	for _, tp := range tps {
+		fmt.Fprintf(&b, "%s %d %d\n", tp.Topic, tp.Partition, offsets[tp])
+	}
+
+	// Replaced in one go, so that a crash leaves either the old or the new
+	// checkpoint
+	path := filepath.Join(m.dir, name)
+	if err := writeFileSync(path+".tmp", []byte(b.String())); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return errors.Join(f.Sync(), f.Close())
+}
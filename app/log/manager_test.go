@@ -0,0 +1,76 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Manager_checkpoints(t *testing.T) {
+	dir := t.TempDir()
+	tp := TopicPartition{Topic: "my-topic", Partition: 1}
+
+	m, err := OpenManager(dir, DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := m.GetOrCreateLog(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if _, err := l.Append(newBatch(2, 0), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkpoint, err := os.ReadFile(filepath.Join(dir, RECOVERY_POINT_CHECKPOINT_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "0\n1\nmy-topic 1 6\n"; string(checkpoint) != want {
+		t.Errorf("%s = %q, want %q", RECOVERY_POINT_CHECKPOINT_FILE, checkpoint, want)
+	}
+
+	// Reopening finds the log, and the marker is gone until the next Close
+	m, err = OpenManager(dir, DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if _, err := os.Stat(filepath.Join(dir, CLEAN_SHUTDOWN_FILE)); !os.IsNotExist(err) {
+		t.Errorf("%s after reopening: %v, want it removed", CLEAN_SHUTDOWN_FILE, err)
+	}
+	l = m.Log(tp)
+	if l == nil {
+		t.Fatalf("Log(%s) = nil after reopening", tp)
+	}
+	if l.EndOffset() != 6 || l.HighWatermark() != 6 {
+		t.Errorf("EndOffset(), HighWatermark() = %d, %d, want 6, 6", l.EndOffset(), l.HighWatermark())
+	}
+}
+
+func Test_parsePartitionDir(t *testing.T) {
+	tests := []struct {
+		name string
+		want TopicPartition
+		ok   bool
+	}{
+		{"orders-0", TopicPartition{"orders", 0}, true},
+		{"my-topic-12", TopicPartition{"my-topic", 12}, true},
+		{"orders", TopicPartition{}, false},
+		{"orders-x", TopicPartition{}, false},
+		{"-1", TopicPartition{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parsePartitionDir(tt.name)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("parsePartitionDir() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
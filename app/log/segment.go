@@ -0,0 +1,423 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	LOG_FILE_SUFFIX        = ".log"
+	INDEX_FILE_SUFFIX      = ".index"
+	TIME_INDEX_FILE_SUFFIX = ".timeindex"
+)
+
+// A .log file of record batches and its two indexes. Only the last segment
+// of a log, the active one, is appended to.
+type Segment struct {
+	baseOffset  int64
+	log         *os.File
+	offsetIndex *OffsetIndex
+	timeIndex   *TimeIndex
+	size        int64
+	// When the segment was created, for log.roll.ms if its first batch
+	// has no timestamp
+	created time.Time
+	// Max timestamp of the first batch, -1 while empty
+	firstBatchTimestamp  int64
+	maxTimestamp         int64
+	offsetOfMaxTimestamp int64
+	// Bytes appended since the indexes were last added to
+	bytesSinceLastIndexEntry int
+	indexIntervalBytes       int
+	// Set when the segment was opened without its index files, which
+	// then need rebuilding
+	indexesMissing bool
+}
+
+// Segment files are named after the segment's base offset, zero padded to
+// 20 digits so that they sort in offset order
+func segmentPath(dir string, baseOffset int64, suffix string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", baseOffset, suffix))
+}
+
+// The base offset of a segment file, or false if the name isn't one
+func parseSegmentPath(path string, suffix string) (int64, bool) {
+	name := filepath.Base(path)
+	if len(name) != 20+len(suffix) || filepath.Ext(name) != suffix {
+		return 0, false
+	}
+	var baseOffset int64
+	if _, err := fmt.Sscanf(name[:20], "%d", &baseOffset); err != nil {
+		return 0, false
+	}
+	return baseOffset, true
+}
+
+// Open the segment's files, creating the ones that don't exist
+func openSegment(dir string, baseOffset int64, config Config, now time.Time) (*Segment, error) {
+	s := &Segment{
+		baseOffset:           baseOffset,
+		created:              now,
+		firstBatchTimestamp:  -1,
+		maxTimestamp:         -1,
+		offsetOfMaxTimestamp: -1,
+		indexIntervalBytes:   config.IndexIntervalBytes,
+	}
+
+	for _, suffix := range []string{INDEX_FILE_SUFFIX, TIME_INDEX_FILE_SUFFIX} {
+		if _, err := os.Stat(segmentPath(dir, baseOffset, suffix)); errors.Is(err, os.ErrNotExist) {
+			s.indexesMissing = true
+		}
+	}
+
+	var err error
+	if s.log, err = os.OpenFile(segmentPath(dir, baseOffset, LOG_FILE_SUFFIX), os.O_RDWR|os.O_CREATE, 0o644); err != nil {
+		return nil, err
+	}
+	if s.offsetIndex, err = openOffsetIndex(segmentPath(dir, baseOffset, INDEX_FILE_SUFFIX), baseOffset, config.MaxIndexSize); err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.timeIndex, err = openTimeIndex(segmentPath(dir, baseOffset, TIME_INDEX_FILE_SUFFIX), baseOffset, config.MaxIndexSize); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	info, err := s.log.Stat()
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	s.size = info.Size()
+	if s.size == 0 {
+		return s, nil
+	}
+
+	s.created = info.ModTime()
+	// A torn first batch is left for recovery to truncate
+	if first, err := s.readBatchHeader(0); err == nil {
+		s.firstBatchTimestamp = first.MaxTimestamp()
+	}
+	if n := len(s.timeIndex.entries); n > 0 {
+		s.maxTimestamp = s.timeIndex.entries[n-1].timestamp
+		s.offsetOfMaxTimestamp = s.timeIndex.entries[n-1].offset
+	}
+	return s, nil
+}
+
+// Append batches that already have their offsets. records holds the
+// batches back to back.
+func (s *Segment) append(records []byte, batches []RecordBatch) error {
+	if _, err := s.log.WriteAt(records, s.size); err != nil {
+		return err
+	}
+
+	position := s.size
+	for _, batch := range batches {
+		if err := s.indexBatch(batch, position); err != nil {
+			return err
+		}
+		position += int64(len(batch))
+	}
+	s.size = position
+	return nil
+}
+
+// Account for the batch at position, adding index entries once
+// index.interval.bytes have been appended since the last ones
+func (s *Segment) indexBatch(batch RecordBatch, position int64) error {
+	if s.firstBatchTimestamp < 0 {
+		s.firstBatchTimestamp = batch.MaxTimestamp()
+	}
+	if batch.MaxTimestamp() > s.maxTimestamp {
+		s.maxTimestamp = batch.MaxTimestamp()
+		s.offsetOfMaxTimestamp = batch.LastOffset()
+	}
+	if s.bytesSinceLastIndexEntry > s.indexIntervalBytes {
+		if err := s.offsetIndex.append(batch.LastOffset(), position); err != nil {
+			return err
+		}
+		if err := s.timeIndex.maybeAppend(s.maxTimestamp, s.offsetOfMaxTimestamp); err != nil {
+			return err
+		}
+		s.bytesSinceLastIndexEntry = 0
+	}
+	s.bytesSinceLastIndexEntry += len(batch)
+	return nil
+}
+
+// Rebuild the indexes by reading every batch, and truncate the segment at
+// the first one that is cut short or fails its CRC check. Returns how many
+// bytes were truncated.
+func (s *Segment) recover() (int64, error) {
+	if err := s.offsetIndex.truncate(); err != nil {
+		return 0, err
+	}
+	if err := s.timeIndex.truncate(); err != nil {
+		return 0, err
+	}
+	s.firstBatchTimestamp, s.maxTimestamp, s.offsetOfMaxTimestamp = -1, -1, -1
+	s.bytesSinceLastIndexEntry = 0
+
+	position := int64(0)
+	for position < s.size {
+		batch, err := s.readBatch(position)
+		if errors.Is(err, ErrCorruptRecord) || errors.Is(err, ErrUnsupportedVersion) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := s.indexBatch(batch, position); err != nil {
+			return 0, err
+		}
+		position += int64(len(batch))
+	}
+
+	truncated := s.size - position
+	if truncated > 0 {
+		if err := s.log.Truncate(position); err != nil {
+			return 0, err
+		}
+		s.size = position
+	}
+	s.indexesMissing = false
+	return truncated, nil
+}
+
+// The whole batch at position, validated
+func (s *Segment) readBatch(position int64) (RecordBatch, error) {
+	header, err := s.readBatchHeader(position)
+	if err != nil {
+		return nil, err
+	}
+	size, _ := batchSize(header)
+	if position+int64(size) > s.size {
+		return nil, fmt.Errorf("%w: batch at position %d cut short", ErrCorruptRecord, position)
+	}
+	batch := make(RecordBatch, size)
+	if _, err := s.log.ReadAt(batch, position); err != nil {
+		return nil, err
+	}
+	return batch, batch.validate()
+}
+
+// Call fn with each batch of the segment, oldest first
+func (s *Segment) forEachBatch(fn func(batch RecordBatch) error) error {
+	for position := int64(0); position < s.size; {
+		batch, err := s.readBatch(position)
+		if err != nil {
+			return err
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		position += int64(len(batch))
+	}
+	return nil
+}
+
+// The header of the batch at position
+func (s *Segment) readBatchHeader(position int64) (RecordBatch, error) {
+	header := make([]byte, RECORD_BATCH_OVERHEAD)
+	if _, err := s.log.ReadAt(header, position); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w: batch header at position %d cut short", ErrCorruptRecord, position)
+		}
+		return nil, err
+	}
+	if _, err := batchSize(header); err != nil {
+		return nil, err
+	}
+	return RecordBatch(header), nil
+}
+
+// Position of the first batch at or after position whose last offset is at
+// least offset, or -1 if there is none
+func (s *Segment) findBatch(offset int64, position int64) (int64, error) {
+	for position < s.size {
+		header, err := s.readBatchHeader(position)
+		if err != nil {
+			return -1, err
+		}
+		if header.LastOffset() >= offset {
+			return position, nil
+		}
+		size, _ := batchSize(header)
+		position += int64(size)
+	}
+	return -1, nil
+}
+
+// Whole batches starting with the one holding offset, as many as fit in
+// maxBytes but at least one. Returns nothing if the segment ends before
+// offset.
+func (s *Segment) read(offset int64, maxBytes int) ([]byte, error) {
+	start, end, err := s.slice(offset, maxBytes)
+	if err != nil || start == end {
+		return nil, err
+	}
+	data := make([]byte, end-start)
+	if _, err := s.log.ReadAt(data, start); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Like read, but the batches are left in the file
+func (s *Segment) readFile(offset int64, maxBytes int) (*FileRecords, error) {
+	start, end, err := s.slice(offset, maxBytes)
+	if err != nil || start == end {
+		return nil, err
+	}
+	return newFileRecords(s.log, start, end-start)
+}
+
+// Where the batches read would return start and end in the file
+func (s *Segment) slice(offset int64, maxBytes int) (int64, int64, error) {
+	start, err := s.findBatch(offset, s.offsetIndex.lookup(offset).position)
+	if err != nil || start < 0 {
+		return 0, 0, err
+	}
+
+	end := start
+	for end < s.size {
+		header, err := s.readBatchHeader(end)
+		if err != nil {
+			return 0, 0, err
+		}
+		size, _ := batchSize(header)
+		if end > start && end+int64(size)-start > int64(maxBytes) {
+			break
+		}
+		end += int64(size)
+	}
+	return start, end, nil
+}
+
+// The offset after the segment's last batch
+func (s *Segment) nextOffset() (int64, error) {
+	next := s.baseOffset
+	position := int64(0)
+	if n := len(s.offsetIndex.entries); n > 0 {
+		next = s.offsetIndex.entries[n-1].offset + 1
+		position = s.offsetIndex.entries[n-1].position
+	}
+	for position < s.size {
+		header, err := s.readBatchHeader(position)
+		if err != nil {
+			return 0, err
+		}
+		size, _ := batchSize(header)
+		next = header.LastOffset() + 1
+		position += int64(size)
+	}
+	return next, nil
+}
+
+// The first record at or after startOffset with a timestamp at or after
+// timestamp, or false if the segment has none
+func (s *Segment) findOffsetByTimestamp(timestamp int64, startOffset int64) (TimestampAndOffset, bool, error) {
+	position := s.offsetIndex.lookup(max(s.timeIndex.lookup(timestamp).offset, startOffset)).position
+	for position < s.size {
+		header, err := s.readBatchHeader(position)
+		if err != nil {
+			return TimestampAndOffset{}, false, err
+		}
+		size, _ := batchSize(header)
+		if header.MaxTimestamp() >= timestamp && header.LastOffset() >= startOffset {
+			batch, err := s.readBatch(position)
+			if err != nil {
+				return TimestampAndOffset{}, false, err
+			}
+			records, err := batch.recordTimestamps()
+			if err != nil {
+				return TimestampAndOffset{}, false, err
+			}
+			for _, record := range records {
+				if record.Timestamp >= timestamp && record.Offset >= startOffset {
+					return record, true, nil
+				}
+			}
+			// Batches without record timestamps that start before startOffset
+			if !batch.hasRecordTimestamps() {
+				return TimestampAndOffset{Timestamp: batch.MaxTimestamp(), Offset: startOffset}, true, nil
+			}
+		}
+		position += int64(size)
+	}
+	return TimestampAndOffset{}, false, nil
+}
+
+// The newest timestamp in the segment, which retention.ms is measured
+// from. Segments without timestamps use the time they were last written.
+func (s *Segment) largestTimestamp() (int64, error) {
+	if s.maxTimestamp >= 0 {
+		return s.maxTimestamp, nil
+	}
+	info, err := s.log.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.ModTime().UnixMilli(), nil
+}
+
+// How long the segment has been taking appends for, measured from its
+// first batch's timestamp if it has one
+func (s *Segment) age(now time.Time) time.Duration {
+	if s.firstBatchTimestamp > 0 {
+		return now.Sub(time.UnixMilli(s.firstBatchTimestamp))
+	}
+	return now.Sub(s.created)
+}
+
+// Called when a new segment is rolled. The time index gets a final entry so
+// that the segment's max timestamp can be found without reading it.
+func (s *Segment) onBecomeInactive() error {
+	if s.maxTimestamp >= 0 {
+		if err := s.timeIndex.maybeAppend(s.maxTimestamp, s.offsetOfMaxTimestamp); err != nil {
+			return err
+		}
+	}
+	return s.flush()
+}
+
+func (s *Segment) flush() error {
+	for _, f := range []*os.File{s.log, s.offsetIndex.file, s.timeIndex.file} {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete the segment's files. While it's open, it can still be read through
+// the open files.
+func (s *Segment) delete(dir string) error {
+	var errs []error
+	for _, suffix := range []string{LOG_FILE_SUFFIX, INDEX_FILE_SUFFIX, TIME_INDEX_FILE_SUFFIX} {
+		if err := os.Remove(segmentPath(dir, s.baseOffset, suffix)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close whichever of the files are open
+func (s *Segment) close() error {
+	var errs []error
+	if s.log != nil {
+		errs = append(errs, s.log.Close())
+	}
+	if s.offsetIndex != nil {
+		errs = append(errs, s.offsetIndex.file.Close())
+	}
+	if s.timeIndex != nil {
+		errs = append(errs, s.timeIndex.file.Close())
+	}
+	return errors.Join(errs...)
+}
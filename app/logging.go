@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Formats of the broker and request logs
+const (
+	LOGGER_FORMAT_TEXT = "text"
+	LOGGER_FORMAT_JSON = "json"
+)
+
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	if format == LOGGER_FORMAT_JSON {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+// Error counts logged as a group, errors.NONE=3 in text logs
+type ErrorCounts map[ErrorCode]int
+
+func (c ErrorCounts) LogValue() slog.Value {
+	codes := make([]ErrorCode, 0, len(c))
+	for code := range c {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+
+	attrs := make([]slog.Attr, 0, len(codes))
+	for _, code := range codes {
+		attrs = append(attrs, slog.Int(code.String(), c[code]))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Log a request once its response is sent, with the details Kafka's
+// kafka.request.logger has at DEBUG
+func (c *Connection) logRequest(pending *PendingResponse, responseBytes int64) {
+	requestLog := c.broker.requestLog
+	if !requestLog.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	header := pending.header
+	requestLog.Debug("Completed request",
+		"api", header.requestApiKey.String(),
+		"version", header.requestApiVersion,
+		"clientId", header.clientID,
+		"correlationId", header.correlationID,
+		"principal", pending.principal.String(),
+		"listener", c.context.listenerName,
+		"clientAddress", c.context.clientAddress.String(),
+		"totalTimeMs", float64(time.Since(pending.received).Microseconds())/1000,
+		"responseBytes", responseBytes,
+		"errors", ErrorCounts(pending.response.body.errorCounts()),
+	)
+}
+
+// Whether the frames of a request and its response are dumped, which only
+// happens for the client request.logger.dump.client.id names, with the
+// request log at DEBUG
+func (c *Connection) dumpsFrames(header RequestHeader) bool {
+	clientID := c.broker.config.requestLoggerDumpClientID
+	return clientID != "" && header.clientID == clientID &&
+		c.broker.requestLog.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// Dump a size-prefixed frame in hex to the request log
+func (c *Connection) dumpFrame(msg string, header RequestHeader, frame []byte) {
+	c.broker.requestLog.Debug(msg,
+		"api", header.requestApiKey.String(),
+		"clientId", header.clientID,
+		"correlationId", header.correlationID,
+		"frame", hex.EncodeToString(frame),
+	)
+}
+
+// A request as it came off the wire, size included
+func requestFrame(req RequestMessage) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(*req.buf))), *req.buf...)
+}
@@ -3,33 +3,108 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
 )
 
 type RecordType byte
 
 type RecordBatchInfo struct {
-	recordsLength int
+	recordsLength   int
+	lastOffsetDelta int32
+	maxTimestamp    int64
 }
 type Records struct {
-	TopicRecords     []TopicRecord
-	PartitionRecords []PartitionRecord
+	// Brokers still registered, with fencing changes already applied
+	RegisterBrokerRecords []RegisterBrokerRecord
+	TopicRecords          []TopicRecord
+	Partitions            PartitionRegistry
+	// Credentials still in effect, removals already applied
+	UserScramCredentialRecords []UserScramCredentialRecord
+	// ACLs still in effect, removals already applied
+	AccessControlEntryRecords []AccessControlEntryRecord
+	// Quotas still in effect, one per entity and key, with removals and
+	// overwritten values already applied
+	ClientQuotaRecords []ClientQuotaRecord
+	// Configs set on each topic by name, e.g. retention.ms. Deleted
+	// topics lose theirs.
+	TopicConfigs map[string]map[string]string
+	// Offset and timestamp of the last record replayed, -1 for an empty
+	// log
+	LastOffset    int64
+	LastTimestamp int64
 }
 
 const (
-	TOPIC_RECORD     RecordType = 2
-	PARTITION_RECORD RecordType = 3
+	REGISTER_BROKER_RECORD              RecordType = 0
+	UNREGISTER_BROKER_RECORD            RecordType = 1
+	TOPIC_RECORD                        RecordType = 2
+	PARTITION_RECORD                    RecordType = 3
+	CONFIG_RECORD                       RecordType = 4
+	PARTITION_CHANGE_RECORD             RecordType = 5
+	ACCESS_CONTROL_ENTRY_RECORD         RecordType = 6
+	FENCE_BROKER_RECORD                 RecordType = 7
+	UNFENCE_BROKER_RECORD               RecordType = 8
+	REMOVE_TOPIC_RECORD                 RecordType = 9
+	USER_SCRAM_CREDENTIAL_RECORD        RecordType = 11
+	CLIENT_QUOTA_RECORD                 RecordType = 14
+	BROKER_REGISTRATION_CHANGE_RECORD   RecordType = 17
+	REMOVE_ACCESS_CONTROL_ENTRY_RECORD  RecordType = 18
+	REMOVE_USER_SCRAM_CREDENTIAL_RECORD RecordType = 22
+)
+
+// PartitionChangeRecord values meaning the field didn't change
+const (
+	NO_LEADER_CHANGE                ReplicaID = -2
+	NO_LEADER_RECOVERY_STATE_CHANGE int8      = -1
 )
 
 type Record interface{}
 
+// Written by the controller when a broker joins the cluster. Only the
+// fields we use are kept.
+type RegisterBrokerRecord struct {
+	version     byte
+	brokerID    int32
+	brokerEpoch int64
+	fenced      bool
+}
+
+type UnregisterBrokerRecord struct {
+	version  byte
+	brokerID int32
+}
+
+// FenceBrokerRecord, UnfenceBrokerRecord and BrokerRegistrationChangeRecord
+// all boil down to this
+type BrokerFencingRecord struct {
+	brokerID int32
+	fenced   bool
+}
+
 type TopicRecord struct {
 	version   byte
 	topicName string
 	topicUUID UUID
 }
 
+// Written when a topic is deleted, along with all of its partitions
+type RemoveTopicRecord struct {
+	version   byte
+	topicUUID UUID
+}
+
 type PartitionRecord struct {
 	version          byte
 	partitionID      int32
@@ -42,35 +117,441 @@ type PartitionRecord struct {
 	leaderEpoch      int32
 	partitionEpoch   int32
 	directories      []UUID
+	// Tagged fields
+	leaderRecoveryState    int8
+	eligibleLeaderReplicas []ReplicaID
+	lastKnownELR           []ReplicaID
+}
+
+// Changes to a partition. Nil fields, NO_LEADER_CHANGE and
+// NO_LEADER_RECOVERY_STATE_CHANGE are left as they were.
+type PartitionChangeRecord struct {
+	version                byte
+	partitionID            int32
+	topicUUID              UUID
+	isrNodes               []ReplicaID
+	leader                 ReplicaID
+	replicaNodes           []ReplicaID
+	removingReplicas       []ReplicaID
+	addingReplicas         []ReplicaID
+	leaderRecoveryState    int8
+	eligibleLeaderReplicas []ReplicaID
+	lastKnownELR           []ReplicaID
+	directories            []UUID
+}
+
+// What a config applies to. Unlike the ACL resource types, these are bits.
+type ConfigResourceType int8
+
+const (
+	CONFIG_RESOURCE_TOPIC  ConfigResourceType = 2
+	CONFIG_RESOURCE_BROKER ConfigResourceType = 4
+)
+
+// Written by kafka-configs.sh --alter --entity-type topics/brokers. A null
+// value, which we read as deleted, removes the config.
+type ConfigRecord struct {
+	version      byte
+	resourceType ConfigResourceType
+	resourceName string
+	name         string
+	value        string
+	deleted      bool
+}
+
+// Written by kafka-configs.sh --alter --add-config 'SCRAM-SHA-256=[...]'
+type UserScramCredentialRecord struct {
+	version    byte
+	name       string
+	mechanism  int8
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+	iterations int32
+}
+
+type RemoveUserScramCredentialRecord struct {
+	version   byte
+	name      string
+	mechanism int8
+}
+
+// Written by kafka-acls.sh --add, through CreateAcls
+type AccessControlEntryRecord struct {
+	version        byte
+	id             UUID
+	resourceType   ResourceType
+	resourceName   string
+	patternType    PatternType
+	principal      string
+	host           string
+	operation      AclOperation
+	permissionType AclPermissionType
+}
+
+type RemoveAccessControlEntryRecord struct {
+	version byte
+	id      UUID
 }
 
-func getRecords() Records {
-	data, err := os.ReadFile("/tmp/kraft-combined-logs/__cluster_metadata-0/00000000000000000000.log")
+// Written by kafka-configs.sh --alter --entity-type users/clients, through
+// AlterClientQuotas. Removals are records of their own with remove set.
+type ClientQuotaRecord struct {
+	version byte
+	entity  QuotaEntity
+	key     string
+	value   float64
+	remove  bool
+}
+
+// The __cluster_metadata log written by the KRaft controller. The broker
+// appends the records of the admin APIs it serves itself, e.g. ACLs.
+type MetadataLog struct {
+	dir string
+	// The broker reading the log, which is online whether or not its
+	// registration made it into the log
+	nodeID int32
+	// Guards the segments against reads of half-written batches
+	mu sync.Mutex
+	// Built on first use and rebuilt whenever the segments change, whoever
+	// appended to them
+	current atomic.Pointer[MetadataImage]
+}
+
+// The log replayed, shared between connections without locking. An image
+// is never modified once built.
+type MetadataImage struct {
+	records Records
+	topics  *TopicIndex
+	// The segments as they were when the image was built
+	segments []SegmentState
+}
+
+func NewMetadataLog(dir string, nodeID int32) *MetadataLog {
+	return &MetadataLog{dir: dir, nodeID: nodeID}
+}
+
+// Read the cluster ID that kafka-storage.sh format wrote to meta.properties
+// in the log directory. Returns "" if the directory wasn't formatted.
+func readClusterID(logDir string) string {
+	f, err := os.Open(filepath.Join(logDir, "meta.properties"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	props, err := readProperties(f)
+	if err != nil {
+		return ""
+	}
+	return props["cluster.id"]
+}
+
+// Paths of the log segments, oldest first. Segment names are zero padded
+// base offsets, so lexical order is offset order.
+func (m *MetadataLog) segmentPaths() []string {
+	paths, err := filepath.Glob(filepath.Join(m.dir, "*.log"))
 	checkError(err)
+	sort.Strings(paths)
+	return paths
+}
+
+// Concatenated contents of every segment. Call with m.mu held.
+func (m *MetadataLog) readSegments() []byte {
+	// A log that hasn't been written yet has no records
+	data := []byte{}
+	for _, path := range m.segmentPaths() {
+		segment, err := os.ReadFile(path)
+		checkError(err)
+		data = append(data, segment...)
+	}
+	return data
+}
+
+// Size and modification time of a segment, to tell when the controller
+// appended to it
+type SegmentState struct {
+	path    string
+	size    int64
+	modTime int64
+}
+
+// States of the segments, oldest first
+func (m *MetadataLog) segmentStates() []SegmentState {
+	paths := m.segmentPaths()
+	states := make([]SegmentState, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted since it was listed, the next lookup rebuilds
+			continue
+		}
+		checkError(err)
+		states = append(states, SegmentState{path: path, size: info.Size(), modTime: info.ModTime().UnixNano()})
+	}
+	return states
+}
+
+// The image of the log, rebuilt if the segments changed since it was last
+// built
+func (m *MetadataLog) image() *MetadataImage {
+	if image := m.current.Load(); image != nil && slices.Equal(image.segments, m.segmentStates()) {
+		return image
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.rebuildImage()
+}
 
+// Rebuild the image, unless it's up to date. Call with m.mu held.
+func (m *MetadataLog) rebuildImage() *MetadataImage {
+	// Taken before reading, so a write in between rebuilds again next time
+	// instead of being missed
+	segments := m.segmentStates()
+	if image := m.current.Load(); image != nil && slices.Equal(image.segments, segments) {
+		return image
+	}
+	records := parseRecords(m.readSegments())
+	image := &MetadataImage{records: records, topics: newTopicIndex(records), segments: segments}
+	m.current.Store(image)
+	return image
+}
+
+func (m *MetadataLog) topicIndex() *TopicIndex {
+	return m.image().topics
+}
+
+// Replay the records of the log, applying changes and removals
+func parseRecords(data []byte) Records {
 	buf := bytes.NewBuffer(data)
-	records := Records{}
+	records := Records{TopicConfigs: map[string]map[string]string{}, LastOffset: -1, LastTimestamp: -1}
 
 	for buf.Len() > 0 {
-		batchBuf := getRecordBatchBuffer(buf)
+		baseOffset, batchBuf := getRecordBatchBuffer(buf)
 		info := readRecordBatchInfo(batchBuf)
+		records.LastOffset = baseOffset + int64(info.lastOffsetDelta)
+		records.LastTimestamp = info.maxTimestamp
 
 		for range info.recordsLength {
 			record := readRecord(batchBuf)
 			switch r := record.(type) {
+			case RegisterBrokerRecord:
+				records.unregisterBroker(r.brokerID)
+				records.RegisterBrokerRecords = append(records.RegisterBrokerRecords, r)
+			case UnregisterBrokerRecord:
+				records.unregisterBroker(r.brokerID)
+			case BrokerFencingRecord:
+				for i := range records.RegisterBrokerRecords {
+					if records.RegisterBrokerRecords[i].brokerID == r.brokerID {
+						records.RegisterBrokerRecords[i].fenced = r.fenced
+					}
+				}
 			case TopicRecord:
 				records.TopicRecords = append(records.TopicRecords, r)
+			case RemoveTopicRecord:
+				for _, t := range records.TopicRecords {
+					if t.topicUUID == r.topicUUID {
+						delete(records.TopicConfigs, t.topicName)
+					}
+				}
+				records.TopicRecords = slices.DeleteFunc(records.TopicRecords, func(t TopicRecord) bool {
+					return t.topicUUID == r.topicUUID
+				})
+				records.Partitions.removeTopic(r.topicUUID)
 			case PartitionRecord:
-				records.PartitionRecords = append(records.PartitionRecords, r)
+				records.Partitions.register(r)
+			case PartitionChangeRecord:
+				records.Partitions.change(r)
+			case ConfigRecord:
+				if r.resourceType != CONFIG_RESOURCE_TOPIC {
+					continue
+				}
+				configs := records.TopicConfigs[r.resourceName]
+				if configs == nil {
+					configs = map[string]string{}
+					records.TopicConfigs[r.resourceName] = configs
+				}
+				if r.deleted {
+					delete(configs, r.name)
+				} else {
+					configs[r.name] = r.value
+				}
+			case UserScramCredentialRecord:
+				records.removeUserScramCredential(r.name, r.mechanism)
+				records.UserScramCredentialRecords = append(records.UserScramCredentialRecords, r)
+			case RemoveUserScramCredentialRecord:
+				records.removeUserScramCredential(r.name, r.mechanism)
+			case AccessControlEntryRecord:
+				records.AccessControlEntryRecords = append(records.AccessControlEntryRecords, r)
+			case RemoveAccessControlEntryRecord:
+				records.AccessControlEntryRecords = slices.DeleteFunc(records.AccessControlEntryRecords, func(acl AccessControlEntryRecord) bool {
+					return acl.id == r.id
+				})
+			case ClientQuotaRecord:
+				records.ClientQuotaRecords = slices.DeleteFunc(records.ClientQuotaRecords, func(q ClientQuotaRecord) bool {
+					return q.entity == r.entity && q.key == r.key
+				})
+				if !r.remove {
+					records.ClientQuotaRecords = append(records.ClientQuotaRecords, r)
+				}
 			}
 		}
 	}
-	fmt.Printf("Records: %+v\n", records)
 	return records
 }
 
-func getRecordBatchBuffer(buf *bytes.Buffer) *bytes.Buffer {
+func (r *Records) unregisterBroker(brokerID int32) {
+	r.RegisterBrokerRecords = slices.DeleteFunc(r.RegisterBrokerRecords, func(b RegisterBrokerRecord) bool {
+		return b.brokerID == brokerID
+	})
+}
+
+// Replicas on brokers that aren't registered, or are fenced. localNodeID
+// is always online.
+func (r *Records) offlineReplicas(replicas []ReplicaID, localNodeID int32) []ReplicaID {
+	offline := []ReplicaID{}
+	for _, replica := range replicas {
+		if int32(replica) == localNodeID {
+			continue
+		}
+		i := slices.IndexFunc(r.RegisterBrokerRecords, func(b RegisterBrokerRecord) bool {
+			return b.brokerID == int32(replica)
+		})
+		if i < 0 || r.RegisterBrokerRecords[i].fenced {
+			offline = append(offline, replica)
+		}
+	}
+	return offline
+}
+
+func (r *Records) removeUserScramCredential(name string, mechanism int8) {
+	r.UserScramCredentialRecords = slices.DeleteFunc(r.UserScramCredentialRecords, func(c UserScramCredentialRecord) bool {
+		return c.name == name && c.mechanism == mechanism
+	})
+}
+
+// The path of the newest segment, and the offset the next record appended
+// to it gets. Call with m.mu held.
+func (m *MetadataLog) activeSegment() (path string, nextOffset int64, err error) {
+	paths := m.segmentPaths()
+	if len(paths) == 0 {
+		return filepath.Join(m.dir, fmt.Sprintf("%020d.log", 0)), 0, nil
+	}
+	path = paths[len(paths)-1]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	nextOffset, err = nextBatchOffset(path, data)
+	return path, nextOffset, err
+}
+
+// The offset the next record appended to the log gets
+func (m *MetadataLog) endOffset() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, nextOffset, err := m.activeSegment()
+	return nextOffset, err
+}
+
+// Append record values as a single batch to the newest segment, creating
+// the log if needed
+func (m *MetadataLog) appendRecords(values [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path, nextOffset, err := m.activeSegment()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(encodeRecordBatch(nextOffset, time.Now().UnixMilli(), values)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	// Rebuilt while the lock is held, so that images are replaced in the
+	// order the log changed
+	m.rebuildImage()
+	return nil
+}
+
+// Truncate whatever follows the last whole, valid batch of the active
+// segment, left behind if the broker died while appending. The metadata log
+// is small enough to check on every start.
+func (m *MetadataLog) recover() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	paths := m.segmentPaths()
+	if len(paths) == 0 {
+		return nil
+	}
+	path := paths[len(paths)-1]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	valid := log.ValidBytes(data)
+	if valid == len(data) {
+		return nil
+	}
+	slog.Warn("Truncating invalid batches", "bytes", len(data)-valid, "path", path)
+	if err := os.Truncate(path, int64(valid)); err != nil {
+		return err
+	}
+	m.current.Store(nil)
+	return nil
+}
+
+// The offset following the last batch of a segment. Segments are named
+// after their base offset, which is where an empty one starts.
+func nextBatchOffset(path string, segment []byte) (int64, error) {
 	var baseOffset int64
+	if _, err := fmt.Sscanf(filepath.Base(path), "%d.log", &baseOffset); err != nil {
+		return 0, fmt.Errorf("invalid segment name %s", filepath.Base(path))
+	}
+
+	next := baseOffset
+	for pos := 0; pos < len(segment); {
+		// baseOffset, batchLength, partitionLeaderEpoch, magic, crc,
+		// attributes, then lastOffsetDelta
+		if len(segment)-pos < 27 {
+			return 0, fmt.Errorf("truncated record batch at position %d of %s", pos, path)
+		}
+		batchBaseOffset := int64(binary.BigEndian.Uint64(segment[pos:]))
+		batchLength := int(binary.BigEndian.Uint32(segment[pos+8:]))
+		lastOffsetDelta := int64(binary.BigEndian.Uint32(segment[pos+23:]))
+		next = batchBaseOffset + lastOffsetDelta + 1
+		pos += 12 + batchLength
+	}
+	return next, nil
+}
+
+// Encode a v2 record batch of keyless records, all stamped with timestamp
+func encodeRecordBatch(baseOffset int64, timestamp int64, values [][]byte) []byte {
+	records := make([]log.Record, len(values))
+	for i, value := range values {
+		records[i] = log.Record{Offset: baseOffset + int64(i), Timestamp: timestamp, Value: value}
+	}
+	return log.EncodeRecordBatch(records)
+}
+
+func getRecordBatchBuffer(buf *bytes.Buffer) (baseOffset int64, batch *bytes.Buffer) {
 	err := binary.Read(buf, binary.BigEndian, &baseOffset)
 	checkError(err)
 
@@ -80,7 +561,7 @@ func getRecordBatchBuffer(buf *bytes.Buffer) *bytes.Buffer {
 
 	out := make([]byte, batchLengthBytes)
 	buf.Read(out)
-	return bytes.NewBuffer(out)
+	return baseOffset, bytes.NewBuffer(out)
 }
 
 func readRecordBatchInfo(buf *bytes.Buffer) (info RecordBatchInfo) {
@@ -129,6 +610,8 @@ func readRecordBatchInfo(buf *bytes.Buffer) (info RecordBatchInfo) {
 	checkError(err)
 
 	info.recordsLength = int(recordsLength)
+	info.lastOffsetDelta = lastOffsetDelta
+	info.maxTimestamp = maxTimestamp
 	return info
 }
 
@@ -152,13 +635,9 @@ func readRecord(inBuf *bytes.Buffer) Record {
 	err = binary.Read(buf, binary.BigEndian, &attributes)
 	checkError(err)
 
-	var timestampDelta byte
-	err = binary.Read(buf, binary.BigEndian, &timestampDelta)
-	checkError(err)
-
-	var offsetDelta byte
-	err = binary.Read(buf, binary.BigEndian, &offsetDelta)
-	checkError(err)
+	// Both are varints, offset deltas past 63 take more than a byte
+	readSignedVarint(buf) // timestamp delta
+	readSignedVarint(buf) // offset delta
 
 	keyLength := readSignedVarint(buf)
 
@@ -186,10 +665,34 @@ func readRecord(inBuf *bytes.Buffer) Record {
 		checkError(err)
 
 		switch recordType {
+		case REGISTER_BROKER_RECORD:
+			return readRegisterBrokerRecord(valueBuffer)
+		case UNREGISTER_BROKER_RECORD:
+			return readUnregisterBrokerRecord(valueBuffer)
+		case FENCE_BROKER_RECORD, UNFENCE_BROKER_RECORD:
+			return readBrokerFencingRecord(valueBuffer, recordType == FENCE_BROKER_RECORD)
+		case BROKER_REGISTRATION_CHANGE_RECORD:
+			return readBrokerRegistrationChangeRecord(valueBuffer)
 		case TOPIC_RECORD:
 			return readTopicRecord(valueBuffer)
+		case REMOVE_TOPIC_RECORD:
+			return readRemoveTopicRecord(valueBuffer)
 		case PARTITION_RECORD:
 			return readPartitionRecord(valueBuffer)
+		case PARTITION_CHANGE_RECORD:
+			return readPartitionChangeRecord(valueBuffer)
+		case CONFIG_RECORD:
+			return readConfigRecord(valueBuffer)
+		case USER_SCRAM_CREDENTIAL_RECORD:
+			return readUserScramCredentialRecord(valueBuffer)
+		case REMOVE_USER_SCRAM_CREDENTIAL_RECORD:
+			return readRemoveUserScramCredentialRecord(valueBuffer)
+		case ACCESS_CONTROL_ENTRY_RECORD:
+			return readAccessControlEntryRecord(valueBuffer)
+		case REMOVE_ACCESS_CONTROL_ENTRY_RECORD:
+			return readRemoveAccessControlEntryRecord(valueBuffer)
+		case CLIENT_QUOTA_RECORD:
+			return readClientQuotaRecord(valueBuffer)
 		}
 	}
 	return nil
@@ -227,6 +730,18 @@ func readTopicRecord(buf *bytes.Buffer) TopicRecord {
 	return topicRecord
 }
 
+func readRemoveTopicRecord(buf *bytes.Buffer) RemoveTopicRecord {
+	record := RemoveTopicRecord{}
+
+	err := binary.Read(buf, binary.BigEndian, &record.version)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.topicUUID)
+	checkError(err)
+
+	return record
+}
+
 func readPartitionRecord(buf *bytes.Buffer) PartitionRecord {
 	partitionRecord := PartitionRecord{}
 
@@ -253,7 +768,296 @@ func readPartitionRecord(buf *bytes.Buffer) PartitionRecord {
 	err = binary.Read(buf, binary.BigEndian, &partitionRecord.partitionEpoch)
 	checkError(err)
 
-	partitionRecord.directories = readCompactArray[UUID](buf)
+	// v0 predates JBOD support
+	if partitionRecord.version >= 1 {
+		partitionRecord.directories = readCompactArray[UUID](buf)
+	}
+
+	readTaggedFields(buf, func(tag int, field *bytes.Buffer) {
+		switch tag {
+		case 0:
+			err := binary.Read(field, binary.BigEndian, &partitionRecord.leaderRecoveryState)
+			checkError(err)
+		case 1:
+			partitionRecord.eligibleLeaderReplicas = readCompactArray[ReplicaID](field)
+		case 2:
+			partitionRecord.lastKnownELR = readCompactArray[ReplicaID](field)
+		}
+	})
 
 	return partitionRecord
 }
+
+// Everything but the partition and topic is a tagged field, present only
+// if it changed
+func readPartitionChangeRecord(buf *bytes.Buffer) PartitionChangeRecord {
+	record := PartitionChangeRecord{
+		leader:              NO_LEADER_CHANGE,
+		leaderRecoveryState: NO_LEADER_RECOVERY_STATE_CHANGE,
+	}
+
+	err := binary.Read(buf, binary.BigEndian, &record.version)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.partitionID)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.topicUUID)
+	checkError(err)
+
+	readTaggedFields(buf, func(tag int, field *bytes.Buffer) {
+		switch tag {
+		case 0:
+			record.isrNodes = readCompactArray[ReplicaID](field)
+		case 1:
+			err := binary.Read(field, binary.BigEndian, &record.leader)
+			checkError(err)
+		case 2:
+			record.replicaNodes = readCompactArray[ReplicaID](field)
+		case 3:
+			record.removingReplicas = readCompactArray[ReplicaID](field)
+		case 4:
+			record.addingReplicas = readCompactArray[ReplicaID](field)
+		case 5:
+			err := binary.Read(field, binary.BigEndian, &record.leaderRecoveryState)
+			checkError(err)
+		case 6:
+			record.eligibleLeaderReplicas = readCompactArray[ReplicaID](field)
+		case 7:
+			record.lastKnownELR = readCompactArray[ReplicaID](field)
+		case 8:
+			record.directories = readCompactArray[UUID](field)
+		}
+	})
+
+	return record
+}
+
+func readRegisterBrokerRecord(buf *bytes.Buffer) RegisterBrokerRecord {
+	record := RegisterBrokerRecord{}
+
+	err := binary.Read(buf, binary.BigEndian, &record.version)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.brokerID)
+	checkError(err)
+
+	if record.version >= 2 {
+		buf.Next(1) // is migrating ZK broker
+	}
+	buf.Next(16) // incarnation ID
+
+	err = binary.Read(buf, binary.BigEndian, &record.brokerEpoch)
+	checkError(err)
+
+	// Endpoints: name, host, port and security protocol
+	for range max(0, readArrayLength(buf, true)) {
+		readComapctString(buf)
+		readComapctString(buf)
+		buf.Next(2 + 2)
+		skipTaggedFields(buf)
+	}
+	// Features: name, min and max supported version
+	for range max(0, readArrayLength(buf, true)) {
+		readComapctString(buf)
+		buf.Next(2 + 2)
+		skipTaggedFields(buf)
+	}
+	readNullableString(buf, true) // rack
+
+	err = binary.Read(buf, binary.BigEndian, &record.fenced)
+	checkError(err)
+
+	return record
+}
+
+func readUnregisterBrokerRecord(buf *bytes.Buffer) UnregisterBrokerRecord {
+	record := UnregisterBrokerRecord{}
+
+	err := binary.Read(buf, binary.BigEndian, &record.version)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.brokerID)
+	checkError(err)
+
+	return record
+}
+
+func readBrokerFencingRecord(buf *bytes.Buffer, fenced bool) BrokerFencingRecord {
+	record := BrokerFencingRecord{fenced: fenced}
+
+	buf.Next(1) // version
+	err := binary.Read(buf, binary.BigEndian, &record.brokerID)
+	checkError(err)
+
+	return record
+}
+
+// Fencing changes are a tagged field: 1 if the broker was fenced, -1 if it
+// was unfenced. Records that leave fencing alone are skipped.
+func readBrokerRegistrationChangeRecord(buf *bytes.Buffer) Record {
+	record := BrokerFencingRecord{}
+
+	buf.Next(1) // version
+	err := binary.Read(buf, binary.BigEndian, &record.brokerID)
+	checkError(err)
+	buf.Next(8) // broker epoch
+
+	var fenced int8
+	readTaggedFields(buf, func(tag int, field *bytes.Buffer) {
+		if tag == 0 {
+			err := binary.Read(field, binary.BigEndian, &fenced)
+			checkError(err)
+		}
+	})
+	if fenced == 0 {
+		return nil
+	}
+	record.fenced = fenced > 0
+	return record
+}
+
+func readConfigRecord(buf *bytes.Buffer) ConfigRecord {
+	record := ConfigRecord{}
+
+	err := binary.Read(buf, binary.BigEndian, &record.version)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.resourceType)
+	checkError(err)
+
+	record.resourceName = readComapctString(buf)
+	record.name = readComapctString(buf)
+	record.value, record.deleted = readNullableString(buf, true)
+
+	return record
+}
+
+func readUserScramCredentialRecord(buf *bytes.Buffer) UserScramCredentialRecord {
+	record := UserScramCredentialRecord{}
+
+	err := binary.Read(buf, binary.BigEndian, &record.version)
+	checkError(err)
+
+	record.name = readComapctString(buf)
+
+	err = binary.Read(buf, binary.BigEndian, &record.mechanism)
+	checkError(err)
+
+	record.salt = readBytes(buf, true)
+	record.storedKey = readBytes(buf, true)
+	record.serverKey = readBytes(buf, true)
+
+	err = binary.Read(buf, binary.BigEndian, &record.iterations)
+	checkError(err)
+
+	return record
+}
+
+func readRemoveUserScramCredentialRecord(buf *bytes.Buffer) RemoveUserScramCredentialRecord {
+	record := RemoveUserScramCredentialRecord{}
+
+	err := binary.Read(buf, binary.BigEndian, &record.version)
+	checkError(err)
+
+	record.name = readComapctString(buf)
+
+	err = binary.Read(buf, binary.BigEndian, &record.mechanism)
+	checkError(err)
+
+	return record
+}
+
+func readAccessControlEntryRecord(buf *bytes.Buffer) AccessControlEntryRecord {
+	record := AccessControlEntryRecord{}
+
+	err := binary.Read(buf, binary.BigEndian, &record.version)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.id)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.resourceType)
+	checkError(err)
+
+	record.resourceName = readComapctString(buf)
+
+	err = binary.Read(buf, binary.BigEndian, &record.patternType)
+	checkError(err)
+
+	record.principal = readComapctString(buf)
+	record.host = readComapctString(buf)
+
+	err = binary.Read(buf, binary.BigEndian, &record.operation)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.permissionType)
+	checkError(err)
+
+	return record
+}
+
+func readRemoveAccessControlEntryRecord(buf *bytes.Buffer) RemoveAccessControlEntryRecord {
+	record := RemoveAccessControlEntryRecord{}
+
+	err := binary.Read(buf, binary.BigEndian, &record.version)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.id)
+	checkError(err)
+
+	return record
+}
+
+// Quotas for entity types we don't support, e.g. ip, are skipped
+func readClientQuotaRecord(buf *bytes.Buffer) Record {
+	record := ClientQuotaRecord{}
+
+	err := binary.Read(buf, binary.BigEndian, &record.version)
+	checkError(err)
+
+	entity, err := newQuotaEntity(readQuotaEntityData(buf, true))
+	if err != nil {
+		return nil
+	}
+	record.entity = entity
+
+	record.key = readComapctString(buf)
+
+	err = binary.Read(buf, binary.BigEndian, &record.value)
+	checkError(err)
+
+	err = binary.Read(buf, binary.BigEndian, &record.remove)
+	checkError(err)
+
+	return record
+}
+
+// Record values start with the frame version, the record type and the
+// record's own version
+func (r AccessControlEntryRecord) serialize() []byte {
+	res := []byte{1, byte(ACCESS_CONTROL_ENTRY_RECORD), r.version}
+	res = append(res, r.id[:]...)
+	res = append(res, byte(r.resourceType))
+	res = append(res, encodeCompactString(r.resourceName)...)
+	res = append(res, byte(r.patternType))
+	res = append(res, encodeCompactString(r.principal)...)
+	res = append(res, encodeCompactString(r.host)...)
+	res = append(res, byte(r.operation), byte(r.permissionType))
+	return append(res, 0)
+}
+
+func (r RemoveAccessControlEntryRecord) serialize() []byte {
+	res := []byte{1, byte(REMOVE_ACCESS_CONTROL_ENTRY_RECORD), r.version}
+	res = append(res, r.id[:]...)
+	return append(res, 0)
+}
+
+func (r ClientQuotaRecord) serialize() []byte {
+	res := []byte{1, byte(CLIENT_QUOTA_RECORD), r.version}
+	res = appendQuotaEntityData(res, r.entity.data(), true)
+	res = append(res, encodeCompactString(r.key)...)
+	res = appendFloat64(res, r.value)
+	res = appendBool(res, r.remove)
+	return append(res, 0)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Response
+type MetadataResponse struct {
+	version                     int16
+	throttleTime                int32
+	brokers                     []MetadataResponseBroker
+	clusterID                   string
+	controllerID                int32
+	topics                      []MetadataResponseTopic
+	clusterAuthorizedOperations int32
+	tagBuffer                   byte
+}
+
+type MetadataResponseBroker struct {
+	version   int16
+	nodeID    int32
+	host      string
+	port      int32
+	rack      string
+	tagBuffer byte
+}
+
+type MetadataResponseTopic struct {
+	version int16
+	Topic
+}
+
+type MetadataResponsePartition struct {
+	version int16
+	Partition
+}
+
+func (r MetadataResponse) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(METADATA, r.version)
+
+	if r.version >= 3 {
+		res = binary.BigEndian.AppendUint32(res, uint32(r.throttleTime))
+	}
+
+	brokers := make([]SerializableElement, len(r.brokers))
+	for i, v := range r.brokers {
+		brokers[i] = v
+	}
+	res = append(res, encodeCustomArray(brokers, flexible)...)
+
+	if r.version >= 2 {
+		res = appendNullableString(res, r.clusterID, flexible)
+	}
+	if r.version >= 1 {
+		res = binary.BigEndian.AppendUint32(res, uint32(r.controllerID))
+	}
+
+	topics := make([]SerializableElement, len(r.topics))
+	for i, v := range r.topics {
+		topics[i] = v
+	}
+	res = append(res, encodeCustomArray(topics, flexible)...)
+
+	if r.version >= 8 && r.version <= 10 {
+		res = binary.BigEndian.AppendUint32(res, uint32(r.clusterAuthorizedOperations))
+	}
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (r MetadataResponse) withThrottleTime(throttleTime int32) SerializableResponse {
+	r.throttleTime = throttleTime
+	return r
+}
+
+func (r MetadataResponse) errorCounts() map[ErrorCode]int {
+	counts := map[ErrorCode]int{}
+	for _, topic := range r.topics {
+		counts[topic.errorCode]++
+		for _, partition := range topic.partitions {
+			counts[partition.errorCode]++
+		}
+	}
+	return counts
+}
+
+func (b MetadataResponseBroker) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(METADATA, b.version)
+
+	res = binary.BigEndian.AppendUint32(res, uint32(b.nodeID))
+	res = appendString(res, b.host, flexible)
+	res = binary.BigEndian.AppendUint32(res, uint32(b.port))
+	if b.version >= 1 {
+		res = appendNullableString(res, b.rack, flexible)
+	}
+
+	if flexible {
+		res = append(res, b.tagBuffer)
+	}
+	return res
+}
+
+func (t MetadataResponseTopic) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(METADATA, t.version)
+
+	res = binary.BigEndian.AppendUint16(res, uint16(t.errorCode))
+	res = appendString(res, t.topicName, flexible)
+	if t.version >= 10 {
+		res = append(res, t.topicID[:]...)
+	}
+	if t.version >= 1 {
+		res = appendBool(res, t.isInternal)
+	}
+
+	partitions := make([]SerializableElement, len(t.partitions))
+	for i, v := range t.partitions {
+		partitions[i] = MetadataResponsePartition{version: t.version, Partition: v}
+	}
+	res = append(res, encodeCustomArray(partitions, flexible)...)
+
+	if t.version >= 8 {
+		res = binary.BigEndian.AppendUint32(res, uint32(t.authorizedOperations))
+	}
+
+	if flexible {
+		res = append(res, t.tagBuffer)
+	}
+	return res
+}
+
+func (p MetadataResponsePartition) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(METADATA, p.version)
+
+	res = binary.BigEndian.AppendUint16(res, uint16(p.errorCode))
+	res = binary.BigEndian.AppendUint32(res, uint32(p.partitionIndex))
+	res = binary.BigEndian.AppendUint32(res, uint32(p.leaderID))
+	if p.version >= 7 {
+		res = binary.BigEndian.AppendUint32(res, uint32(p.leaderEpoch))
+	}
+	res = append(res, encodeInt32Array(p.replicaNodes, flexible)...)
+	res = append(res, encodeInt32Array(p.isrNodes, flexible)...)
+	if p.version >= 5 {
+		res = append(res, encodeInt32Array(p.offlineReplicas, flexible)...)
+	}
+
+	if flexible {
+		res = append(res, p.tagBuffer)
+	}
+	return res
+}
+
+// The brokers a client of the given listener can reach. We only know our
+// own endpoints, and only advertise the one for the listener the client
+// connected through.
+func (b *Broker) getAdvertisedBrokers(listenerName string) []MetadataResponseBroker {
+	endpoint, ok := b.config.advertisedListener(listenerName)
+	if !ok {
+		return []MetadataResponseBroker{}
+	}
+
+	return []MetadataResponseBroker{{
+		nodeID: b.config.nodeID,
+		host:   endpoint.host,
+		port:   endpoint.port,
+		rack:   b.config.rack,
+	}}
+}
+
+func (b *Broker) buildMetadataResponse(req RequestMessage) MetadataResponse {
+	reqBody := req.body.(*MetadataRequest)
+	response := MetadataResponse{
+		version:      reqBody.version,
+		throttleTime: 0,
+		clusterID:    b.clusterID,
+		// KRaft brokers report themselves as the controller, clients can't
+		// talk to the real one anyway
+		controllerID:                b.config.nodeID,
+		clusterAuthorizedOperations: AUTHORIZED_OPERATIONS_OMITTED,
+	}
+
+	for _, broker := range b.getAdvertisedBrokers(req.context.listenerName) {
+		broker.version = reqBody.version
+		response.brokers = append(response.brokers, broker)
+	}
+
+	if reqBody.includeClusterAuthorizedOperations {
+		response.clusterAuthorizedOperations = b.clusterAuthorizedOperations(req.context)
+	}
+
+	// Listing every topic only lists the ones the client may describe
+	requestedTopics := reqBody.topics
+	if requestedTopics == nil {
+		for _, name := range b.metadata.getTopicNames() {
+			if b.authorize(req.context, OPERATION_DESCRIBE, RESOURCE_TOPIC, name) {
+				requestedTopics = append(requestedTopics, MetadataRequestTopic{name: name})
+			}
+		}
+	}
+
+	for _, requestedTopic := range requestedTopics {
+		// Auto topic creation isn't supported, unknown topics are errors
+		var topic Topic
+		if requestedTopic.name == "" && requestedTopic.topicID != DEFAULT_TOPIC_ID {
+			topic = b.metadata.getTopicByID(requestedTopic.topicID)
+			if topic.errorCode == ERR_NONE && !b.authorize(req.context, OPERATION_DESCRIBE, RESOURCE_TOPIC, topic.topicName) {
+				// Don't reveal the name behind the ID
+				topic = Topic{errorCode: ERR_TOPIC_AUTHORIZATION_FAILED, topicID: requestedTopic.topicID}
+			} else if topic.errorCode == ERR_NONE {
+				topic.partitions = b.metadata.getTopicPartitions(topic.topicID)
+			}
+		} else if !b.authorize(req.context, OPERATION_DESCRIBE, RESOURCE_TOPIC, requestedTopic.name) {
+			topic = Topic{errorCode: ERR_TOPIC_AUTHORIZATION_FAILED, topicName: requestedTopic.name}
+		} else {
+			topic = b.metadata.getTopicByName(requestedTopic.name)
+		}
+
+		topic.authorizedOperations = AUTHORIZED_OPERATIONS_OMITTED
+		if reqBody.includeTopicAuthorizedOperations && topic.errorCode == ERR_NONE {
+			topic.authorizedOperations = b.authorizedOperations(req.context, RESOURCE_TOPIC, topic.topicName)
+		}
+		response.topics = append(response.topics, MetadataResponseTopic{version: reqBody.version, Topic: topic})
+	}
+
+	return response
+}
+
+// Every requested topic is echoed back with the error. The request is
+// decoded with the newest layout we know, on a best-effort basis.
+func buildMetadataErrorResponse(req RequestMessage, errorCode ErrorCode) MetadataResponse {
+	supported, _ := getSupportedApiVersion(METADATA)
+	version := min(req.header.requestApiVersion, supported.MaxVersion)
+	response := MetadataResponse{
+		version:                     version,
+		brokers:                     []MetadataResponseBroker{},
+		controllerID:                -1,
+		topics:                      []MetadataResponseTopic{},
+		clusterAuthorizedOperations: AUTHORIZED_OPERATIONS_OMITTED,
+	}
+
+	reqBody := &MetadataRequest{version: version}
+	if !tryDeserialize(reqBody, req.rawBody) {
+		return response
+	}
+
+	for _, topic := range reqBody.topics {
+		response.topics = append(response.topics, MetadataResponseTopic{
+			version: version,
+			Topic: Topic{
+				errorCode:            errorCode,
+				topicName:            topic.name,
+				topicID:              topic.topicID,
+				partitions:           []Partition{},
+				authorizedOperations: AUTHORIZED_OPERATIONS_OMITTED,
+			},
+		})
+	}
+	return response
+}
+
+// Request
+type MetadataRequest struct {
+	version int16
+	// nil means all topics
+	topics                             []MetadataRequestTopic
+	allowAutoTopicCreation             bool
+	includeClusterAuthorizedOperations bool
+	includeTopicAuthorizedOperations   bool
+}
+
+type MetadataRequestTopic struct {
+	version int16
+	topicID UUID
+	name    string
+}
+
+func (r *MetadataRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+	flexible := isFlexibleVersion(METADATA, r.version)
+
+	// A null array asks for every topic. v0 has no null arrays and uses an
+	// empty one instead.
+	numTopics := readArrayLength(buf, flexible)
+	if numTopics > 0 || (numTopics == 0 && r.version >= 1) {
+		r.topics = []MetadataRequestTopic{}
+	}
+	for range max(0, numTopics) {
+		topic := MetadataRequestTopic{version: r.version}
+		topic.deserialize(buf)
+		r.topics = append(r.topics, topic)
+	}
+
+	r.allowAutoTopicCreation = true
+	if r.version >= 4 {
+		err := binary.Read(buf, binary.BigEndian, &r.allowAutoTopicCreation)
+		checkError(err)
+	}
+
+	if r.version >= 8 {
+		if r.version <= 10 {
+			err := binary.Read(buf, binary.BigEndian, &r.includeClusterAuthorizedOperations)
+			checkError(err)
+		}
+		err := binary.Read(buf, binary.BigEndian, &r.includeTopicAuthorizedOperations)
+		checkError(err)
+	}
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
+
+func (t *MetadataRequestTopic) deserialize(buf *bytes.Buffer) {
+	flexible := isFlexibleVersion(METADATA, t.version)
+
+	if t.version >= 10 {
+		err := binary.Read(buf, binary.BigEndian, &t.topicID)
+		checkError(err)
+	}
+	t.name = readString(buf, flexible)
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
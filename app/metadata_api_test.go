@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func Test_advertisedListenerPerConnection(t *testing.T) {
+	broker := newTestBroker(t, map[string]string{
+		"listeners":                      "INTERNAL://:9092,EXTERNAL://:9093",
+		"advertised.listeners":           "INTERNAL://10.0.0.1:9092,EXTERNAL://broker.example.com:19093",
+		"listener.security.protocol.map": "INTERNAL:PLAINTEXT,EXTERNAL:PLAINTEXT",
+	})
+
+	tests := []struct {
+		name         string
+		listenerName string
+		apiKey       ApiKey
+		version      int16
+		body         []byte
+		// Offset of the first broker's ID in the response body
+		brokerOffset int
+		wantHost     string
+		wantPort     int32
+	}{
+		{"Metadata internal", "INTERNAL", METADATA, 12, []byte{1, 0, 0, 0}, 5, "10.0.0.1", 9092},
+		{"Metadata external", "EXTERNAL", METADATA, 12, []byte{1, 0, 0, 0}, 5, "broker.example.com", 19093},
+		{"Metadata v0 external", "EXTERNAL", METADATA, 0, []byte{0, 0, 0, 0}, 4, "broker.example.com", 19093},
+		{"DescribeCluster internal", "INTERNAL", DESCRIBE_CLUSTER, 1, []byte{0, 1, 0}, 14, "10.0.0.1", 9092},
+		{"DescribeCluster external", "EXTERNAL", DESCRIBE_CLUSTER, 1, []byte{0, 1, 0}, 14, "broker.example.com", 19093},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := encodeRequest(tt.apiKey, tt.version, 1, tt.body)
+			req, err := getRequestMessage(bytes.NewReader(frame), len(frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.context = RequestContext{listenerName: tt.listenerName}
+
+			res := broker.NewResponse(req)
+			body := bytes.NewBuffer(res.body.serialize())
+			body.Next(tt.brokerOffset)
+
+			var nodeID int32
+			checkError(binary.Read(body, binary.BigEndian, &nodeID))
+			host := readString(body, isFlexibleVersion(tt.apiKey, tt.version))
+			var port int32
+			checkError(binary.Read(body, binary.BigEndian, &port))
+
+			if nodeID != broker.config.nodeID || host != tt.wantHost || port != tt.wantPort {
+				t.Errorf("broker = %v %v:%v, want %v %v:%v", nodeID, host, port, broker.config.nodeID, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are served on /metrics in the Prometheus text format. Names are
+// Kafka's JMX MBeans the way the Prometheus JMX exporter renders them, e.g.
+// kafka.network:type=RequestMetrics,name=RequestsPerSec,request=Fetch
+// becomes kafka_network_requestmetrics_requests_total{request="Fetch"}.
+type BrokerMetrics struct {
+	requests  *CounterVec
+	totalTime *HistogramVec
+	errors    *CounterVec
+	bytesOut  *CounterVec
+}
+
+// Bucket bounds of the request time histograms, in milliseconds
+var TOTAL_TIME_MS_BUCKETS = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+func newBrokerMetrics() *BrokerMetrics {
+	return &BrokerMetrics{
+		requests: newCounterVec("kafka_network_requestmetrics_requests_total",
+			"Requests served, by API and version", "request", "version"),
+		totalTime: newHistogramVec("kafka_network_requestmetrics_totaltimems",
+			"Time from reading a request to sending its response, in milliseconds", TOTAL_TIME_MS_BUCKETS, "request", "version"),
+		errors: newCounterVec("kafka_network_requestmetrics_errors_total",
+			"Error codes in responses, by API and error", "request", "error"),
+		bytesOut: newCounterVec("kafka_server_brokertopicmetrics_bytesout_total",
+			"Record bytes fetched, by topic", "topic"),
+	}
+}
+
+// Count a request whose response was sent
+func (m *BrokerMetrics) recordRequest(header RequestHeader, totalTime time.Duration, errorCounts map[ErrorCode]int) {
+	api, version := header.requestApiKey.String(), strconv.Itoa(int(header.requestApiVersion))
+	m.requests.add(1, api, version)
+	m.totalTime.observe(float64(totalTime.Microseconds())/1000, api, version)
+	for code, count := range errorCounts {
+		m.errors.add(float64(count), api, code.String())
+	}
+}
+
+// Serve /metrics on metrics.http.address, if set, until shutdown
+func (b *Broker) listenMetrics() error {
+	if b.config.metricsHTTPAddress == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", b.config.metricsHTTPAddress)
+	if err != nil {
+		return fmt.Errorf("failed to bind metrics.http.address %s: %w", b.config.metricsHTTPAddress, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := b.writeMetrics(w); err != nil {
+			slog.Debug("Error writing metrics", "error", err)
+		}
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server failed", "error", err)
+		}
+	}()
+	b.onShutdown("metrics server", server.Close)
+	return nil
+}
+
+// Write every metric. Gauges are read from the broker as it is now.
+func (b *Broker) writeMetrics(out io.Writer) error {
+	w := &MetricsWriter{w: bufio.NewWriter(out)}
+	b.metrics.requests.write(w)
+	b.metrics.totalTime.write(w)
+	b.metrics.errors.write(w)
+	b.metrics.bytesOut.write(w)
+
+	// Connections by listener, including listeners without any
+	connections := map[string]int{}
+	b.mu.Lock()
+	for _, l := range b.listeners {
+		connections[l.name] = 0
+	}
+	for c := range b.connections {
+		connections[c.context.listenerName]++
+	}
+	b.mu.Unlock()
+	w.header("kafka_server_socketservermetrics_connection_count", "gauge", "Open connections, by listener")
+	for _, listener := range sortedKeys(connections) {
+		w.sample("kafka_server_socketservermetrics_connection_count", float64(connections[listener]), "listener", listener)
+	}
+
+	// Incremental fetch sessions (KIP-227) aren't implemented, every fetch
+	// is a full fetch, so the session cache is always empty
+	w.header("kafka_server_fetchsessioncache_numincrementalfetchsessions", "gauge", "Incremental fetch sessions in the cache")
+	w.sample("kafka_server_fetchsessioncache_numincrementalfetchsessions", 0)
+
+	b.writeLogMetrics(w)
+	b.writeMetadataMetrics(w)
+	return w.flush()
+}
+
+// Offsets, segment counts and sizes of the partition logs
+func (b *Broker) writeLogMetrics(w *MetricsWriter) {
+	type partitionLog struct {
+		topic, partition                 string
+		start, end, size, numLogSegments int64
+	}
+	logs := []partitionLog{}
+	for _, manager := range b.logs {
+		for tp, l := range manager.Logs() {
+			logs = append(logs, partitionLog{
+				topic:          tp.Topic,
+				partition:      strconv.Itoa(int(tp.Partition)),
+				start:          l.StartOffset(),
+				end:            l.EndOffset(),
+				size:           l.Size(),
+				numLogSegments: int64(l.NumSegments()),
+			})
+		}
+	}
+	slices.SortFunc(logs, func(a, b partitionLog) int {
+		return strings.Compare(a.topic+"\xff"+a.partition, b.topic+"\xff"+b.partition)
+	})
+
+	families := []struct {
+		name, help string
+		value      func(partitionLog) int64
+	}{
+		{"kafka_log_log_logstartoffset", "First offset of the partition log", func(l partitionLog) int64 { return l.start }},
+		{"kafka_log_log_logendoffset", "Offset the next record of the partition log gets", func(l partitionLog) int64 { return l.end }},
+		{"kafka_log_log_numlogsegments", "Segments of the partition log", func(l partitionLog) int64 { return l.numLogSegments }},
+		{"kafka_log_log_size", "Bytes in the segments of the partition log", func(l partitionLog) int64 { return l.size }},
+	}
+	for _, family := range families {
+		w.header(family.name, "gauge", family.help)
+		for _, l := range logs {
+			w.sample(family.name, float64(family.value(l)), "topic", l.topic, "partition", l.partition)
+		}
+	}
+}
+
+// The last metadata record replayed, like Kafka's broker-metadata-metrics.
+// The image catches up with the log here, as on any lookup. The replay lag
+// is taken before that: the records the controller wrote that the image
+// served until now didn't have.
+func (b *Broker) writeMetadataMetrics(w *MetricsWriter) {
+	replayedOffset := int64(-1)
+	if served := b.metadata.current.Load(); served != nil {
+		replayedOffset = served.records.LastOffset
+	}
+	endOffset, err := b.metadata.endOffset()
+	if err != nil {
+		slog.Warn("Failed to read the metadata log end offset", "error", err)
+		endOffset = replayedOffset + 1
+	}
+	records := b.metadata.image().records
+
+	w.header("kafka_server_broker_metadata_metrics_last_applied_record_offset", "gauge", "Offset of the last metadata record replayed")
+	w.sample("kafka_server_broker_metadata_metrics_last_applied_record_offset", float64(records.LastOffset))
+	w.header("kafka_server_broker_metadata_metrics_last_applied_record_timestamp", "gauge", "Timestamp of the last metadata record replayed, in milliseconds")
+	w.sample("kafka_server_broker_metadata_metrics_last_applied_record_timestamp", float64(records.LastTimestamp))
+	w.header("kafka_server_broker_metadata_metrics_last_applied_record_lag_ms", "gauge", "Milliseconds since the timestamp of the last metadata record replayed")
+	lag := int64(0)
+	if records.LastTimestamp >= 0 {
+		lag = time.Now().UnixMilli() - records.LastTimestamp
+	}
+	w.sample("kafka_server_broker_metadata_metrics_last_applied_record_lag_ms", float64(lag))
+	w.header("kafka_server_broker_metadata_metrics_replay_lag_records", "gauge", "Metadata records written but not replayed yet")
+	w.sample("kafka_server_broker_metadata_metrics_replay_lag_records", float64(endOffset-replayedOffset-1))
+}
+
+// A family of counters, one per set of label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	series map[string]*CounterSeries
+}
+
+type CounterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, series: map[string]*CounterSeries{}}
+}
+
+func (v *CounterVec) add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	series, ok := v.series[key]
+	if !ok {
+		series = &CounterSeries{labelValues: labelValues}
+		v.series[key] = series
+	}
+	series.value += delta
+}
+
+func (v *CounterVec) write(w *MetricsWriter) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	w.header(v.name, "counter", v.help)
+	for _, key := range sortedKeys(v.series) {
+		series := v.series[key]
+		w.sample(v.name, series.value, zipLabels(v.labels, series.labelValues)...)
+	}
+}
+
+// A family of histograms, one per set of label values
+type HistogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+	mu      sync.Mutex
+	series  map[string]*HistogramSeries
+}
+
+type HistogramSeries struct {
+	labelValues []string
+	// Observations per bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, buckets: buckets, labels: labels, series: map[string]*HistogramSeries{}}
+}
+
+func (v *HistogramVec) observe(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	series, ok := v.series[key]
+	if !ok {
+		series = &HistogramSeries{labelValues: labelValues, counts: make([]uint64, len(v.buckets))}
+		v.series[key] = series
+	}
+	if i, _ := slices.BinarySearch(v.buckets, value); i < len(v.buckets) {
+		series.counts[i]++
+	}
+	series.count++
+	series.sum += value
+}
+
+func (v *HistogramVec) write(w *MetricsWriter) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	w.header(v.name, "histogram", v.help)
+	for _, key := range sortedKeys(v.series) {
+		series := v.series[key]
+		labels := zipLabels(v.labels, series.labelValues)
+		cumulative := uint64(0)
+		for i, bound := range v.buckets {
+			cumulative += series.counts[i]
+			w.sample(v.name+"_bucket", float64(cumulative), append(labels, "le", formatFloat(bound))...)
+		}
+		w.sample(v.name+"_bucket", float64(series.count), append(labels, "le", "+Inf")...)
+		w.sample(v.name+"_sum", series.sum, labels...)
+		w.sample(v.name+"_count", float64(series.count), labels...)
+	}
+}
+
+// Writes the Prometheus text format. The first write error sticks and is
+// returned by flush.
+type MetricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *MetricsWriter) header(name string, kind string, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// A sample, with labels given as name, value pairs
+func (w *MetricsWriter) sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(escapeLabelValue(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	w.printf("%s %s\n", b.String(), formatFloat(value))
+}
+
+func (w *MetricsWriter) printf(format string, args ...any) {
+	if w.err == nil {
+		_, w.err = fmt.Fprintf(w.w, format, args...)
+	}
+}
+
+func (w *MetricsWriter) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Label names and values, interleaved as MetricsWriter.sample takes them
+func zipLabels(names []string, values []string) []string {
+	labels := make([]string, 0, 2*len(names))
+	for i, name := range names {
+		labels = append(labels, name, values[i])
+	}
+	return labels
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
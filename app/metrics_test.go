@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
+)
+
+func Test_Broker_writeMetrics(t *testing.T) {
+	broker := newTestBroker(t, nil)
+	alpha := UUID{1}
+	writeMetadataRecords(t, broker, topicRecord("alpha", alpha), partitionRecord(alpha, 0))
+	if err := broker.loadLogs(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.shutdown(time.Second) })
+
+	l, err := broker.logs[0].GetOrCreateLog(log.TopicPartition{Topic: "alpha", Partition: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, err := l.Append(encodeRecordBatch(0, time.Now().UnixMilli(), [][]byte{[]byte("value")}), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConnection(broker, "PLAINTEXT", server).serve()
+	if _, err := sendTestRequest(client, API_VERSIONS, 4, []byte{2, 't', 2, '1', 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`kafka_network_requestmetrics_requests_total{request="ApiVersions",version="4"} 1`,
+		`kafka_network_requestmetrics_totaltimems_bucket{request="ApiVersions",version="4",le="+Inf"} 1`,
+		`kafka_network_requestmetrics_totaltimems_count{request="ApiVersions",version="4"} 1`,
+		`kafka_network_requestmetrics_errors_total{request="ApiVersions",error="NONE"} 1`,
+		`kafka_server_fetchsessioncache_numincrementalfetchsessions 0`,
+		`kafka_log_log_logstartoffset{topic="alpha",partition="0"} 0`,
+		`kafka_log_log_logendoffset{topic="alpha",partition="0"} 2`,
+		`kafka_log_log_numlogsegments{topic="alpha",partition="0"} 1`,
+		`kafka_server_broker_metadata_metrics_last_applied_record_offset 1`,
+		`kafka_server_broker_metadata_metrics_replay_lag_records 0`,
+	}
+	// Requests are counted once their response is written, which the
+	// client may see first. Error counts are recorded last.
+	out := &bytes.Buffer{}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		out.Reset()
+		if err := broker.writeMetrics(out); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(out.String(), want[3]) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	lines := strings.Split(out.String(), "\n")
+	for _, line := range want {
+		found := false
+		for _, got := range lines {
+			found = found || got == line
+		}
+		if !found {
+			t.Errorf("no %s in\n%s", line, out)
+		}
+	}
+}
+
+// The controller appends to the metadata log behind the broker's back
+func Test_Broker_writeMetadataMetrics(t *testing.T) {
+	broker := newTestBroker(t, nil)
+	alpha, beta := UUID{1}, UUID{2}
+	writeMetadataRecords(t, broker, topicRecord("alpha", alpha), partitionRecord(alpha, 0))
+
+	paths := broker.metadata.segmentPaths()
+	nextOffset := broker.metadata.image().records.LastOffset + 1
+	f, err := os.OpenFile(paths[len(paths)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(encodeRecordBatch(nextOffset, time.Now().UnixMilli(), [][]byte{topicRecord("beta", beta), partitionRecord(beta, 0)}))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first scrape replays the new records
+	for _, want := range []string{"2", "0"} {
+		out := &bytes.Buffer{}
+		w := &MetricsWriter{w: bufio.NewWriter(out)}
+		broker.writeMetadataMetrics(w)
+		if err := w.flush(); err != nil {
+			t.Fatal(err)
+		}
+		line := "kafka_server_broker_metadata_metrics_replay_lag_records " + want
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("no %s in\n%s", line, out)
+		}
+	}
+}
+
+func Test_HistogramVec_write(t *testing.T) {
+	h := newHistogramVec("latency", "Latency", []float64{1, 10}, "api")
+	for _, value := range []float64{0.5, 1, 5, 50} {
+		h.observe(value, `a"b`)
+	}
+	out := &bytes.Buffer{}
+	w := &MetricsWriter{w: bufio.NewWriter(out)}
+	h.write(w)
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP latency Latency
+# TYPE latency histogram
+latency_bucket{api="a\"b",le="1"} 2
+latency_bucket{api="a\"b",le="10"} 3
+latency_bucket{api="a\"b",le="+Inf"} 4
+latency_sum{api="a\"b"} 56.5
+latency_count{api="a\"b"} 4
+`
+	if out.String() != want {
+		t.Errorf("write() = %s, want %s", out, want)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SASL_OAUTHBEARER = "OAUTHBEARER"
+
+// What the client gets back when its token is rejected (RFC 7628 section 3.2.2)
+const OAUTHBEARER_ERROR_CHALLENGE = `{"status":"invalid_token"}`
+
+// Validates the bearer tokens presented on a listener. With a JWKS file
+// tokens have to be signed with one of its keys, without one only unsecured
+// (alg none) tokens are accepted, which is meant for development.
+type OAuthBearerValidator struct {
+	jwks             *JwksFile
+	principalClaim   string
+	scopeClaim       string
+	requiredScopes   []string
+	expectedAudience []string
+	expectedIssuer   string
+	clockSkew        time.Duration
+}
+
+type OAuthBearerToken struct {
+	principal string
+	expiry    time.Time
+	scopes    []string
+}
+
+func newOAuthBearerValidator(config *Config, listenerName string) (*OAuthBearerValidator, error) {
+	property := func(key string) string {
+		return config.saslProperty(listenerName, SASL_OAUTHBEARER, key)
+	}
+
+	jwksPath, err := jwksFilePath(property("sasl.oauthbearer.jwks.endpoint.url"))
+	if err != nil {
+		return nil, err
+	}
+	if jwksPath != "" {
+		jwks, err := loadJwksFile(jwksPath)
+		if err != nil {
+			return nil, err
+		}
+		clockSkew, _ := strconv.Atoi(property("sasl.oauthbearer.clock.skew.seconds"))
+		return &OAuthBearerValidator{
+			jwks:             jwks,
+			principalClaim:   property("sasl.oauthbearer.sub.claim.name"),
+			scopeClaim:       property("sasl.oauthbearer.scope.claim.name"),
+			expectedAudience: splitList(property("sasl.oauthbearer.expected.audience")),
+			expectedIssuer:   property("sasl.oauthbearer.expected.issuer"),
+			clockSkew:        time.Duration(clockSkew) * time.Second,
+		}, nil
+	}
+
+	// Unsecured tokens are configured through the login module options, like
+	// Kafka's OAuthBearerUnsecuredValidatorCallbackHandler
+	options := config.jaasConfig(listenerName, SASL_OAUTHBEARER).options
+	option := func(key string, defaultValue string) string {
+		if value, ok := options[key]; ok {
+			return value
+		}
+		return defaultValue
+	}
+	clockSkewMs, err := strconv.Atoi(option("unsecuredValidatorAllowableClockSkewMs", "0"))
+	if err != nil {
+		return nil, fmt.Errorf("unsecuredValidatorAllowableClockSkewMs: %w", err)
+	}
+	return &OAuthBearerValidator{
+		principalClaim: option("unsecuredValidatorPrincipalClaimName", "sub"),
+		scopeClaim:     option("unsecuredValidatorScopeClaimName", "scope"),
+		requiredScopes: splitList(option("unsecuredValidatorRequiredScope", "")),
+		clockSkew:      time.Duration(clockSkewMs) * time.Millisecond,
+	}, nil
+}
+
+// Only local JWKS files are supported, given either as a path or a file:// URL
+func jwksFilePath(endpoint string) (string, error) {
+	if endpoint == "" || !strings.Contains(endpoint, "://") {
+		return endpoint, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("sasl.oauthbearer.jwks.endpoint.url: only file:// URLs are supported, got %s", endpoint)
+	}
+	return u.Path, nil
+}
+
+func splitList(value string) []string {
+	out := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Check the JWT's signature and claims
+func (v *OAuthBearerValidator) validate(token string, now time.Time) (OAuthBearerToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return OAuthBearerToken{}, fmt.Errorf("malformed JWT, expected 3 parts but got %d", len(parts))
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return OAuthBearerToken{}, fmt.Errorf("malformed JWT header: %w", err)
+	}
+	if err := v.verifySignature(header.Alg, header.Kid, parts); err != nil {
+		return OAuthBearerToken{}, err
+	}
+
+	claims := map[string]any{}
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return OAuthBearerToken{}, fmt.Errorf("malformed JWT payload: %w", err)
+	}
+
+	expiry, ok := claims["exp"].(float64)
+	if !ok {
+		return OAuthBearerToken{}, fmt.Errorf("JWT has no exp claim")
+	}
+	result := OAuthBearerToken{expiry: time.UnixMilli(int64(expiry * 1000))}
+	if !now.Before(result.expiry.Add(v.clockSkew)) {
+		return OAuthBearerToken{}, fmt.Errorf("JWT expired at %s", result.expiry.UTC().Format(time.RFC3339))
+	}
+	if notBefore, ok := claims["nbf"].(float64); ok && now.Add(v.clockSkew).Before(time.UnixMilli(int64(notBefore*1000))) {
+		return OAuthBearerToken{}, fmt.Errorf("JWT is not valid yet")
+	}
+
+	result.principal, _ = claims[v.principalClaim].(string)
+	if result.principal == "" {
+		return OAuthBearerToken{}, fmt.Errorf("JWT has no %s claim to take the principal from", v.principalClaim)
+	}
+
+	if v.expectedIssuer != "" && claims["iss"] != v.expectedIssuer {
+		return OAuthBearerToken{}, fmt.Errorf("JWT issuer %v is not %s", claims["iss"], v.expectedIssuer)
+	}
+	if len(v.expectedAudience) > 0 {
+		audience := claimStrings(claims["aud"], ",")
+		if !slices.ContainsFunc(audience, func(a string) bool { return slices.Contains(v.expectedAudience, a) }) {
+			return OAuthBearerToken{}, fmt.Errorf("JWT audience %v is not one of %v", audience, v.expectedAudience)
+		}
+	}
+
+	// Scopes are either a space separated string or an array
+	result.scopes = claimStrings(claims[v.scopeClaim], " ")
+	for _, scope := range v.requiredScopes {
+		if !slices.Contains(result.scopes, scope) {
+			return OAuthBearerToken{}, fmt.Errorf("JWT is missing the required scope %s", scope)
+		}
+	}
+
+	return result, nil
+}
+
+func (v *OAuthBearerValidator) verifySignature(alg string, kid string, parts []string) error {
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed JWT signature")
+	}
+
+	if v.jwks == nil {
+		if alg != "none" || len(signature) != 0 {
+			return fmt.Errorf("only unsecured JWTs (alg none) are accepted without a JWKS, got alg %s", alg)
+		}
+		return nil
+	}
+	if alg != "RS256" && alg != "ES256" {
+		return fmt.Errorf("JWT alg %s is not supported, expected RS256 or ES256", alg)
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	for _, key := range v.jwks.get() {
+		if kid != "" && key.kid != kid {
+			continue
+		}
+		switch publicKey := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			if alg == "RS256" && rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			// JWS encodes ES256 signatures as r || s, not ASN.1
+			if alg == "ES256" && len(signature) == 64 {
+				r := new(big.Int).SetBytes(signature[:32])
+				s := new(big.Int).SetBytes(signature[32:])
+				if ecdsa.Verify(publicKey, digest[:], r, s) {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("JWT signature does not match any key in the JWKS (kid %q)", kid)
+}
+
+func decodeJwtPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// A claim holding either a list of strings or a single string of sep
+// separated items
+func claimStrings(claim any, sep string) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(sep, r) })
+	case []any:
+		out := []string{}
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return []string{}
+}
+
+// A JSON Web Key Set on disk, re-read when it changes so keys can be
+// rotated without a restart
+type JwksFile struct {
+	path    string
+	mu      sync.Mutex
+	keys    []JsonWebKey
+	modTime time.Time
+}
+
+type JsonWebKey struct {
+	kid       string
+	publicKey crypto.PublicKey
+}
+
+func loadJwksFile(path string) (*JwksFile, error) {
+	f := &JwksFile{path: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if f.keys, err = readJwks(path); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	f.modTime = info.ModTime()
+	return f, nil
+}
+
+func (f *JwksFile) get() []JsonWebKey {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil || info.ModTime().Equal(f.modTime) {
+		return f.keys
+	}
+	keys, err := readJwks(f.path)
+	if err != nil {
+		slog.Warn("Failed to reload JWKS", "path", f.path, "error", err)
+		return f.keys
+	}
+	f.keys, f.modTime = keys, info.ModTime()
+	return f.keys
+}
+
+func readJwks(path string) ([]JsonWebKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := []JsonWebKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		decode := func(s string) []byte {
+			b, decodeErr := base64.RawURLEncoding.DecodeString(s)
+			if decodeErr != nil {
+				err = fmt.Errorf("key %s: %w", k.Kid, decodeErr)
+			}
+			return b
+		}
+
+		switch k.Kty {
+		case "RSA":
+			n, e := decode(k.N), decode(k.E)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, JsonWebKey{kid: k.Kid, publicKey: &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}})
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, y := decode(k.X), decode(k.Y)
+			if err != nil {
+				return nil, err
+			}
+			// Let crypto/ecdh check that the point is on the curve
+			point := append([]byte{4}, append(make([]byte, 32-min(32, len(x))), x...)...)
+			point = append(point, append(make([]byte, 32-min(32, len(y))), y...)...)
+			if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+				return nil, fmt.Errorf("key %s: %w", k.Kid, err)
+			}
+			keys = append(keys, JsonWebKey{kid: k.Kid, publicKey: &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RS256 or ES256 signing keys")
+	}
+	return keys, nil
+}
+
+// Server side of OAUTHBEARER (RFC 7628)
+type OAuthBearerSaslServer struct {
+	validator *OAuthBearerValidator
+	token     OAuthBearerToken
+	complete  bool
+	// Set once the error challenge was sent. The client acknowledges it
+	// and then gets the error.
+	failure error
+}
+
+func (s *OAuthBearerSaslServer) evaluateResponse(response []byte) ([]byte, error) {
+	if s.failure != nil {
+		return nil, s.failure
+	}
+
+	token, authzid, err := parseOAuthBearerClientResponse(string(response))
+	if err != nil {
+		return nil, fmt.Errorf("Authentication failed: %w", err)
+	}
+
+	s.token, err = s.validator.validate(token, time.Now())
+	if err == nil && authzid != "" && authzid != s.token.principal {
+		err = fmt.Errorf("authorization id %s is not the token's principal %s", authzid, s.token.principal)
+	}
+	if err != nil {
+		s.failure = fmt.Errorf("Authentication failed: %w", err)
+		return []byte(OAUTHBEARER_ERROR_CHALLENGE), nil
+	}
+
+	s.complete = true
+	return []byte{}, nil
+}
+
+func (s *OAuthBearerSaslServer) isComplete() bool {
+	return s.complete
+}
+
+func (s *OAuthBearerSaslServer) authorizationID() string {
+	return s.token.principal
+}
+
+// Sessions can't outlive the token they were authenticated with
+func (s *OAuthBearerSaslServer) credentialExpiry() time.Time {
+	return s.token.expiry
+}
+
+// Split "n,a=authzid,\x01auth=Bearer <token>\x01key=value\x01\x01"
+func parseOAuthBearerClientResponse(response string) (token string, authzid string, err error) {
+	gs2Header, rest, ok := strings.Cut(response, "\x01")
+	if !ok {
+		return "", "", fmt.Errorf("invalid OAUTHBEARER client response")
+	}
+	headerParts := strings.Split(gs2Header, ",")
+	if len(headerParts) != 3 || headerParts[0] != "n" || headerParts[2] != "" {
+		return "", "", fmt.Errorf("invalid OAUTHBEARER GS2 header")
+	}
+	if headerParts[1] != "" {
+		if authzid, ok = strings.CutPrefix(headerParts[1], "a="); !ok {
+			return "", "", fmt.Errorf("invalid OAUTHBEARER GS2 header")
+		}
+	}
+
+	for _, kv := range strings.Split(rest, "\x01") {
+		if value, ok := strings.CutPrefix(kv, "auth="); ok {
+			scheme, bearer, _ := strings.Cut(value, " ")
+			if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(bearer) == "" {
+				return "", "", fmt.Errorf("invalid OAUTHBEARER auth value")
+			}
+			return strings.TrimSpace(bearer), authzid, nil
+		}
+	}
+	return "", "", fmt.Errorf("OAUTHBEARER client response has no auth value")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testJwtKeys struct {
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	jwksPath string
+}
+
+// Generate an RS256 and an ES256 key and write them to a JWKS file
+func newTestJwtKeys(t *testing.T) testJwtKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	checkError(os.WriteFile(path, jwks, 0o644))
+
+	return testJwtKeys{rsaKey: rsaKey, ecKey: ecKey, jwksPath: path}
+}
+
+// Build a JWT signed with alg, which is one of none, RS256 or ES256
+func (k testJwtKeys) token(t *testing.T, alg string, kid string, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func Test_OAuthBearerValidator_validate(t *testing.T) {
+	keys := newTestJwtKeys(t)
+	now := time.Now()
+	claims := func(extra map[string]any) map[string]any {
+		out := map[string]any{"sub": "orders-service", "exp": now.Add(time.Hour).Unix(), "aud": "kafka"}
+		for k, v := range extra {
+			out[k] = v
+		}
+		return out
+	}
+
+	unsecured := &OAuthBearerValidator{principalClaim: "sub", scopeClaim: "scope", requiredScopes: []string{}}
+	jwks, err := loadJwksFile(keys.jwksPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secured := &OAuthBearerValidator{
+		jwks:             jwks,
+		principalClaim:   "sub",
+		scopeClaim:       "scope",
+		expectedAudience: []string{"kafka"},
+		clockSkew:        30 * time.Second,
+	}
+	clientIDClaim := *secured
+	clientIDClaim.principalClaim = "client_id"
+
+	tamperedToken := keys.token(t, "RS256", "rsa-1", claims(nil))
+	tamperedToken = tamperedToken[:len(tamperedToken)-4] + "AAAA"
+
+	tests := []struct {
+		name          string
+		validator     *OAuthBearerValidator
+		token         string
+		wantPrincipal string
+		wantErr       bool
+	}{
+		{"unsecured", unsecured, keys.token(t, "none", "", claims(nil)), "orders-service", false},
+		{"unsecured rejects signed tokens", unsecured, keys.token(t, "RS256", "rsa-1", claims(nil)), "", true},
+		{"RS256", secured, keys.token(t, "RS256", "rsa-1", claims(nil)), "orders-service", false},
+		{"ES256", secured, keys.token(t, "ES256", "ec-1", claims(nil)), "orders-service", false},
+		{"ES256 without kid", secured, keys.token(t, "ES256", "", claims(nil)), "orders-service", false},
+		{"JWKS rejects unsigned tokens", secured, keys.token(t, "none", "", claims(nil)), "", true},
+		{"unknown kid", secured, keys.token(t, "RS256", "rsa-2", claims(nil)), "", true},
+		{"tampered signature", secured, tamperedToken, "", true},
+		{"expired", secured, keys.token(t, "RS256", "rsa-1", claims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), "", true},
+		{"expired within clock skew", secured, keys.token(t, "RS256", "rsa-1", claims(map[string]any{"exp": now.Add(-10 * time.Second).Unix()})), "orders-service", false},
+		{"no expiry", secured, keys.token(t, "RS256", "rsa-1", claims(map[string]any{"exp": nil})), "", true},
+		{"wrong audience", secured, keys.token(t, "RS256", "rsa-1", claims(map[string]any{"aud": []string{"billing"}})), "", true},
+		{"audience list", secured, keys.token(t, "RS256", "rsa-1", claims(map[string]any{"aud": []string{"billing", "kafka"}})), "orders-service", false},
+		{"principal from another claim", &clientIDClaim, keys.token(t, "ES256", "ec-1", claims(map[string]any{"client_id": "svc-42"})), "svc-42", false},
+		{"missing principal claim", &clientIDClaim, keys.token(t, "ES256", "ec-1", claims(nil)), "", true},
+		{"not a JWT", secured, "opaque-token", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.validator.validate(tt.token, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.principal != tt.wantPrincipal {
+				t.Errorf("principal = %v, want %v", got.principal, tt.wantPrincipal)
+			}
+		})
+	}
+}
+
+func Test_OAuthBearer_sessionEndsWithToken(t *testing.T) {
+	keys := newTestJwtKeys(t)
+	broker := newTestBroker(t, map[string]string{
+		"listeners":                      "SASL_PLAINTEXT://127.0.0.1:0",
+		"listener.security.protocol.map": "SASL_PLAINTEXT:SASL_PLAINTEXT",
+		"sasl.enabled.mechanisms":        "OAUTHBEARER",
+		"connections.max.reauth.ms":      "3600000",
+		"listener.name.sasl_plaintext.oauthbearer.sasl.oauthbearer.jwks.endpoint.url": "file://" + keys.jwksPath,
+	})
+	if err := broker.listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.shutdown(time.Second)
+
+	login := func(conn io.ReadWriter, token string) (SaslAuthenticateResponse, error) {
+		if errorCode, err := saslHandshake(conn, SASL_OAUTHBEARER); err != nil || errorCode != ERR_NONE {
+			t.Fatalf("handshake: %v %v", errorCode, err)
+		}
+		return saslAuthenticate(conn, []byte("n,,\x01auth=Bearer "+token+"\x01\x01"))
+	}
+
+	t.Run("valid token", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		c := newConnection(broker, "SASL_PLAINTEXT", server)
+		go c.serve()
+
+		// Shorter than connections.max.reauth.ms, so the token decides
+		expiry := time.Now().Add(10 * time.Minute)
+		response, err := login(client, keys.token(t, "RS256", "rsa-1", map[string]any{"sub": "orders-service", "exp": expiry.Unix()}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lifetime := time.Duration(response.sessionLifetimeMs) * time.Millisecond; lifetime > 10*time.Minute || lifetime < 9*time.Minute {
+			t.Errorf("session lifetime = %v, want about 10m", lifetime)
+		}
+		if got := c.context.sasl.principal.String(); got != "User:orders-service" {
+			t.Errorf("principal = %v, want User:orders-service", got)
+		}
+		if err := c.context.sasl.checkRequest(METADATA, expiry.Add(time.Second)); err == nil {
+			t.Errorf("request after the token expired was accepted")
+		}
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go newConnection(broker, "SASL_PLAINTEXT", server).serve()
+
+		expired := keys.token(t, "RS256", "rsa-1", map[string]any{"sub": "orders-service", "exp": time.Now().Add(-time.Hour).Unix()})
+		response, err := login(client, expired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(response.authBytes) != OAUTHBEARER_ERROR_CHALLENGE {
+			t.Fatalf("challenge = %q, want %q", response.authBytes, OAUTHBEARER_ERROR_CHALLENGE)
+		}
+
+		// The client acknowledges the error and gets the reason
+		if _, err := saslAuthenticate(client, []byte{0x01}); err == nil {
+			t.Fatalf("authentication with an expired token succeeded")
+		}
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read after failed authentication: %v, want EOF", err)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import "sort"
+
+// Identifies a partition in the metadata log
+type TopicPartition struct {
+	topicID     UUID
+	partitionID int32
+}
+
+// The current state of every partition, built by replaying the
+// PartitionRecords and PartitionChangeRecords of the metadata log. The
+// zero value is empty and ready to use.
+type PartitionRegistry struct {
+	partitions map[TopicPartition]PartitionRecord
+}
+
+// A PartitionRecord for a partition we already know replaces it
+func (r *PartitionRegistry) register(record PartitionRecord) {
+	if r.partitions == nil {
+		r.partitions = map[TopicPartition]PartitionRecord{}
+	}
+	r.partitions[TopicPartition{record.topicUUID, record.partitionID}] = record
+}
+
+// Changes to partitions we don't know are ignored
+func (r *PartitionRegistry) change(change PartitionChangeRecord) {
+	key := TopicPartition{change.topicUUID, change.partitionID}
+	partition, ok := r.partitions[key]
+	if !ok {
+		return
+	}
+	partition.apply(change)
+	r.partitions[key] = partition
+}
+
+func (r *PartitionRegistry) removeTopic(topicID UUID) {
+	for key := range r.partitions {
+		if key.topicID == topicID {
+			delete(r.partitions, key)
+		}
+	}
+}
+
+func (r *PartitionRegistry) get(topicID UUID, partitionID int32) (PartitionRecord, bool) {
+	partition, ok := r.partitions[TopicPartition{topicID, partitionID}]
+	return partition, ok
+}
+
+// The topic's partitions in partition ID order
+func (r *PartitionRegistry) topicPartitions(topicID UUID) []PartitionRecord {
+	partitions := []PartitionRecord{}
+	for key, partition := range r.partitions {
+		if key.topicID == topicID {
+			partitions = append(partitions, partition)
+		}
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].partitionID < partitions[j].partitionID })
+	return partitions
+}
+
+// Merge a change into the partition, the way the controller does
+func (p *PartitionRecord) apply(change PartitionChangeRecord) {
+	if change.replicaNodes != nil {
+		p.replicaNodes = change.replicaNodes
+	}
+	if change.isrNodes != nil {
+		p.isrNodes = change.isrNodes
+	}
+	if change.removingReplicas != nil {
+		p.removingReplicas = change.removingReplicas
+	}
+	if change.addingReplicas != nil {
+		p.addingReplicas = change.addingReplicas
+	}
+	if change.leader != NO_LEADER_CHANGE {
+		p.leader = change.leader
+		p.leaderEpoch++
+	}
+	if change.leaderRecoveryState != NO_LEADER_RECOVERY_STATE_CHANGE {
+		p.leaderRecoveryState = change.leaderRecoveryState
+	}
+	if change.eligibleLeaderReplicas != nil {
+		p.eligibleLeaderReplicas = change.eligibleLeaderReplicas
+	}
+	if change.lastKnownELR != nil {
+		p.lastKnownELR = change.lastKnownELR
+	}
+	if change.directories != nil {
+		p.directories = change.directories
+	}
+	p.partitionEpoch++
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_PartitionRegistry(t *testing.T) {
+	alpha, beta := UUID{1}, UUID{2}
+	partition := func(topicID UUID, partitionID int32, leader ReplicaID) PartitionRecord {
+		return PartitionRecord{topicUUID: topicID, partitionID: partitionID, leader: leader}
+	}
+	change := func(topicID UUID, partitionID int32, leader ReplicaID, isr []ReplicaID) PartitionChangeRecord {
+		return PartitionChangeRecord{
+			topicUUID:           topicID,
+			partitionID:         partitionID,
+			leader:              leader,
+			isrNodes:            isr,
+			leaderRecoveryState: NO_LEADER_RECOVERY_STATE_CHANGE,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		records []Record
+		// Partition ID, leader, leader epoch and partition epoch of alpha's
+		// partitions
+		want [][4]int32
+	}{
+		{"out of order", []Record{partition(alpha, 2, 1), partition(beta, 0, 1), partition(alpha, 0, 1)}, [][4]int32{{0, 1, 0, 0}, {2, 1, 0, 0}}},
+		{"gaps are kept", []Record{partition(alpha, 1, 1), partition(alpha, 3, 1)}, [][4]int32{{1, 1, 0, 0}, {3, 1, 0, 0}}},
+		{"registered again", []Record{partition(alpha, 0, 1), partition(alpha, 0, 2)}, [][4]int32{{0, 2, 0, 0}}},
+		{"leader change", []Record{partition(alpha, 0, 1), partition(alpha, 1, 1), change(alpha, 1, 2, nil)}, [][4]int32{{0, 1, 0, 0}, {1, 2, 1, 1}}},
+		{"ISR change", []Record{partition(alpha, 0, 1), change(alpha, 0, NO_LEADER_CHANGE, []ReplicaID{1})}, [][4]int32{{0, 1, 0, 1}}},
+		{"change to an unknown partition", []Record{partition(alpha, 0, 1), change(alpha, 5, 2, nil)}, [][4]int32{{0, 1, 0, 0}}},
+		{"topic removed", []Record{partition(alpha, 0, 1), partition(beta, 0, 1), RemoveTopicRecord{topicUUID: alpha}}, [][4]int32{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := PartitionRegistry{}
+			for _, record := range tt.records {
+				switch r := record.(type) {
+				case PartitionRecord:
+					registry.register(r)
+				case PartitionChangeRecord:
+					registry.change(r)
+				case RemoveTopicRecord:
+					registry.removeTopic(r.topicUUID)
+				}
+			}
+
+			got := [][4]int32{}
+			for _, p := range registry.topicPartitions(alpha) {
+				got = append(got, [4]int32{p.partitionID, int32(p.leader), p.leaderEpoch, p.partitionEpoch})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topicPartitions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
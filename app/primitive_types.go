@@ -3,30 +3,168 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 )
 
 func encodeCompactString(s string) []byte {
-	encoded := []byte{}
-	strLen := len(s) + 1
-	encoded = append(encoded, byte(strLen))
+	encoded := appendUnsignedVarint([]byte{}, len(s)+1)
 	encoded = append(encoded, []byte(s)...)
 
 	return encoded
 }
 
 func readComapctString(buf *bytes.Buffer) string {
-	var strLenByte byte
-	err := binary.Read(buf, binary.BigEndian, &strLenByte)
+	strLen := max(0, readUnsignedVarint(buf)-1)
+	if buf.Len() < strLen {
+		panic(io.ErrUnexpectedEOF)
+	}
+	out := make([]byte, strLen)
+	err := binary.Read(buf, binary.BigEndian, &out)
 	checkError(err)
 
-	strLen := max(0, int(strLenByte)-1)
-	out := make([]byte, strLen)
+	return string(out)
+}
+
+// Read a STRING (int16 length) or, for flexible versions, a COMPACT_STRING.
+// Null strings are returned as "".
+func readString(buf *bytes.Buffer, flexible bool) string {
+	if flexible {
+		return readComapctString(buf)
+	}
+
+	var strLen int16
+	err := binary.Read(buf, binary.BigEndian, &strLen)
+	checkError(err)
+
+	out := make([]byte, max(0, int(strLen)))
 	err = binary.Read(buf, binary.BigEndian, &out)
 	checkError(err)
 
 	return string(out)
 }
 
+// Read a NULLABLE_STRING or, for flexible versions, a COMPACT_NULLABLE_STRING,
+// for fields where null and "" mean different things
+func readNullableString(buf *bytes.Buffer, flexible bool) (s string, isNull bool) {
+	var strLen int
+	if flexible {
+		strLen = readUnsignedVarint(buf) - 1
+	} else {
+		var n int16
+		err := binary.Read(buf, binary.BigEndian, &n)
+		checkError(err)
+		strLen = int(n)
+	}
+	if strLen < 0 {
+		return "", true
+	}
+
+	if buf.Len() < strLen {
+		panic(io.ErrUnexpectedEOF)
+	}
+	out := make([]byte, strLen)
+	err := binary.Read(buf, binary.BigEndian, &out)
+	checkError(err)
+
+	return string(out), false
+}
+
+func appendString(b []byte, s string, flexible bool) []byte {
+	if flexible {
+		return append(b, encodeCompactString(s)...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// Read BYTES (int32 length) or, for flexible versions, COMPACT_BYTES
+func readBytes(buf *bytes.Buffer, flexible bool) []byte {
+	var size int
+	if flexible {
+		size = readUnsignedVarint(buf) - 1
+	} else {
+		var bytesLen int32
+		err := binary.Read(buf, binary.BigEndian, &bytesLen)
+		checkError(err)
+		size = int(bytesLen)
+	}
+
+	if buf.Len() < size {
+		panic(io.ErrUnexpectedEOF)
+	}
+	out := make([]byte, max(0, size))
+	copy(out, buf.Next(max(0, size)))
+	return out
+}
+
+func appendBytes(b []byte, data []byte, flexible bool) []byte {
+	if flexible {
+		b = appendUnsignedVarint(b, len(data)+1)
+	} else {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	}
+	return append(b, data...)
+}
+
+// Read the length prefix of an ARRAY (int32) or COMPACT_ARRAY (unsigned
+// varint N+1). Null arrays are returned as -1.
+func readArrayLength(buf *bytes.Buffer, flexible bool) int {
+	if flexible {
+		return readUnsignedVarint(buf) - 1
+	}
+
+	var arrLen int32
+	err := binary.Read(buf, binary.BigEndian, &arrLen)
+	checkError(err)
+
+	return int(arrLen)
+}
+
+func appendArrayLength(b []byte, arrLen int, flexible bool) []byte {
+	if flexible {
+		return appendUnsignedVarint(b, arrLen+1)
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(int32(arrLen)))
+}
+
+// Skip a tagged fields section. None of the tagged fields we receive are
+// understood yet, so their contents are discarded.
+func skipTaggedFields(buf *bytes.Buffer) {
+	numFields := readUnsignedVarint(buf)
+	for range numFields {
+		readUnsignedVarint(buf) // tag
+		size := readUnsignedVarint(buf)
+		if buf.Len() < size {
+			panic(io.ErrUnexpectedEOF)
+		}
+		buf.Next(size)
+	}
+}
+
+// Read a tagged fields section, handing each field to read along with its
+// tag. Tags read doesn't know about should be ignored.
+func readTaggedFields(buf *bytes.Buffer, read func(tag int, field *bytes.Buffer)) {
+	numFields := readUnsignedVarint(buf)
+	for range numFields {
+		tag := readUnsignedVarint(buf)
+		size := readUnsignedVarint(buf)
+		if buf.Len() < size {
+			panic(io.ErrUnexpectedEOF)
+		}
+		read(tag, bytes.NewBuffer(buf.Next(size)))
+	}
+}
+
+func readUnsignedVarint(buf *bytes.Buffer) int {
+	n, err := binary.ReadUvarint(buf)
+	checkError(err)
+	return int(n)
+}
+
+func appendUnsignedVarint(b []byte, n int) []byte {
+	return binary.AppendUvarint(b, uint64(n))
+}
+
 func decodeSignedVarint(n int) int {
 	return (n >> 1) ^ -(n & 0x1)
 }
@@ -59,11 +197,7 @@ func readSignedVarint(buf *bytes.Buffer) int {
 //
 // elementSize: size of element in bytes
 func readCompactArray[T any](buf *bytes.Buffer) []T {
-	var lengthByte byte
-	err := binary.Read(buf, binary.BigEndian, &lengthByte)
-	checkError(err)
-
-	length := int(lengthByte) - 1
+	length := readUnsignedVarint(buf) - 1
 	if length < 0 {
 		return nil
 	} else if length == 0 {
@@ -74,7 +208,7 @@ func readCompactArray[T any](buf *bytes.Buffer) []T {
 
 	for range length {
 		var ele T
-		err = binary.Read(buf, binary.BigEndian, &ele)
+		err := binary.Read(buf, binary.BigEndian, &ele)
 		checkError(err)
 		out = append(out, ele)
 	}
@@ -86,55 +220,72 @@ type CompactArrayElement interface {
 	deserialize(buf *bytes.Buffer)
 }
 
-func readCustomComapctArray(buf *bytes.Buffer, newElement func()CompactArrayElement) []CompactArrayElement {
-	var arrLenByte byte
-	err := binary.Read(buf, binary.BigEndian, &arrLenByte)
-	checkError(err)
+func readCustomComapctArray(buf *bytes.Buffer, newElement func() CompactArrayElement) []CompactArrayElement {
+	return readCustomArray(buf, true, newElement)
+}
 
-	arrLen := max(0, int(arrLenByte)-1)
+// Read an ARRAY or, for flexible versions, a COMPACT_ARRAY of elements
+func readCustomArray(buf *bytes.Buffer, flexible bool, newElement func() CompactArrayElement) []CompactArrayElement {
+	arrLen := max(0, readArrayLength(buf, flexible))
 	out := []CompactArrayElement{}
 
-	for range(arrLen) {
+	for range arrLen {
 		element := newElement()
 		element.deserialize(buf)
 		out = append(out, element)
 	}
-	
+
 	return out
 }
 
-func encodeCompactArray[T uint16 | uint32, E ~int32 | int](arr []E, appendBits func(b []byte, v T) []byte) []byte {
+// Encode an ARRAY or, for flexible versions, a COMPACT_ARRAY of int32s.
+// A nil slice is encoded as a null array.
+func encodeInt32Array[E ~int32](arr []E, flexible bool) []byte {
 	if arr == nil {
-		return []byte{0}
+		return appendArrayLength([]byte{}, -1, flexible)
 	}
-	arrLen := len(arr)
-	if arrLen == 0 {
-		return []byte{1}
-	}
-
-	res := []byte{byte(arrLen + 1)}
 
+	res := appendArrayLength([]byte{}, len(arr), flexible)
 	for _, ele := range arr {
-		res = appendBits(res, T(ele))
+		res = binary.BigEndian.AppendUint32(res, uint32(ele))
 	}
-
 	return res
 }
 
+// Append a NULLABLE_STRING or COMPACT_NULLABLE_STRING, encoding "" as null
+func appendNullableString(b []byte, s string, flexible bool) []byte {
+	if s != "" {
+		return appendString(b, s, flexible)
+	}
+	if flexible {
+		return append(b, 0)
+	}
+	return binary.BigEndian.AppendUint16(b, 0xffff)
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
 type SerializableElement interface {
 	serialize() []byte
 }
 
 func encodeCustomCompactArray(arr []SerializableElement) []byte {
+	return encodeCustomArray(arr, true)
+}
+
+// Encode an ARRAY or, for flexible versions, a COMPACT_ARRAY of elements.
+// A nil slice is encoded as a null array.
+func encodeCustomArray(arr []SerializableElement, flexible bool) []byte {
 	if arr == nil {
-		return []byte{0}
-	}
-	arrLen := len(arr)
-	if arrLen == 0 {
-		return []byte{1}
+		return appendArrayLength([]byte{}, -1, flexible)
 	}
 
-	res := []byte{byte(arrLen + 1)}
+	res := appendArrayLength([]byte{}, len(arr), flexible)
 
 	for _, ele := range arr {
 		element := ele.serialize()
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"io"
 	"reflect"
 	"testing"
 )
@@ -108,3 +109,27 @@ func Test_readSignedVarint(t *testing.T) {
 		})
 	}
 }
+
+func Test_readString_truncated(t *testing.T) {
+	tests := []struct {
+		name string
+		read func(buf *bytes.Buffer)
+	}{
+		{"compact string", func(buf *bytes.Buffer) { readString(buf, true) }},
+		{"compact nullable string", func(buf *bytes.Buffer) { readNullableString(buf, true) }},
+		{"compact bytes", func(buf *bytes.Buffer) { readBytes(buf, true) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A length far beyond the buffer must not be allocated
+			buf := bytes.NewBuffer(appendUnsignedVarint([]byte{}, 1<<40))
+			buf.WriteString("abc")
+			defer func() {
+				if r := recover(); r != io.ErrUnexpectedEOF {
+					t.Errorf("recover() = %v, want %v", r, io.ErrUnexpectedEOF)
+				}
+			}()
+			tt.read(buf)
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Sensors of clients that stopped sending requests are dropped after this
+// long, like Kafka's inactive sensor expiration
+const QUOTA_SENSOR_EXPIRATION = time.Hour
+
+// Measures clients against the quotas in the metadata log and works out how
+// long they are throttled, modelled after Kafka's ClientQuotaManager
+type QuotaManager struct {
+	metadata   *MetadataLog
+	windowNum  int
+	windowSize time.Duration
+	mu         sync.Mutex
+	sensors    map[QuotaSensorKey]*QuotaSensor
+	lastExpiry time.Time
+}
+
+// Clients that share a quota share its sensor. A quota set for a user (or
+// the default user) is shared by every client ID of that user, so the
+// sensor only keeps the parts the quota's entity has.
+type QuotaSensorKey struct {
+	key      string
+	user     string
+	clientID string
+}
+
+// A rate sampled over quota.window.num windows of quota.window.size.seconds,
+// like Kafka's Rate stat
+type QuotaSensor struct {
+	samples    []QuotaSample
+	current    int
+	lastRecord time.Time
+}
+
+type QuotaSample struct {
+	start time.Time
+	value float64
+}
+
+func newQuotaManager(config *Config, metadata *MetadataLog) *QuotaManager {
+	return &QuotaManager{
+		metadata:   metadata,
+		windowNum:  config.quotaWindowNum,
+		windowSize: config.quotaWindowSize,
+		sensors:    map[QuotaSensorKey]*QuotaSensor{},
+	}
+}
+
+// Quota values by entity and key
+func (q *QuotaManager) quotas() map[QuotaEntity]map[string]float64 {
+	quotas := map[QuotaEntity]map[string]float64{}
+	for _, record := range q.metadata.image().records.ClientQuotaRecords {
+		if quotas[record.entity] == nil {
+			quotas[record.entity] = map[string]float64{}
+		}
+		quotas[record.entity][record.key] = record.value
+	}
+	return quotas
+}
+
+// The entities whose quotas apply to a user's connections with a client ID,
+// most specific first
+func quotaCandidates(user string, clientID string) []QuotaEntity {
+	u, c := namedQuotaEntity(user), namedQuotaEntity(clientID)
+	defaultUser, defaultClientID := defaultQuotaEntity(), defaultQuotaEntity()
+	return []QuotaEntity{
+		{user: u, clientID: c},
+		{user: u, clientID: defaultClientID},
+		{user: u},
+		{user: defaultUser, clientID: c},
+		{user: defaultUser, clientID: defaultClientID},
+		{user: defaultUser},
+		{clientID: c},
+		{clientID: defaultClientID},
+	}
+}
+
+// The quota for key that applies to the client and the sensor it is
+// measured with. Clients without a quota aren't limited.
+func resolveQuota(quotas map[QuotaEntity]map[string]float64, key string, user string, clientID string) (float64, QuotaSensorKey, bool) {
+	for _, entity := range quotaCandidates(user, clientID) {
+		bound, ok := quotas[entity][key]
+		if !ok {
+			continue
+		}
+		sensorKey := QuotaSensorKey{key: key}
+		if entity.user.set {
+			sensorKey.user = user
+		}
+		if entity.clientID.set {
+			sensorKey.clientID = clientID
+		}
+		return bound, sensorKey, true
+	}
+	return 0, QuotaSensorKey{}, false
+}
+
+// Record value against the client's quota for key and return how long the
+// client is throttled for
+func (q *QuotaManager) record(quotas map[QuotaEntity]map[string]float64, key string, user string, clientID string, value float64, now time.Time) time.Duration {
+	bound, sensorKey, ok := resolveQuota(quotas, key, user, clientID)
+	if !ok {
+		return 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expireSensors(now)
+	sensor, ok := q.sensors[sensorKey]
+	if !ok {
+		sensor = &QuotaSensor{samples: make([]QuotaSample, q.windowNum)}
+		sensor.samples[0].start = now
+		q.sensors[sensorKey] = sensor
+	}
+	sensor.record(value, now, q.windowSize)
+
+	rate, window := sensor.measure(now, q.windowSize)
+	if rate <= bound {
+		return 0
+	}
+	// Long enough for the rate over the window to come back down to the
+	// quota, but never longer than the window itself
+	throttle := time.Duration((rate - bound) / bound * float64(window))
+	return min(throttle, time.Duration(q.windowNum)*q.windowSize)
+}
+
+// The changes to one entity's quotas
+type QuotaAlteration struct {
+	entity QuotaEntity
+	ops    []QuotaOp
+}
+
+// Set key to value, or remove it
+type QuotaOp struct {
+	key    string
+	value  float64
+	remove bool
+}
+
+// Validate the alterations and, unless validateOnly is set, store the
+// valid ones. Returns an error (or nil) for each alteration.
+func (q *QuotaManager) alterQuotas(alterations []QuotaAlteration, validateOnly bool) []error {
+	errs := make([]error, len(alterations))
+	values := [][]byte{}
+	for i, alteration := range alterations {
+		// An alteration is stored whole or not at all
+		alterationValues := [][]byte{}
+		seen := map[string]bool{}
+		for _, op := range alteration.ops {
+			if seen[op.key] {
+				errs[i] = newKafkaError(ERR_INVALID_REQUEST, "Duplicate quota key %s for %s", op.key, alteration.entity)
+				break
+			}
+			seen[op.key] = true
+
+			// Removals don't carry a value, but the key must still be known
+			value := op.value
+			if op.remove {
+				value = 1
+			}
+			if errs[i] = validateQuota(op.key, value); errs[i] != nil {
+				break
+			}
+			record := ClientQuotaRecord{entity: alteration.entity, key: op.key, value: op.value, remove: op.remove}
+			alterationValues = append(alterationValues, record.serialize())
+		}
+		if errs[i] == nil {
+			values = append(values, alterationValues...)
+		}
+	}
+	if validateOnly || len(values) == 0 {
+		return errs
+	}
+
+	if err := q.metadata.appendRecords(values); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+func (q *QuotaManager) expireSensors(now time.Time) {
+	if now.Sub(q.lastExpiry) < time.Minute {
+		return
+	}
+	q.lastExpiry = now
+	for key, sensor := range q.sensors {
+		if now.Sub(sensor.lastRecord) > QUOTA_SENSOR_EXPIRATION {
+			delete(q.sensors, key)
+		}
+	}
+}
+
+func (s *QuotaSensor) record(value float64, now time.Time, windowSize time.Duration) {
+	if now.Sub(s.samples[s.current].start) >= windowSize {
+		s.current = (s.current + 1) % len(s.samples)
+		s.samples[s.current] = QuotaSample{start: now}
+	}
+	s.samples[s.current].value += value
+	s.lastRecord = now
+}
+
+// The rate per second over the samples still in the window, and the length
+// of the window it was measured over
+func (s *QuotaSensor) measure(now time.Time, windowSize time.Duration) (float64, time.Duration) {
+	total := 0.0
+	oldest := now
+	for i := range s.samples {
+		sample := &s.samples[i]
+		if now.Sub(sample.start) >= time.Duration(len(s.samples))*windowSize {
+			*sample = QuotaSample{start: now}
+			continue
+		}
+		total += sample.value
+		if sample.start.Before(oldest) {
+			oldest = sample.start
+		}
+	}
+
+	// New sensors are measured over all but one of the windows, so the
+	// first requests of a client don't look like a huge rate
+	window := now.Sub(oldest)
+	fullWindows := int(window / windowSize)
+	if minFullWindows := max(1, len(s.samples)-1); fullWindows < minFullWindows {
+		window += time.Duration(minFullWindows-fullWindows) * windowSize
+	}
+	return total / window.Seconds(), window
+}
+
+// Responses with a throttle time field
+type ThrottledResponse interface {
+	withThrottleTime(throttleTime int32) SerializableResponse
+}
+
+// Record the request against the client's quotas and set the throttle time
+// of its response. Returns how long the connection stays muted for.
+// Responses without a throttle time, i.e. those of the SASL exchange, are
+// exempt.
+func (b *Broker) throttle(req RequestMessage, response *ResponseMessage, handlerTime time.Duration) time.Duration {
+	if response == nil {
+		return 0
+	}
+	throttled, ok := response.body.(ThrottledResponse)
+	if !ok {
+		return 0
+	}
+	quotas := b.quotas.quotas()
+	if len(quotas) == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	user, clientID := req.context.principal.name, req.header.clientID
+	// Request quotas are a percentage of one handler's time
+	throttle := b.quotas.record(quotas, REQUEST_PERCENTAGE, user, clientID, handlerTime.Seconds()*100, now)
+	if req.header.requestApiKey == FETCH {
+		fetched := float64(responseSize(response.body))
+		throttle = max(throttle, b.quotas.record(quotas, CONSUMER_BYTE_RATE, user, clientID, fetched, now))
+	}
+
+	response.body = throttled.withThrottleTime(int32(throttle / time.Millisecond))
+	return throttle
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_resolveQuota(t *testing.T) {
+	alice, ordersApp := namedQuotaEntity("alice"), namedQuotaEntity("orders-app")
+	quotas := map[QuotaEntity]map[string]float64{
+		{user: alice, clientID: ordersApp}:               {CONSUMER_BYTE_RATE: 1},
+		{user: alice}:                                    {CONSUMER_BYTE_RATE: 2},
+		{user: defaultQuotaEntity()}:                     {CONSUMER_BYTE_RATE: 3},
+		{clientID: ordersApp}:                            {CONSUMER_BYTE_RATE: 4, REQUEST_PERCENTAGE: 50},
+		{clientID: defaultQuotaEntity()}:                 {REQUEST_PERCENTAGE: 10},
+		{user: alice, clientID: defaultQuotaEntity()}:    {REQUEST_PERCENTAGE: 20},
+		{user: namedQuotaEntity("bob"), clientID: alice}: {PRODUCER_BYTE_RATE: 5},
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		user       string
+		clientID   string
+		wantBound  float64
+		wantSensor QuotaSensorKey
+		wantOk     bool
+	}{
+		{"user and client ID", CONSUMER_BYTE_RATE, "alice", "orders-app", 1, QuotaSensorKey{CONSUMER_BYTE_RATE, "alice", "orders-app"}, true},
+		{"user shared by client IDs", CONSUMER_BYTE_RATE, "alice", "billing", 2, QuotaSensorKey{CONSUMER_BYTE_RATE, "alice", ""}, true},
+		{"default user before client ID", CONSUMER_BYTE_RATE, "carol", "orders-app", 3, QuotaSensorKey{CONSUMER_BYTE_RATE, "carol", ""}, true},
+		{"default client ID of a user", REQUEST_PERCENTAGE, "alice", "billing", 20, QuotaSensorKey{REQUEST_PERCENTAGE, "alice", "billing"}, true},
+		{"client ID", REQUEST_PERCENTAGE, "carol", "orders-app", 50, QuotaSensorKey{REQUEST_PERCENTAGE, "", "orders-app"}, true},
+		{"default client ID", REQUEST_PERCENTAGE, "carol", "billing", 10, QuotaSensorKey{REQUEST_PERCENTAGE, "", "billing"}, true},
+		{"no quota", PRODUCER_BYTE_RATE, "alice", "orders-app", 0, QuotaSensorKey{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bound, sensor, ok := resolveQuota(quotas, tt.key, tt.user, tt.clientID)
+			if bound != tt.wantBound || sensor != tt.wantSensor || ok != tt.wantOk {
+				t.Errorf("resolveQuota() = %v, %+v, %v, want %v, %+v, %v", bound, sensor, ok, tt.wantBound, tt.wantSensor, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_QuotaManager_record(t *testing.T) {
+	quotas := map[QuotaEntity]map[string]float64{
+		{user: defaultQuotaEntity()}: {CONSUMER_BYTE_RATE: 5},
+	}
+	start := time.Now()
+
+	type recording struct {
+		after time.Duration
+		value float64
+	}
+	tests := []struct {
+		name       string
+		recordings []recording
+		// Throttle time of the last recording
+		want time.Duration
+	}{
+		// New sensors are measured over 10 of the 11 one second windows
+		{"under quota", []recording{{0, 40}}, 0},
+		{"over quota", []recording{{0, 100}}, 10 * time.Second},
+		{"capped at the quota window", []recording{{0, 1000}}, 11 * time.Second},
+		{"samples add up", []recording{{0, 40}, {2 * time.Second, 40}}, 6 * time.Second},
+		{"old samples expire", []recording{{0, 100}, {20 * time.Second, 10}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &QuotaManager{windowNum: 11, windowSize: time.Second, sensors: map[QuotaSensorKey]*QuotaSensor{}}
+			var got time.Duration
+			for _, r := range tt.recordings {
+				got = q.record(quotas, CONSUMER_BYTE_RATE, "alice", "orders-app", r.value, start.Add(r.after))
+			}
+			if got.Round(time.Millisecond) != tt.want {
+				t.Errorf("record() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ClientQuotaApis(t *testing.T) {
+	broker := newTestBroker(t, nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConnection(broker, "PLAINTEXT", server).serve()
+
+	// consumer_byte_rate=1 for the test client, and a quota we don't know
+	entity := appendArrayLength(nil, 1, true)
+	entity = appendString(entity, QUOTA_ENTITY_CLIENT_ID, true)
+	entity = appendString(entity, "test-client", true)
+	entity = append(entity, 0)
+	alter := appendArrayLength(nil, 2, true)
+	for _, key := range []string{CONSUMER_BYTE_RATE, "connection_creation_rate"} {
+		alter = append(alter, entity...)
+		alter = appendArrayLength(alter, 1, true)
+		alter = appendString(alter, key, true)
+		alter = appendFloat64(alter, 1)
+		alter = append(alter, 0, 0, 0)
+	}
+	alter = append(alter, 0, 0)
+	response, err := sendTestRequest(client, ALTER_CLIENT_QUOTAS, 1, alter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(response[4:])
+	readArrayLength(buf, true)
+	for _, want := range []ErrorCode{ERR_NONE, ERR_INVALID_REQUEST} {
+		if errorCode := ErrorCode(binary.BigEndian.Uint16(buf.Next(2))); errorCode != want {
+			t.Errorf("AlterClientQuotas error = %v, want %v", errorCode, want)
+		}
+		readComapctString(buf)
+		readQuotaEntityData(buf, true)
+		buf.Next(1)
+	}
+
+	describe := appendArrayLength(nil, 1, true)
+	describe = appendString(describe, QUOTA_ENTITY_CLIENT_ID, true)
+	describe = append(describe, byte(QUOTA_MATCH_ANY), 0, 0)
+	describe = append(describe, 0, 0)
+	response, err = sendTestRequest(client, DESCRIBE_CLIENT_QUOTAS, 1, describe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = bytes.NewBuffer(response[4:])
+	if errorCode := ErrorCode(binary.BigEndian.Uint16(buf.Next(2))); errorCode != ERR_NONE {
+		t.Fatalf("DescribeClientQuotas error = %v", errorCode)
+	}
+	readComapctString(buf)
+	if entries := readArrayLength(buf, true); entries != 1 {
+		t.Fatalf("DescribeClientQuotas returned %d entries, want 1", entries)
+	}
+	if parts := readQuotaEntityData(buf, true); len(parts) != 1 || parts[0].entityName != "test-client" {
+		t.Errorf("DescribeClientQuotas entity = %+v, want client-id=test-client", parts)
+	}
+	readArrayLength(buf, true)
+	if key, value := readComapctString(buf), math.Float64frombits(binary.BigEndian.Uint64(buf.Next(8))); key != CONSUMER_BYTE_RATE || value != 1 {
+		t.Errorf("DescribeClientQuotas value = %v=%v, want %v=1", key, value, CONSUMER_BYTE_RATE)
+	}
+
+	// Any fetch response is over one byte per second
+	fetch := binary.BigEndian.AppendUint32(nil, 500)
+	fetch = binary.BigEndian.AppendUint32(fetch, 1)
+	fetch = binary.BigEndian.AppendUint32(fetch, 1024)
+	fetch = append(fetch, 0)
+	fetch = binary.BigEndian.AppendUint32(fetch, 0)
+	fetch = binary.BigEndian.AppendUint32(fetch, 0)
+	fetch = append(fetch, 1, 1, 1, 0)
+	response, err = sendTestRequest(client, FETCH, 16, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttleTime := int32(binary.BigEndian.Uint32(response)); throttleTime <= 0 || throttleTime > 11000 {
+		t.Errorf("Fetch throttle time = %v, want between 0 and 11000", throttleTime)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"time"
 )
 
 type RequestHeader struct {
@@ -22,66 +24,151 @@ type RequestBody interface {
 type RequestMessage struct {
 	header RequestHeader
 	body   RequestBody
+	// Undecoded request body, kept around for error responses
+	rawBody []byte
+	context RequestContext
+	// The pooled buffer the request was read into, rawBody points into it
+	buf *[]byte
+	// When the whole frame was read, before any of it was decoded
+	received time.Time
+	// The span of the handler, nil unless tracing is on
+	span *Span
 }
 
-func getRequestBody(apiKey ApiKey) RequestBody {
+// Where a request came from, as opposed to what it asks for
+type RequestContext struct {
+	listenerName     string
+	securityProtocol SecurityProtocol
+	clientAddress    net.Addr
+	principal        KafkaPrincipal
+	// Authentication state of connections to SASL listeners, nil otherwise
+	sasl *SaslSession
+}
+
+func getRequestBody(apiKey ApiKey, version int16) RequestBody {
 	switch apiKey {
 	case DESCRIBE_TOPIC_PARTITIONS:
-		return &DescribeTopicPartitionsRequest{}
+		return &DescribeTopicPartitionsRequest{version: version}
 	case FETCH:
-		return &FetchRequest{}
+		return &FetchRequest{version: version}
+	case LIST_OFFSETS:
+		return &ListOffsetsRequest{version: version}
+	case METADATA:
+		return &MetadataRequest{version: version}
+	case DELETE_RECORDS:
+		return &DeleteRecordsRequest{version: version}
+	case DESCRIBE_CLUSTER:
+		return &DescribeClusterRequest{version: version}
+	case SASL_HANDSHAKE:
+		return &SaslHandshakeRequest{version: version}
+	case SASL_AUTHENTICATE:
+		return &SaslAuthenticateRequest{version: version}
+	case DESCRIBE_ACLS:
+		return &DescribeAclsRequest{version: version}
+	case CREATE_ACLS:
+		return &CreateAclsRequest{version: version}
+	case DELETE_ACLS:
+		return &DeleteAclsRequest{version: version}
+	case DESCRIBE_CLIENT_QUOTAS:
+		return &DescribeClientQuotasRequest{version: version}
+	case ALTER_CLIENT_QUOTAS:
+		return &AlterClientQuotasRequest{version: version}
 	default:
 		return nil
 	}
 }
+
 func (h *RequestHeader) deserialize(header []byte) int {
-	h.requestApiKey = ApiKey(binary.BigEndian.Uint16(header[:2]))
-	h.requestApiVersion = int16(binary.BigEndian.Uint16(header[2:4]))
-	h.correlationID = int32(binary.BigEndian.Uint32(header[4:8]))
+	buf := bytes.NewBuffer(header)
 
-	clientIDLength := int(binary.BigEndian.Uint16(header[8:10]))
-	h.clientID = string(header[10 : 10+clientIDLength])
+	err := binary.Read(buf, binary.BigEndian, &h.requestApiKey)
+	checkError(err)
+	err = binary.Read(buf, binary.BigEndian, &h.requestApiVersion)
+	checkError(err)
+	err = binary.Read(buf, binary.BigEndian, &h.correlationID)
+	checkError(err)
 
-	tagBufferLength := header[10+clientIDLength]
-	requestBodyIdx := 10 + clientIDLength + 1
+	// Client ID is a nullable string, even in flexible headers
+	h.clientID = readString(buf, false)
 
-	if tagBufferLength != 0 {
-		requestBodyIdx += int(tagBufferLength)
+	// Only request header v2 (flexible versions) has a tag buffer
+	if isFlexibleVersion(h.requestApiKey, h.requestApiVersion) {
+		skipTaggedFields(buf)
 	}
+
 	// Returns index to the start of request body
-	return requestBodyIdx
+	return len(header) - buf.Len()
+}
+
+func (h RequestHeader) isSupportedVersion() bool {
+	supported, ok := getSupportedApiVersion(h.requestApiKey)
+	return ok && supported.isSupported(h.requestApiVersion)
 }
 
-func getRequestMessage(conn net.Conn) RequestMessage {
+// Read and decode the next request, which may be at most maxSize bytes.
+// Errors are only returned for failed reads and oversized requests,
+// malformed requests still panic. The request is read into a pooled buffer
+// that must be released once the request is handled.
+func getRequestMessage(r io.Reader, maxSize int) (RequestMessage, error) {
 	sizeBytes := make([]byte, 4)
-	_, err := io.ReadFull(conn, sizeBytes)
-	checkError(err)
+	if _, err := io.ReadFull(r, sizeBytes); err != nil {
+		return RequestMessage{}, err
+	}
 
-	size := int(binary.BigEndian.Uint32(sizeBytes))
-	data := make([]byte, size)
-	_, err = io.ReadFull(conn, data)
-	checkError(err)
+	// Checked before anything is allocated, a size is all it takes to make
+	// us allocate 2 GB otherwise
+	size := int(int32(binary.BigEndian.Uint32(sizeBytes)))
+	if size < 0 || size > maxSize {
+		return RequestMessage{}, fmt.Errorf("invalid request size %d, socket.request.max.bytes is %d", size, maxSize)
+	}
+	buf := getBuffer(size)
+	*buf = (*buf)[:size]
+	data := *buf
+	if _, err := io.ReadFull(r, data); err != nil {
+		putBuffer(buf)
+		return RequestMessage{}, err
+	}
+	received := time.Now()
 
 	header := RequestHeader{size: size}
 	bodyIdx := header.deserialize(data)
 
-	body := getRequestBody(header.requestApiKey)
+	// Bodies are only decoded for versions we know the layout of. Anything
+	// else is answered with UNSUPPORTED_VERSION by Broker.NewResponse.
+	var body RequestBody
+	if header.isSupportedVersion() {
+		body = getRequestBody(header.requestApiKey, header.requestApiVersion)
+	}
 	if body != nil {
 		body.deserialize(data[bodyIdx:])
 	}
-	fmt.Printf("Request Body: %+v\n", body)
 
 	return RequestMessage{
-		header: header,
-		body:   body,
+		header:   header,
+		body:     body,
+		rawBody:  data[bodyIdx:],
+		buf:      buf,
+		received: received,
+	}, nil
+}
+
+// Hand the buffer the request was read into back to the pool. Decoded
+// bodies hold copies of what they read, only rawBody goes away.
+func (r *RequestMessage) release() {
+	if r.buf != nil {
+		putBuffer(r.buf)
+		r.buf, r.rawBody = nil, nil
 	}
 }
 
-func (r RequestMessage) printHeader() {
-	fmt.Println("Received request. Request header:")
-	fmt.Println("size:", r.header.size)
-	fmt.Println("requestApiKey:", r.header.requestApiKey)
-	fmt.Println("requestApiVersion:", r.header.requestApiVersion)
-	fmt.Println("correlationID:", r.header.correlationID)
-	fmt.Println("clientID:", r.header.clientID)
+// Decode a request body that may not match the layout we expect, reporting
+// whether it succeeded instead of panicking
+func tryDeserialize(body RequestBody, data []byte) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	body.deserialize(data)
+	return true
 }
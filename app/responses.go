@@ -1,13 +1,14 @@
 package main
 
 import (
-	"encoding/binary"
-	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"time"
 )
 
 type ResponseHeader interface {
-	serialize() []byte
+	encode(e *Encoder)
 }
 
 type ResponseHeaderV0 struct {
@@ -21,6 +22,9 @@ type ResponseHeaderV1 struct {
 
 type SerializableResponse interface {
 	serialize() []byte
+	// The error codes the response carries and how often, top-level and
+	// per entry alike
+	errorCounts() map[ErrorCode]int
 }
 
 type ResponseMessage struct {
@@ -28,63 +32,205 @@ type ResponseMessage struct {
 	body   SerializableResponse
 }
 
-func NewResponse(req RequestMessage) *ResponseMessage {
+// Part of a response that is written straight from a file instead of
+// being copied into memory, like record batches read from a segment
+type FileRegion interface {
+	Len() int
+	WriteTo(w io.Writer) (int64, error)
+	Bytes() ([]byte, error)
+	Close() error
+}
+
+// A response that encodes itself field by field, straight into the buffer
+// the message is sent from
+type EncodableResponse interface {
+	SerializableResponse
+	encode(e *Encoder)
+}
+
+// A response holding file regions, which must be closed once it is sent or
+// dropped
+type FileBackedResponse interface {
+	EncodableResponse
+	Close() error
+}
+
+func (b *Broker) NewResponse(req RequestMessage) *ResponseMessage {
 	response := ResponseMessage{}
 	apiKey := req.header.requestApiKey
 
+	if _, ok := getSupportedApiVersion(apiKey); !ok {
+		// There's no error shape for APIs we don't know about
+		return nil
+	}
+	response.header = newResponseHeader(req.header)
+
+	if !req.header.isSupportedVersion() {
+		response.body = buildErrorResponse(req, ERR_UNSUPPORTED_VERSION)
+		return &response
+	}
+
 	switch apiKey {
 	case API_VERSIONS:
 		response.body = buildApiVersionsResponse(req)
-		response.header = ResponseHeaderV0{correlationID: req.header.correlationID}
 	case DESCRIBE_TOPIC_PARTITIONS:
-		response.body = buildDescribeTopicPartitionsResponse(req)
-		response.header = ResponseHeaderV1{correlationID: req.header.correlationID}
+		response.body = b.buildDescribeTopicPartitionsResponse(req)
 	case FETCH:
-		response.body = buildFetchResposne(req)
-		response.header = ResponseHeaderV1{correlationID: req.header.correlationID}
+		response.body = b.buildFetchResposne(req)
+	case LIST_OFFSETS:
+		response.body = b.buildListOffsetsResponse(req)
+	case METADATA:
+		response.body = b.buildMetadataResponse(req)
+	case DELETE_RECORDS:
+		response.body = b.buildDeleteRecordsResponse(req)
+	case DESCRIBE_CLUSTER:
+		response.body = b.buildDescribeClusterResponse(req)
+	case SASL_HANDSHAKE:
+		response.body = b.buildSaslHandshakeResponse(req)
+	case SASL_AUTHENTICATE:
+		response.body = b.buildSaslAuthenticateResponse(req)
+	case DESCRIBE_ACLS:
+		response.body = b.buildDescribeAclsResponse(req)
+	case CREATE_ACLS:
+		response.body = b.buildCreateAclsResponse(req)
+	case DELETE_ACLS:
+		response.body = b.buildDeleteAclsResponse(req)
+	case DESCRIBE_CLIENT_QUOTAS:
+		response.body = b.buildDescribeClientQuotasResponse(req)
+	case ALTER_CLIENT_QUOTAS:
+		response.body = b.buildAlterClientQuotasResponse(req)
 	}
 
 	return &response
 }
 
-func (rs ResponseHeaderV0) serialize() []byte {
-	header := make([]byte, 4)
-	binary.BigEndian.PutUint32(header, uint32(rs.correlationID))
-	return header
+// Build the response for a request that failed as a whole, in the shape
+// its API uses to report errors
+func buildErrorResponse(req RequestMessage, errorCode ErrorCode) SerializableResponse {
+	switch req.header.requestApiKey {
+	case API_VERSIONS:
+		return buildApiVersionsErrorResponse(req, errorCode)
+	case DESCRIBE_TOPIC_PARTITIONS:
+		return buildDescribeTopicPartitionsErrorResponse(req, errorCode)
+	case FETCH:
+		return buildFetchErrorResponse(req, errorCode)
+	case LIST_OFFSETS:
+		return buildListOffsetsErrorResponse(req, errorCode)
+	case METADATA:
+		return buildMetadataErrorResponse(req, errorCode)
+	case DELETE_RECORDS:
+		return buildDeleteRecordsErrorResponse(req, errorCode)
+	case DESCRIBE_CLUSTER:
+		return buildDescribeClusterErrorResponse(req, errorCode)
+	case SASL_HANDSHAKE:
+		return buildSaslHandshakeErrorResponse(req, errorCode)
+	case SASL_AUTHENTICATE:
+		return buildSaslAuthenticateErrorResponse(req, errorCode)
+	case DESCRIBE_ACLS:
+		return buildDescribeAclsErrorResponse(req, errorCode)
+	case CREATE_ACLS:
+		return buildCreateAclsErrorResponse(req, errorCode)
+	case DELETE_ACLS:
+		return buildDeleteAclsErrorResponse(req, errorCode)
+	case DESCRIBE_CLIENT_QUOTAS:
+		return buildDescribeClientQuotasErrorResponse(req, errorCode)
+	case ALTER_CLIENT_QUOTAS:
+		return buildAlterClientQuotasErrorResponse(req, errorCode)
+	}
+	return nil
+}
+
+func newResponseHeader(header RequestHeader) ResponseHeader {
+	// ApiVersions responses always use header v0 so that clients can parse
+	// them before knowing what the broker supports
+	if header.requestApiKey == API_VERSIONS || !isFlexibleVersion(header.requestApiKey, header.requestApiVersion) {
+		return ResponseHeaderV0{correlationID: header.correlationID}
+	}
+	return ResponseHeaderV1{correlationID: header.correlationID}
+}
+
+func (rs ResponseHeaderV0) encode(e *Encoder) {
+	e.putInt32(rs.correlationID)
 }
 
-func (rs ResponseHeaderV1) serialize() []byte {
-	header := make([]byte, 4)
-	binary.BigEndian.PutUint32(header, uint32(rs.correlationID))
-	header = append(header, rs.tagBuffer)
-	return header
+func (rs ResponseHeaderV1) encode(e *Encoder) {
+	e.putInt32(rs.correlationID)
+	e.putInt8(int8(rs.tagBuffer))
 }
 
 func (r ResponseMessage) serialize() []byte {
-	serializedHeader := r.header.serialize()
-	serializedBody := []byte{}
+	e := r.encode()
+	defer e.release()
+	return e.Bytes()
+}
 
-	if r.body != nil {
-		body := r.body.serialize()
-		serializedBody = append(serializedBody, body...)
+// The message with its size prefix, in a pooled encoder that must be
+// released once written out. Bodies that can't be encoded are serialized
+// and copied in.
+func (r ResponseMessage) encode() *Encoder {
+	body, encodable := r.body.(EncodableResponse)
+	var serializedBody []byte
+	if !encodable && r.body != nil {
+		serializedBody = r.body.serialize()
 	}
 
-	messageSize := len(serializedHeader) + len(serializedBody)
-	message := make([]byte, 4+messageSize) // messageSize itself is 4 bytes
+	// Sized up front, so the buffer never grows
+	counter := newCountingEncoder()
+	r.header.encode(counter)
+	if encodable {
+		body.encode(counter)
+	} else {
+		counter.putBytes(serializedBody)
+	}
 
-	fmt.Println("Header", serializedHeader)
-	fmt.Println("Body:", serializedBody)
+	e := newEncoder(4 + counter.bufferedLen())
+	e.putInt32(int32(counter.Len()))
+	r.header.encode(e)
+	if encodable {
+		body.encode(e)
+	} else {
+		e.putBytes(serializedBody)
+	}
 
-	binary.BigEndian.PutUint32(message, uint32(messageSize))
-	copy(message[4:], serializedHeader)
-	copy(message[4+len(serializedHeader):], serializedBody)
+	return e
+}
 
-	return message
+// How many bytes the response body takes on the wire
+func responseSize(body SerializableResponse) int {
+	if body, ok := body.(EncodableResponse); ok {
+		counter := newCountingEncoder()
+		body.encode(counter)
+		return counter.Len()
+	}
+	return len(body.serialize())
 }
 
-func sendResponse(conn net.Conn, responseMessage ResponseMessage) {
-	serializedMsg := responseMessage.serialize()
-	_, err := conn.Write(serializedMsg)
-	checkError(err)
-	fmt.Println("Sent:", serializedMsg)
+// Release whatever the response holds besides memory
+func releaseResponse(responseMessage *ResponseMessage) {
+	if responseMessage == nil {
+		return
+	}
+	if body, ok := responseMessage.body.(FileBackedResponse); ok {
+		if err := body.Close(); err != nil {
+			slog.Warn("Error releasing response", "error", err)
+		}
+	}
+}
+
+// Send the response, returning how many bytes went out. The encoding and
+// the write are traced as children of span.
+func sendResponse(conn net.Conn, responseMessage ResponseMessage, span *Span) (int64, error) {
+	encode := span.startChild("encode", time.Now())
+	e := responseMessage.encode()
+	defer e.release()
+	encode.finish()
+
+	send := span.startChild("send", time.Now())
+	n, err := e.WriteTo(conn)
+	send.setAttributes(slog.Int64("kafka.response.bytes", n))
+	if err != nil {
+		send.fail(err.Error())
+	}
+	send.finish()
+	return n, err
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func encodeRequest(apiKey ApiKey, version int16, correlationID int32, body []byte) []byte {
+	header := []byte{}
+	header = binary.BigEndian.AppendUint16(header, uint16(apiKey))
+	header = binary.BigEndian.AppendUint16(header, uint16(version))
+	header = binary.BigEndian.AppendUint32(header, uint32(correlationID))
+	header = appendString(header, "test-client", false)
+	if isFlexibleVersion(apiKey, version) {
+		header = append(header, 0)
+	}
+
+	frame := binary.BigEndian.AppendUint32([]byte{}, uint32(len(header)+len(body)))
+	frame = append(frame, header...)
+	return append(frame, body...)
+}
+
+func Test_NewResponse_versionMatrix(t *testing.T) {
+	broker := newTestBroker(t, nil)
+
+	fetchV0Body := []byte{}
+	fetchV0Body = binary.BigEndian.AppendUint32(fetchV0Body, 0xffffffff) // replica ID
+	fetchV0Body = binary.BigEndian.AppendUint32(fetchV0Body, 500)        // max wait
+	fetchV0Body = binary.BigEndian.AppendUint32(fetchV0Body, 1)          // min bytes
+	fetchV0Body = appendArrayLength(fetchV0Body, 1, false)
+	fetchV0Body = appendString(fetchV0Body, "foo", false)
+	fetchV0Body = appendArrayLength(fetchV0Body, 1, false)
+	fetchV0Body = binary.BigEndian.AppendUint32(fetchV0Body, 0)    // partition
+	fetchV0Body = binary.BigEndian.AppendUint64(fetchV0Body, 0)    // fetch offset
+	fetchV0Body = binary.BigEndian.AppendUint32(fetchV0Body, 1024) // partition max bytes
+
+	fetchV16Body := []byte{}
+	fetchV16Body = binary.BigEndian.AppendUint32(fetchV16Body, 500)
+	fetchV16Body = binary.BigEndian.AppendUint32(fetchV16Body, 1)
+	fetchV16Body = binary.BigEndian.AppendUint32(fetchV16Body, 1024)
+	fetchV16Body = append(fetchV16Body, 0)
+	fetchV16Body = binary.BigEndian.AppendUint32(fetchV16Body, 0) // session ID
+	fetchV16Body = binary.BigEndian.AppendUint32(fetchV16Body, 0) // session epoch
+	fetchV16Body = appendArrayLength(fetchV16Body, 0, true)
+	fetchV16Body = appendArrayLength(fetchV16Body, 0, true)
+	fetchV16Body = appendString(fetchV16Body, "", true)
+	fetchV16Body = append(fetchV16Body, 0)
+
+	deleteRecordsV0Body := appendArrayLength([]byte{}, 1, false)
+	deleteRecordsV0Body = appendString(deleteRecordsV0Body, "foo", false)
+	deleteRecordsV0Body = appendArrayLength(deleteRecordsV0Body, 1, false)
+	deleteRecordsV0Body = binary.BigEndian.AppendUint32(deleteRecordsV0Body, 0) // partition
+	deleteRecordsV0Body = binary.BigEndian.AppendUint64(deleteRecordsV0Body, 0) // offset
+	deleteRecordsV0Body = binary.BigEndian.AppendUint32(deleteRecordsV0Body, 1000)
+
+	deleteRecordsV2Body := appendArrayLength([]byte{}, 1, true)
+	deleteRecordsV2Body = appendString(deleteRecordsV2Body, "foo", true)
+	deleteRecordsV2Body = appendArrayLength(deleteRecordsV2Body, 1, true)
+	deleteRecordsV2Body = binary.BigEndian.AppendUint32(deleteRecordsV2Body, 0)
+	deleteRecordsV2Body = binary.BigEndian.AppendUint64(deleteRecordsV2Body, 0)
+	deleteRecordsV2Body = append(deleteRecordsV2Body, 0, 0)
+	deleteRecordsV2Body = binary.BigEndian.AppendUint32(deleteRecordsV2Body, 1000)
+	deleteRecordsV2Body = append(deleteRecordsV2Body, 0)
+
+	describeFooBody := []byte{}
+	describeFooBody = appendArrayLength(describeFooBody, 1, true)
+	describeFooBody = appendString(describeFooBody, "foo", true)
+	describeFooBody = append(describeFooBody, 0)
+	describeFooBody = binary.BigEndian.AppendUint32(describeFooBody, 100)
+	describeFooBody = append(describeFooBody, 0xff, 0)
+
+	describeEmptyBody := []byte{1, 0, 0, 0, 100, 0xff, 0}
+
+	metadataFooBody := appendArrayLength([]byte{}, 1, true)
+	metadataFooBody = append(metadataFooBody, make([]byte, 16)...) // topic ID
+	metadataFooBody = appendString(metadataFooBody, "foo", true)
+	metadataFooBody = append(metadataFooBody, 0, 0, 0, 0)
+
+	// Match any ACL, with null name, principal and host
+	aclFilterV0Body := []byte{byte(RESOURCE_ANY), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, byte(OPERATION_ANY), byte(PERMISSION_ANY)}
+	aclFilterV1Body := []byte{byte(RESOURCE_ANY), 0xff, 0xff, byte(PATTERN_ANY), 0xff, 0xff, 0xff, 0xff, byte(OPERATION_ANY), byte(PERMISSION_ANY)}
+	aclFilterV3Body := []byte{byte(RESOURCE_ANY), 0, byte(PATTERN_ANY), 0, 0, byte(OPERATION_ANY), byte(PERMISSION_ANY)}
+
+	createAclsV0Body := appendArrayLength([]byte{}, 1, false)
+	createAclsV0Body = append(createAclsV0Body, byte(RESOURCE_TOPIC))
+	createAclsV0Body = appendString(createAclsV0Body, "foo", false)
+	createAclsV0Body = appendString(createAclsV0Body, "User:alice", false)
+	createAclsV0Body = appendString(createAclsV0Body, "*", false)
+	createAclsV0Body = append(createAclsV0Body, byte(OPERATION_READ), byte(PERMISSION_ALLOW))
+
+	createAclsV1Body := appendArrayLength([]byte{}, 1, false)
+	createAclsV1Body = append(createAclsV1Body, byte(RESOURCE_TOPIC))
+	createAclsV1Body = appendString(createAclsV1Body, "foo", false)
+	createAclsV1Body = append(createAclsV1Body, byte(PATTERN_LITERAL))
+	createAclsV1Body = appendString(createAclsV1Body, "User:alice", false)
+	createAclsV1Body = appendString(createAclsV1Body, "*", false)
+	createAclsV1Body = append(createAclsV1Body, byte(OPERATION_READ), byte(PERMISSION_ALLOW))
+
+	createAclsV3Body := appendArrayLength([]byte{}, 1, true)
+	createAclsV3Body = append(createAclsV3Body, byte(RESOURCE_TOPIC))
+	createAclsV3Body = appendString(createAclsV3Body, "foo", true)
+	createAclsV3Body = append(createAclsV3Body, byte(PATTERN_LITERAL))
+	createAclsV3Body = appendString(createAclsV3Body, "User:alice", true)
+	createAclsV3Body = appendString(createAclsV3Body, "*", true)
+	createAclsV3Body = append(createAclsV3Body, byte(OPERATION_READ), byte(PERMISSION_ALLOW), 0, 0)
+
+	deleteAclsV0Body := append(appendArrayLength([]byte{}, 1, false), aclFilterV0Body...)
+	deleteAclsV1Body := append(appendArrayLength([]byte{}, 1, false), aclFilterV1Body...)
+	deleteAclsV3Body := append(append(appendArrayLength([]byte{}, 1, true), aclFilterV3Body...), 0, 0)
+
+	// One entry for the default client ID, without any changes
+	alterQuotasV1Body := appendArrayLength([]byte{}, 1, true)
+	alterQuotasV1Body = appendArrayLength(alterQuotasV1Body, 1, true)
+	alterQuotasV1Body = appendString(alterQuotasV1Body, QUOTA_ENTITY_CLIENT_ID, true)
+	alterQuotasV1Body = append(alterQuotasV1Body, 0, 0)
+	alterQuotasV1Body = appendArrayLength(alterQuotasV1Body, 0, true)
+	alterQuotasV1Body = append(alterQuotasV1Body, 0, 0, 0)
+
+	tests := []struct {
+		name    string
+		apiKey  ApiKey
+		version int16
+		body    []byte
+		// Offset of the error code in the response body, -1 if the response
+		// carries no error code for this request
+		errOffset int
+		wantErr   ErrorCode
+	}{
+		{"ApiVersions min", API_VERSIONS, 0, []byte{}, 0, ERR_NONE},
+		{"ApiVersions max", API_VERSIONS, 4, []byte{2, 't', 2, '1', 0}, 0, ERR_NONE},
+		{"ApiVersions above max", API_VERSIONS, 5, []byte{2, 't', 2, '1', 0}, 0, ERR_UNSUPPORTED_VERSION},
+		{"Fetch min", FETCH, 0, fetchV0Body, 17, ERR_UNKNOWN_TOPIC_OR_PARTITION},
+		{"Fetch max", FETCH, 16, fetchV16Body, 4, ERR_NONE},
+		{"Fetch above max", FETCH, 17, fetchV16Body, 4, ERR_UNSUPPORTED_VERSION},
+		{"DeleteRecords min", DELETE_RECORDS, 0, deleteRecordsV0Body, 29, ERR_UNKNOWN_TOPIC_OR_PARTITION},
+		{"DeleteRecords max", DELETE_RECORDS, 2, deleteRecordsV2Body, 22, ERR_UNKNOWN_TOPIC_OR_PARTITION},
+		{"DeleteRecords above max", DELETE_RECORDS, 3, deleteRecordsV2Body, 22, ERR_UNSUPPORTED_VERSION},
+		{"DescribeTopicPartitions min/max", DESCRIBE_TOPIC_PARTITIONS, 0, describeEmptyBody, -1, ERR_NONE},
+		{"DescribeTopicPartitions above max", DESCRIBE_TOPIC_PARTITIONS, 1, describeFooBody, 5, ERR_UNSUPPORTED_VERSION},
+		{"Metadata min", METADATA, 0, []byte{0, 0, 0, 0}, -1, ERR_NONE},
+		{"Metadata max", METADATA, 12, []byte{1, 0, 0, 0}, -1, ERR_NONE},
+		{"Metadata above max", METADATA, 13, metadataFooBody, 11, ERR_UNSUPPORTED_VERSION},
+		{"DescribeCluster min", DESCRIBE_CLUSTER, 0, []byte{0, 0}, 4, ERR_NONE},
+		{"DescribeCluster max", DESCRIBE_CLUSTER, 1, []byte{0, 1, 0}, 4, ERR_NONE},
+		{"DescribeCluster above max", DESCRIBE_CLUSTER, 2, []byte{0, 1, 0, 0}, 4, ERR_UNSUPPORTED_VERSION},
+		// Only SASL listeners take part in SASL
+		{"SaslHandshake below min", SASL_HANDSHAKE, 0, []byte{0, 5, 'P', 'L', 'A', 'I', 'N'}, 0, ERR_UNSUPPORTED_VERSION},
+		{"SaslHandshake min/max", SASL_HANDSHAKE, 1, []byte{0, 5, 'P', 'L', 'A', 'I', 'N'}, 0, ERR_ILLEGAL_SASL_STATE},
+		{"SaslAuthenticate min", SASL_AUTHENTICATE, 0, []byte{0, 0, 0, 0}, 0, ERR_ILLEGAL_SASL_STATE},
+		{"SaslAuthenticate max", SASL_AUTHENTICATE, 2, []byte{1, 0}, 0, ERR_ILLEGAL_SASL_STATE},
+		{"SaslAuthenticate above max", SASL_AUTHENTICATE, 3, []byte{1, 0}, 0, ERR_UNSUPPORTED_VERSION},
+		// The test broker has no authorizer
+		{"DescribeAcls below min", DESCRIBE_ACLS, 0, aclFilterV0Body, 4, ERR_UNSUPPORTED_VERSION},
+		{"DescribeAcls min", DESCRIBE_ACLS, 1, aclFilterV1Body, 4, ERR_SECURITY_DISABLED},
+		{"DescribeAcls max", DESCRIBE_ACLS, 3, append(aclFilterV3Body, 0), 4, ERR_SECURITY_DISABLED},
+		{"DescribeAcls above max", DESCRIBE_ACLS, 4, append(aclFilterV3Body, 0), 4, ERR_UNSUPPORTED_VERSION},
+		{"CreateAcls below min", CREATE_ACLS, 0, createAclsV0Body, 8, ERR_UNSUPPORTED_VERSION},
+		{"CreateAcls min", CREATE_ACLS, 1, createAclsV1Body, 8, ERR_SECURITY_DISABLED},
+		{"CreateAcls max", CREATE_ACLS, 3, createAclsV3Body, 5, ERR_SECURITY_DISABLED},
+		{"CreateAcls above max", CREATE_ACLS, 4, createAclsV3Body, 5, ERR_UNSUPPORTED_VERSION},
+		{"DeleteAcls below min", DELETE_ACLS, 0, deleteAclsV0Body, 8, ERR_UNSUPPORTED_VERSION},
+		{"DeleteAcls min", DELETE_ACLS, 1, deleteAclsV1Body, 8, ERR_SECURITY_DISABLED},
+		{"DeleteAcls max", DELETE_ACLS, 3, deleteAclsV3Body, 5, ERR_SECURITY_DISABLED},
+		{"DeleteAcls above max", DELETE_ACLS, 4, deleteAclsV3Body, 5, ERR_UNSUPPORTED_VERSION},
+		{"DescribeClientQuotas min", DESCRIBE_CLIENT_QUOTAS, 0, []byte{0, 0, 0, 0, 0}, 4, ERR_NONE},
+		{"DescribeClientQuotas max", DESCRIBE_CLIENT_QUOTAS, 1, []byte{1, 0, 0}, 4, ERR_NONE},
+		{"DescribeClientQuotas above max", DESCRIBE_CLIENT_QUOTAS, 2, []byte{1, 0, 0}, 4, ERR_UNSUPPORTED_VERSION},
+		{"AlterClientQuotas min", ALTER_CLIENT_QUOTAS, 0, []byte{0, 0, 0, 0, 0}, -1, ERR_NONE},
+		{"AlterClientQuotas max", ALTER_CLIENT_QUOTAS, 1, alterQuotasV1Body, 5, ERR_NONE},
+		{"AlterClientQuotas above max", ALTER_CLIENT_QUOTAS, 2, alterQuotasV1Body, 5, ERR_UNSUPPORTED_VERSION},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := encodeRequest(tt.apiKey, tt.version, 7, tt.body)
+			req, err := getRequestMessage(bytes.NewReader(frame), len(frame))
+			if err != nil {
+				t.Fatalf("getRequestMessage() error = %v", err)
+			}
+
+			res := broker.NewResponse(req)
+			if res == nil {
+				t.Fatalf("NewResponse() = nil")
+			}
+			out := res.serialize()
+
+			if size := int(binary.BigEndian.Uint32(out)); size != len(out)-4 {
+				t.Fatalf("message size = %v, want %v", size, len(out)-4)
+			}
+			if correlationID := int32(binary.BigEndian.Uint32(out[4:8])); correlationID != 7 {
+				t.Errorf("correlationID = %v, want 7", correlationID)
+			}
+
+			headerLen := 4
+			if _, ok := res.header.(ResponseHeaderV1); ok {
+				headerLen = 5
+			}
+			body := out[4+headerLen:]
+
+			if tt.errOffset < 0 {
+				return
+			}
+			if got := ErrorCode(binary.BigEndian.Uint16(body[tt.errOffset:])); got != tt.wantErr {
+				t.Errorf("error code = %v, want %v", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_NewResponse_unknownApiKey(t *testing.T) {
+	frame := encodeRequest(ApiKey(1000), 0, 7, []byte{})
+	req, err := getRequestMessage(bytes.NewReader(frame), len(frame))
+	if err != nil {
+		t.Fatalf("getRequestMessage() error = %v", err)
+	}
+	if res := newTestBroker(t, nil).NewResponse(req); res != nil {
+		t.Errorf("NewResponse() = %v, want nil", res)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const SASL_PLAIN = "PLAIN"
+
+var SupportedSaslMechanisms = []string{SASL_PLAIN, SCRAM_SHA_256.name, SCRAM_SHA_512.name, SASL_OAUTHBEARER}
+
+// Server side of one SASL mechanism, modelled after javax.security.sasl.SaslServer
+type SaslServer interface {
+	// Process the client's next message and return the challenge to send
+	// back. Errors are reported to the client as is.
+	evaluateResponse(response []byte) ([]byte, error)
+	isComplete() bool
+	// The authenticated user, once complete
+	authorizationID() string
+}
+
+// Implemented by mechanisms whose credentials expire, e.g. bearer tokens.
+// The session ends when the credential does (KIP-368).
+type ExpiringCredential interface {
+	credentialExpiry() time.Time
+}
+
+func (b *Broker) newSaslServer(listenerName string, mechanism string) SaslServer {
+	if scram, ok := getScramMechanism(mechanism); ok {
+		return &ScramSaslServer{broker: b, listenerName: listenerName, mechanism: scram}
+	}
+	if mechanism == SASL_OAUTHBEARER {
+		return &OAuthBearerSaslServer{validator: b.oauthBearerValidators[listenerName]}
+	}
+	return &PlainSaslServer{users: b.config.jaasConfig(listenerName, SASL_PLAIN).users()}
+}
+
+// PLAIN (RFC 4616): a single "authzid NUL authcid NUL password" message
+type PlainSaslServer struct {
+	users    map[string]string
+	username string
+}
+
+func (s *PlainSaslServer) evaluateResponse(response []byte) ([]byte, error) {
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid SASL/PLAIN response: expected 3 tokens, got %d", len(parts))
+	}
+	authzid, username, password := string(parts[0]), string(parts[1]), parts[2]
+	if username == "" {
+		return nil, fmt.Errorf("Authentication failed: username not specified")
+	}
+	if authzid != "" && authzid != username {
+		return nil, fmt.Errorf("Authentication failed: Client requested an authorization id that is different from username")
+	}
+
+	expected, ok := s.users[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), password) != 1 {
+		return nil, fmt.Errorf("Authentication failed: Invalid username or password")
+	}
+	s.username = username
+	return []byte{}, nil
+}
+
+func (s *PlainSaslServer) isComplete() bool {
+	return s.username != ""
+}
+
+func (s *PlainSaslServer) authorizationID() string {
+	return s.username
+}
+
+type SaslState int
+
+const (
+	// Waiting for SaslHandshake, ApiVersions is allowed as well
+	SASL_HANDSHAKE_REQUEST SaslState = iota
+	// A mechanism was picked, waiting for SaslAuthenticate
+	SASL_AUTHENTICATE_REQUEST
+	SASL_AUTHENTICATED
+	// The connection gets closed once the error is sent
+	SASL_FAILED
+)
+
+// Authentication state of a connection to a SASL listener. Only touched by
+// SaslHandshake and SaslAuthenticate, which never run concurrently with
+// other requests of the connection.
+type SaslSession struct {
+	broker       *Broker
+	listenerName string
+	state        SaslState
+	mechanism    string
+	server       SaslServer
+	principal    KafkaPrincipal
+	// When the client has to re-authenticate by, zero if never
+	sessionExpiry time.Time
+	// Set while an authenticated client goes through the exchange again
+	// (KIP-368)
+	reauthenticating bool
+}
+
+func newSaslSession(broker *Broker, listenerName string) *SaslSession {
+	return &SaslSession{
+		broker:       broker,
+		listenerName: listenerName,
+		state:        SASL_HANDSHAKE_REQUEST,
+		principal:    ANONYMOUS_PRINCIPAL,
+	}
+}
+
+// Check that a request can be handled in the current state. An error means
+// the connection has to be closed.
+func (s *SaslSession) checkRequest(apiKey ApiKey, now time.Time) error {
+	switch s.state {
+	case SASL_HANDSHAKE_REQUEST:
+		if apiKey == API_VERSIONS || apiKey == SASL_HANDSHAKE {
+			return nil
+		}
+		return fmt.Errorf("unexpected request of type %d during SASL handshake", apiKey)
+	case SASL_AUTHENTICATE_REQUEST:
+		if apiKey == SASL_AUTHENTICATE {
+			return nil
+		}
+		return fmt.Errorf("unexpected request of type %d during SASL authentication", apiKey)
+	case SASL_AUTHENTICATED:
+		// Once the session expires the client may only start over
+		if !s.sessionExpiry.IsZero() && now.After(s.sessionExpiry) && apiKey != SASL_HANDSHAKE {
+			return fmt.Errorf("SASL session of %s expired", s.principal)
+		}
+		return nil
+	}
+	return fmt.Errorf("SASL authentication failed")
+}
+
+func (s *SaslSession) enabledMechanisms() []string {
+	return s.broker.config.saslMechanisms(s.listenerName)
+}
+
+func (s *SaslSession) handshake(mechanism string) ErrorCode {
+	if s.state == SASL_AUTHENTICATE_REQUEST {
+		return ERR_ILLEGAL_SASL_STATE
+	}
+	if !slices.Contains(s.enabledMechanisms(), mechanism) {
+		s.state = SASL_FAILED
+		return ERR_UNSUPPORTED_SASL_MECHANISM
+	}
+	if s.state == SASL_AUTHENTICATED && mechanism != s.mechanism {
+		// Re-authentication has to stick to the original mechanism
+		s.state = SASL_FAILED
+		return ERR_ILLEGAL_SASL_STATE
+	}
+
+	s.reauthenticating = s.state == SASL_AUTHENTICATED
+	s.mechanism = mechanism
+	s.server = s.broker.newSaslServer(s.listenerName, mechanism)
+	s.state = SASL_AUTHENTICATE_REQUEST
+	return ERR_NONE
+}
+
+// Feed the client's message to the mechanism. Returns the challenge for the
+// client and, once authenticated, how long the session lasts.
+func (s *SaslSession) authenticate(response []byte, now time.Time) (challenge []byte, sessionLifetime time.Duration, err error) {
+	if s.state != SASL_AUTHENTICATE_REQUEST {
+		return nil, 0, fmt.Errorf("Unexpected SaslAuthenticate request")
+	}
+
+	challenge, err = s.server.evaluateResponse(response)
+	if err != nil {
+		s.state = SASL_FAILED
+		return nil, 0, err
+	}
+	if !s.server.isComplete() {
+		return challenge, 0, nil
+	}
+
+	principal := KafkaPrincipal{principalType: "User", name: s.server.authorizationID()}
+	if s.reauthenticating && principal != s.principal {
+		s.state = SASL_FAILED
+		return nil, 0, fmt.Errorf("Cannot change principals during re-authentication from %s: %s", s.principal, principal)
+	}
+
+	s.principal = principal
+	s.state = SASL_AUTHENTICATED
+	s.sessionExpiry = time.Time{}
+	sessionLifetime = s.broker.config.sessionLifetime(s.listenerName, s.mechanism)
+	if expiring, ok := s.server.(ExpiringCredential); ok {
+		untilExpiry := expiring.credentialExpiry().Sub(now)
+		if sessionLifetime == 0 || untilExpiry < sessionLifetime {
+			sessionLifetime = untilExpiry
+		}
+	}
+	if sessionLifetime > 0 {
+		s.sessionExpiry = now.Add(sessionLifetime)
+	}
+	return challenge, sessionLifetime, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"time"
+)
+
+// Response
+type SaslAuthenticateResponse struct {
+	version           int16
+	errorCode         ErrorCode
+	errorMessage      string
+	authBytes         []byte
+	sessionLifetimeMs int64
+	tagBuffer         byte
+}
+
+func (r SaslAuthenticateResponse) serialize() []byte {
+	res := []byte{}
+	flexible := isFlexibleVersion(SASL_AUTHENTICATE, r.version)
+
+	res = binary.BigEndian.AppendUint16(res, uint16(r.errorCode))
+	res = appendNullableString(res, r.errorMessage, flexible)
+	res = appendBytes(res, r.authBytes, flexible)
+	if r.version >= 1 {
+		res = binary.BigEndian.AppendUint64(res, uint64(r.sessionLifetimeMs))
+	}
+
+	if flexible {
+		res = append(res, r.tagBuffer)
+	}
+	return res
+}
+
+func (r SaslAuthenticateResponse) errorCounts() map[ErrorCode]int {
+	return map[ErrorCode]int{r.errorCode: 1}
+}
+
+func (b *Broker) buildSaslAuthenticateResponse(req RequestMessage) SaslAuthenticateResponse {
+	reqBody := req.body.(*SaslAuthenticateRequest)
+	response := SaslAuthenticateResponse{version: reqBody.version, authBytes: []byte{}}
+
+	session := req.context.sasl
+	if session == nil || session.state != SASL_AUTHENTICATE_REQUEST {
+		response.errorCode = ERR_ILLEGAL_SASL_STATE
+		response.errorMessage = "SaslAuthenticate request received without a preceding SaslHandshake"
+		return response
+	}
+
+	challenge, sessionLifetime, err := session.authenticate(reqBody.authBytes, time.Now())
+	if err != nil {
+		slog.Info("Failed authentication", "clientAddress", req.context.clientAddress.String(), "error", err)
+		response.errorCode = ERR_SASL_AUTHENTICATION_FAILED
+		response.errorMessage = err.Error()
+		return response
+	}
+
+	response.authBytes = challenge
+	response.sessionLifetimeMs = sessionLifetime.Milliseconds()
+	return response
+}
+
+func buildSaslAuthenticateErrorResponse(req RequestMessage, errorCode ErrorCode) SaslAuthenticateResponse {
+	supported, _ := getSupportedApiVersion(SASL_AUTHENTICATE)
+	return SaslAuthenticateResponse{
+		version:   min(req.header.requestApiVersion, supported.MaxVersion),
+		errorCode: errorCode,
+		authBytes: []byte{},
+	}
+}
+
+// Request
+type SaslAuthenticateRequest struct {
+	version   int16
+	authBytes []byte
+}
+
+func (r *SaslAuthenticateRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+	flexible := isFlexibleVersion(SASL_AUTHENTICATE, r.version)
+
+	r.authBytes = readBytes(buf, flexible)
+
+	if flexible {
+		skipTaggedFields(buf)
+	}
+}
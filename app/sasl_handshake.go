@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Response
+type SaslHandshakeResponse struct {
+	errorCode ErrorCode
+	// The mechanisms enabled on the listener
+	mechanisms []string
+}
+
+func (r SaslHandshakeResponse) serialize() []byte {
+	res := []byte{}
+	res = binary.BigEndian.AppendUint16(res, uint16(r.errorCode))
+	res = appendArrayLength(res, len(r.mechanisms), false)
+	for _, mechanism := range r.mechanisms {
+		res = appendString(res, mechanism, false)
+	}
+	return res
+}
+
+func (r SaslHandshakeResponse) errorCounts() map[ErrorCode]int {
+	return map[ErrorCode]int{r.errorCode: 1}
+}
+
+func (b *Broker) buildSaslHandshakeResponse(req RequestMessage) SaslHandshakeResponse {
+	reqBody := req.body.(*SaslHandshakeRequest)
+	session := req.context.sasl
+	if session == nil {
+		// Not a SASL listener
+		return SaslHandshakeResponse{errorCode: ERR_ILLEGAL_SASL_STATE, mechanisms: []string{}}
+	}
+
+	return SaslHandshakeResponse{
+		errorCode:  session.handshake(reqBody.mechanism),
+		mechanisms: session.enabledMechanisms(),
+	}
+}
+
+func buildSaslHandshakeErrorResponse(req RequestMessage, errorCode ErrorCode) SaslHandshakeResponse {
+	return SaslHandshakeResponse{errorCode: errorCode, mechanisms: []string{}}
+}
+
+// Request
+type SaslHandshakeRequest struct {
+	version   int16
+	mechanism string
+}
+
+func (r *SaslHandshakeRequest) deserialize(data []byte) {
+	buf := bytes.NewBuffer(data)
+	r.mechanism = readString(buf, false)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSaslProps = map[string]string{
+	"listeners":                      "SASL_PLAINTEXT://:9092",
+	"listener.security.protocol.map": "SASL_PLAINTEXT:SASL_PLAINTEXT",
+	"sasl.enabled.mechanisms":        "PLAIN,SCRAM-SHA-256,SCRAM-SHA-512",
+	"listener.name.sasl_plaintext.plain.sasl.jaas.config": `org.apache.kafka.common.security.plain.PlainLoginModule required
+		username="admin" password="admin-secret" user_admin="admin-secret" user_alice="alice-secret";`,
+	"listener.name.sasl_plaintext.scram-sha-256.sasl.jaas.config": `org.apache.kafka.common.security.scram.ScramLoginModule required user_bob="bob-secret";`,
+}
+
+// Append a batch holding the given record values to the metadata log
+func writeMetadataRecords(t *testing.T, broker *Broker, values ...[]byte) {
+	t.Helper()
+
+	if err := broker.metadata.appendRecords(values); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func userScramCredentialRecord(name string, mechanism ScramMechanism, credential ScramCredential) []byte {
+	value := []byte{1, byte(USER_SCRAM_CREDENTIAL_RECORD), 0}
+	value = append(value, encodeCompactString(name)...)
+	value = append(value, byte(mechanism.code))
+	value = appendBytes(value, credential.salt, true)
+	value = appendBytes(value, credential.storedKey, true)
+	value = appendBytes(value, credential.serverKey, true)
+	value = binary.BigEndian.AppendUint32(value, uint32(credential.iterations))
+	return append(value, 0)
+}
+
+// Send a request and return the body of its response
+func sendTestRequest(conn io.ReadWriter, apiKey ApiKey, version int16, body []byte) ([]byte, error) {
+	if _, err := conn.Write(encodeRequest(apiKey, version, 1, body)); err != nil {
+		return nil, err
+	}
+	sizeBytes := make([]byte, 4)
+	if _, err := io.ReadFull(conn, sizeBytes); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint32(sizeBytes))
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return nil, err
+	}
+
+	headerLen := 4
+	if apiKey != API_VERSIONS && isFlexibleVersion(apiKey, version) {
+		headerLen = 5
+	}
+	return message[headerLen:], nil
+}
+
+func saslHandshake(conn io.ReadWriter, mechanism string) (ErrorCode, error) {
+	response, err := sendTestRequest(conn, SASL_HANDSHAKE, 1, appendString(nil, mechanism, false))
+	if err != nil {
+		return 0, err
+	}
+	return ErrorCode(binary.BigEndian.Uint16(response)), nil
+}
+
+// Send a SaslAuthenticate v2 and decode its response
+func saslAuthenticate(conn io.ReadWriter, authBytes []byte) (SaslAuthenticateResponse, error) {
+	body := appendBytes(nil, authBytes, true)
+	body = append(body, 0)
+	data, err := sendTestRequest(conn, SASL_AUTHENTICATE, 2, body)
+	if err != nil {
+		return SaslAuthenticateResponse{}, err
+	}
+
+	buf := bytes.NewBuffer(data)
+	response := SaslAuthenticateResponse{version: 2}
+	checkError(binary.Read(buf, binary.BigEndian, &response.errorCode))
+	response.errorMessage = readComapctString(buf)
+	response.authBytes = readBytes(buf, true)
+	checkError(binary.Read(buf, binary.BigEndian, &response.sessionLifetimeMs))
+	if response.errorCode != ERR_NONE {
+		return response, errors.New(response.errorMessage)
+	}
+	return response, nil
+}
+
+func plainLogin(conn io.ReadWriter, username string, password string) error {
+	if errorCode, err := saslHandshake(conn, SASL_PLAIN); err != nil || errorCode != ERR_NONE {
+		return errors.Join(err, errors.New("handshake failed"))
+	}
+	_, err := saslAuthenticate(conn, []byte("\x00"+username+"\x00"+password))
+	return err
+}
+
+// Client side of SCRAM, RFC 5802 section 3
+func scramLogin(conn io.ReadWriter, mechanism ScramMechanism, username string, password string) error {
+	if errorCode, err := saslHandshake(conn, mechanism.name); err != nil || errorCode != ERR_NONE {
+		return errors.Join(err, errors.New("handshake failed"))
+	}
+
+	clientFirstBare := "n=" + username + ",r=clientnonce"
+	response, err := saslAuthenticate(conn, []byte("n,,"+clientFirstBare))
+	if err != nil {
+		return err
+	}
+	serverFirst := string(response.authBytes)
+	attributes, err := parseScramAttributes(serverFirst)
+	if err != nil {
+		return err
+	}
+	salt, _ := base64.StdEncoding.DecodeString(attributes["s"])
+	iterations, _ := strconv.Atoi(attributes["i"])
+
+	credential := newScramCredential(mechanism, password, salt, iterations)
+	clientKey := mechanism.hmac(pbkdf2(mechanism.hash, []byte(password), salt, iterations), []byte("Client Key"))
+	withoutProof := "c=biws,r=" + attributes["r"]
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + withoutProof)
+	clientSignature := mechanism.hmac(credential.storedKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	response, err = saslAuthenticate(conn, []byte(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	serverSignature := mechanism.hmac(credential.serverKey, authMessage)
+	if string(response.authBytes) != "v="+base64.StdEncoding.EncodeToString(serverSignature) {
+		return errors.New("invalid server signature")
+	}
+	return nil
+}
+
+func Test_SaslAuthentication(t *testing.T) {
+	broker := newTestBroker(t, testSaslProps)
+	carol := newScramCredential(SCRAM_SHA_512, "carol-secret", []byte("carol-salt"), 4096)
+	bobOverride := newScramCredential(SCRAM_SHA_256, "bob-rotated", []byte("bob-salt"), 8192)
+	writeMetadataRecords(t, broker,
+		userScramCredentialRecord("carol", SCRAM_SHA_512, carol),
+		userScramCredentialRecord("dave", SCRAM_SHA_512, carol),
+		// Removed again, dave can't log in
+		[]byte{0, byte(REMOVE_USER_SCRAM_CREDENTIAL_RECORD), 0, 5, 'd', 'a', 'v', 'e', byte(SCRAM_SHA_512.code), 0},
+		userScramCredentialRecord("erin", SCRAM_SHA_256, bobOverride),
+	)
+
+	tests := []struct {
+		name      string
+		login     func(conn io.ReadWriter) error
+		principal string
+		wantErr   string
+	}{
+		{
+			name:      "PLAIN",
+			login:     func(conn io.ReadWriter) error { return plainLogin(conn, "alice", "alice-secret") },
+			principal: "User:alice",
+		},
+		{
+			name:    "PLAIN wrong password",
+			login:   func(conn io.ReadWriter) error { return plainLogin(conn, "alice", "bob-secret") },
+			wantErr: "Authentication failed: Invalid username or password",
+		},
+		{
+			name:    "PLAIN unknown user",
+			login:   func(conn io.ReadWriter) error { return plainLogin(conn, "mallory", "") },
+			wantErr: "Authentication failed: Invalid username or password",
+		},
+		{
+			name:      "SCRAM-SHA-256 from JAAS",
+			login:     func(conn io.ReadWriter) error { return scramLogin(conn, SCRAM_SHA_256, "bob", "bob-secret") },
+			principal: "User:bob",
+		},
+		{
+			name:    "SCRAM-SHA-256 wrong password",
+			login:   func(conn io.ReadWriter) error { return scramLogin(conn, SCRAM_SHA_256, "bob", "alice-secret") },
+			wantErr: "Authentication failed: Invalid client credentials",
+		},
+		{
+			name:      "SCRAM-SHA-512 from metadata log",
+			login:     func(conn io.ReadWriter) error { return scramLogin(conn, SCRAM_SHA_512, "carol", "carol-secret") },
+			principal: "User:carol",
+		},
+		{
+			name:      "SCRAM-SHA-256 from metadata log",
+			login:     func(conn io.ReadWriter) error { return scramLogin(conn, SCRAM_SHA_256, "erin", "bob-rotated") },
+			principal: "User:erin",
+		},
+		{
+			name:    "removed SCRAM credential",
+			login:   func(conn io.ReadWriter) error { return scramLogin(conn, SCRAM_SHA_512, "dave", "carol-secret") },
+			wantErr: "Authentication failed: Invalid user credentials",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			c := newConnection(broker, "SASL_PLAINTEXT", server)
+			go c.serve()
+
+			err := tt.login(client)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("login error = %v, want %v", err, tt.wantErr)
+				}
+				// Failed authentications close the connection
+				if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("read after failed authentication: %v, want EOF", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("login error = %v", err)
+			}
+
+			if _, err := sendTestRequest(client, METADATA, 12, []byte{1, 0, 0, 0}); err != nil {
+				t.Fatalf("Metadata after authentication: %v", err)
+			}
+			if got := c.context.sasl.principal.String(); got != tt.principal {
+				t.Errorf("principal = %v, want %v", got, tt.principal)
+			}
+		})
+	}
+}
+
+func Test_SaslSession_requiresAuthentication(t *testing.T) {
+	broker := newTestBroker(t, testSaslProps)
+
+	tests := []struct {
+		name string
+		// Requests sent before the one that gets the connection closed
+		prepare func(conn io.ReadWriter) error
+	}{
+		{
+			name:    "before handshake",
+			prepare: func(conn io.ReadWriter) error { return nil },
+		},
+		{
+			name: "after ApiVersions",
+			prepare: func(conn io.ReadWriter) error {
+				_, err := sendTestRequest(conn, API_VERSIONS, 4, []byte{2, 't', 2, '1', 0})
+				return err
+			},
+		},
+		{
+			name: "between handshake and authenticate",
+			prepare: func(conn io.ReadWriter) error {
+				_, err := saslHandshake(conn, SASL_PLAIN)
+				return err
+			},
+		},
+		{
+			name: "after an unsupported mechanism",
+			prepare: func(conn io.ReadWriter) error {
+				errorCode, err := saslHandshake(conn, "GSSAPI")
+				if err == nil && errorCode != ERR_UNSUPPORTED_SASL_MECHANISM {
+					t.Errorf("handshake error code = %v, want %v", errorCode, ERR_UNSUPPORTED_SASL_MECHANISM)
+				}
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go newConnection(broker, "SASL_PLAINTEXT", server).serve()
+
+			if err := tt.prepare(client); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sendTestRequest(client, METADATA, 12, []byte{1, 0, 0, 0}); err == nil {
+				t.Errorf("Metadata was answered on an unauthenticated connection")
+			}
+		})
+	}
+}
+
+func Test_SaslSession_reauthentication(t *testing.T) {
+	props := map[string]string{"connections.max.reauth.ms": "60000"}
+	for k, v := range testSaslProps {
+		props[k] = v
+	}
+	broker := newTestBroker(t, props)
+	now := time.Now()
+
+	login := func(session *SaslSession, username string, password string) error {
+		if errorCode := session.handshake(SASL_PLAIN); errorCode != ERR_NONE {
+			return errors.New("handshake failed")
+		}
+		_, sessionLifetime, err := session.authenticate([]byte("\x00"+username+"\x00"+password), now)
+		if err == nil && sessionLifetime != time.Minute {
+			t.Errorf("session lifetime = %v, want %v", sessionLifetime, time.Minute)
+		}
+		return err
+	}
+
+	session := newSaslSession(broker, "SASL_PLAINTEXT")
+	if err := login(session, "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.checkRequest(METADATA, now.Add(59*time.Second)); err != nil {
+		t.Errorf("request within the session lifetime rejected: %v", err)
+	}
+	if err := session.checkRequest(METADATA, now.Add(61*time.Second)); err == nil {
+		t.Errorf("request after the session expired was accepted")
+	}
+	if err := session.checkRequest(SASL_HANDSHAKE, now.Add(61*time.Second)); err != nil {
+		t.Errorf("re-authentication after the session expired rejected: %v", err)
+	}
+
+	now = now.Add(61 * time.Second)
+	if err := login(session, "alice", "alice-secret"); err != nil {
+		t.Fatalf("re-authentication failed: %v", err)
+	}
+	if err := session.checkRequest(METADATA, now.Add(time.Second)); err != nil {
+		t.Errorf("request after re-authentication rejected: %v", err)
+	}
+
+	if err := login(session, "admin", "admin-secret"); err == nil || !strings.Contains(err.Error(), "Cannot change principals") {
+		t.Errorf("re-authentication as another user: error = %v", err)
+	}
+}
+
+func Test_parseJaasConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "quoted and bare values",
+			value: `org.apache.kafka.common.security.plain.PlainLoginModule required username=admin user_admin="a \"quoted\" secret" user_x="";`,
+			want:  map[string]string{"username": "admin", "user_admin": `a "quoted" secret`, "user_x": ""},
+		},
+		{
+			name:  "no options",
+			value: "org.apache.kafka.common.security.scram.ScramLoginModule optional ;",
+			want:  map[string]string{},
+		},
+		{name: "missing flag", value: "org.apache.kafka.common.security.plain.PlainLoginModule;", wantErr: true},
+		{name: "invalid flag", value: "PlainLoginModule always;", wantErr: true},
+		{name: "missing semicolon", value: `PlainLoginModule required user_a="a"`, wantErr: true},
+		{name: "unterminated quote", value: `PlainLoginModule required user_a="a;`, wantErr: true},
+		{name: "two modules", value: "A required; B required;", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJaasConfig(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJaasConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(got.options) != len(tt.want) {
+				t.Errorf("options = %v, want %v", got.options, tt.want)
+			}
+			for k, v := range tt.want {
+				if got.options[k] != v {
+					t.Errorf("options[%v] = %q, want %q", k, got.options[k], v)
+				}
+			}
+		})
+	}
+}
+
+// Test vector from RFC 7677 section 3
+func Test_ScramSaslServer_rfc7677(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	credential := newScramCredential(SCRAM_SHA_256, "pencil", salt, 4096)
+
+	authMessage := "n=user,r=rOprNGfwEbeRWgbNEkqO,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096,c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	serverSignature := SCRAM_SHA_256.hmac(credential.serverKey, []byte(authMessage))
+	if got := base64.StdEncoding.EncodeToString(serverSignature); got != "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Errorf("server signature = %v", got)
+	}
+
+	clientSignature := SCRAM_SHA_256.hmac(credential.storedKey, []byte(authMessage))
+	proof, _ := base64.StdEncoding.DecodeString("dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := SCRAM_SHA_256.hash()
+	storedKey.Write(clientKey)
+	if !hmac.Equal(storedKey.Sum(nil), credential.storedKey) {
+		t.Errorf("client proof from RFC 7677 does not verify")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// A SCRAM hash function, as numbered in UserScramCredentialRecord
+type ScramMechanism struct {
+	name string
+	code int8
+	hash func() hash.Hash
+}
+
+var (
+	SCRAM_SHA_256 = ScramMechanism{name: "SCRAM-SHA-256", code: 1, hash: sha256.New}
+	SCRAM_SHA_512 = ScramMechanism{name: "SCRAM-SHA-512", code: 2, hash: sha512.New}
+)
+
+// Iterations used for credentials derived from passwords in the JAAS config,
+// the minimum Kafka accepts
+const SCRAM_DEFAULT_ITERATIONS = 4096
+
+func getScramMechanism(name string) (ScramMechanism, bool) {
+	for _, mechanism := range []ScramMechanism{SCRAM_SHA_256, SCRAM_SHA_512} {
+		if mechanism.name == name {
+			return mechanism, true
+		}
+	}
+	return ScramMechanism{}, false
+}
+
+// What the server keeps to verify a password without knowing it (RFC 5802)
+type ScramCredential struct {
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+	iterations int
+}
+
+func newScramCredential(mechanism ScramMechanism, password string, salt []byte, iterations int) ScramCredential {
+	saltedPassword := pbkdf2(mechanism.hash, []byte(password), salt, iterations)
+	clientKey := mechanism.hmac(saltedPassword, []byte("Client Key"))
+	storedKey := mechanism.hash()
+	storedKey.Write(clientKey)
+
+	return ScramCredential{
+		salt:       salt,
+		storedKey:  storedKey.Sum(nil),
+		serverKey:  mechanism.hmac(saltedPassword, []byte("Server Key")),
+		iterations: iterations,
+	}
+}
+
+func (m ScramMechanism) hmac(key []byte, data []byte) []byte {
+	mac := hmac.New(m.hash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// PBKDF2 with an output the size of one hash block, which is all SCRAM needs
+// (RFC 2898 section 5.2)
+func pbkdf2(h func() hash.Hash, password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+
+	out := bytes.Clone(u)
+	for range iterations - 1 {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for i := range out {
+			out[i] ^= u[i]
+		}
+	}
+	return out
+}
+
+// Look up the credential of a user, preferring the ones set through the
+// metadata log over passwords from the listener's JAAS config
+func (b *Broker) getScramCredential(listenerName string, mechanism ScramMechanism, username string) (ScramCredential, bool) {
+	for _, record := range b.metadata.image().records.UserScramCredentialRecords {
+		if record.name == username && record.mechanism == mechanism.code {
+			return ScramCredential{
+				salt:       record.salt,
+				storedKey:  record.storedKey,
+				serverKey:  record.serverKey,
+				iterations: int(record.iterations),
+			}, true
+		}
+	}
+
+	password, ok := b.config.jaasConfig(listenerName, mechanism.name).users()[username]
+	if !ok {
+		return ScramCredential{}, false
+	}
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	checkError(err)
+	return newScramCredential(mechanism, password, salt, SCRAM_DEFAULT_ITERATIONS), true
+}
+
+// Server side of a SCRAM exchange: client-first, server-first, client-final,
+// server-final
+type ScramSaslServer struct {
+	broker       *Broker
+	listenerName string
+	mechanism    ScramMechanism
+
+	username   string
+	credential ScramCredential
+	// The GS2 header the client started with, it has to echo it back base64
+	// encoded in client-final
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	done            bool
+}
+
+func (s *ScramSaslServer) evaluateResponse(response []byte) ([]byte, error) {
+	if s.serverFirst == "" {
+		return s.handleClientFirst(string(response))
+	}
+	if !s.done {
+		return s.handleClientFinal(string(response))
+	}
+	return nil, fmt.Errorf("Authentication failed: unexpected message after the SCRAM exchange completed")
+}
+
+func (s *ScramSaslServer) isComplete() bool {
+	return s.done
+}
+
+func (s *ScramSaslServer) authorizationID() string {
+	return s.username
+}
+
+func (s *ScramSaslServer) handleClientFirst(message string) ([]byte, error) {
+	// gs2-header: channel binding flag, optional authzid, then the bare
+	// message
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Authentication failed: invalid SCRAM client first message")
+	}
+	switch parts[0] {
+	case "n", "y":
+	default:
+		return nil, fmt.Errorf("Authentication failed: channel binding is not supported")
+	}
+	authzid := ""
+	if parts[1] != "" {
+		value, ok := strings.CutPrefix(parts[1], "a=")
+		if !ok {
+			return nil, fmt.Errorf("Authentication failed: invalid SCRAM client first message")
+		}
+		authzid = decodeScramName(value)
+	}
+
+	attributes, err := parseScramAttributes(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	clientNonce, hasNonce := attributes["r"]
+	username, hasUsername := attributes["n"]
+	if !hasNonce || !hasUsername || clientNonce == "" {
+		return nil, fmt.Errorf("Authentication failed: invalid SCRAM client first message")
+	}
+	username = decodeScramName(username)
+	if attributes["tokenauth"] == "true" {
+		return nil, fmt.Errorf("Authentication failed: delegation tokens are not supported")
+	}
+	if authzid != "" && authzid != username {
+		return nil, fmt.Errorf("Authentication failed: Client requested an authorization id that is different from username")
+	}
+
+	credential, ok := s.broker.getScramCredential(s.listenerName, s.mechanism, username)
+	if !ok {
+		return nil, fmt.Errorf("Authentication failed: Invalid user credentials")
+	}
+
+	serverNonce := make([]byte, 18)
+	_, err = rand.Read(serverNonce)
+	checkError(err)
+
+	s.username = username
+	s.credential = credential
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+	s.nonce = clientNonce + base64.RawURLEncoding.EncodeToString(serverNonce)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(credential.salt), credential.iterations)
+	return []byte(s.serverFirst), nil
+}
+
+func (s *ScramSaslServer) handleClientFinal(message string) ([]byte, error) {
+	withoutProof, proofAttribute, ok := strings.Cut(message, ",p=")
+	if !ok {
+		return nil, fmt.Errorf("Authentication failed: invalid SCRAM client final message")
+	}
+	attributes, err := parseScramAttributes(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+
+	if attributes["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return nil, fmt.Errorf("Authentication failed: invalid channel binding")
+	}
+	if attributes["r"] != s.nonce {
+		return nil, fmt.Errorf("Authentication failed: invalid server nonce: does not match client nonce")
+	}
+	proof, err := base64.StdEncoding.DecodeString(proofAttribute)
+	if err != nil {
+		return nil, fmt.Errorf("Authentication failed: invalid client proof")
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSignature := s.mechanism.hmac(s.credential.storedKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, fmt.Errorf("Authentication failed: Invalid client credentials")
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := s.mechanism.hash()
+	storedKey.Write(clientKey)
+	if subtle.ConstantTimeCompare(storedKey.Sum(nil), s.credential.storedKey) != 1 {
+		return nil, fmt.Errorf("Authentication failed: Invalid client credentials")
+	}
+
+	s.done = true
+	serverSignature := s.mechanism.hmac(s.credential.serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// Split "k=v,k=v" SCRAM attributes. Values may contain '=' but not ','.
+func parseScramAttributes(message string) (map[string]string, error) {
+	attributes := map[string]string{}
+	for _, attribute := range strings.Split(message, ",") {
+		key, value, ok := strings.Cut(attribute, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("Authentication failed: invalid SCRAM attribute %s", strconv.Quote(attribute))
+		}
+		attributes[key] = value
+	}
+	return attributes, nil
+}
+
+// Usernames escape ',' and '=' as =2C and =3D
+func decodeScramName(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
@@ -1,41 +1,413 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
 )
 
+// How often the recovery points and high watermarks of the partition logs
+// are checkpointed, like Kafka's log.flush.offset.checkpoint.interval.ms
+const LOG_CHECKPOINT_INTERVAL = time.Minute
+
 func checkError(err error) {
 	if err != nil {
 		panic(err)
 	}
 }
 
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-	for {
-		requestMessage := getRequestMessage(conn)
-		requestMessage.printHeader()
+type Broker struct {
+	config    *Config
+	metadata  *MetadataLog
+	clusterID string
+	// nil unless authorizer.class.name is set
+	authorizer Authorizer
+	quotas     *QuotaManager
+	// Completed requests, like Kafka's kafka.request.logger
+	requestLog *slog.Logger
+	metrics    *BrokerMetrics
+	// nil unless tracing.exporter is set
+	tracer *Tracer
+	// One per log.dirs entry, opened by loadLogs
+	logs      []*log.Manager
+	listeners []*BrokerListener
+	// TLS configs of the SSL listeners, by listener name
+	tlsLoaders map[string]*TLSConfigLoader
+	// Bearer token validators of the listeners with OAUTHBEARER enabled
+	oauthBearerValidators map[string]*OAuthBearerValidator
+	mu                    sync.Mutex
+	connections           map[*Connection]struct{}
+	connectionsPerIp      map[string]int
+	closing               bool
+	wg                    sync.WaitGroup
+	// Run once all connections are gone, to flush whatever state the
+	// broker keeps in memory
+	shutdownHooks []ShutdownHook
+}
+
+// A bound socket from the listeners config, named so that connections know
+// which listener they came through
+type BrokerListener struct {
+	net.Listener
+	name string
+}
+
+type ShutdownHook struct {
+	name string
+	run  func() error
+}
 
-		responseMessage := NewResponse(requestMessage)
-		sendResponse(conn, *responseMessage)
+func NewBroker(config *Config) *Broker {
+	metadata := NewMetadataLog(config.metadataLogPath(), config.nodeID)
+	return &Broker{
+		config:                config,
+		metadata:              metadata,
+		clusterID:             readClusterID(config.metadataLogDir),
+		authorizer:            newAuthorizer(config, metadata),
+		quotas:                newQuotaManager(config, metadata),
+		requestLog:            newLogger(os.Stdout, config.loggerFormat, config.requestLoggerLevel),
+		metrics:               newBrokerMetrics(),
+		tlsLoaders:            map[string]*TLSConfigLoader{},
+		oauthBearerValidators: map[string]*OAuthBearerValidator{},
+		connections:           map[*Connection]struct{}{},
+		connectionsPerIp:      map[string]int{},
 	}
 }
 
-func main() {
-	l, err := net.Listen("tcp", "0.0.0.0:9092")
+func (b *Broker) onShutdown(name string, run func() error) {
+	b.shutdownHooks = append(b.shutdownHooks, ShutdownHook{name: name, run: run})
+}
+
+// Recover the metadata log and open the partition logs of every log dir.
+// Logs are checkpointed, cleaned of old segments and compacted
+// periodically, and closed cleanly on shutdown.
+func (b *Broker) loadLogs() error {
+	if err := b.metadata.recover(); err != nil {
+		return fmt.Errorf("failed to recover the metadata log: %w", err)
+	}
+	for _, dir := range b.config.logDirs {
+		manager, err := log.OpenManager(dir, b.config.logConfig())
+		if err != nil {
+			return err
+		}
+		b.logs = append(b.logs, manager)
+	}
+	b.updateLogConfigs()
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		checkpoint := time.NewTicker(LOG_CHECKPOINT_INTERVAL)
+		defer checkpoint.Stop()
+		retention := time.NewTicker(time.Duration(b.config.logRetentionCheckIntervalMs) * time.Millisecond)
+		defer retention.Stop()
+		// Without the cleaner, compacted topics grow forever
+		var cleaner <-chan time.Time
+		if b.config.logCleanerEnable {
+			ticker := time.NewTicker(time.Duration(b.config.logCleanerBackoffMs) * time.Millisecond)
+			defer ticker.Stop()
+			cleaner = ticker.C
+		}
+		for {
+			select {
+			case <-checkpoint.C:
+				b.checkpointLogs()
+			case <-retention.C:
+				b.deleteOldSegments()
+			case <-cleaner:
+				b.compactLogs()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	b.onShutdown("logs", func() error {
+		// A retention or cleaner pass in progress finishes before the logs
+		// are closed under it
+		close(stop)
+		<-done
+		errs := []error{}
+		for _, manager := range b.logs {
+			errs = append(errs, manager.Close())
+		}
+		return errors.Join(errs...)
+	})
+	return nil
+}
+
+// Write the checkpoint files of every log dir
+func (b *Broker) checkpointLogs() {
+	for _, manager := range b.logs {
+		if err := manager.Checkpoint(); err != nil {
+			slog.Error("Failed to checkpoint logs", "error", err)
+		}
+	}
+}
+
+// Give every log the settings of its topic. Topic configs are only read
+// from the metadata log here, so changes apply from the next retention
+// check or compaction.
+func (b *Broker) updateLogConfigs() {
+	topicConfigs := b.metadata.getTopicConfigs()
+	for _, manager := range b.logs {
+		for tp, l := range manager.Logs() {
+			l.SetConfig(b.config.topicLogConfig(topicConfigs[tp.Topic]))
+		}
+	}
+}
+
+// Delete the segments of every log that are past their topic's retention
+func (b *Broker) deleteOldSegments() {
+	b.updateLogConfigs()
+	for _, manager := range b.logs {
+		for tp, l := range manager.Logs() {
+			deleted, err := l.DeleteOldSegments()
+			if err != nil {
+				slog.Error("Failed to delete old segments", "partition", tp.String(), "error", err)
+			} else if deleted > 0 {
+				slog.Info("Deleted segments past retention", "partition", tp.String(), "segments", deleted, "logStartOffset", l.StartOffset())
+			}
+		}
+	}
+}
+
+// Compact the logs of every topic whose cleanup policy is compact
+func (b *Broker) compactLogs() {
+	b.updateLogConfigs()
+	for _, manager := range b.logs {
+		for tp, l := range manager.Logs() {
+			stats, err := l.Compact()
+			if err != nil {
+				slog.Error("Failed to compact", "partition", tp.String(), "error", err)
+			} else if stats.SegmentsCleaned > 0 {
+				slog.Info("Compacted segments", "partition", tp.String(), "segments", stats.SegmentsCleaned, "recordsRemoved", stats.RecordsRemoved, "bytesRead", stats.BytesRead, "bytesWritten", stats.BytesWritten)
+			}
+		}
+	}
+}
+
+// The log of a partition, or nil if no log dir has it
+func (b *Broker) partitionLog(topicName string, partition int32) *log.Log {
+	for _, manager := range b.logs {
+		if l := manager.Log(log.TopicPartition{Topic: topicName, Partition: partition}); l != nil {
+			return l
+		}
+	}
+	return nil
+}
+
+// Bind every broker listener
+func (b *Broker) listen() error {
+	for _, endpoint := range b.config.brokerListeners() {
+		l, err := b.bind(endpoint)
+		if err != nil {
+			for _, bound := range b.listeners {
+				bound.Close()
+			}
+			return fmt.Errorf("failed to bind listener %s: %w", endpoint, err)
+		}
+		b.listeners = append(b.listeners, &BrokerListener{Listener: l, name: endpoint.listenerName})
+	}
+	return nil
+}
+
+func (b *Broker) bind(endpoint Endpoint) (net.Listener, error) {
+	var loader *TLSConfigLoader
+	protocol := b.config.securityProtocolMap[endpoint.listenerName]
+	if protocol == SSL || protocol == SASL_SSL {
+		var err error
+		if loader, err = newTLSConfigLoader(b.config, endpoint.listenerName); err != nil {
+			return nil, err
+		}
+	}
+
+	var validator *OAuthBearerValidator
+	if (protocol == SASL_PLAINTEXT || protocol == SASL_SSL) && slices.Contains(b.config.saslMechanisms(endpoint.listenerName), SASL_OAUTHBEARER) {
+		var err error
+		if validator, err = newOAuthBearerValidator(b.config, endpoint.listenerName); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("tcp", endpoint.address())
 	if err != nil {
-		fmt.Println("Failed to bind to port 9092")
-		os.Exit(1)
+		return nil, err
+	}
+	if validator != nil {
+		b.oauthBearerValidators[endpoint.listenerName] = validator
 	}
+	if loader == nil {
+		return l, nil
+	}
+
+	b.tlsLoaders[endpoint.listenerName] = loader
+	// The handshake happens lazily, on the connection's own goroutine
+	return tls.NewListener(l, loader.tlsConfig()), nil
+}
+
+func (b *Broker) serve(l *BrokerListener) {
+	b.mu.Lock()
+	if !slices.Contains(b.listeners, l) {
+		b.listeners = append(b.listeners, l)
+	}
+	b.mu.Unlock()
 
 	for {
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			fmt.Println("Error accepting connection: ", err.Error())
+			slog.Error("Error accepting connection", "listener", l.name, "error", err)
 			continue
 		}
-		go handleConnection(conn)
+		b.handleConnection(l.name, conn)
+	}
+}
+
+func (b *Broker) handleConnection(listenerName string, conn net.Conn) {
+	c := newConnection(b, listenerName, conn)
+	ip := connectionIP(conn)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closing {
+		conn.Close()
+		return
+	}
+	if limit := b.config.maxConnections(ip); b.connectionsPerIp[ip] >= limit {
+		slog.Warn("Rejected connection, the address has too many connections", "clientAddress", ip, "maxConnections", limit)
+		conn.Close()
+		return
+	}
+	b.connections[c] = struct{}{}
+	b.connectionsPerIp[ip]++
+	b.wg.Add(1)
+
+	go func() {
+		defer b.wg.Done()
+		c.serve()
+
+		b.mu.Lock()
+		delete(b.connections, c)
+		if b.connectionsPerIp[ip]--; b.connectionsPerIp[ip] == 0 {
+			delete(b.connectionsPerIp, ip)
+		}
+		b.mu.Unlock()
+	}()
+}
+
+// The IP address a connection comes from, which connection limits apply to
+func connectionIP(conn net.Conn) string {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return ip
+}
+
+// Stop accepting connections, let in-flight requests finish within timeout,
+// then run the shutdown hooks. Returns the process exit code.
+func (b *Broker) shutdown(timeout time.Duration) int {
+	exitCode := 0
+
+	b.mu.Lock()
+	b.closing = true
+	for _, l := range b.listeners {
+		l.Close()
+	}
+	for c := range b.connections {
+		c.drain()
+	}
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("Timed out waiting for in-flight requests, closing connections")
+		exitCode = 1
+
+		b.mu.Lock()
+		for c := range b.connections {
+			c.close()
+		}
+		b.mu.Unlock()
+		<-done
 	}
+
+	for _, hook := range b.shutdownHooks {
+		if err := hook.run(); err != nil {
+			slog.Error("Shutdown hook failed", "hook", hook.name, "error", err)
+			exitCode = 1
+		}
+	}
+
+	return exitCode
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	configPath, overrides, err := parseCommandLine(os.Args[1:])
+	if err != nil {
+		fmt.Println(err.Error())
+		fmt.Println("Usage: kafka [server.properties] [--override property=value]...")
+		os.Exit(2)
+	}
+
+	config, err := loadConfig(configPath, overrides)
+	if err != nil {
+		fmt.Println("Invalid configuration:", err.Error())
+		os.Exit(1)
+	}
+	slog.SetDefault(newLogger(os.Stdout, config.loggerFormat, config.loggerLevel))
+	for _, key := range config.unknownProperties() {
+		slog.Warn("The configuration was supplied but isn't a known config", "name", key)
+	}
+
+	broker := NewBroker(config)
+	if err := broker.loadLogs(); err != nil {
+		slog.Error("Failed to load logs", "error", err)
+		os.Exit(1)
+	}
+	if err := broker.listen(); err != nil {
+		slog.Error("Failed to listen", "error", err)
+		os.Exit(1)
+	}
+	if err := broker.startTracing(); err != nil {
+		slog.Error("Failed to start tracing", "error", err)
+		os.Exit(1)
+	}
+	if err := broker.listenMetrics(); err != nil {
+		slog.Error("Failed to listen", "error", err)
+		os.Exit(1)
+	}
+	for _, l := range broker.listeners {
+		go broker.serve(l)
+	}
+
+	<-ctx.Done()
+	// A second signal kills the process right away
+	stop()
+	slog.Info("Shutting down")
+
+	os.Exit(broker.shutdown(config.gracefulShutdownTimeout))
 }
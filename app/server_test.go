@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
+)
+
+func newTestBroker(t *testing.T, props map[string]string) *Broker {
+	t.Helper()
+
+	allProps := map[string]string{"log.dirs": t.TempDir()}
+	for k, v := range props {
+		allProps[k] = v
+	}
+	config, err := newConfig(allProps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewBroker(config)
+}
+
+func Test_Broker_shutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := newTestBroker(t, nil)
+	flushed := false
+	broker.onShutdown("test", func() error {
+		flushed = true
+		return nil
+	})
+	go broker.serve(&BrokerListener{Listener: l, name: "PLAINTEXT"})
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	frame := encodeRequest(API_VERSIONS, 4, 1, []byte{2, 't', 2, '1', 0})
+	if _, err := client.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	sizeBytes := make([]byte, 4)
+	if _, err := io.ReadFull(client, sizeBytes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, binary.BigEndian.Uint32(sizeBytes))); err != nil {
+		t.Fatal(err)
+	}
+
+	if exitCode := broker.shutdown(time.Second); exitCode != 0 {
+		t.Errorf("shutdown() = %v, want 0", exitCode)
+	}
+	if !flushed {
+		t.Errorf("shutdown hook was not run")
+	}
+
+	// The broker closed its end, so the client sees a clean EOF
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client read error = %v, want EOF", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Errorf("broker still accepting connections")
+	}
+}
+
+func Test_Broker_loadLogs(t *testing.T) {
+	broker := newTestBroker(t, nil)
+	alpha := UUID{1}
+	writeMetadataRecords(t, broker, topicRecord("alpha", alpha))
+	writeMetadataRecords(t, broker, topicRecord("beta", UUID{2}))
+
+	// The broker died while appending beta's batch
+	paths := broker.metadata.segmentPaths()
+	path := paths[len(paths)-1]
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := broker.loadLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := broker.metadata.getTopicNames(); !reflect.DeepEqual(got, []string{"alpha"}) {
+		t.Errorf("topics after recovery = %v, want [alpha]", got)
+	}
+	writeMetadataRecords(t, broker, topicRecord("gamma", UUID{3}))
+	if got := broker.metadata.getTopicNames(); !reflect.DeepEqual(got, []string{"alpha", "gamma"}) {
+		t.Errorf("topics after appending = %v, want [alpha gamma]", got)
+	}
+
+	// Shutting down marks the log dir as cleanly shut down
+	if code := broker.shutdown(time.Second); code != 0 {
+		t.Fatalf("shutdown() = %d, want 0", code)
+	}
+	if _, err := os.Stat(filepath.Join(broker.config.logDirs[0], log.CLEAN_SHUTDOWN_FILE)); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Broker_maxConnectionsPerIp(t *testing.T) {
+	tests := []struct {
+		name  string
+		props map[string]string
+		want  int
+	}{
+		{"limit", map[string]string{"max.connections.per.ip": "2"}, 2},
+		{"override", map[string]string{"max.connections.per.ip": "2", "max.connections.per.ip.overrides": "127.0.0.1:1"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			broker := newTestBroker(t, tt.props)
+			go broker.serve(&BrokerListener{Listener: l, name: "PLAINTEXT"})
+			defer broker.shutdown(time.Second)
+
+			// Connections past the limit are closed right away, the others
+			// get answers
+			served := 0
+			for range 3 {
+				client, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer client.Close()
+				client.SetDeadline(time.Now().Add(5 * time.Second))
+				if _, err := sendTestRequest(client, API_VERSIONS, 4, []byte{2, 't', 2, '1', 0}); err == nil {
+					served++
+				}
+			}
+			if served != tt.want {
+				t.Errorf("%d connections served, want %d", served, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The identity requests are authorized as, e.g. User:alice
+type KafkaPrincipal struct {
+	principalType string
+	name          string
+}
+
+var ANONYMOUS_PRINCIPAL = KafkaPrincipal{principalType: "User", name: "ANONYMOUS"}
+
+func (p KafkaPrincipal) String() string {
+	return p.principalType + ":" + p.name
+}
+
+// Builds the TLS config of an SSL listener, re-reading the PEM files when
+// they change so certificates can be rotated without a restart
+type TLSConfigLoader struct {
+	config       *Config
+	listenerName string
+	rules        []PrincipalMappingRule
+
+	mu      sync.Mutex
+	current *tls.Config
+	// Modification time of every file the current config was loaded from
+	modTimes map[string]time.Time
+}
+
+func newTLSConfigLoader(config *Config, listenerName string) (*TLSConfigLoader, error) {
+	rules, err := parsePrincipalMappingRules(config.listenerProperty(listenerName, "ssl.principal.mapping.rules"))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &TLSConfigLoader{
+		config:       config,
+		listenerName: listenerName,
+		rules:        rules,
+	}
+	if l.current, l.modTimes, err = l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// The config to hand to tls.Server. Every handshake picks up the latest
+// certificates.
+func (l *TLSConfigLoader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.get(), nil
+		},
+	}
+}
+
+func (l *TLSConfigLoader) get() *tls.Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.filesChanged() {
+		return l.current
+	}
+
+	// Keep serving the old certificates if the new ones are broken, the
+	// files might be halfway through being replaced
+	current, modTimes, err := l.load()
+	if err != nil {
+		slog.Warn("Failed to reload SSL config", "listener", l.listenerName, "error", err)
+		return l.current
+	}
+	slog.Info("Reloaded SSL config", "listener", l.listenerName)
+	l.current, l.modTimes = current, modTimes
+	return l.current
+}
+
+func (l *TLSConfigLoader) filesChanged() bool {
+	for path, modTime := range l.modTimes {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *TLSConfigLoader) load() (*tls.Config, map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+	property := func(key string) string {
+		return l.config.listenerProperty(l.listenerName, key)
+	}
+
+	// Read either the PEM file at <key>.location or the inline PEM in
+	// inlineKey, as Kafka allows both
+	readPEM := func(locationKey string, inlineKeys ...string) ([]byte, error) {
+		if path := property(locationKey); path != "" {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			modTimes[path] = info.ModTime()
+			return os.ReadFile(path)
+		}
+		data := []byte{}
+		for _, key := range inlineKeys {
+			data = append(data, property(key)...)
+			data = append(data, '\n')
+		}
+		return data, nil
+	}
+
+	keystore, err := readPEM("ssl.keystore.location", "ssl.keystore.key", "ssl.keystore.certificate.chain")
+	if err != nil {
+		return nil, nil, err
+	}
+	// The PEM keystore holds both the private key and the certificate
+	// chain, X509KeyPair picks the blocks it needs from each
+	certificate, err := tls.X509KeyPair(keystore, keystore)
+	if err != nil {
+		return nil, nil, fmt.Errorf("keystore: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	truststore, err := readPEM("ssl.truststore.location", "ssl.truststore.certificates")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(strings.TrimSpace(string(truststore))) > 0 {
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(truststore) {
+			return nil, nil, fmt.Errorf("truststore: no certificates found")
+		}
+	}
+
+	switch property("ssl.client.auth") {
+	case "required":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "requested":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		tlsConfig.ClientAuth = tls.NoClientCert
+	}
+
+	return tlsConfig, modTimes, nil
+}
+
+// Principal of a client that authenticated with the given certificate,
+// ANONYMOUS if it didn't present one
+func (l *TLSConfigLoader) principal(state tls.ConnectionState) (KafkaPrincipal, error) {
+	if len(state.PeerCertificates) == 0 {
+		return ANONYMOUS_PRINCIPAL, nil
+	}
+
+	name, err := applyPrincipalMappingRules(l.rules, state.PeerCertificates[0].Subject.String())
+	if err != nil {
+		return KafkaPrincipal{}, err
+	}
+	return KafkaPrincipal{principalType: "User", name: name}, nil
+}
+
+// One entry of ssl.principal.mapping.rules, either DEFAULT or
+// RULE:pattern/replacement/[LU]
+type PrincipalMappingRule struct {
+	isDefault   bool
+	pattern     *regexp.Regexp
+	replacement string
+	toLowerCase bool
+	toUpperCase bool
+}
+
+var javaGroupReference = regexp.MustCompile(`\$(\d+)`)
+
+func parsePrincipalMappingRules(rules string) ([]PrincipalMappingRule, error) {
+	out := []PrincipalMappingRule{}
+	rest := rules
+
+	for {
+		rest = strings.TrimLeft(rest, " \t\n,")
+		if rest == "" {
+			break
+		}
+
+		if after, ok := strings.CutPrefix(rest, "DEFAULT"); ok {
+			out = append(out, PrincipalMappingRule{isDefault: true})
+			rest = after
+			continue
+		}
+
+		after, ok := strings.CutPrefix(rest, "RULE:")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule %q", rest)
+		}
+		pattern, after, ok := cutUnescapedSlash(after)
+		if !ok {
+			return nil, fmt.Errorf("rule is missing its replacement: %q", rest)
+		}
+		replacement, after, ok := cutUnescapedSlash(after)
+		if !ok {
+			return nil, fmt.Errorf("rule is missing its closing '/': %q", rest)
+		}
+
+		// Rules have to match the whole name, like Java's Matcher.matches
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		rule := PrincipalMappingRule{
+			pattern:     re,
+			replacement: javaGroupReference.ReplaceAllString(replacement, "$${$1}"),
+		}
+		switch {
+		case strings.HasPrefix(after, "L"):
+			rule.toLowerCase = true
+			after = after[1:]
+		case strings.HasPrefix(after, "U"):
+			rule.toUpperCase = true
+			after = after[1:]
+		}
+		out = append(out, rule)
+
+		// Skip to the next rule
+		_, rest, _ = strings.Cut(after, ",")
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no rules")
+	}
+	return out, nil
+}
+
+// Split s at the first '/' not escaped as '\/', unescaping the first part
+func cutUnescapedSlash(s string) (before string, after string, found bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == '/' {
+			i++
+			continue
+		}
+		if s[i] == '/' {
+			return strings.ReplaceAll(s[:i], `\/`, "/"), s[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// Map a certificate's distinguished name to a principal name using the first
+// rule that matches it
+func applyPrincipalMappingRules(rules []PrincipalMappingRule, distinguishedName string) (string, error) {
+	for _, rule := range rules {
+		if rule.isDefault {
+			return distinguishedName, nil
+		}
+		if !rule.pattern.MatchString(distinguishedName) {
+			continue
+		}
+
+		name := rule.pattern.ReplaceAllString(distinguishedName, rule.replacement)
+		if rule.toLowerCase {
+			name = strings.ToLower(name)
+		} else if rule.toUpperCase {
+			name = strings.ToUpper(name)
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("no principal mapping rule matches %s", distinguishedName)
+}
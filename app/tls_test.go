@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Issue a certificate for subject, self-signed if parent is nil
+func newTestCertificate(t *testing.T, subject pkix.Name, parent *testCertificate) testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	issuer, signer := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		issuer, signer = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCertificate{cert: cert, key: key}
+}
+
+func (c testCertificate) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+// Private key followed by the certificate, as in a Kafka PEM keystore
+func (c testCertificate) keystorePEM(t *testing.T) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), c.certPEM()...)
+}
+
+func (c testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// Start a broker with a single SSL listener and return its address
+func newTestSSLBroker(t *testing.T, props map[string]string) (*Broker, string) {
+	t.Helper()
+
+	allProps := map[string]string{
+		"listeners":                      "SSL://127.0.0.1:0",
+		"listener.security.protocol.map": "SSL:SSL",
+	}
+	for k, v := range props {
+		allProps[k] = v
+	}
+	broker := newTestBroker(t, allProps)
+	if err := broker.listen(); err != nil {
+		t.Fatal(err)
+	}
+	go broker.serve(broker.listeners[0])
+	t.Cleanup(func() { broker.shutdown(time.Second) })
+	return broker, broker.listeners[0].Addr().String()
+}
+
+// Send an ApiVersions request and wait for its response
+func roundTrip(t *testing.T, conn io.ReadWriter) {
+	t.Helper()
+
+	if _, err := conn.Write(encodeRequest(API_VERSIONS, 4, 1, []byte{2, 't', 2, '1', 0})); err != nil {
+		t.Fatal(err)
+	}
+	sizeBytes := make([]byte, 4)
+	if _, err := io.ReadFull(conn, sizeBytes); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, binary.BigEndian.Uint32(sizeBytes))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func connectionPrincipals(broker *Broker) []KafkaPrincipal {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	out := []KafkaPrincipal{}
+	for c := range broker.connections {
+		out = append(out, c.context.principal)
+	}
+	return out
+}
+
+func Test_SSLListener_mutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, pkix.Name{CommonName: "Test CA"}, nil)
+	server := newTestCertificate(t, pkix.Name{CommonName: "localhost"}, &ca)
+	client := newTestCertificate(t, pkix.Name{CommonName: "Alice", Organization: []string{"Example"}}, &ca)
+
+	keystore := filepath.Join(dir, "server.pem")
+	truststore := filepath.Join(dir, "ca.pem")
+	checkError(os.WriteFile(keystore, server.keystorePEM(t), 0o600))
+	checkError(os.WriteFile(truststore, ca.certPEM(), 0o600))
+
+	broker, addr := newTestSSLBroker(t, map[string]string{
+		"ssl.keystore.location":       keystore,
+		"ssl.truststore.location":     truststore,
+		"ssl.client.auth":             "required",
+		"ssl.principal.mapping.rules": "RULE:^CN=([^,]*),O=.*$/$1/L,DEFAULT",
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{client.tlsCertificate()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+
+	want := KafkaPrincipal{principalType: "User", name: "alice"}
+	if got := connectionPrincipals(broker); len(got) != 1 || got[0] != want {
+		t.Errorf("principals = %v, want [%v]", got, want)
+	}
+
+	// Clients without a certificate are turned away
+	anonymous, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err == nil {
+		defer anonymous.Close()
+		// TLS 1.3 clients only learn about the rejection on their first read
+		_, err = anonymous.Read(make([]byte, 1))
+	}
+	if err == nil {
+		t.Errorf("connection without a client certificate was accepted")
+	}
+}
+
+func Test_SSLListener_reloadsCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, pkix.Name{CommonName: "Test CA"}, nil)
+	keystore := filepath.Join(dir, "server.pem")
+	first := newTestCertificate(t, pkix.Name{CommonName: "localhost", SerialNumber: "1"}, &ca)
+	checkError(os.WriteFile(keystore, first.keystorePEM(t), 0o600))
+
+	broker, addr := newTestSSLBroker(t, map[string]string{"ssl.keystore.location": keystore})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	serverCertificate := func() *x509.Certificate {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		roundTrip(t, conn)
+		if got := connectionPrincipals(broker); len(got) == 0 || got[0] != ANONYMOUS_PRINCIPAL {
+			t.Errorf("principals = %v, want %v", got, ANONYMOUS_PRINCIPAL)
+		}
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	if got := serverCertificate(); !got.Equal(first.cert) {
+		t.Fatalf("served %v, want the initial certificate", got.Subject)
+	}
+
+	second := newTestCertificate(t, pkix.Name{CommonName: "localhost", SerialNumber: "2"}, &ca)
+	checkError(os.WriteFile(keystore, second.keystorePEM(t), 0o600))
+	// Make sure the change is visible even on filesystems with coarse mtimes
+	future := time.Now().Add(time.Minute)
+	checkError(os.Chtimes(keystore, future, future))
+
+	if got := serverCertificate(); !got.Equal(second.cert) {
+		t.Errorf("served %v, want the rotated certificate", got.Subject)
+	}
+}
+
+func Test_applyPrincipalMappingRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		dn      string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "default keeps the distinguished name",
+			rules: "DEFAULT",
+			dn:    "CN=alice,O=Example",
+			want:  "CN=alice,O=Example",
+		},
+		{
+			name:  "first matching rule wins",
+			rules: "RULE:^CN=(.*?),OU=ServiceUsers.*$/$1/,RULE:^CN=(.*?),O=(.*)$/$1@$2/L,DEFAULT",
+			dn:    "CN=Bob,O=Example",
+			want:  "bob@example",
+		},
+		{
+			name:  "falls through to default",
+			rules: "RULE:^CN=(.*?),OU=ServiceUsers.*$/$1/, DEFAULT",
+			dn:    "CN=carol",
+			want:  "CN=carol",
+		},
+		{
+			name:  "escaped slash and upper case",
+			rules: `RULE:^CN=(.*)\/(.*)$/$1\/$2/U`,
+			dn:    "CN=team/dave",
+			want:  "TEAM/DAVE",
+		},
+		{
+			name:  "group followed by text",
+			rules: "RULE:^CN=(.*)$/$1x/",
+			dn:    "CN=erin",
+			want:  "erinx",
+		},
+		{
+			name:    "no rule matches",
+			rules:   "RULE:^CN=admin$/admin/",
+			dn:      "CN=mallory",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parsePrincipalMappingRules(tt.rules)
+			if err != nil {
+				t.Fatalf("parsePrincipalMappingRules() error = %v", err)
+			}
+			got, err := applyPrincipalMappingRules(rules, tt.dn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyPrincipalMappingRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("applyPrincipalMappingRules() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,25 +1,67 @@
 package main
 
 import (
-	"encoding/binary"
 	"fmt"
+	"sort"
 )
 
 var (
-	TopicNameToID                 = map[string]UUID{}
-	DEFAULT_TOPIC_ID              = UUID{0}
-	DEFAULT_AUTHORIZED_OPERATIONS = [4]byte{0, 0, 0x0d, 0xf8}
+	DEFAULT_TOPIC_ID = UUID{0}
+	// Sent when the client didn't ask for authorized operations, or isn't
+	// allowed to know them
+	AUTHORIZED_OPERATIONS_OMITTED int32 = -2147483648
 )
 
 type UUID [16]byte
 
+// Topic names and IDs, both ways. An index is never modified once built,
+// so it can be shared between connections without locking.
+type TopicIndex struct {
+	idsByName map[string]UUID
+	namesByID map[UUID]string
+}
+
+func newTopicIndex(records Records) *TopicIndex {
+	index := &TopicIndex{
+		idsByName: map[string]UUID{},
+		namesByID: map[UUID]string{},
+	}
+	for _, record := range records.TopicRecords {
+		index.idsByName[record.topicName] = record.topicUUID
+		index.namesByID[record.topicUUID] = record.topicName
+	}
+	return index
+}
+
+func (i *TopicIndex) id(name string) (UUID, bool) {
+	id, ok := i.idsByName[name]
+	return id, ok
+}
+
+func (i *TopicIndex) name(id UUID) (string, bool) {
+	name, ok := i.namesByID[id]
+	return name, ok
+}
+
+// Every topic name, sorted
+func (i *TopicIndex) names() []string {
+	names := make([]string, 0, len(i.idsByName))
+	for name := range i.idsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type Topic struct {
-	errorCode            ErrorCode
-	topicName            string
-	topicID              UUID
-	isInternal           bool
-	partitions           []Partition
-	authorizedOperations [4]byte
+	errorCode  ErrorCode
+	topicName  string
+	topicID    UUID
+	isInternal bool
+	partitions []Partition
+	// Bitfield of AclOperations, filled in by the request handlers since
+	// it depends on who asks
+	authorizedOperations int32
 	tagBuffer            byte
 }
 
@@ -38,112 +80,103 @@ type Partition struct {
 
 type ReplicaID int32
 
-func getTopicByName(topicName string) (topic Topic) {
-	ID, err := getTopicID(topicName)
+func (m *MetadataLog) getTopicByName(topicName string) (topic Topic) {
+	ID, err := m.getTopicID(topicName)
 
 	if err != nil {
 		topic.errorCode = ERR_UNKNOWN_TOPIC_OR_PARTITION
 	} else {
-		topic.partitions = getTopicPartitions(ID)
+		topic.partitions = m.getTopicPartitions(ID)
 	}
 
 	topic.topicName = topicName
 	topic.topicID = ID
 	topic.isInternal = false
-	topic.authorizedOperations = DEFAULT_AUTHORIZED_OPERATIONS
+	topic.authorizedOperations = AUTHORIZED_OPERATIONS_OMITTED
 	topic.tagBuffer = 0
 
 	return topic
 }
 
-func getTopicByID(topicID UUID) (topic Topic) {
+func (m *MetadataLog) getTopicByID(topicID UUID) (topic Topic) {
 	topic.topicID = topicID
 	topic.isInternal = false
-	topic.authorizedOperations = DEFAULT_AUTHORIZED_OPERATIONS
+	topic.authorizedOperations = AUTHORIZED_OPERATIONS_OMITTED
 	topic.tagBuffer = 0
-	
-	records := getRecords()
-	for _, record := range(records.TopicRecords) {
-		if record.topicUUID == topicID {
-			topic.topicName = record.topicName
-			return topic
-		}
+
+	name, ok := m.topicIndex().name(topicID)
+	if !ok {
+		topic.errorCode = ERR_UNKNOWN_TOPIC
+		return topic
 	}
-	
-	topic.errorCode = ERR_UNKNOWN_TOPIC
+	topic.topicName = name
 	return topic
 }
 
-func getTopicPartitions(topicID UUID) []Partition {
-	records := getRecords()
-	partitions := []Partition{}
-	var currIdx int32
-
-	for _, record := range records.PartitionRecords {
-		if record.topicUUID == topicID {
-			partition := Partition{
-				errorCode:              0,
-				partitionIndex:         currIdx,
-				leaderID:               record.leader,
-				leaderEpoch:            record.leaderEpoch,
-				replicaNodes:           record.replicaNodes,
-				isrNodes:               record.isrNodes,
-				eligibleLeaderReplicas: []ReplicaID{},
-				lastKnownELR:           []ReplicaID{},
-				offlineReplicas:        []ReplicaID{},
-				tagBuffer:              0,
-			}
-			partitions = append(partitions, partition)
-			currIdx++
-		}
-	}
-	return partitions
+// Names of every topic in the cluster, sorted
+func (m *MetadataLog) getTopicNames() []string {
+	return m.topicIndex().names()
 }
 
-func getTopicID(topicName string) (UUID, error) {
-	if _, ok := TopicNameToID[topicName]; ok {
-		return TopicNameToID[topicName], nil
-	} else {
-		records := getRecords()
+// Configs set on each topic, by topic name
+func (m *MetadataLog) getTopicConfigs() map[string]map[string]string {
+	return m.image().records.TopicConfigs
+}
+
+// The current state of a partition
+func (m *MetadataLog) getPartition(topicID UUID, partitionID int32) (PartitionRecord, bool) {
+	records := m.image().records
+	return records.Partitions.get(topicID, partitionID)
+}
 
-		for _, topicRecord := range records.TopicRecords {
-			name := topicRecord.topicName
-			ID := topicRecord.topicUUID
-			TopicNameToID[name] = ID
+func (m *MetadataLog) getTopicPartitions(topicID UUID) []Partition {
+	records := m.image().records
+	partitions := []Partition{}
+
+	for _, record := range records.Partitions.topicPartitions(topicID) {
+		partition := Partition{
+			errorCode:              0,
+			partitionIndex:         record.partitionID,
+			leaderID:               record.leader,
+			leaderEpoch:            record.leaderEpoch,
+			replicaNodes:           record.replicaNodes,
+			isrNodes:               record.isrNodes,
+			eligibleLeaderReplicas: record.eligibleLeaderReplicas,
+			lastKnownELR:           record.lastKnownELR,
+			offlineReplicas:        records.offlineReplicas(record.replicaNodes, m.nodeID),
+			tagBuffer:              0,
+		}
+		// The ELR fields are only written once ELR is enabled
+		if partition.eligibleLeaderReplicas == nil {
+			partition.eligibleLeaderReplicas = []ReplicaID{}
+		}
+		if partition.lastKnownELR == nil {
+			partition.lastKnownELR = []ReplicaID{}
 		}
+		partitions = append(partitions, partition)
 	}
+	return partitions
+}
 
-	if _, ok := TopicNameToID[topicName]; !ok {
+func (m *MetadataLog) getTopicID(topicName string) (UUID, error) {
+	ID, ok := m.topicIndex().id(topicName)
+	if !ok {
 		return UUID{}, fmt.Errorf("topic not found in topic records")
 	}
-
-	return TopicNameToID[topicName], nil
+	return ID, nil
 }
 
-func (p Partition) serialize() []byte {
-	res := []byte{}
-
-	res = binary.BigEndian.AppendUint16(res, uint16(p.errorCode))
-	res = binary.BigEndian.AppendUint32(res, uint32(p.partitionIndex))
-	res = binary.BigEndian.AppendUint32(res, uint32(p.leaderID))
-	res = binary.BigEndian.AppendUint32(res, uint32(p.leaderEpoch))
-
-	replicaNodes := encodeCompactArray(p.replicaNodes, binary.BigEndian.AppendUint32)
-	res = append(res, replicaNodes...)
-
-	isrNodes := encodeCompactArray(p.isrNodes, binary.BigEndian.AppendUint32)
-	res = append(res, isrNodes...)
-
-	eligibleLeaders := encodeCompactArray(p.eligibleLeaderReplicas, binary.BigEndian.AppendUint32)
-	res = append(res, eligibleLeaders...)
-
-	lastKnownELR := encodeCompactArray(p.lastKnownELR, binary.BigEndian.AppendUint32)
-	res = append(res, lastKnownELR...)
-
-	offlineReplicas := encodeCompactArray(p.offlineReplicas, binary.BigEndian.AppendUint32)
-	res = append(res, offlineReplicas...)
+func (p Partition) encode(e *Encoder) {
+	e.putInt16(int16(p.errorCode))
+	e.putInt32(p.partitionIndex)
+	e.putInt32(int32(p.leaderID))
+	e.putInt32(p.leaderEpoch)
 
-	res = append(res, p.tagBuffer)
+	e.putInt32Array(p.replicaNodes, true)
+	e.putInt32Array(p.isrNodes, true)
+	e.putInt32Array(p.eligibleLeaderReplicas, true)
+	e.putInt32Array(p.lastKnownELR, true)
+	e.putInt32Array(p.offlineReplicas, true)
 
-	return res
+	e.putInt8(int8(p.tagBuffer))
 }
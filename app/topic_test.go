@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func removeTopicRecord(id UUID) []byte {
+	value := []byte{1, byte(REMOVE_TOPIC_RECORD), 0}
+	value = append(value, id[:]...)
+	return append(value, 0)
+}
+
+// Run with -race: connections look topics up while they are deleted and
+// created again
+func Test_MetadataLog_concurrentTopicLookups(t *testing.T) {
+	broker := newTestBroker(t, nil)
+	alpha := UUID{1}
+	writeMetadataRecords(t, broker, topicRecord("alpha", alpha), partitionRecord(alpha, 0))
+
+	describe := appendArrayLength(nil, 2, true)
+	for _, name := range []string{"alpha", "beta"} {
+		describe = append(appendString(describe, name, true), 0)
+	}
+	describe = binary.BigEndian.AppendUint32(describe, 100)
+	describe = append(describe, 0xff, 0)
+
+	fetch := binary.BigEndian.AppendUint32(nil, 0) // max wait
+	fetch = binary.BigEndian.AppendUint32(fetch, 1)
+	fetch = binary.BigEndian.AppendUint32(fetch, 1024)
+	fetch = append(fetch, 0)
+	fetch = binary.BigEndian.AppendUint32(fetch, 0) // session ID
+	fetch = binary.BigEndian.AppendUint32(fetch, 0) // session epoch
+	fetch = appendArrayLength(fetch, 1, true)
+	fetch = append(fetch, alpha[:]...)
+	fetch = appendArrayLength(fetch, 1, true)
+	fetch = binary.BigEndian.AppendUint32(fetch, 0)  // partition
+	fetch = binary.BigEndian.AppendUint32(fetch, 0)  // current leader epoch
+	fetch = binary.BigEndian.AppendUint64(fetch, 0)  // fetch offset
+	fetch = binary.BigEndian.AppendUint32(fetch, 0)  // last fetched epoch
+	fetch = binary.BigEndian.AppendUint64(fetch, 0)  // log start offset
+	fetch = binary.BigEndian.AppendUint32(fetch, 64) // partition max bytes
+	fetch = append(fetch, 0, 0, 1, 1, 0)             // tag buffers, forgotten topics, rack ID
+
+	var wg sync.WaitGroup
+	for range 4 {
+		client, server := net.Pipe()
+		defer client.Close()
+		go newConnection(broker, "PLAINTEXT", server).serve()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				// alpha is never deleted, so it is always found
+				response, err := sendTestRequest(client, DESCRIBE_TOPIC_PARTITIONS, 0, describe)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				buf := bytes.NewBuffer(response[4:])
+				readArrayLength(buf, true)
+				if errorCode := ErrorCode(binary.BigEndian.Uint16(buf.Next(2))); errorCode != ERR_NONE {
+					t.Errorf("DescribeTopicPartitions error = %v for alpha", errorCode)
+				}
+
+				response, err = sendTestRequest(client, FETCH, 16, fetch)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				buf = bytes.NewBuffer(response[4+2+4:])
+				readArrayLength(buf, true)
+				buf.Next(16)
+				readArrayLength(buf, true)
+				buf.Next(4)
+				if errorCode := ErrorCode(binary.BigEndian.Uint16(buf.Next(2))); errorCode != ERR_NONE {
+					t.Errorf("Fetch error = %v for alpha", errorCode)
+				}
+			}
+		}()
+	}
+
+	// beta is recreated with a new ID each time
+	for i := range 20 {
+		id := UUID{2, byte(i)}
+		writeMetadataRecords(t, broker, topicRecord("beta", id), partitionRecord(id, 0))
+		writeMetadataRecords(t, broker, removeTopicRecord(id))
+	}
+	writeMetadataRecords(t, broker, topicRecord("beta", UUID{3}))
+	wg.Wait()
+
+	if id, err := broker.metadata.getTopicID("beta"); err != nil || id != (UUID{3}) {
+		t.Errorf("getTopicID(beta) = %v, %v, want %v", id, err, UUID{3})
+	}
+	if topic := broker.metadata.getTopicByID(UUID{2, 19}); topic.errorCode != ERR_UNKNOWN_TOPIC {
+		t.Errorf("getTopicByID() of a deleted topic = %v, want %v", topic.errorCode, ERR_UNKNOWN_TOPIC)
+	}
+}
+
+// The controller appends to the log behind the broker's back
+func Test_MetadataLog_topicIndexFollowsLog(t *testing.T) {
+	broker := newTestBroker(t, nil)
+	alpha, beta := UUID{1}, UUID{2}
+	writeMetadataRecords(t, broker, topicRecord("alpha", alpha), partitionRecord(alpha, 0))
+	if _, err := broker.metadata.getTopicID("alpha"); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := broker.metadata.segmentPaths()
+	nextOffset := broker.metadata.image().records.LastOffset + 1
+	f, err := os.OpenFile(paths[len(paths)-1], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(encodeRecordBatch(nextOffset, time.Now().UnixMilli(), [][]byte{topicRecord("beta", beta), partitionRecord(beta, 0)}))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := broker.metadata.getTopicID("beta"); err != nil || id != beta {
+		t.Errorf("getTopicID(beta) = %v, %v, want %v", id, err, beta)
+	}
+	if topic := broker.metadata.getTopicByID(beta); topic.topicName != "beta" {
+		t.Errorf("getTopicByID() of beta = %q, %v", topic.topicName, topic.errorCode)
+	}
+	if records := broker.metadata.image().records; records.LastOffset != nextOffset+1 {
+		t.Errorf("LastOffset = %d, want %d", records.LastOffset, nextOffset+1)
+	}
+}
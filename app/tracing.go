@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Where finished spans go, set with tracing.exporter
+const (
+	TRACING_EXPORTER_NONE = "none"
+	TRACING_EXPORTER_OTLP = "otlp"
+	TRACING_EXPORTER_FILE = "file"
+)
+
+// Finished spans are exported in batches of up to TRACE_EXPORT_BATCH_SIZE,
+// at least every TRACE_EXPORT_INTERVAL. Spans ended while
+// TRACE_QUEUE_SIZE are waiting are dropped.
+const (
+	TRACE_EXPORT_BATCH_SIZE = 512
+	TRACE_EXPORT_INTERVAL   = 5 * time.Second
+	TRACE_QUEUE_SIZE        = 2048
+)
+
+const TRACE_EXPORT_TIMEOUT = 10 * time.Second
+
+// OTLP span kinds
+const (
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_SERVER   = 2
+)
+
+// OTLP status code of failed spans, the rest are left unset
+const SPAN_STATUS_ERROR = 2
+
+// Traces request handling in OpenTelemetry's data model. Kafka requests
+// carry no trace context, so every request starts a trace of its own.
+// A nil *Tracer doesn't trace, and the spans it starts are nil.
+type Tracer struct {
+	exporter SpanExporter
+	resource []slog.Attr
+	mu       sync.RWMutex
+	spans    chan *Span
+	closed   bool
+	done     chan struct{}
+}
+
+type SpanExporter interface {
+	export(resource []slog.Attr, spans []*Span) error
+	close() error
+}
+
+type Span struct {
+	tracer       *Tracer
+	traceID      [16]byte
+	spanID       [8]byte
+	parentSpanID [8]byte
+	name         string
+	kind         int
+	start        time.Time
+	end          time.Time
+	attributes   []slog.Attr
+	status       int
+	message      string
+}
+
+// Start the tracer tracing.exporter asks for, if any
+func (b *Broker) startTracing() error {
+	var exporter SpanExporter
+	switch b.config.tracingExporter {
+	case TRACING_EXPORTER_NONE:
+		return nil
+	case TRACING_EXPORTER_OTLP:
+		exporter = &OtlpHttpExporter{endpoint: b.config.tracingOtlpEndpoint, client: &http.Client{Timeout: TRACE_EXPORT_TIMEOUT}}
+	case TRACING_EXPORTER_FILE:
+		f, err := os.OpenFile(b.config.tracingFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open tracing.file.path: %w", err)
+		}
+		exporter = &OtlpFileExporter{f: f}
+	}
+
+	b.tracer = newTracer(exporter, []slog.Attr{
+		slog.String("service.name", "kafka"),
+		slog.String("service.instance.id", strconv.Itoa(int(b.config.nodeID))),
+	})
+	b.onShutdown("tracer", b.tracer.close)
+	return nil
+}
+
+func newTracer(exporter SpanExporter, resource []slog.Attr) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		resource: resource,
+		spans:    make(chan *Span, TRACE_QUEUE_SIZE),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Export finished spans until the tracer is closed
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(TRACE_EXPORT_INTERVAL)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.export(t.resource, batch); err != nil {
+			slog.Warn("Failed to export spans", "spans", len(batch), "error", err)
+		}
+		batch = []*Span{}
+	}
+	for {
+		select {
+		case span, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= TRACE_EXPORT_BATCH_SIZE {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Export the spans already ended and stop. Spans ended afterwards are
+// dropped.
+func (t *Tracer) close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.spans)
+	}
+	t.mu.Unlock()
+
+	<-t.done
+	return t.exporter.close()
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		slog.Debug("Dropping span, the export queue is full", "span", s.name)
+	}
+}
+
+// Start a span of its own trace
+func (t *Tracer) startSpan(name string, start time.Time, attributes ...slog.Attr) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, kind: SPAN_KIND_SERVER, start: start, attributes: attributes}
+	binary.BigEndian.PutUint64(s.traceID[:8], rand.Uint64())
+	binary.BigEndian.PutUint64(s.traceID[8:], rand.Uint64())
+	binary.BigEndian.PutUint64(s.spanID[:], rand.Uint64())
+	return s
+}
+
+// Start the span of a request, with the attributes the request log has
+func (c *Connection) startRequestSpan(req RequestMessage) *Span {
+	return c.broker.tracer.startSpan(req.header.requestApiKey.String(), req.received,
+		slog.String("messaging.system", "kafka"),
+		slog.Int("kafka.api_key", int(req.header.requestApiKey)),
+		slog.Int("kafka.api_version", int(req.header.requestApiVersion)),
+		slog.Int("kafka.correlation_id", int(req.header.correlationID)),
+		slog.String("messaging.client.id", req.header.clientID),
+		slog.String("kafka.principal", req.context.principal.String()),
+		slog.String("kafka.listener", c.context.listenerName),
+		slog.String("client.address", c.context.clientAddress.String()),
+	)
+}
+
+// Attributes of the spans of partition log I/O
+func partitionAttributes(topic string, partition int32) []slog.Attr {
+	return []slog.Attr{slog.String("kafka.topic", topic), slog.Int("kafka.partition", int(partition))}
+}
+
+// Start a span for part of the work of s
+func (s *Span) startChild(name string, start time.Time, attributes ...slog.Attr) *Span {
+	if s == nil {
+		return nil
+	}
+	child := &Span{tracer: s.tracer, traceID: s.traceID, parentSpanID: s.spanID, name: name, kind: SPAN_KIND_INTERNAL, start: start, attributes: attributes}
+	binary.BigEndian.PutUint64(child.spanID[:], rand.Uint64())
+	return child
+}
+
+func (s *Span) setAttributes(attributes ...slog.Attr) {
+	if s != nil {
+		s.attributes = append(s.attributes, attributes...)
+	}
+}
+
+// Mark the span as failed
+func (s *Span) fail(message string) {
+	if s != nil {
+		s.status, s.message = SPAN_STATUS_ERROR, message
+	}
+}
+
+// Record the error code of a partition, failing the span unless it's NONE
+func (s *Span) setErrorCode(code ErrorCode) {
+	s.setAttributes(slog.String("kafka.error_code", code.String()))
+	if code != ERR_NONE {
+		s.fail(code.String())
+	}
+}
+
+func (s *Span) finish() {
+	s.finishAt(time.Now())
+}
+
+// End the span at t and queue it for export
+func (s *Span) finishAt(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.end = t
+	s.tracer.enqueue(s)
+}
+
+// Posts spans to an OTLP/HTTP collector endpoint, JSON encoded
+type OtlpHttpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (e *OtlpHttpExporter) export(resource []slog.Attr, spans []*Span) error {
+	data, err := json.Marshal(newOtlpTraces(resource, spans))
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %s", e.endpoint, res.Status)
+	}
+	return nil
+}
+
+func (e *OtlpHttpExporter) close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// Appends spans to a file, one OTLP JSON request per line like the
+// collector's file exporter
+type OtlpFileExporter struct {
+	f *os.File
+}
+
+func (e *OtlpFileExporter) export(resource []slog.Attr, spans []*Span) error {
+	w := bufio.NewWriter(e.f)
+	if err := json.NewEncoder(w).Encode(newOtlpTraces(resource, spans)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (e *OtlpFileExporter) close() error {
+	return e.f.Close()
+}
+
+// ExportTraceServiceRequest in the OTLP JSON encoding: IDs are hex, 64 bit
+// integers are strings
+type OtlpTraces struct {
+	ResourceSpans []OtlpResourceSpans `json:"resourceSpans"`
+}
+
+type OtlpResourceSpans struct {
+	Resource struct {
+		Attributes []OtlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []OtlpScopeSpans `json:"scopeSpans"`
+}
+
+type OtlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []OtlpSpan `json:"spans"`
+}
+
+type OtlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []OtlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Message string `json:"message,omitempty"`
+		Code    int    `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+type OtlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value OtlpValue `json:"value"`
+}
+
+type OtlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func newOtlpTraces(resource []slog.Attr, spans []*Span) OtlpTraces {
+	scopeSpans := OtlpScopeSpans{Spans: make([]OtlpSpan, 0, len(spans))}
+	scopeSpans.Scope.Name = "kafka.server"
+	for _, s := range spans {
+		span := OtlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        newOtlpKeyValues(s.attributes),
+		}
+		if s.parentSpanID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentSpanID[:])
+		}
+		span.Status.Code, span.Status.Message = s.status, s.message
+		scopeSpans.Spans = append(scopeSpans.Spans, span)
+	}
+
+	resourceSpans := OtlpResourceSpans{ScopeSpans: []OtlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = newOtlpKeyValues(resource)
+	return OtlpTraces{ResourceSpans: []OtlpResourceSpans{resourceSpans}}
+}
+
+func newOtlpKeyValues(attributes []slog.Attr) []OtlpKeyValue {
+	keyValues := make([]OtlpKeyValue, 0, len(attributes))
+	for _, attr := range attributes {
+		value := OtlpValue{}
+		switch attr.Value.Kind() {
+		case slog.KindInt64:
+			s := strconv.FormatInt(attr.Value.Int64(), 10)
+			value.IntValue = &s
+		case slog.KindFloat64:
+			f := attr.Value.Float64()
+			value.DoubleValue = &f
+		case slog.KindBool:
+			b := attr.Value.Bool()
+			value.BoolValue = &b
+		default:
+			s := attr.Value.String()
+			value.StringValue = &s
+		}
+		keyValues = append(keyValues, OtlpKeyValue{Key: attr.Key, Value: value})
+	}
+	return keyValues
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/kafka-starter-go/app/log"
+)
+
+func Test_Tracer_fileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	broker := newTestBroker(t, map[string]string{"tracing.exporter": "file", "tracing.file.path": path})
+	alpha := UUID{1}
+	writeMetadataRecords(t, broker, topicRecord("alpha", alpha), partitionRecord(alpha, 0))
+	if err := broker.loadLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.startTracing(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := broker.logs[0].GetOrCreateLog(log.TopicPartition{Topic: "alpha", Partition: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Append(encodeRecordBatch(0, time.Now().UnixMilli(), [][]byte{[]byte("value")}), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go newConnection(broker, "PLAINTEXT", server).serve()
+	if errorCode, _, _ := fetchPartition(t, client, alpha, 0); errorCode != ERR_NONE {
+		t.Fatalf("Fetch() error = %d", errorCode)
+	}
+	// The request span ends once its response is written, which is before
+	// the next response goes out
+	if _, err := sendTestRequest(client, API_VERSIONS, 4, []byte{2, 't', 2, '1', 0}); err != nil {
+		t.Fatal(err)
+	}
+	if code := broker.shutdown(time.Second); code != 0 {
+		t.Fatalf("shutdown() = %d, want 0", code)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	all := []OtlpSpan{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		traces := OtlpTraces{}
+		if err := json.Unmarshal(scanner.Bytes(), &traces); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, traces.ResourceSpans[0].ScopeSpans[0].Spans...)
+	}
+	var request OtlpSpan
+	for _, span := range all {
+		if span.Name == "Fetch" {
+			request = span
+		}
+	}
+	if request.Name == "" {
+		t.Fatalf("no Fetch span in %v", all)
+	}
+	// The spans of the Fetch trace, by name
+	spans := map[string]OtlpSpan{}
+	for _, span := range all {
+		if span.TraceID == request.TraceID {
+			spans[span.Name] = span
+		}
+	}
+	attributes := map[string]OtlpValue{}
+	for _, attr := range request.Attributes {
+		attributes[attr.Key] = attr.Value
+	}
+	if v := attributes["kafka.api_key"].IntValue; v == nil || *v != "1" {
+		t.Errorf("kafka.api_key = %v, want 1", v)
+	}
+	if v := attributes["kafka.api_version"].IntValue; v == nil || *v != "16" {
+		t.Errorf("kafka.api_version = %v, want 16", v)
+	}
+	if request.Kind != SPAN_KIND_SERVER || request.ParentSpanID != "" {
+		t.Errorf("Fetch span kind = %d, parent = %q, want a server root span", request.Kind, request.ParentSpanID)
+	}
+
+	// Children of the request span, and of its handler
+	for name, parent := range map[string]string{"decode": "Fetch", "handle": "Fetch", "encode": "Fetch", "send": "Fetch", "log.read": "handle"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.ParentSpanID != spans[parent].SpanID {
+			t.Errorf("%s span is not a child of the %s span", name, parent)
+		}
+	}
+	if spans["log.read"].Status.Code != 0 {
+		t.Errorf("log.read span failed: %s", spans["log.read"].Status.Message)
+	}
+}